@@ -0,0 +1,756 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminSockPrefix prefixes the names of admin API sockets, which are created
+// per guardian (i.e. per intermediary host).
+const AdminSockPrefix = ".sga-admin-"
+
+var adminSocketSanitizer = strings.NewReplacer("/", "_", "\\", "_", ":", "_")
+
+// The admin API is plain HTTP with JSON bodies over a socket that is only
+// accessible by the user running the guardian.
+
+type AdminTokenRequest struct {
+	Scope   Scope
+	Command string
+	TTL     time.Duration
+}
+
+type AdminTokenResponse struct {
+	Token   string
+	Expires time.Time
+}
+
+// AdminInvitationRequest describes an invitation to issue: the requests Rule
+// matches are auto-approved for TTL, at most MaxUses times if set.
+type AdminInvitationRequest struct {
+	Rule    PolicyRule
+	TTL     time.Duration
+	MaxUses int
+	Note    string
+}
+
+type AdminLockdownRequest struct {
+	Reason string
+}
+
+// AdminRuleRequest selects a stored approval or remembered denial of Command
+// (empty for any command) in Scope, to remove it or change when it expires.
+type AdminRuleRequest struct {
+	Scope   Scope
+	Command string
+	Expires time.Time
+}
+
+// AdminStoreRequest asks for an export of the store, or carries a bundle to
+// import.
+type AdminStoreRequest struct {
+	Passphrase string
+	Bundle     []byte `json:",omitempty"`
+}
+
+// AdminPairingResponse carries the device paired with a pairing code, once it
+// answered.
+type AdminPairingResponse struct {
+	Device *PushDevice
+}
+
+type AdminError struct {
+	Error string
+}
+
+// ServeAdmin serves the admin API on l until it is closed.
+func (agent *Agent) ServeAdmin(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tokens", agent.handleAdminTokens)
+	mux.HandleFunc("/invitations", agent.handleAdminInvitations)
+	mux.HandleFunc("/credentials", agent.handleAdminCredentials)
+	mux.HandleFunc("/keys", agent.handleAdminKeys)
+	mux.HandleFunc("/sessions", notPerTenant(agent.handleAdminSessions))
+	mux.HandleFunc("/debug/sessions", notPerTenant(agent.handleAdminSessionDebug))
+	mux.HandleFunc("/lockdown", notPerTenant(agent.handleAdminLockdown))
+	mux.HandleFunc("/rules", agent.handleAdminRules)
+	mux.HandleFunc("/denials", agent.handleAdminDenials)
+	mux.HandleFunc("/rules/stale", agent.handleAdminStaleRules)
+	mux.HandleFunc("/store/export", notPerTenant(agent.handleAdminStore))
+	mux.HandleFunc("/store/import", notPerTenant(agent.handleAdminStore))
+	mux.HandleFunc("/devices", notPerTenant(agent.handleAdminDevices))
+	mux.HandleFunc("/devices/pair", notPerTenant(agent.handleAdminPairing))
+	mux.HandleFunc("/approvers", notPerTenant(agent.handleAdminApprovers))
+	mux.HandleFunc("/approvers/prompts", notPerTenant(agent.handleAdminApprovers))
+	mux.HandleFunc("/approvers/answer", notPerTenant(agent.handleAdminApprovers))
+	mux.HandleFunc("/reload", notPerTenant(agent.handleAdminReload))
+	mux.HandleFunc("/health", notPerTenant(agent.handleAdminHealth))
+	mux.HandleFunc("/ready", notPerTenant(agent.handleAdminHealth))
+	return http.Serve(l, mux)
+}
+
+// notPerTenant refuses requests selecting a tenant with ?tenant= to handler,
+// which serves what all tenants share (sessions, the lockdown, the approvers
+// and the configuration) or what only the guardian's owner has (the
+// exportable store and the paired devices).
+func notPerTenant(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("tenant") != "" {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("%s is not kept per tenant", r.URL.Path))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleAdminTokens lists the outstanding one-time tokens (of ?tenant=, if
+// set) on GET, and issues one on POST.
+func (agent *Agent) handleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	policy := agent.adminPolicy(w, r)
+	if policy == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, policy.Tokens.Pending())
+	case "POST":
+		var req AdminTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+			return
+		}
+		if req.Scope.ServiceUsername == "" || req.Scope.ServiceHostname == "" || req.Command == "" {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("a token requires a user, a host and a command"))
+			return
+		}
+		if req.TTL <= 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid token lifetime: %s", req.TTL))
+			return
+		}
+		if err := checkDelegation(policy.System, req.Scope, req.Command); err != nil {
+			writeAdminError(w, http.StatusForbidden, err)
+			return
+		}
+		token, err := policy.Tokens.Issue(req.Scope, req.Command, req.TTL)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		expires := time.Now().Add(req.TTL)
+		log.Printf("Issued one-time token for '%s' on %s@%s", req.Command, req.Scope.ServiceUsername, req.Scope.ServiceHostname)
+		agent.policy.Audit.Record(AuditEventPolicy, req.Scope, req.Command, "",
+			"one-time token issued, expires "+expires.Format(time.RFC3339))
+		writeAdminJSON(w, http.StatusOK, AdminTokenResponse{Token: token, Expires: expires})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// checkDelegation reports why cmd may not be approved in advance in scope, by
+// a one-time token or an invitation: requests which system policy denies,
+// which must always be confirmed, or which must be approved by given
+// approvers would not honor it.
+func checkDelegation(sys *SystemPolicy, scope Scope, cmd string) error {
+	if rule := sys.Denies(scope, cmd); rule != nil {
+		return fmt.Errorf("command is denied by system policy %s", rule.source)
+	}
+	if pattern := sys.CatastrophicMatch(cmd); pattern != nil {
+		return fmt.Errorf("command matches the catastrophic pattern %s", pattern.Name)
+	}
+	for _, command := range restrictedCommands(cmd) {
+		if rule := sys.AlwaysAsks(scope, command); rule != nil {
+			return fmt.Errorf("command must always be confirmed by system policy %s", rule.source)
+		}
+	}
+	if rule := sys.RequiredApprovers(scope, cmd); rule != nil {
+		return fmt.Errorf("command must be approved as required by system policy %s", rule.source)
+	}
+	return nil
+}
+
+// handleAdminInvitations lists the active invitations (of ?tenant=, if set)
+// on GET, issues one on POST and revokes ?id= on DELETE.
+func (agent *Agent) handleAdminInvitations(w http.ResponseWriter, r *http.Request) {
+	policy := agent.adminPolicy(w, r)
+	if policy == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, policy.Invitations.List())
+	case "POST":
+		var req AdminInvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+			return
+		}
+		if req.TTL <= 0 || req.MaxUses < 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid invitation lifetime %s or maximum uses %d", req.TTL, req.MaxUses))
+			return
+		}
+		if req.Rule.AllCommands {
+			if rule := policy.System.DeniesAny(req.Rule.Scope); rule != nil {
+				writeAdminError(w, http.StatusForbidden, fmt.Errorf("some commands are denied by system policy %s", rule.source))
+				return
+			}
+			if rule := policy.System.RequiredApprovers(req.Rule.Scope, ""); rule != nil {
+				writeAdminError(w, http.StatusForbidden, fmt.Errorf("some commands must be approved as required by system policy %s", rule.source))
+				return
+			}
+		}
+		for _, cmd := range req.Rule.Commands {
+			if err := checkDelegation(policy.System, req.Rule.Scope, cmd); err != nil {
+				writeAdminError(w, http.StatusForbidden, fmt.Errorf("'%s': %s", cmd, err))
+				return
+			}
+		}
+		file, err := policy.Invitations.Issue(req.Rule, req.TTL, req.MaxUses, req.Note)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		issued := req.Rule
+		issued.source = "invitation " + file.ID
+		log.Printf("Issued invitation: %s", issued.describe())
+		agent.policy.Audit.Record(AuditEventPolicy, req.Rule.Scope, "", "",
+			fmt.Sprintf("invitation issued: %s, expires %s", issued.describe(), file.Expires.Format(time.RFC3339)))
+		writeAdminJSON(w, http.StatusOK, file)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if err := policy.Invitations.Revoke(id); err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "invitation "+id+" revoked")
+		writeAdminJSON(w, http.StatusOK, struct{}{})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleAdminCredentials lists the issued tokens and invitations (of
+// ?tenant=, if set) matching ?since=, ?until=, ?client=, ?user=, ?server=,
+// ?kind= and ?status=.
+func (agent *Agent) handleAdminCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	policy := agent.adminPolicy(w, r)
+	if policy == nil {
+		return
+	}
+	query := r.URL.Query()
+	filter := CredentialFilter{
+		Client: query.Get("client"),
+		User:   query.Get("user"),
+		Server: query.Get("server"),
+		Kind:   query.Get("kind"),
+		Status: query.Get("status"),
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = ParseAuditTime(since); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = ParseAuditTime(until); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, policy.Ledger.Query(filter))
+}
+
+// handleAdminKeys lists the key constraints (of ?tenant=, if set), sets one on
+// POST and removes ?fingerprint= on DELETE.
+func (agent *Agent) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	store := agent.adminStore(w, r)
+	if store == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, store.KeyConstraints())
+	case "POST":
+		var constraint KeyConstraint
+		if err := json.NewDecoder(r.Body).Decode(&constraint); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+			return
+		}
+		if err := store.SetKeyConstraint(constraint); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "key constraint set for "+constraint.Fingerprint)
+		writeAdminJSON(w, http.StatusOK, constraint)
+	case "DELETE":
+		fingerprint := r.URL.Query().Get("fingerprint")
+		if _, ok := store.KeyConstraint(fingerprint); !ok {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("no constraint on key %s", fingerprint))
+			return
+		}
+		if err := store.RemoveKeyConstraint(fingerprint); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "key constraint removed for "+fingerprint)
+		writeAdminJSON(w, http.StatusOK, struct{}{})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleAdminSessions lists the active sessions, and terminates them on DELETE,
+// either by ?id= or all of a ?client=.
+func (agent *Agent) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, agent.policy.Sessions.List())
+	case "DELETE":
+		var killed []Session
+		if client := r.URL.Query().Get("client"); client != "" {
+			killed = agent.policy.Sessions.KillClient(client)
+		} else {
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writeAdminError(w, http.StatusBadRequest, fmt.Errorf("a session ID or client is required"))
+				return
+			}
+			session, err := agent.policy.Sessions.Kill(id)
+			if err != nil {
+				writeAdminError(w, http.StatusNotFound, err)
+				return
+			}
+			killed = append(killed, session)
+		}
+		for _, session := range killed {
+			log.Printf("Terminated session %d: '%s' on %s@%s", session.ID, session.Command,
+				session.Scope.ServiceUsername, session.Scope.ServiceHostname)
+			agent.policy.Audit.forRequest(session.RequestID).Record(AuditEventHandoff, session.Scope, session.Command, "terminated",
+				"session terminated by the admin API")
+		}
+		writeAdminJSON(w, http.StatusOK, killed)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleAdminSessionDebug returns the resource usage of the active sessions.
+func (agent *Agent) handleAdminSessionDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, agent.SessionDebug())
+}
+
+// denialCache returns the denial cache of tenant, or the guardian's if tenant
+// is nil, which Reconfigure may set.
+func (agent *Agent) denialCache(tenant *Tenant) *DenialCache {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if tenant != nil {
+		return tenant.policy.Denials
+	}
+	return agent.policy.Denials
+}
+
+// handleAdminReload rereads the configuration on POST, and returns which
+// changes were applied and which take a restart.
+func (agent *Agent) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	report, err := agent.Reload()
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, report)
+}
+
+// handleAdminLockdown returns the lockdown state (null when not locked down),
+// engages the lockdown on POST and releases it on DELETE.
+func (agent *Agent) handleAdminLockdown(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, agent.policy.Lockdown.Active())
+	case "POST":
+		var req AdminLockdownRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "no reason given"
+		}
+		log.Printf("Locking down: %s", req.Reason)
+		state, err := agent.Lock(req.Reason)
+		if err != nil {
+			// The lockdown is engaged regardless, but would not survive a
+			// restart.
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, state)
+	case "DELETE":
+		if err := agent.Unlock(); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("Lockdown released")
+		writeAdminJSON(w, http.StatusOK, struct{}{})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// adminTenant returns the tenant selected with ?tenant=, or nil if none is.
+// It reports false, having answered the request, if the tenant is not served.
+func (agent *Agent) adminTenant(w http.ResponseWriter, r *http.Request) (*Tenant, bool) {
+	name := r.URL.Query().Get("tenant")
+	if name == "" {
+		return nil, true
+	}
+	tenant := agent.tenant(name)
+	if tenant == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no tenant %s", name))
+		return nil, false
+	}
+	return tenant, true
+}
+
+// adminStore returns the store of the tenant selected with ?tenant=, if any,
+// or else the personal policy's.
+func (agent *Agent) adminStore(w http.ResponseWriter, r *http.Request) *Store {
+	tenant, ok := agent.adminTenant(w, r)
+	if !ok {
+		return nil
+	}
+	if tenant == nil {
+		return agent.store
+	}
+	return tenant.policy.Store
+}
+
+// adminPolicy returns the policy of the tenant selected with ?tenant=, if
+// any, or else the guardian's. Only the per-tenant parts of a tenant's policy
+// are set (see Tenant.apply), and its denial cache is only read through
+// denialCache.
+func (agent *Agent) adminPolicy(w http.ResponseWriter, r *http.Request) *Policy {
+	tenant, ok := agent.adminTenant(w, r)
+	if !ok {
+		return nil
+	}
+	if tenant == nil {
+		return &agent.policy
+	}
+	return &tenant.policy
+}
+
+// handleAdminRules lists the stored approvals (of ?tenant=, if set), changes
+// when one expires on PUT (never if Expires is zero) and removes one on DELETE.
+func (agent *Agent) handleAdminRules(w http.ResponseWriter, r *http.Request) {
+	store := agent.adminStore(w, r)
+	if store == nil {
+		return
+	}
+	if r.Method == "GET" {
+		writeAdminJSON(w, http.StatusOK, store.Rules())
+		return
+	}
+	var req AdminRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+		return
+	}
+	var err error
+	var detail string
+	switch r.Method {
+	case "PUT":
+		err = store.SetRuleExpiry(req.Scope, req.Command, req.Expires)
+		detail = "approval expires " + req.Expires.Format(time.RFC3339)
+		if req.Expires.IsZero() {
+			detail = "approval never expires"
+		}
+	case "DELETE":
+		err = store.RemoveRule(req.Scope, req.Command)
+		detail = "approval removed"
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	agent.policy.Audit.Record(AuditEventPolicy, req.Scope, req.Command, "", detail)
+	writeAdminJSON(w, http.StatusOK, struct{}{})
+}
+
+// handleAdminDenials lists the remembered denials (of ?tenant=, if set),
+// changes when one expires on PUT and forgets one on DELETE.
+func (agent *Agent) handleAdminDenials(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := agent.adminTenant(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "GET" {
+		writeAdminJSON(w, http.StatusOK, agent.denialCache(tenant).List())
+		return
+	}
+	var req AdminRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+		return
+	}
+	var found bool
+	switch r.Method {
+	case "PUT":
+		found = agent.denialCache(tenant).SetExpiry(req.Scope, req.Command, req.Expires)
+	case "DELETE":
+		found = agent.denialCache(tenant).Forget(req.Scope, req.Command)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if !found {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no such denial"))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct{}{})
+}
+
+// handleAdminStaleRules lists the stored approvals (of ?tenant=, if set)
+// unused for ?days=, and removes them on DELETE.
+func (agent *Agent) handleAdminStaleRules(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("a positive number of days is required"))
+		return
+	}
+	maxAge := time.Duration(days) * 24 * time.Hour
+	store := agent.adminStore(w, r)
+	if store == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, store.StaleRules(maxAge))
+	case "DELETE":
+		expired, err := store.ExpireStaleRules(maxAge)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, rule := range expired {
+			agent.policy.Audit.Record(AuditEventPolicy, rule.Scope, rule.Command, "",
+				fmt.Sprintf("approval expired, unused for %d days", days))
+		}
+		writeAdminJSON(w, http.StatusOK, expired)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleAdminStore exports the store as an encrypted bundle, or imports one.
+func (agent *Agent) handleAdminStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	var req AdminStoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+		return
+	}
+	if r.URL.Path == "/store/export" {
+		bundle, err := agent.ExportStore(req.Passphrase)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, AdminStoreRequest{Bundle: bundle})
+		return
+	}
+	summary, err := agent.ImportStore(req.Bundle, req.Passphrase)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("Imported store bundle from %s", summary.Host)
+	writeAdminJSON(w, http.StatusOK, summary)
+}
+
+// handleAdminDevices lists the paired mobile devices, and unpairs one on
+// DELETE ?id=.
+func (agent *Agent) handleAdminDevices(w http.ResponseWriter, r *http.Request) {
+	push := agent.push
+	if push == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("push approvals are not enabled (see --push-relay)"))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeAdminJSON(w, http.StatusOK, push.Devices())
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if err := push.Unpair(id); err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "device unpaired: "+id)
+		writeAdminJSON(w, http.StatusOK, struct{}{})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleAdminApprovers lists the attached approvers, and serves prompts to
+// them and takes their answers in team mode.
+func (agent *Agent) handleAdminApprovers(w http.ResponseWriter, r *http.Request) {
+	sessions := agent.sessions
+	if sessions == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("team mode is not enabled (see --team)"))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	switch {
+	case r.URL.Path == "/approvers" && r.Method == "GET":
+		writeAdminJSON(w, http.StatusOK, sessions.Attached())
+	case r.URL.Path == "/approvers/prompts" && r.Method == "GET" && name != "":
+		sessions.servePrompts(w, r, "session:"+name)
+	case r.URL.Path == "/approvers/answer" && r.Method == "POST" && name != "":
+		sessions.serveAnswer(w, r, "session:"+name)
+	default:
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// handleAdminPairing creates a pairing code on POST, and waits a while for a
+// device to answer it on GET ?channel=.
+func (agent *Agent) handleAdminPairing(w http.ResponseWriter, r *http.Request) {
+	push := agent.push
+	if push == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("push approvals are not enabled (see --push-relay)"))
+		return
+	}
+	switch r.Method {
+	case "POST":
+		pairing, err := push.StartPairing()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, pairing)
+	case "GET":
+		device, err := push.AwaitPairing(r.URL.Query().Get("channel"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadGateway, err)
+			return
+		}
+		if device != nil {
+			log.Printf("Paired device %s (%s)", device.Name, device.ID)
+			agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "",
+				fmt.Sprintf("device paired: %s (%s)", device.Name, device.ID))
+		}
+		writeAdminJSON(w, http.StatusOK, AdminPairingResponse{Device: device})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleAdminHealth reports the guardian's health. /ready fails with 503 when
+// the guardian is not ready, for supervisors that only check the status.
+func (agent *Agent) handleAdminHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	health := agent.Health()
+	status := http.StatusOK
+	if r.URL.Path == "/ready" && !health.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeAdminJSON(w, status, health)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, AdminError{Error: err.Error()})
+}
+
+// AdminClient talks to the admin API of a running guardian.
+type AdminClient struct {
+	// Bearer token sent with requests, if set (see ApproverKeys).
+	Token string
+
+	client http.Client
+}
+
+func NewAdminClient(socketPath string) *AdminClient {
+	return &AdminClient{client: http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return DialSocket(socketPath)
+			},
+		},
+	}}
+}
+
+// Do sends in (if not nil) as the JSON body of a request to the admin API,
+// and decodes the response into out (if not nil).
+func (admin *AdminClient) Do(method string, path string, in interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://guardian"+path, &body)
+	if err != nil {
+		return err
+	}
+	if admin.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+admin.Token)
+	}
+	resp, err := admin.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to reach guardian: %s", err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var adminErr AdminError
+		if json.Unmarshal(buf, &adminErr) == nil && adminErr.Error != "" {
+			return fmt.Errorf("%s", adminErr.Error)
+		}
+		return fmt.Errorf("guardian returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
@@ -1,6 +1,7 @@
 package guardianagent
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +9,11 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	"golang.org/x/crypto/ssh"
@@ -23,11 +29,50 @@ const (
 )
 
 type Agent struct {
+	// Guards the settings changed by Reconfigure.
+	mu sync.Mutex
+
 	policy Policy
 	store  *Store
+
+	policyConfigPath string
+	systemPolicyDir  string
+	verifier         *PolicyVerifier
+	remote           *RemotePolicy
+	pending          *PendingDecisions
+	ui               *monitoredUI
+	push             *PushApprover
+	sessions         *ApproverSessions
+
+	agentPassthrough bool
+	passthroughKeys  passthroughKeys
+
+	// Recipients that recordings required by the system policy are
+	// encrypted to, in addition to those of its record rules.
+	recordingRecipients []string
+
+	// Key of encrypted control channels, if enabled, and whether they are
+	// required.
+	noise         *NoiseKey
+	noiseRequired bool
+
+	// Delegatees served with their own policy and keys, by name.
+	tenants map[string]*Tenant
+
+	// Caps on the resources of each session.
+	sessionLimits SessionLimits
+
+	// Connections being served, and since when there were none, see Idle.
+	activeMu  sync.Mutex
+	active    int
+	idleSince time.Time
+
+	// Rereads the configuration, see Reload.
+	reloader Reloader
+	reloadMu sync.Mutex
 }
 
-func NewGuardian(policyConfigPath string, inType InputType) (*Agent, error) {
+func NewGuardian(policyConfigPath string, systemPolicyDir string, verifier *PolicyVerifier, inType InputType) (*Agent, error) {
 	var ui UI
 	switch inType {
 	case Terminal:
@@ -39,60 +84,409 @@ func NewGuardian(policyConfigPath string, inType InputType) (*Agent, error) {
 	case Display:
 		ui = &AskPassUI{}
 	}
+	monitored := newMonitoredUI(ui)
 
 	// get policy store
 	store, err := NewStore(policyConfigPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load policy store: %s", err)
 	}
-	return &Agent{
-			store:  store,
-			policy: Policy{Store: store, UI: ui}},
-		nil
+	lockdown, err := NewLockdown(policyConfigPath + ".lockdown")
+	if err != nil {
+		return nil, err
+	}
+	history, err := NewHistory(policyConfigPath + ".history")
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := NewCredentialLedger(policyConfigPath + ".ledger")
+	if err != nil {
+		return nil, err
+	}
+	invitations, err := NewInvitations(policyConfigPath+".invitations", ledger)
+	if err != nil {
+		return nil, err
+	}
+	policy := Policy{
+		Store:       store,
+		UI:          monitored,
+		Tokens:      NewApprovalTokens(ledger),
+		Invitations: invitations,
+		Ledger:      ledger,
+		Batches:     NewBatchApprovals(),
+		GitRuns:     NewGitRuns(),
+		Lockdown:    lockdown,
+		Sessions:    NewSessions(),
+		Quotas:      NewQuotaUsage(),
+		History:     history,
+	}
+	agent := &Agent{
+		store:            store,
+		policy:           policy,
+		policyConfigPath: policyConfigPath,
+		systemPolicyDir:  systemPolicyDir,
+		verifier:         verifier,
+		pending:          NewPendingDecisions(),
+		ui:               monitored,
+		idleSince:        time.Now(),
+	}
+	if agent.policy.System, err = agent.loadSystemPolicy(); err != nil {
+		return nil, err
+	}
+	agent.reportPolicyProblems()
+	if state := lockdown.Active(); state != nil {
+		monitored.Alert(fmt.Sprintf("Guardian is LOCKED DOWN since %s: %s\nAll requests will be denied until it is unlocked with sga-admin unlock.",
+			state.Since.Format(time.RFC1123), state.Reason))
+	}
+	return agent, nil
+}
+
+// loadSystemPolicy reads the system policy directory, the cached remote policy
+// bundle, if any, and the packs included by the personal policy.
+func (agent *Agent) loadSystemPolicy() (*SystemPolicy, error) {
+	return agent.loadSystemPolicyWith(agent.store)
+}
+
+func (agent *Agent) loadSystemPolicyWith(store *Store) (*SystemPolicy, error) {
+	agent.mu.Lock()
+	dir := agent.systemPolicyDir
+	agent.mu.Unlock()
+	system, err := LoadSystemPolicy(dir, agent.verifier)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load system policy: %s", err)
+	}
+	if agent.remote != nil {
+		if cached := agent.remote.CachedPath(); cached != "" {
+			if err = system.loadFile(cached, nil); err != nil {
+				return nil, fmt.Errorf("Failed to load remote policy: %s", err)
+			}
+		}
+	}
+	if err = system.Include(store.Includes(), path.Dir(agent.policyConfigPath)); err != nil {
+		return nil, fmt.Errorf("Failed to load policy packs: %s", err)
+	}
+	system.AddTags(store.Tags())
+	if err = system.CheckTags(); err != nil {
+		return nil, fmt.Errorf("Invalid policy: %s", err)
+	}
+	return system, nil
+}
+
+func (agent *Agent) reportPolicyProblems() {
+	system := agent.policy.System
+	if len(system.Warnings) > 0 {
+		agent.policy.UI.Alert(fmt.Sprintf("Unverified policy files were loaded:\n  %s",
+			strings.Join(system.Warnings, "\n  ")))
+	}
+	if conflicts := system.Conflicts(agent.store); len(conflicts) > 0 {
+		agent.policy.UI.Alert(fmt.Sprintf("Policy conflicts (system deny rules take precedence):\n  %s",
+			strings.Join(conflicts, "\n  ")))
+	}
+}
+
+// SetNetworkContext shows the network context of requests (address and kind
+// of network of the client and server, and optionally their AS and country)
+// in prompts and the audit log.
+func (agent *Agent) SetNetworkContext(lookupASN bool) {
+	agent.policy.Network = NewNetworkLocator(lookupASN)
+	agent.policy.Network.DNS = agent.policy.DNS
+}
+
+// DisableNetworkContext stops showing the network context of requests.
+func (agent *Agent) DisableNetworkContext() {
+	agent.policy.Network = nil
+}
+
+// SetApprovePipelines approves pipelines and command lists whose commands
+// are each allowed.
+func (agent *Agent) SetApprovePipelines(approve bool) {
+	agent.policy.ApprovePipelines = approve
+}
+
+// SetPolicyProgram consults program for every request.
+func (agent *Agent) SetPolicyProgram(program *PolicyProgram) {
+	agent.policy.Program = program
+}
+
+// SetDNS caches the resolution of server names for ttl, and failures for
+// negativeTTL. If checkServers is set, prompts warn about servers whose names
+// do not resolve.
+func (agent *Agent) SetDNS(ttl time.Duration, negativeTTL time.Duration, checkServers bool) {
+	agent.policy.DNS = NewDNSCache(ttl, negativeTTL)
+	agent.policy.CheckServerDNS = checkServers
+	if agent.policy.Network != nil {
+		// Connections may be using the previous locator.
+		agent.SetNetworkContext(agent.policy.Network.LookupASN)
+	}
+}
+
+// EnableNoise accepts encrypted control channels from clients which pinned
+// the guardian's key, which is returned, and refuses all others if required.
+func (agent *Agent) EnableNoise(required bool) (string, error) {
+	key, err := LoadNoiseKey(agent.policyConfigPath + ".noise")
+	if err != nil {
+		return "", err
+	}
+	agent.noise, agent.noiseRequired = key, required
+	return key.Public(), nil
+}
+
+// SetRecordingRecipients encrypts the recordings required by the system
+// policy to recipients, e.g. the guardian owner's key, as well.
+func (agent *Agent) SetRecordingRecipients(recipients []string) error {
+	for _, recipient := range recipients {
+		if _, err := ParseRecordingRecipient(recipient); err != nil {
+			return err
+		}
+	}
+	agent.recordingRecipients = recipients
+	return nil
+}
+
+// SetClockCheck checks the clock against the NTP server every interval, and
+// alerts the approver and warns in prompts while it is off by more than
+// maxSkew.
+func (agent *Agent) SetClockCheck(server string, maxSkew time.Duration, interval time.Duration) {
+	agent.policy.Clock = NewClockCheck(server, maxSkew, func(msg string) {
+		agent.policy.UI.Alert(msg)
+		agent.policy.Audit.Record(AuditEventError, Scope{}, "", "", msg)
+	})
+	go agent.policy.Clock.Run(interval)
+}
+
+// SetDenialMemory makes the agent repeat interactive denials for the given
+// period instead of prompting again.
+func (agent *Agent) SetDenialMemory(period time.Duration) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	caches := []**DenialCache{&agent.policy.Denials}
+	for _, tenant := range agent.tenants {
+		caches = append(caches, &tenant.policy.Denials)
+	}
+	for _, cache := range caches {
+		if *cache != nil {
+			(*cache).SetPeriod(period)
+		} else {
+			*cache = NewDenialCache(period)
+		}
+	}
+}
+
+// SetScreenLockAware defers prompts while the approver's screen is locked,
+// and denies requests whose prompt was deferred for longer than maxWait, if
+// set.
+func (agent *Agent) SetScreenLockAware(maxWait time.Duration) {
+	agent.ui.screen = NewScreenLock(maxWait)
+}
+
+// SetPromptEscalation sets when unanswered prompts of each risk tier ring
+// and show an urgent notification, and the sound file played instead of the
+// terminal bell, if set.
+func (agent *Agent) SetPromptEscalation(escalation map[string]Escalation, sound string) {
+	agent.ui.escalation = escalation
+	agent.ui.sound = sound
+}
+
+// SetPushApprover also sends prompts to the mobile devices paired through the
+// push relay at relayURL, giving up on them after timeout.
+func (agent *Agent) SetPushApprover(relayURL string, timeout time.Duration) error {
+	push, err := NewPushApprover(relayURL, agent.policyConfigPath+".devices", timeout)
+	if err != nil {
+		return err
+	}
+	agent.push = push
+	agent.ui.remotes = append(agent.ui.remotes, push)
+	return nil
+}
+
+// AddRemoteApprover also sends prompts to remote, e.g. a chat room.
+func (agent *Agent) AddRemoteApprover(remote RemoteApprover) {
+	agent.ui.remotes = append(agent.ui.remotes, remote)
+}
+
+// SetTeamMode also shows prompts to the approvers attached through the
+// admin API or the approver web UI.
+func (agent *Agent) SetTeamMode() {
+	if agent.sessions != nil {
+		return
+	}
+	agent.sessions = NewApproverSessions()
+	agent.ui.remotes = append(agent.ui.remotes, agent.sessions)
+}
+
+// ServeApproverWeb serves the approver web UI on l, for the given users
+// (bcrypt hashes by name). It requires team mode.
+func (agent *Agent) ServeApproverWeb(l net.Listener, users map[string][]byte) error {
+	if agent.sessions == nil {
+		return fmt.Errorf("the approver web UI requires team mode")
+	}
+	return agent.sessions.ServeApproverWeb(l, users)
+}
+
+// SetApproverAuth makes the agent authenticate the approver through the given
+// PAM service before honoring interactive approvals.
+func (agent *Agent) SetApproverAuth(service string, grace time.Duration) error {
+	auth, err := NewApproverAuth(service, grace)
+	if err != nil {
+		return err
+	}
+	agent.policy.Approver = auth
+	return nil
+}
+
+// SetStepUp requires completing factor before approvals of the given kinds
+// are honored.
+func (agent *Agent) SetStepUp(factor StepUpFactor, kinds []string) error {
+	stepUp, err := NewStepUp(factor, kinds)
+	if err != nil {
+		return err
+	}
+	agent.policy.StepUp = stepUp
+	return nil
+}
+
+// SetRemotePolicy layers a centrally managed policy bundle over the system
+// policy, and keeps it up to date in the background. If the bundle cannot be
+// fetched, the last-known-good copy is used.
+func (agent *Agent) SetRemotePolicy(remote *RemotePolicy) error {
+	agent.remote = remote
+	if _, err := remote.Fetch(); err != nil {
+		if remote.CachedPath() == "" {
+			return err
+		}
+		agent.policy.UI.Alert(fmt.Sprintf("%s\nUsing the last known good remote policy.", err))
+	}
+	system, err := agent.loadSystemPolicy()
+	if err != nil {
+		return err
+	}
+	agent.policy.System.Replace(system)
+	agent.reportPolicyProblems()
+	if remote.Interval > 0 {
+		go agent.refreshRemotePolicy()
+	}
+	return nil
+}
+
+func (agent *Agent) refreshRemotePolicy() {
+	for range time.Tick(agent.remote.Interval) {
+		changed, err := agent.remote.Fetch()
+		if err != nil {
+			log.Printf("Keeping last known good remote policy: %s", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		system, err := agent.loadSystemPolicy()
+		if err != nil {
+			log.Printf("Keeping previous policy: %s", err)
+			continue
+		}
+		if err = agent.reloadTenants(); err != nil {
+			log.Printf("Keeping previous policy: %s", err)
+			continue
+		}
+		agent.policy.System.Replace(system)
+		log.Printf("Updated remote policy from %s", agent.remote.URL)
+		agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "updated remote policy from "+agent.remote.URL)
+	}
+}
+
+// SetAuditLog makes the agent record requests, decisions and handoffs to the
+// given audit log.
+func (agent *Agent) SetAuditLog(audit *AuditLog) {
+	agent.policy.Audit = audit
+	audit.SetTagger(agent.policy.System.TagsFor)
+}
+
+// Close closes the audit log, if any, along with its sinks and hooks.
+func (agent *Agent) Close() error {
+	return agent.policy.Audit.Close()
 }
 
-func (agent *Agent) proxySSH(scope Scope, toClient net.Conn, toServer net.Conn, control net.Conn, fil *ssh.Filter) error {
+func (agent *Agent) proxySSH(session *Session, tenant *Tenant, toClient net.Conn, toServer net.Conn, control net.Conn, fil *ssh.Filter) error {
+	scope := session.Scope
 	curuser, err := user.Current()
 	if err != nil {
 		return fmt.Errorf("Failed to get current user: %s", err)
 	}
 
+	var auth []ssh.AuthMethod
+	if tenant != nil {
+		auth = []ssh.AuthMethod{ssh.PublicKeys(tenant.signers(agent.policy.UI)...),
+			passwordAuth(scope.ServiceUsername, scope.ServiceHostname, agent.policy.UI)}
+	} else {
+		auth = getAuth(scope.ServiceUsername, scope.ServiceHostname, curuser.HomeDir, agent.policy.UI)
+	}
 	clientConfig := &ssh.ClientConfig{
 		User: scope.ServiceUsername,
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 			return HostKeyCallback(hostname, remote, key, agent.policy.UI)
 		},
-		Auth:              getAuth(scope.ServiceUsername, scope.ServiceHostname, curuser.HomeDir, agent.policy.UI),
-		HostKeyAlgorithms: knownhosts.OrderHostKeyAlgs(scope.ServiceHostname, toServer.RemoteAddr(), path.Join(curuser.HomeDir, ".ssh", "known_hosts")),
+		Auth:              auth,
+		HostKeyAlgorithms: knownhosts.OrderHostKeyAlgs(scope.ServiceHostname, toServer.RemoteAddr(), knownHostsFile(curuser)),
 	}
 
-	meteredConnToServer := CustomConn{Conn: toServer}
+	if err = agent.policy.Sessions.transition(session, SessionProxying, nil); err != nil {
+		return err
+	}
+	meteredConnToServer := CustomConn{Conn: &sessionConn{Conn: toServer, session: session, limit: agent.sessionLimits.MaxBytes}}
 	proxy, err := ssh.NewProxyConn(scope.ServiceHostname, toClient, &meteredConnToServer, clientConfig, fil)
 	if err != nil {
 		return err
 	}
 	done := proxy.Run()
 
-	err = <-done
-	var msgNum byte
-	var msg interface{}
-	if err != nil {
-		msg = HandoffFailedMessage{Msg: err.Error()}
-		msgNum = MsgHandoffFailed
-
-	} else {
-		msg = HandoffCompleteMessage{
-			NextTransportByte: uint32(meteredConnToServer.BytesRead() - proxy.BufferedFromServer())}
-		msgNum = MsgHandoffComplete
+	if err = <-done; err != nil {
+		agent.policy.Sessions.transition(session, SessionFailed, err)
+		agent.policy.Audit.forRequest(session.RequestID).Record(AuditEventHandoff, scope, "", "failed", err.Error())
+		WriteControlPacket(control, MsgHandoffFailed, ssh.Marshal(HandoffFailedMessage{Msg: err.Error()}))
+		return err
+	}
+	if err = agent.policy.Sessions.transition(session, SessionHandoffPending, nil); err != nil {
+		// Terminated through the admin API.
+		return err
 	}
-	packet := ssh.Marshal(msg)
-	return WriteControlPacket(control, msgNum, packet)
+	msg := HandoffCompleteMessage{
+		NextTransportByte: uint32(meteredConnToServer.BytesRead() - proxy.BufferedFromServer())}
+	if err = WriteControlPacket(control, MsgHandoffComplete, ssh.Marshal(msg)); err != nil {
+		agent.policy.Sessions.transition(session, SessionFailed, err)
+		agent.policy.Audit.forRequest(session.RequestID).Record(AuditEventHandoff, scope, "", "failed", err.Error())
+		return err
+	}
+	agent.policy.Sessions.transition(session, SessionHandedOff, nil)
+	agent.policy.Audit.forRequest(session.RequestID).Record(AuditEventHandoff, scope, "", "complete", "")
+	return nil
 }
 
+// HandleConnection serves a connection from the guardian's own forwarding.
 func (agent *Agent) HandleConnection(conn net.Conn) error {
+	return agent.handleConnection(conn, &Listener{})
+}
+
+func (agent *Agent) handleConnection(conn net.Conn, listener *Listener) error {
 	log.Printf("New incoming connection")
 
-	var scope Scope
+	agent.mu.Lock()
+	policy := agent.policy
+	agent.mu.Unlock()
+	policy.AlwaysAsk = policy.AlwaysAsk || listener.AlwaysAsk
+	policy.Peer = conn.RemoteAddr()
+	if listener.Tenant != "" {
+		tenant := agent.tenant(listener.Tenant)
+		if tenant == nil {
+			conn.Close()
+			return fmt.Errorf("Tenant %s is not served", listener.Tenant)
+		}
+		agent.mu.Lock()
+		tenant.apply(&policy)
+		agent.mu.Unlock()
+	}
+	scope := Scope{Client: listener.Client}
+	var probes probeLimiter
+	var bindings []sessionBinding
+	encrypted := false
 	for {
 		msgNum, payload, err := ReadControlPacket(conn)
 		if err == io.EOF || err == io.ErrClosedPipe {
@@ -101,51 +495,178 @@ func (agent *Agent) HandleConnection(conn net.Conn) error {
 		if err != nil {
 			return fmt.Errorf("Failed to read control packet: %s", err)
 		}
+		if agent.noiseRequired && !encrypted && msgNum != MsgNoiseHandshake {
+			agent.policy.Audit.Record(AuditEventError, scope, "", "", "refused unencrypted connection")
+			WriteControlPacket(conn, MsgAgentFailure, []byte{})
+			return fmt.Errorf("Refusing unencrypted connection")
+		}
 		switch msgNum {
+		case MsgNoiseHandshake:
+			if agent.noise == nil || encrypted {
+				if err = agent.rejectProbe(conn, scope, &probes, "unexpected Noise handshake"); err != nil {
+					return err
+				}
+				continue
+			}
+			if conn, err = agent.noise.acceptNoise(conn, payload); err != nil {
+				agent.policy.Audit.Record(AuditEventError, scope, "", "", "failed Noise handshake: "+err.Error())
+				return fmt.Errorf("Failed Noise handshake: %s", err)
+			}
+			encrypted = true
 		case MsgAgentForwardingNotice:
 			notice := new(AgentForwardingNoticeMsg)
 			if err := ssh.Unmarshal(payload, notice); err != nil {
 				return fmt.Errorf("Failed to unmarshal AgentForwardingNoticeMsg: %s", err)
 			}
 			scope.Client = notice.Client
+			policy.ClientWarnings = verifyClientName(conn.RemoteAddr(), notice.Client)
+			// Never auto-approve requests from clients that may not be who
+			// they claim to be.
+			policy.AlwaysAsk = policy.AlwaysAsk || len(policy.ClientWarnings) > 0
+			agent.policy.Audit.Record(AuditEventConnection, scope, "", "", strings.Join(policy.ClientWarnings, "; "))
 		case MsgExecutionRequest:
 			execReq := new(ExecutionRequestMessage)
 			if err = ssh.Unmarshal(payload, execReq); err != nil {
 				return fmt.Errorf("Failed to unmarshal ExecutionRequestMessage: %s", err)
 			}
+			meta, err := ParseRequestMetadata(execReq.Metadata)
+			if err != nil {
+				return err
+			}
 			scope.ServiceHostname = execReq.Server
 			scope.ServiceUsername = execReq.User
-			agent.handleExecutionRequest(conn, scope, execReq.Command)
+			agent.handleExecutionRequest(conn, &policy, listener, scope, execReq.Command, meta)
+		case MsgSessionRecorded:
+			recorded := new(SessionRecordedMessage)
+			if err = ssh.Unmarshal(payload, recorded); err != nil {
+				return fmt.Errorf("Failed to unmarshal SessionRecordedMessage: %s", err)
+			}
+			agent.policy.Audit.forRequest(recorded.RequestID).Record(AuditEventRecording, scope, "", "", "sha256:"+recorded.Hash)
+			WriteControlPacket(conn, MsgAgentSuccess, []byte{})
 		case MsgAgentCExtension:
-			queryExtension := new(AgentCExtensionMsg)
-			ssh.Unmarshal(payload, queryExtension)
-			if queryExtension.ExtensionType == AgentGuardExtensionType {
+			queryExtension := new(agentExtensionMsg)
+			if ssh.Unmarshal(payload, queryExtension) == nil && queryExtension.ExtensionType == AgentGuardExtensionType {
 				WriteControlPacket(conn, MsgAgentSuccess, []byte{})
 				continue
 			}
+			if agent.agentPassthrough && queryExtension.ExtensionType == sessionBindExtension {
+				if err = agent.handleAgentRequest(conn, &policy, scope, &bindings, msgNum, payload); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = agent.rejectProbe(conn, scope, &probes, fmt.Sprintf("unsupported extension %q", queryExtension.ExtensionType)); err != nil {
+				return err
+			}
+		case msgAgentRequestIdentities, msgAgentSignRequest:
+			if agent.agentPassthrough {
+				if err = agent.handleAgentRequest(conn, &policy, scope, &bindings, msgNum, payload); err != nil {
+					return err
+				}
+				continue
+			}
 			fallthrough
 		default:
-			WriteControlPacket(conn, MsgAgentFailure, []byte{})
-			return fmt.Errorf("Unrecognized incoming message: %d", msgNum)
+			if err = agent.rejectProbe(conn, scope, &probes, fmt.Sprintf("unrecognized message %d", msgNum)); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (ag *Agent) handleExecutionRequest(conn net.Conn, scope Scope, cmd string) error {
-	err := ag.policy.RequestApproval(scope, cmd)
+// rejectProbe replies to an unsupported message with a failure, auditing the
+// first one on the connection, and fails once the connection has sent too
+// many of them.
+func (agent *Agent) rejectProbe(conn net.Conn, scope Scope, probes *probeLimiter, what string) error {
+	if probes.count == 0 {
+		agent.policy.Audit.Record(AuditEventError, scope, "", "", "client sent "+what)
+	}
+	if !probes.admit() {
+		agent.policy.Audit.Record(AuditEventError, scope, "", "",
+			fmt.Sprintf("closing connection after %d unsupported messages", maxProbes))
+		return fmt.Errorf("Too many unsupported messages, last: %s", what)
+	}
+	log.Printf("Rejecting %s", what)
+	return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+}
+
+func (ag *Agent) handleExecutionRequest(conn net.Conn, policy *Policy, listener *Listener, scope Scope, cmd string, meta RequestMetadata) error {
+	// Only clients that chose a request ID understand keepalives and
+	// response metadata.
+	var respMeta []byte
+	keepAlive := meta.RequestID != ""
+	if keepAlive {
+		respMeta = (&RequestMetadata{RequestID: meta.RequestID}).Marshal()
+	} else {
+		id, err := NewRequestID()
+		if err != nil {
+			return err
+		}
+		meta.RequestID = id
+	}
+
+	// Older clients cannot record sessions.
+	if rule := policy.System.RecordingFor(scope, cmd); rule != nil && rule.Recording != RecordingNone && !keepAlive {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED: the client cannot record sessions, as system policy %s requires",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, rule.source))
+		ag.policy.Audit.forRequest(meta.RequestID).Record(AuditEventDecision, scope, cmd, "denied", "client cannot record sessions, required by system policy "+rule.source)
+		WriteControlPacket(conn, MsgExecutionDenied, ssh.Marshal(ExecutionDeniedMessage{Reason: "The system policy requires recording the session, which this client does not support"}))
+		return nil
+	}
+
+	// Requests from different listeners never share decisions.
+	requested := cmd
+	cmd, err := ag.pending.Await(conn, listener.Name+"/"+meta.RequestID, scope, requested, keepAlive, func(ctx context.Context) (string, error) {
+		return policy.RequestApproval(ctx, scope, requested, meta)
+	})
+	if err == errClientGone {
+		log.Printf("%s Client disconnected, keeping request pending", requestTag(meta.RequestID, scope))
+		return err
+	}
+	if err == nil {
+		// The lockdown may have been engaged while the user was deciding.
+		err = policy.Lockdown.Deny()
+	}
+	if err != nil && keepAlive {
+		respMeta = (&RequestMetadata{RequestID: meta.RequestID, Denial: denialCode(err)}).Marshal()
+	}
 	if err != nil {
 		WriteControlPacket(conn, MsgExecutionDenied,
-			ssh.Marshal(ExecutionDeniedMessage{Reason: err.Error()}))
+			ssh.Marshal(ExecutionDeniedMessage{Reason: err.Error(), Metadata: respMeta}))
 		return nil
 	}
-	filter := ssh.NewFilter(cmd, func() error { return ag.policy.RequestApprovalForAllCommands(scope) })
-	WriteControlPacket(conn, MsgExecutionApproved, []byte{})
+	if rule := policy.System.RecordingFor(scope, cmd); rule != nil && rule.Recording != RecordingNone && keepAlive {
+		recipients := mergeRecipients(ag.recordingRecipients, rule.Recipients)
+		respMeta = (&RequestMetadata{RequestID: meta.RequestID, Recording: rule.Recording, RecordingRecipients: recipients}).Marshal()
+		detail := rule.Recording
+		if len(recipients) > 0 {
+			detail += fmt.Sprintf(", encrypted to %s", strings.Join(recipients, ", "))
+		}
+		ag.policy.Audit.forRequest(meta.RequestID).Record(AuditEventRecording, scope, cmd, "required", detail+" (system policy "+rule.source+")")
+	}
+	filter := ssh.NewFilter(cmd, func() error { return policy.RequestApprovalForAllCommands(scope, meta.RequestID) })
+	WriteControlPacket(conn, MsgExecutionApproved, ssh.Marshal(ExecutionApprovedMessage{Command: cmd, Metadata: respMeta}))
+	session := &Session{RequestID: meta.RequestID, Listener: listener.Name, Scope: scope, Command: cmd, kill: conn.Close}
+	ag.policy.Sessions.add(session)
+	defer func() { ag.policy.Sessions.finish(session, err) }()
+
+	// The goroutines started for the session, e.g. by yamux and the SSH
+	// proxy, inherit the label by which they are counted.
+	pprof.Do(context.Background(), pprof.Labels(sessionLabel, strconv.FormatUint(session.ID, 10)), func(context.Context) {
+		err = ag.serveSession(conn, session, policy.Tenant, filter)
+	})
+	return err
+}
 
-	ymux, err := yamux.Server(conn, nil)
+// serveSession proxies an approved session until its handoff.
+func (ag *Agent) serveSession(conn net.Conn, session *Session, tenant *Tenant, filter *ssh.Filter) error {
+	config := ag.sessionLimits.yamuxConfig()
+	ymux, err := yamux.Server(conn, config)
 	if err != nil {
 		return fmt.Errorf("Failed to start ymux: %s", err)
 	}
 	defer ymux.Close()
+	ag.policy.Sessions.setStreams(session, ymux, config)
 
 	control, err := ymux.Accept()
 	if err != nil {
@@ -165,7 +686,7 @@ func (ag *Agent) handleExecutionRequest(conn net.Conn, scope Scope, cmd string)
 	}
 	defer transport.Close()
 
-	err = ag.proxySSH(scope, sshData, transport, control, filter)
+	err = ag.proxySSH(session, tenant, sshData, transport, control, filter)
 	transport.Close()
 	sshData.Close()
 	control.Close()
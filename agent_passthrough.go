@@ -0,0 +1,329 @@
+package guardianagent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Messages of the standard ssh-agent protocol, which uses the same framing as
+// control packets. They are only answered in passthrough mode. (Message 11 is
+// also MsgHandoffFailed, which is only ever sent to clients.)
+const (
+	msgAgentRequestIdentities = 11
+	msgAgentIdentitiesAnswer  = 12
+	msgAgentSignRequest       = 13
+	msgAgentSignResponse      = 14
+)
+
+type agentSignRequestMsg struct {
+	KeyBlob []byte
+	Data    []byte
+	Flags   uint32
+}
+
+type agentSignResponseMsg struct {
+	SigBlob []byte
+}
+
+type agentIdentity struct {
+	KeyBlob []byte
+	Comment string
+	Rest    []byte `ssh:"rest"`
+}
+
+// publickeySignedData is the data signed for SSH public key authentication
+// (RFC 4252, section 7).
+type publickeySignedData struct {
+	SessionID []byte
+	MsgType   byte
+	User      string
+	Service   string
+	Method    string
+	HasSig    bool
+	Algo      string
+	PubKey    []byte
+}
+
+const msgUserAuthRequest = 50
+
+// The session-bind@openssh.com extension, with which ssh (OpenSSH 8.9 and
+// later) tells the agent which host a connection is to, proven by the host's
+// signature over the session ID. It is the only extension handled in
+// passthrough mode.
+const sessionBindExtension = "session-bind@openssh.com"
+
+type agentExtensionMsg struct {
+	ExtensionType string
+	Contents      []byte `ssh:"rest"`
+}
+
+type sessionBindMsg struct {
+	HostKey      []byte
+	SessionID    []byte
+	Signature    []byte
+	IsForwarding bool
+}
+
+// sessionBinding records a session-bind on an agent connection.
+type sessionBinding struct {
+	sessionID []byte
+	hostKey   ssh.PublicKey
+	// Name of the host (host:port) according to known_hosts, if found.
+	host string
+}
+
+// passthroughKeys holds the key files used when there is no local ssh-agent,
+// loaded once so that passphrases are only asked for once.
+type passthroughKeys struct {
+	once    sync.Once
+	signers []ssh.Signer
+}
+
+// SetAgentPassthrough makes the guardian also answer standard ssh-agent
+// requests on the forwarded socket, asking the user to approve every
+// signature, so that it can replace ssh-agent forwarding altogether.
+func (agent *Agent) SetAgentPassthrough(enabled bool) {
+	agent.agentPassthrough = enabled
+}
+
+// keyFileSigners returns the key files of tenant, if set, or else those of
+// the user running the guardian.
+func (agent *Agent) keyFileSigners(tenant *Tenant) []ssh.Signer {
+	if tenant != nil {
+		return tenant.signers(agent.policy.UI)
+	}
+	agent.passthroughKeys.once.Do(func() {
+		curuser, err := user.Current()
+		if err != nil {
+			log.Printf("Failed to get current user: %s", err)
+			return
+		}
+		agent.passthroughKeys.signers = getKeyFileSigners(path.Join(curuser.HomeDir, ".ssh"), agent.policy.UI)
+	})
+	return agent.passthroughKeys.signers
+}
+
+func (agent *Agent) handleAgentRequest(conn net.Conn, policy *Policy, scope Scope, bindings *[]sessionBinding, msgNum byte, payload []byte) error {
+	switch msgNum {
+	case MsgAgentCExtension:
+		ext := new(agentExtensionMsg)
+		if err := ssh.Unmarshal(payload, ext); err != nil {
+			return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+		}
+		binding, err := parseSessionBind(ext.Contents)
+		if err != nil {
+			log.Printf("Rejecting session-bind: %s", err)
+			agent.policy.Audit.Record(AuditEventError, scope, "", "", "invalid session-bind: "+err.Error())
+			return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+		}
+		*bindings = append(*bindings, binding)
+		return WriteControlPacket(conn, MsgAgentSuccess, []byte{})
+	case msgAgentRequestIdentities:
+		var identities []agentIdentity
+		if policy.Tenant == nil {
+			respNum, resp, err := localAgentRoundTrip(msgNum, payload)
+			if err == nil && respNum == msgAgentIdentitiesAnswer {
+				identities = parseIdentities(resp)
+			}
+		}
+		if len(identities) == 0 {
+			for _, signer := range agent.keyFileSigners(policy.Tenant) {
+				identities = append(identities, agentIdentity{KeyBlob: signer.PublicKey().Marshal()})
+			}
+		}
+		// Expired keys are not offered.
+		now := time.Now()
+		answer := make([]byte, 4)
+		var count uint32
+		for _, identity := range identities {
+			key, err := ssh.ParsePublicKey(identity.KeyBlob)
+			if err != nil {
+				continue
+			}
+			if constraint, ok := policy.Store.KeyConstraint(ssh.FingerprintSHA256(key)); ok && constraint.expired(now) {
+				continue
+			}
+			identity.Rest = nil
+			answer = append(answer, ssh.Marshal(identity)...)
+			count++
+		}
+		binary.BigEndian.PutUint32(answer, count)
+		return WriteControlPacket(conn, msgAgentIdentitiesAnswer, answer)
+	case msgAgentSignRequest:
+		req := new(agentSignRequestMsg)
+		if err := ssh.Unmarshal(payload, req); err != nil {
+			return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+		}
+		key, err := ssh.ParsePublicKey(req.KeyBlob)
+		if err != nil {
+			return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+		}
+		var hostKey ssh.PublicKey
+		scope.ServiceHostname = ""
+		if binding := findBinding(*bindings, req.Data); binding != nil {
+			hostKey = binding.hostKey
+			scope.ServiceHostname = binding.host
+		} else if len(*bindings) > 0 {
+			// Bound connections must only be used to sign in to the hosts
+			// they were bound to.
+			agent.policy.Audit.Record(AuditEventError, scope, "", "", "signature request for an unbound session")
+			return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+		}
+		if err = policy.RequestSignature(scope, key, hostKey, req.Data); err != nil {
+			return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+		}
+		// The local agent gets the request as is, so that it honors the
+		// requested signature flags. It holds the owner's keys, which
+		// tenants never sign with.
+		if policy.Tenant == nil {
+			respNum, resp, err := localAgentRoundTrip(msgNum, payload)
+			if err == nil && respNum == msgAgentSignResponse {
+				return WriteControlPacket(conn, respNum, resp)
+			}
+		}
+		for _, signer := range agent.keyFileSigners(policy.Tenant) {
+			if !bytes.Equal(signer.PublicKey().Marshal(), req.KeyBlob) {
+				continue
+			}
+			sig, err := signer.Sign(rand.Reader, req.Data)
+			if err != nil {
+				log.Printf("Failed to sign: %s", err)
+				break
+			}
+			return WriteControlPacket(conn, msgAgentSignResponse, ssh.Marshal(agentSignResponseMsg{SigBlob: ssh.Marshal(sig)}))
+		}
+		return WriteControlPacket(conn, MsgAgentFailure, []byte{})
+	}
+	return fmt.Errorf("Unexpected ssh-agent message: %d", msgNum)
+}
+
+func parseIdentities(answer []byte) []agentIdentity {
+	if len(answer) < 4 {
+		return nil
+	}
+	count := binary.BigEndian.Uint32(answer)
+	rest := answer[4:]
+	var identities []agentIdentity
+	for i := uint32(0); i < count; i++ {
+		var identity agentIdentity
+		if err := ssh.Unmarshal(rest, &identity); err != nil {
+			return identities
+		}
+		identities = append(identities, identity)
+		rest = identity.Rest
+	}
+	return identities
+}
+
+func parseSessionBind(contents []byte) (sessionBinding, error) {
+	var msg sessionBindMsg
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return sessionBinding{}, err
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return sessionBinding{}, err
+	}
+	sig := new(ssh.Signature)
+	if err = ssh.Unmarshal(msg.Signature, sig); err != nil {
+		return sessionBinding{}, err
+	}
+	if err = hostKey.Verify(msg.SessionID, sig); err != nil {
+		return sessionBinding{}, fmt.Errorf("bad host signature: %s", err)
+	}
+	return sessionBinding{sessionID: msg.SessionID, hostKey: hostKey, host: knownHostFor(hostKey)}, nil
+}
+
+// findBinding returns the binding of the session that data (a public key
+// authentication) belongs to, if any.
+func findBinding(bindings []sessionBinding, data []byte) *sessionBinding {
+	var signed publickeySignedData
+	if ssh.Unmarshal(data, &signed) != nil {
+		return nil
+	}
+	for i := range bindings {
+		if bytes.Equal(bindings[i].sessionID, signed.SessionID) {
+			return &bindings[i]
+		}
+	}
+	return nil
+}
+
+// knownHostFor looks up the name of the host with the given key in the user's
+// known_hosts. Hashed entries cannot be looked up.
+func knownHostFor(key ssh.PublicKey) string {
+	curuser, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	buf, err := ioutil.ReadFile(knownHostsFile(curuser))
+	if err != nil {
+		return ""
+	}
+	for len(buf) > 0 {
+		marker, hosts, pub, _, rest, err := ssh.ParseKnownHosts(buf)
+		if err != nil {
+			break
+		}
+		buf = rest
+		if marker != "" || !bytes.Equal(pub.Marshal(), key.Marshal()) {
+			continue
+		}
+		for _, host := range hosts {
+			if strings.HasPrefix(host, "|") {
+				continue
+			}
+			if strings.HasPrefix(host, "[") {
+				if h, p, err := net.SplitHostPort(host); err == nil {
+					return net.JoinHostPort(strings.Trim(h, "[]"), p)
+				}
+				continue
+			}
+			return net.JoinHostPort(host, "22")
+		}
+	}
+	return ""
+}
+
+// localAgentRoundTrip relays a request to the ssh-agent running alongside the
+// guardian, if any.
+func localAgentRoundTrip(msgNum byte, payload []byte) (byte, []byte, error) {
+	realAgentPath := os.Getenv("SSH_AUTH_SOCK")
+	if realAgentPath == "" {
+		return 0, nil, errors.New("no local ssh-agent")
+	}
+	realAgent, err := net.Dial("unix", realAgentPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer realAgent.Close()
+	if err = WriteControlPacket(realAgent, msgNum, payload); err != nil {
+		return 0, nil, err
+	}
+	return ReadControlPacket(realAgent)
+}
+
+// describeSignedData describes what a signature would authorize, and returns
+// the user it signs in as, if the data is that of a public key authentication.
+func describeSignedData(data []byte) (string, string) {
+	var signed publickeySignedData
+	if ssh.Unmarshal(data, &signed) != nil || signed.MsgType != msgUserAuthRequest {
+		return "", "  Data: not an SSH sign-in"
+	}
+	return signed.User, fmt.Sprintf("  Session ID: %s", hex.EncodeToString(signed.SessionID))
+}
@@ -0,0 +1,121 @@
+package guardianagent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ApproverAuth re-authenticates the approver through PAM, with pamtester(1),
+// before an interactive approval is honored, so that someone at an unlocked
+// guardian cannot approve requests. PAM prompts (e.g. for a password) are
+// shown with the UI; messages (e.g. to touch a fingerprint reader) are
+// shown as they arrive.
+type ApproverAuth struct {
+	service string
+	user    string
+
+	// A successful authentication is not repeated for this long.
+	grace time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func NewApproverAuth(service string, grace time.Duration) (*ApproverAuth, error) {
+	if _, err := exec.LookPath("pamtester"); err != nil {
+		return nil, fmt.Errorf("Failed to find pamtester, which approver authentication requires: %s", err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get current user: %s", err)
+	}
+	return &ApproverAuth{service: service, user: u.Username, grace: grace}, nil
+}
+
+// Authenticate authenticates the approver, prompting with ui. Concurrent
+// approvals are authenticated one at a time.
+func (auth *ApproverAuth) Authenticate(ui UI) error {
+	if auth == nil {
+		return nil
+	}
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if auth.grace > 0 && time.Since(auth.last) < auth.grace {
+		return nil
+	}
+
+	cmd := exec.Command("pamtester", auth.service, auth.user, "authenticate")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	output, conversation := io.Pipe()
+	cmd.Stdout = conversation
+	cmd.Stderr = conversation
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to run pamtester: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+		conversation.Close()
+	}()
+
+	if err = converse(output, stdin, ui); err != nil {
+		cmd.Process.Kill()
+		output.Close()
+		<-done
+		return err
+	}
+	if err = <-done; err != nil {
+		return fmt.Errorf("authentication as %s failed", auth.user)
+	}
+	auth.last = time.Now()
+	return nil
+}
+
+// converse relays the PAM conversation of pamtester: lines are messages, and
+// output ending in a colon without a newline is a prompt, which pamtester
+// waits for an answer to.
+func converse(output io.Reader, answers io.Writer, ui UI) error {
+	var pending bytes.Buffer
+	buf := make([]byte, 1024)
+	for {
+		n, err := output.Read(buf)
+		pending.Write(buf[:n])
+		for {
+			line, lineErr := pending.ReadString('\n')
+			if lineErr != nil {
+				// Not a complete line, keep it for later.
+				pending.Reset()
+				pending.WriteString(line)
+				break
+			}
+			line = strings.TrimSpace(line)
+			// pamtester reports the outcome itself, which is reported by the
+			// caller instead.
+			if line != "" && !strings.HasPrefix(line, "pamtester:") {
+				ui.Inform(line)
+			}
+		}
+		if prompt := strings.TrimSpace(pending.String()); strings.HasSuffix(prompt, ":") {
+			pending.Reset()
+			answer, err := ui.AskPassword(prompt)
+			if err != nil {
+				return fmt.Errorf("Failed to get approver authentication: %s", err)
+			}
+			if _, err = io.WriteString(answers, answer+"\n"); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
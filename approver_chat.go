@@ -0,0 +1,284 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errChatTimeout = errors.New("no answer in the chat")
+
+// chatMessage is a message posted in the chat of a ChatApprover.
+type chatMessage struct {
+	// Who posted it, as named in the audit log, e.g. "telegram:@alice".
+	sender string
+	// The name approvers are listed by.
+	name    string
+	text    string
+	replyTo string
+}
+
+// chatTransport posts to and reads from a private chat room.
+type chatTransport interface {
+	// post posts text, in reply to the message with ID replyTo if set, and
+	// returns the ID of the message.
+	post(text string, replyTo string) (string, error)
+	// receive waits a while for new messages by others than the bot.
+	receive() ([]chatMessage, error)
+}
+
+type chatPrompt struct {
+	prompt    Prompt
+	messageID string
+	answers   chan RemoteAnswer
+}
+
+// ChatApprover posts prompts to a private chat room, in which approvers
+// answer them with "approve" (optionally with how long to remember the
+// approval, e.g. "approve 8h"), "deny", or the number of a choice. Replies
+// must reply to the prompt or quote its code if several are pending.
+type ChatApprover struct {
+	transport chatTransport
+	timeout   time.Duration
+
+	// Who may answer, by name; anyone in the chat if empty.
+	approvers []string
+
+	mu      sync.Mutex
+	pending map[string]*chatPrompt
+	polling bool
+}
+
+func newChatApprover(transport chatTransport, approvers []string, timeout time.Duration) *ChatApprover {
+	return &ChatApprover{
+		transport: transport,
+		timeout:   timeout,
+		approvers: approvers,
+		pending:   make(map[string]*chatPrompt),
+	}
+}
+
+func formatChatPrompt(code string, prompt Prompt) string {
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "[%s] %s\n", code, prompt.Question)
+	for i, choice := range prompt.Choices {
+		fmt.Fprintf(&text, "%d. %s\n", i+1, choice)
+	}
+	text.WriteString("Reply \"approve\"")
+	if prompt.Forever > 0 {
+		text.WriteString(" (or e.g. \"approve 8h\" to remember it)")
+	}
+	text.WriteString(", \"deny\", or the number of a choice.")
+	return text.String()
+}
+
+// Ask posts the prompt, and waits for an approver to answer it.
+func (chat *ChatApprover) Ask(ctx context.Context, prompt Prompt) (RemoteAnswer, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return RemoteAnswer{}, err
+	}
+	code := hex.EncodeToString(buf)
+	id, err := chat.transport.post(formatChatPrompt(code, prompt), "")
+	if err != nil {
+		return RemoteAnswer{}, err
+	}
+	p := &chatPrompt{prompt: prompt, messageID: id, answers: make(chan RemoteAnswer, 1)}
+	chat.mu.Lock()
+	chat.pending[code] = p
+	if !chat.polling {
+		chat.polling = true
+		go chat.poll()
+	}
+	chat.mu.Unlock()
+	defer func() {
+		chat.mu.Lock()
+		delete(chat.pending, code)
+		chat.mu.Unlock()
+	}()
+
+	timeout := time.NewTimer(chat.timeout)
+	defer timeout.Stop()
+	select {
+	case answer := <-p.answers:
+		decision := "answered: " + prompt.Choices[answer.Choice-1]
+		switch {
+		case answer.Choice == 1:
+			decision = "denied"
+		case answer.TTL > 0:
+			decision = fmt.Sprintf("approved for %s", answer.TTL)
+		case answer.Choice == prompt.Once || answer.Choice == prompt.Forever:
+			decision = "approved"
+		}
+		chat.notify(fmt.Sprintf("[%s] %s by %s", code, decision, answer.Approver), id)
+		return answer, nil
+	case <-timeout.C:
+		chat.notify(fmt.Sprintf("[%s] expired without an answer", code), id)
+		return RemoteAnswer{}, errChatTimeout
+	case <-ctx.Done():
+		chat.notify(fmt.Sprintf("[%s] withdrawn", code), id)
+		return RemoteAnswer{}, ctx.Err()
+	}
+}
+
+func (chat *ChatApprover) notify(text string, replyTo string) {
+	if _, err := chat.transport.post(text, replyTo); err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// poll reads replies while prompts are pending.
+func (chat *ChatApprover) poll() {
+	for {
+		chat.mu.Lock()
+		if len(chat.pending) == 0 {
+			chat.polling = false
+			chat.mu.Unlock()
+			return
+		}
+		chat.mu.Unlock()
+
+		messages, err := chat.transport.receive()
+		if err != nil {
+			log.Printf("%s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, msg := range messages {
+			chat.handle(msg)
+		}
+	}
+}
+
+func (chat *ChatApprover) mayApprove(name string) bool {
+	if len(chat.approvers) == 0 {
+		return true
+	}
+	for _, approver := range chat.approvers {
+		if strings.TrimPrefix(approver, "@") == strings.TrimPrefix(name, "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// handle answers the prompt msg replies to, if it is a valid answer.
+func (chat *ChatApprover) handle(msg chatMessage) {
+	reply, ok := parseChatReply(msg.text)
+	if !ok {
+		return
+	}
+	if !chat.mayApprove(msg.name) {
+		log.Printf("Ignoring answer by %s, who is not an approver", msg.sender)
+		return
+	}
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	var target *chatPrompt
+	for code, p := range chat.pending {
+		if (msg.replyTo != "" && msg.replyTo == p.messageID) || code == reply.code {
+			target = p
+		}
+	}
+	if target == nil && len(chat.pending) == 1 && reply.code == "" && msg.replyTo == "" {
+		for _, p := range chat.pending {
+			target = p
+		}
+	}
+	if target == nil {
+		if len(chat.pending) > 1 {
+			go chat.notify("Several requests are pending: reply to one, or quote its code.", "")
+		}
+		return
+	}
+
+	answer := RemoteAnswer{Approver: msg.sender}
+	prompt := target.prompt
+	switch {
+	case reply.choice > 0 && reply.choice <= len(prompt.Choices):
+		answer.Choice = reply.choice
+	case reply.deny:
+		answer.Choice = 1
+	case reply.approve && reply.ttl > 0 && prompt.Forever > 0:
+		answer.Choice, answer.TTL = prompt.Forever, reply.ttl
+	case reply.approve && reply.ttl == 0 && prompt.Once > 0:
+		answer.Choice = prompt.Once
+	default:
+		go chat.notify("This request cannot be answered that way.", target.messageID)
+		return
+	}
+	if answer.Choice != 1 && !MayApprove(prompt.Approvers, answer.Approver) {
+		go chat.notify(fmt.Sprintf("%s may not approve this request.", msg.name), target.messageID)
+		return
+	}
+	select {
+	case target.answers <- answer:
+	default:
+	}
+}
+
+type chatReply struct {
+	approve bool
+	deny    bool
+	choice  int
+	ttl     time.Duration
+	code    string
+}
+
+// parseChatReply parses a reply such as "approve 8h", "deny a1b2c3" or "2".
+func parseChatReply(text string) (chatReply, bool) {
+	var reply chatReply
+	for _, line := range strings.Split(text, "\n") {
+		// Skip quotes of the prompt in replies.
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		for _, word := range strings.Fields(strings.ToLower(line)) {
+			word = strings.Trim(word, "[].,!")
+			switch word {
+			case "approve", "approved", "allow", "yes", "y", "ok":
+				reply.approve = true
+				continue
+			case "deny", "denied", "reject", "no", "n":
+				reply.deny = true
+				continue
+			}
+			if n, err := strconv.Atoi(word); err == nil && len(word) <= 2 {
+				reply.choice = n
+			} else if _, err := hex.DecodeString(word); err == nil && len(word) == 6 {
+				reply.code = word
+			} else if ttl, err := parseChatTTL(word); err == nil {
+				reply.ttl = ttl
+			}
+		}
+	}
+	if reply.approve == reply.deny && reply.choice == 0 {
+		return reply, false
+	}
+	return reply, true
+}
+
+// parseChatTTL parses a duration such as 30m, 8h or 7d.
+func parseChatTTL(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return ttl, nil
+}
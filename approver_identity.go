@@ -0,0 +1,354 @@
+package guardianagent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Prefixes of approver identities whose names were authenticated, and can
+// therefore be matched against user and group patterns: local users (by the
+// UID of their connection), SSH keys and users of the approver web UI.
+var authenticatedApproverPrefixes = []string{"unix:", "key:", "web:"}
+
+// How long a login with an SSH key lasts.
+const approverLoginLifetime = 12 * time.Hour
+
+// localApprover returns the identity of the user answering the guardian's
+// own prompts.
+func localApprover() string {
+	if u, err := user.Current(); err == nil {
+		return "unix:" + u.Username
+	}
+	return "unix:" + strconv.Itoa(os.Getuid())
+}
+
+// MayApprove reports whether the approver with the given identity (e.g.
+// "unix:alice") is allowed by patterns: user names, %groups, +netgroups, or
+// exact identities such as "telegram:@alice". Empty patterns allow anyone.
+func MayApprove(patterns []string, identity string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	var name string
+	for _, prefix := range authenticatedApproverPrefixes {
+		if strings.HasPrefix(identity, prefix) {
+			name = strings.TrimPrefix(identity, prefix)
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern == identity || (name != "" && !strings.Contains(pattern, ":") && matchesUserOrGroup(pattern, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerListener identifies the local user at the other end of each
+// connection to a Unix socket, and makes it the connection's remote address
+// ("uid:<n>"), for HTTP handlers to find it in Request.RemoteAddr.
+type peerListener struct {
+	net.Listener
+}
+
+type peerAddr int
+
+func (addr peerAddr) Network() string { return "unix" }
+func (addr peerAddr) String() string  { return fmt.Sprintf("uid:%d", int(addr)) }
+
+type peerConn struct {
+	net.Conn
+	uid int
+}
+
+func (conn peerConn) RemoteAddr() net.Addr { return peerAddr(conn.uid) }
+
+func (l peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err != nil {
+			log.Printf("Failed to identify approver: %s", err)
+			conn.Close()
+			continue
+		}
+		return peerConn{Conn: conn, uid: uid}, nil
+	}
+}
+
+// peerIdentity returns the identity of the local user who made r on a
+// peerListener.
+func peerIdentity(r *http.Request) (string, error) {
+	uid := strings.TrimPrefix(r.RemoteAddr, "uid:")
+	if uid == r.RemoteAddr {
+		return "", fmt.Errorf("unidentified connection")
+	}
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return "unix:" + uid, nil
+	}
+	return "unix:" + u.Username, nil
+}
+
+// ApproverChallenge is signed with an approver's SSH key to log in.
+type ApproverChallenge struct {
+	Challenge string
+}
+
+// ApproverLoginRequest proves the possession of an SSH key by signing a
+// challenge (see ApproverLoginData).
+type ApproverLoginRequest struct {
+	Challenge string
+	PublicKey []byte
+	Signature *ssh.Signature
+}
+
+// ApproverLoginResponse carries the bearer token of a logged in approver.
+type ApproverLoginResponse struct {
+	Token    string
+	Identity string
+	Expires  time.Time
+}
+
+// ApproverLoginData returns the data signed to log in with a challenge.
+func ApproverLoginData(challenge string) []byte {
+	return []byte("sga-approver-login\x00" + challenge)
+}
+
+type approverToken struct {
+	identity string
+	expires  time.Time
+}
+
+// ApproverKeys authenticates approvers by their SSH keys, e.g. several
+// people sharing a Unix account.
+type ApproverKeys struct {
+	// Approver names by key fingerprint.
+	names map[string]string
+
+	mu         sync.Mutex
+	challenges map[string]time.Time
+	tokens     map[string]approverToken
+}
+
+// LoadApproverKeys reads an authorized_keys file, in which the comment of
+// each key names its approver.
+func LoadApproverKeys(path string) (*ApproverKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read approver keys: %s", err)
+	}
+	defer f.Close()
+	keys := &ApproverKeys{
+		names:      make(map[string]string),
+		challenges: make(map[string]time.Time),
+		tokens:     make(map[string]approverToken),
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if comment == "" || strings.ContainsAny(comment, " :") {
+			return nil, fmt.Errorf("%s:%d: the comment must name the approver", path, line)
+		}
+		keys.names[ssh.FingerprintSHA256(key)] = comment
+	}
+	return keys, scanner.Err()
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Challenge returns a fresh challenge to sign, valid for a minute.
+func (keys *ApproverKeys) Challenge() (string, error) {
+	challenge, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	for c, expires := range keys.challenges {
+		if time.Now().After(expires) {
+			delete(keys.challenges, c)
+		}
+	}
+	keys.challenges[challenge] = time.Now().Add(time.Minute)
+	return challenge, nil
+}
+
+// Login checks the signature of a challenge, and returns a bearer token for
+// the key's approver.
+func (keys *ApproverKeys) Login(req ApproverLoginRequest) (ApproverLoginResponse, error) {
+	keys.mu.Lock()
+	expires, ok := keys.challenges[req.Challenge]
+	delete(keys.challenges, req.Challenge)
+	keys.mu.Unlock()
+	if !ok || time.Now().After(expires) || req.Signature == nil {
+		return ApproverLoginResponse{}, fmt.Errorf("invalid or expired challenge")
+	}
+	key, err := ssh.ParsePublicKey(req.PublicKey)
+	if err != nil {
+		return ApproverLoginResponse{}, fmt.Errorf("invalid public key: %s", err)
+	}
+	name, ok := keys.names[ssh.FingerprintSHA256(key)]
+	if !ok {
+		return ApproverLoginResponse{}, fmt.Errorf("unknown approver key %s", ssh.FingerprintSHA256(key))
+	}
+	if err = key.Verify(ApproverLoginData(req.Challenge), req.Signature); err != nil {
+		return ApproverLoginResponse{}, fmt.Errorf("invalid signature: %s", err)
+	}
+	token, err := randomToken()
+	if err != nil {
+		return ApproverLoginResponse{}, err
+	}
+	resp := ApproverLoginResponse{Token: token, Identity: "key:" + name, Expires: time.Now().Add(approverLoginLifetime)}
+	keys.mu.Lock()
+	keys.tokens[token] = approverToken{identity: resp.Identity, expires: resp.Expires}
+	keys.mu.Unlock()
+	return resp, nil
+}
+
+// identity returns the approver logged in with the bearer token of r, if
+// any.
+func (keys *ApproverKeys) identity(r *http.Request) (string, bool) {
+	if keys == nil {
+		return "", false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	t, ok := keys.tokens[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(t.expires) {
+		delete(keys.tokens, token)
+		return "", false
+	}
+	return t.identity, true
+}
+
+// LoginApprover logs in to the approver socket of a guardian with the first
+// key of the SSH agent which signs the challenge, and sets the bearer token of
+// admin.
+func LoginApprover(admin *AdminClient, signer agent.Agent) (string, error) {
+	keys, err := signer.List()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list SSH agent keys: %s", err)
+	}
+	for _, key := range keys {
+		var challenge ApproverChallenge
+		if err = admin.Do("GET", "/approvers/challenge", nil, &challenge); err != nil {
+			return "", err
+		}
+		sig, err := signer.Sign(key, ApproverLoginData(challenge.Challenge))
+		if err != nil {
+			continue
+		}
+		var resp ApproverLoginResponse
+		err = admin.Do("POST", "/approvers/login", ApproverLoginRequest{Challenge: challenge.Challenge, PublicKey: key.Marshal(), Signature: sig}, &resp)
+		if err != nil {
+			continue
+		}
+		admin.Token = resp.Token
+		return resp.Identity, nil
+	}
+	return "", fmt.Errorf("None of the SSH agent's keys is an approver key")
+}
+
+// ServeApprovers serves prompts to other local users attached through the
+// Unix socket l, identified by their UID or, if keys is set, by logging in
+// with an SSH key. Local users must match users (names, %groups or
+// +netgroups), or be the user running the guardian if users is empty. It
+// requires team mode.
+func (agent *Agent) ServeApprovers(l net.Listener, keys *ApproverKeys, users []string) error {
+	sessions := agent.sessions
+	if sessions == nil {
+		return fmt.Errorf("the approver socket requires team mode")
+	}
+	identified := func(handler func(w http.ResponseWriter, r *http.Request, identity string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := keys.identity(r)
+			if !ok {
+				var err error
+				if identity, err = peerIdentity(r); err != nil {
+					writeAdminError(w, http.StatusUnauthorized, err)
+					return
+				}
+				if !MayApprove(users, identity) || (len(users) == 0 && identity != localApprover()) {
+					writeAdminError(w, http.StatusForbidden, fmt.Errorf("%s may not attach as an approver", identity))
+					return
+				}
+			}
+			handler(w, r, identity)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/approvers/prompts", identified(sessions.servePrompts))
+	mux.HandleFunc("/approvers/answer", identified(func(w http.ResponseWriter, r *http.Request, identity string) {
+		if r.Method != "POST" {
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		sessions.serveAnswer(w, r, identity)
+	}))
+	mux.HandleFunc("/approvers/challenge", func(w http.ResponseWriter, r *http.Request) {
+		if keys == nil {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("SSH key logins are not enabled (see --approver-keys)"))
+			return
+		}
+		challenge, err := keys.Challenge()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, ApproverChallenge{Challenge: challenge})
+	})
+	mux.HandleFunc("/approvers/login", func(w http.ResponseWriter, r *http.Request) {
+		var req ApproverLoginRequest
+		if keys == nil || r.Method != "POST" {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("SSH key logins are not enabled (see --approver-keys)"))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+			return
+		}
+		resp, err := keys.Login(req)
+		if err != nil {
+			agent.policy.Audit.Record(AuditEventError, Scope{}, "", "", "approver login failed: "+err.Error())
+			writeAdminError(w, http.StatusUnauthorized, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, resp)
+	})
+	return http.Serve(peerListener{l}, mux)
+}
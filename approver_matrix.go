@@ -0,0 +1,163 @@
+package guardianagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long the homeserver is asked to wait for new messages.
+const matrixSyncTimeout = 25 * time.Second
+
+// matrixTransport uses the client-server API of a Matrix homeserver, as the
+// bot user owning the access token. The room must not be end-to-end
+// encrypted.
+type matrixTransport struct {
+	homeserver string
+	room       string
+	token      string
+	user       string
+	since      string
+	txn        int64
+	client     http.Client
+}
+
+// NewMatrixApprover posts prompts to a Matrix room, in which the approvers
+// (Matrix user IDs, or anyone in the room if none) answer them.
+func NewMatrixApprover(homeserver string, room string, token string, approvers []string, timeout time.Duration) (*ChatApprover, error) {
+	transport := &matrixTransport{
+		homeserver: strings.TrimSuffix(homeserver, "/"),
+		room:       room,
+		token:      token,
+		txn:        time.Now().UnixNano(),
+		client:     http.Client{Timeout: matrixSyncTimeout + 15*time.Second},
+	}
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := transport.call("GET", "/account/whoami", nil, &whoami); err != nil {
+		return nil, err
+	}
+	transport.user = whoami.UserID
+	// Skip the room's history.
+	if _, err := transport.sync(0); err != nil {
+		return nil, err
+	}
+	return newChatApprover(transport, approvers, timeout), nil
+}
+
+func (transport *matrixTransport) call(method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, transport.homeserver+"/_matrix/client/v3"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+transport.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := transport.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to call Matrix homeserver: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var matrixErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&matrixErr)
+		return fmt.Errorf("Failed to call Matrix homeserver: %s %s", resp.Status, matrixErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (transport *matrixTransport) post(text string, replyTo string) (string, error) {
+	content := map[string]interface{}{"msgtype": "m.text", "body": text}
+	if replyTo != "" {
+		content["m.relates_to"] = map[string]interface{}{
+			"m.in_reply_to": map[string]string{"event_id": replyTo},
+		}
+	}
+	var sent struct {
+		EventID string `json:"event_id"`
+	}
+	txn := atomic.AddInt64(&transport.txn, 1)
+	err := transport.call("PUT", fmt.Sprintf("/rooms/%s/send/m.room.message/sga%d", url.PathEscape(transport.room), txn), content, &sent)
+	return sent.EventID, err
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	EventID string `json:"event_id"`
+	Content struct {
+		Body      string `json:"body"`
+		RelatesTo struct {
+			InReplyTo struct {
+				EventID string `json:"event_id"`
+			} `json:"m.in_reply_to"`
+		} `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+// sync returns the events in the room since the last sync.
+func (transport *matrixTransport) sync(timeout time.Duration) ([]matrixEvent, error) {
+	filter, _ := json.Marshal(map[string]interface{}{
+		"room": map[string]interface{}{
+			"rooms":    []string{transport.room},
+			"timeline": map[string]interface{}{"types": []string{"m.room.message"}},
+		},
+		"presence":     map[string]interface{}{"types": []string{}},
+		"account_data": map[string]interface{}{"types": []string{}},
+	})
+	query := url.Values{"timeout": {fmt.Sprint(int(timeout / time.Millisecond))}, "filter": {string(filter)}}
+	if transport.since != "" {
+		query.Set("since", transport.since)
+	}
+	var result struct {
+		NextBatch string `json:"next_batch"`
+		Rooms     struct {
+			Join map[string]struct {
+				Timeline struct {
+					Events []matrixEvent `json:"events"`
+				} `json:"timeline"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err := transport.call("GET", "/sync?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	transport.since = result.NextBatch
+	return result.Rooms.Join[transport.room].Timeline.Events, nil
+}
+
+func (transport *matrixTransport) receive() ([]chatMessage, error) {
+	events, err := transport.sync(matrixSyncTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var messages []chatMessage
+	for _, event := range events {
+		if event.Type != "m.room.message" || event.Sender == transport.user {
+			continue
+		}
+		messages = append(messages, chatMessage{
+			sender:  "matrix:" + event.Sender,
+			name:    event.Sender,
+			text:    event.Content.Body,
+			replyTo: event.Content.RelatesTo.InReplyTo.EventID,
+		})
+	}
+	return messages, nil
+}
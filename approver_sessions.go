@@ -0,0 +1,190 @@
+package guardianagent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Attached approvers which have not polled for this long are listed as gone.
+const approverSessionIdle = time.Minute
+
+// AttachedPrompt is a prompt shown to attached approvers.
+type AttachedPrompt struct {
+	ID       string
+	Question string
+	Choices  []string
+	Once     int `json:",omitempty"`
+	Forever  int `json:",omitempty"`
+	Asked    time.Time
+
+	// Who may approve the request (see MayApprove), anyone if empty.
+	Approvers []string `json:",omitempty"`
+}
+
+// AttachedPrompts are the prompts waiting for an answer, as of Version.
+type AttachedPrompts struct {
+	Version int
+	Prompts []AttachedPrompt
+}
+
+// AttachedApprover is an approver session attached to the guardian.
+type AttachedApprover struct {
+	Name     string
+	LastSeen time.Time
+}
+
+type attachedPrompt struct {
+	AttachedPrompt
+	answers chan RemoteAnswer
+}
+
+// ApproverSessions shows prompts to approvers attached to the guardian
+// (with sga-admin attach, or the approver web UI), so that a team can share
+// guard duty. Every prompt is shown to all of them, and the first answer
+// wins.
+type ApproverSessions struct {
+	mu       sync.Mutex
+	prompts  map[string]*attachedPrompt
+	sessions map[string]time.Time
+	version  int
+	changed  chan struct{}
+}
+
+func NewApproverSessions() *ApproverSessions {
+	return &ApproverSessions{
+		prompts:  make(map[string]*attachedPrompt),
+		sessions: make(map[string]time.Time),
+		changed:  make(chan struct{}),
+	}
+}
+
+// change wakes up the approvers waiting for prompts.
+func (sessions *ApproverSessions) change() {
+	sessions.version++
+	close(sessions.changed)
+	sessions.changed = make(chan struct{})
+}
+
+// Ask shows the prompt to the attached approvers, including those attaching
+// while it is pending, and waits for one of them to answer it.
+func (sessions *ApproverSessions) Ask(ctx context.Context, prompt Prompt) (RemoteAnswer, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return RemoteAnswer{}, err
+	}
+	p := &attachedPrompt{
+		AttachedPrompt: AttachedPrompt{
+			ID:       hex.EncodeToString(buf),
+			Question: prompt.Question,
+			Choices:  prompt.Choices,
+			Once:     prompt.Once,
+			Forever:  prompt.Forever,
+			Asked:    time.Now(),
+
+			Approvers: prompt.Approvers,
+		},
+		answers: make(chan RemoteAnswer, 1),
+	}
+	sessions.mu.Lock()
+	sessions.prompts[p.ID] = p
+	sessions.change()
+	sessions.mu.Unlock()
+	defer func() {
+		sessions.mu.Lock()
+		delete(sessions.prompts, p.ID)
+		sessions.change()
+		sessions.mu.Unlock()
+	}()
+
+	select {
+	case answer := <-p.answers:
+		return answer, nil
+	case <-ctx.Done():
+		return RemoteAnswer{}, ctx.Err()
+	}
+}
+
+// Prompts returns the pending prompts for the approver with the given name,
+// after waiting up to wait for them to change from version.
+func (sessions *ApproverSessions) Prompts(name string, version int, wait time.Duration) AttachedPrompts {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	for {
+		sessions.sessions[name] = time.Now()
+		if sessions.version != version {
+			break
+		}
+		changed := sessions.changed
+		sessions.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout.C:
+			sessions.mu.Lock()
+			sessions.sessions[name] = time.Now()
+			return sessions.snapshot()
+		}
+		sessions.mu.Lock()
+	}
+	return sessions.snapshot()
+}
+
+func (sessions *ApproverSessions) snapshot() AttachedPrompts {
+	prompts := AttachedPrompts{Version: sessions.version, Prompts: []AttachedPrompt{}}
+	for _, p := range sessions.prompts {
+		prompts.Prompts = append(prompts.Prompts, p.AttachedPrompt)
+	}
+	sort.Slice(prompts.Prompts, func(i, j int) bool {
+		return prompts.Prompts[i].Asked.Before(prompts.Prompts[j].Asked)
+	})
+	return prompts
+}
+
+// Answer answers the prompt with the given ID on behalf of approver.
+func (sessions *ApproverSessions) Answer(id string, answer RemoteAnswer) error {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	p, ok := sessions.prompts[id]
+	if !ok {
+		return fmt.Errorf("the request was already answered or withdrawn")
+	}
+	if answer.Choice < 1 || answer.Choice > len(p.Choices) {
+		return fmt.Errorf("invalid choice %d", answer.Choice)
+	}
+	if answer.Choice != 1 && !MayApprove(p.Approvers, answer.Approver) {
+		return fmt.Errorf("%s may not approve this request", answer.Approver)
+	}
+	if answer.TTL > 0 && answer.Choice != p.Forever {
+		return fmt.Errorf("only permanent approvals can expire")
+	}
+	select {
+	case p.answers <- answer:
+	default:
+		return fmt.Errorf("the request was already answered")
+	}
+	delete(sessions.prompts, id)
+	sessions.change()
+	return nil
+}
+
+// Attached lists the approvers which polled for prompts recently.
+func (sessions *ApproverSessions) Attached() []AttachedApprover {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	approvers := []AttachedApprover{}
+	for name, seen := range sessions.sessions {
+		if time.Since(seen) > approverSessionIdle {
+			delete(sessions.sessions, name)
+			continue
+		}
+		approvers = append(approvers, AttachedApprover{Name: name, LastSeen: seen})
+	}
+	sort.Slice(approvers, func(i, j int) bool { return approvers[i].Name < approvers[j].Name })
+	return approvers
+}
@@ -0,0 +1,143 @@
+package guardianagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// How long Telegram is asked to wait for new messages.
+const telegramPollTimeout = 25 * time.Second
+
+// telegramTransport uses the Telegram Bot API.
+type telegramTransport struct {
+	token  string
+	chat   int64
+	offset int64
+	client http.Client
+}
+
+// NewTelegramApprover posts prompts to a Telegram chat with a bot, in which
+// the approvers (user names or IDs, or anyone in the chat if none) answer
+// them.
+func NewTelegramApprover(token string, chat string, approvers []string, timeout time.Duration) (*ChatApprover, error) {
+	chatID, err := strconv.ParseInt(chat, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Telegram chat ID %q", chat)
+	}
+	transport := &telegramTransport{
+		token:  token,
+		chat:   chatID,
+		client: http.Client{Timeout: telegramPollTimeout + 15*time.Second},
+	}
+	// Skip the updates that arrived before.
+	updates, err := transport.updates(-1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(updates) > 0 {
+		transport.offset = updates[len(updates)-1].UpdateID + 1
+	}
+	return newChatApprover(transport, approvers, timeout), nil
+}
+
+func (transport *telegramTransport) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.client.Post(fmt.Sprintf("https://api.telegram.org/bot%s/%s", transport.token, method),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL contains the token.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Failed to call Telegram: %s", err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("Failed to call Telegram: %s", resp.Status)
+	}
+	if !reply.OK {
+		return fmt.Errorf("Failed to call Telegram: %s", reply.Description)
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+func (transport *telegramTransport) post(text string, replyTo string) (string, error) {
+	params := map[string]interface{}{"chat_id": transport.chat, "text": text}
+	if replyTo != "" {
+		params["reply_to_message_id"], _ = strconv.ParseInt(replyTo, 10, 64)
+	}
+	var sent struct {
+		MessageID int64 `json:"message_id"`
+	}
+	if err := transport.call("sendMessage", params, &sent); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(sent.MessageID, 10), nil
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		MessageID int64 `json:"message_id"`
+		From      struct {
+			ID       int64  `json:"id"`
+			Username string `json:"username"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text           string `json:"text"`
+		ReplyToMessage *struct {
+			MessageID int64 `json:"message_id"`
+		} `json:"reply_to_message"`
+	} `json:"message"`
+}
+
+func (transport *telegramTransport) updates(offset int64, timeout time.Duration) ([]telegramUpdate, error) {
+	var updates []telegramUpdate
+	err := transport.call("getUpdates", map[string]interface{}{
+		"offset":          offset,
+		"timeout":         int(timeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	return updates, err
+}
+
+func (transport *telegramTransport) receive() ([]chatMessage, error) {
+	updates, err := transport.updates(transport.offset, telegramPollTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var messages []chatMessage
+	for _, update := range updates {
+		transport.offset = update.UpdateID + 1
+		msg := update.Message
+		if msg == nil || msg.Chat.ID != transport.chat {
+			continue
+		}
+		sender := "telegram:" + strconv.FormatInt(msg.From.ID, 10)
+		name := strconv.FormatInt(msg.From.ID, 10)
+		if msg.From.Username != "" {
+			sender, name = "telegram:@"+msg.From.Username, msg.From.Username
+		}
+		message := chatMessage{sender: sender, name: name, text: msg.Text}
+		if msg.ReplyToMessage != nil {
+			message.replyTo = strconv.FormatInt(msg.ReplyToMessage.MessageID, 10)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
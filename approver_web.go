@@ -0,0 +1,180 @@
+package guardianagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long approvers wait for prompts to change in a single poll.
+const approverPollWait = 20 * time.Second
+
+// AdminAnswerRequest answers an attached prompt.
+type AdminAnswerRequest struct {
+	ID     string
+	Choice int
+	TTL    time.Duration
+}
+
+// LoadApproverUsers reads an htpasswd file of approvers with bcrypt
+// password hashes (htpasswd -B).
+func LoadApproverUsers(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read approver users: %s", err)
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return nil, fmt.Errorf("invalid approver user %q in %s (expected name:bcrypt-hash)", parts[0], path)
+		}
+		users[parts[0]] = []byte(parts[1])
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no approver users in %s", path)
+	}
+	return users, scanner.Err()
+}
+
+// servePrompts serves the pending prompts to the named approver.
+func (sessions *ApproverSessions) servePrompts(w http.ResponseWriter, r *http.Request, name string) {
+	version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait > approverPollWait {
+		wait = approverPollWait
+	}
+	writeAdminJSON(w, http.StatusOK, sessions.Prompts(name, version, wait))
+}
+
+// serveAnswer answers a prompt on behalf of approver.
+func (sessions *ApproverSessions) serveAnswer(w http.ResponseWriter, r *http.Request, approver string) {
+	var req AdminAnswerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+		return
+	}
+	err := sessions.Answer(req.ID, RemoteAnswer{Choice: req.Choice, Approver: approver, TTL: req.TTL})
+	if err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct{}{})
+}
+
+// ServeApproverWeb serves a web UI for approvers on l, authenticated with
+// HTTP basic authentication against users (bcrypt hashes by name), until l
+// is closed. l should use TLS unless it only accepts local connections.
+func (sessions *ApproverSessions) ServeApproverWeb(l net.Listener, users map[string][]byte) error {
+	authenticated := func(handler func(w http.ResponseWriter, r *http.Request, name string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			name, password, ok := r.BasicAuth()
+			hash, known := users[name]
+			if !ok || !known || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sga-guard"`)
+				writeAdminError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+				return
+			}
+			handler(w, r, name)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", authenticated(func(w http.ResponseWriter, r *http.Request, name string) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		fmt.Fprint(w, approverWebPage)
+	}))
+	mux.HandleFunc("/prompts", authenticated(func(w http.ResponseWriter, r *http.Request, name string) {
+		sessions.servePrompts(w, r, "web:"+name)
+	}))
+	mux.HandleFunc("/answer", authenticated(func(w http.ResponseWriter, r *http.Request, name string) {
+		if r.Method != "POST" {
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		// Other sites cannot set the header without a preflight request.
+		if r.Header.Get("X-SGA-Answer") != "1" {
+			writeAdminError(w, http.StatusForbidden, fmt.Errorf("missing X-SGA-Answer header"))
+			return
+		}
+		sessions.serveAnswer(w, r, "web:"+name)
+	}))
+	return http.Serve(l, mux)
+}
+
+const approverWebPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Guardian Agent</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+.prompt { border: 1px solid #ccc; border-radius: 4px; padding: 1em; margin: 1em 0; }
+.prompt pre { white-space: pre-wrap; }
+button { display: block; margin: 0.3em 0; }
+</style>
+</head>
+<body>
+<h1>Guardian Agent requests</h1>
+<p id="status">Waiting for requests...</p>
+<div id="prompts"></div>
+<script>
+var version = 0;
+function answer(id, choice, ttl) {
+  fetch("answer", {method: "POST", headers: {"X-SGA-Answer": "1"}, body: JSON.stringify({ID: id, Choice: choice, TTL: ttl})})
+    .then(function(r) { return r.json(); })
+    .then(function(r) { if (r.Error) alert(r.Error); });
+}
+function render(prompts) {
+  var list = document.getElementById("prompts");
+  list.textContent = "";
+  document.getElementById("status").textContent = prompts.length ? "" : "Waiting for requests...";
+  prompts.forEach(function(p) {
+    var div = document.createElement("div");
+    div.className = "prompt";
+    var q = document.createElement("pre");
+    q.textContent = p.Question;
+    div.appendChild(q);
+    p.Choices.forEach(function(choice, i) {
+      var b = document.createElement("button");
+      b.textContent = choice;
+      b.onclick = function() { answer(p.ID, i + 1, 0); };
+      div.appendChild(b);
+    });
+    list.appendChild(div);
+  });
+  if (prompts.length && document.hidden && window.Notification && Notification.permission === "granted") {
+    new Notification("Guardian Agent request", {body: prompts[0].Question.split("\n")[0]});
+  }
+}
+function poll() {
+  fetch("prompts?version=" + version)
+    .then(function(r) { return r.json(); })
+    .then(function(r) { version = r.Version; render(r.Prompts); poll(); })
+    .catch(function() { document.getElementById("status").textContent = "Disconnected, retrying..."; setTimeout(poll, 5000); });
+}
+if (window.Notification && Notification.permission === "default") Notification.requestPermission();
+poll();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,450 @@
+package guardianagent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	AuditEventConnection = "connection"
+	AuditEventRequest    = "request"
+	AuditEventDecision   = "decision"
+	AuditEventHandoff    = "handoff"
+	AuditEventError      = "error"
+	AuditEventCheckpoint = "checkpoint"
+	AuditEventPolicy     = "policy"
+	AuditEventRecording  = "recording"
+)
+
+// Number of entries between signed checkpoints.
+const auditCheckpointInterval = 64
+
+const auditKeyPEMType = "ED25519 PRIVATE KEY"
+
+// AuditEntry is a single line of the audit log. Each entry carries the hash
+// of the entry preceding it, so that removing or modifying an entry breaks
+// the chain.
+type AuditEntry struct {
+	Seq      uint64    `json:"Seq"`
+	Time     time.Time `json:"Time"`
+	Event    string    `json:"Event"`
+	Scope    Scope     `json:"Scope"`
+	Command  string    `json:"Command,omitempty"`
+	Decision string    `json:"Decision,omitempty"`
+	Detail   string    `json:"Detail,omitempty"`
+	Tags     []string  `json:"Tags,omitempty"`
+
+	// ID of the execution request the entry belongs to.
+	RequestID string `json:"RequestID,omitempty"`
+
+	// Who decided, e.g. "unix:alice" or "telegram:@alice".
+	Approver string `json:"Approver,omitempty"`
+
+	// Justification and working directory supplied by the client.
+	Reason     string `json:"Reason,omitempty"`
+	WorkingDir string `json:"WorkingDir,omitempty"`
+
+	// Mismatches between the client's name and address, how the request
+	// differs from the client's history, and where its client and server are
+	// on the network.
+	Warnings  []string `json:"Warnings,omitempty"`
+	Anomalies []string `json:"Anomalies,omitempty"`
+	Network   string   `json:"Network,omitempty"`
+
+	// Signature over the hash of the preceding entry, only set on checkpoints.
+	Signature string `json:"Signature,omitempty"`
+
+	PrevHash string `json:"PrevHash"`
+	Hash     string `json:"Hash"`
+}
+
+func (entry *AuditEntry) computeHash() (string, error) {
+	tmp := *entry
+	tmp.Hash = ""
+	b, err := json.Marshal(tmp)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func checkpointSignedData(seq uint64, hash string) []byte {
+	return []byte(fmt.Sprintf("%s:%d:%s", AuditEventCheckpoint, seq, hash))
+}
+
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *RotatingFile
+	signer   ssh.Signer
+	lastSeq  uint64
+	lastHash string
+	unsigned int
+	sinks    []AuditSink
+	tagger   func(hostname string) []string
+}
+
+// OpenAuditLog opens (or creates) the audit log at logPath, resuming the hash
+// chain from its last entry. Checkpoints are signed with the key stored at
+// logPath.key, which is generated on first use; its public half is written to
+// logPath.pub for use by verifiers. The log is rotated according to rotation,
+// and the chain continues across rotated files, each of which ends with a
+// checkpoint.
+func OpenAuditLog(logPath string, rotation RotationPolicy) (*AuditLog, error) {
+	signer, err := loadOrCreateAuditKey(logPath+".key", logPath+".pub")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load audit signing key: %s", err)
+	}
+	audit := &AuditLog{signer: signer}
+	if err = audit.resume(logPath); err != nil {
+		return nil, fmt.Errorf("Failed to read audit log %s: %s", logPath, err)
+	}
+	audit.file, err = OpenRotatingFile(logPath, rotation)
+	if err != nil {
+		return nil, err
+	}
+	if err = PruneRotated(logPath, rotation); err != nil {
+		return nil, fmt.Errorf("Failed to prune rotated audit logs: %s", err)
+	}
+	return audit, nil
+}
+
+// NewEventLog returns an audit log that keeps no file, and only passes entries
+// on to its sinks.
+func NewEventLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// resume finds the head of the chain, looking at the most recent rotated file
+// if the current one is empty.
+func (audit *AuditLog) resume(logPath string) error {
+	candidates, err := RotatedFiles(logPath)
+	if err != nil {
+		return err
+	}
+	candidates = append(candidates, logPath)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		found, err := audit.resumeFrom(candidates[i])
+		if found || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (audit *AuditLog) resumeFrom(name string) (found bool, err error) {
+	file, err := OpenLogFile(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), MaxAgentPacketSize*16)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return false, err
+		}
+		found = true
+		audit.lastSeq = entry.Seq
+		audit.lastHash = entry.Hash
+		if entry.Event == AuditEventCheckpoint {
+			audit.unsigned = 0
+		} else {
+			audit.unsigned++
+		}
+	}
+	return found, scanner.Err()
+}
+
+func loadOrCreateAuditKey(keyPath string, pubPath string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		block := pem.EncodeToMemory(&pem.Block{Type: auditKeyPEMType, Bytes: priv})
+		if err = ioutil.WriteFile(keyPath, block, 0600); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(pubPath, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != auditKeyPEMType || len(block.Bytes) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not a valid audit key", keyPath)
+	}
+	return ssh.NewSignerFromKey(ed25519.PrivateKey(block.Bytes))
+}
+
+// SetTagger makes Record annotate entries with the tags of the server.
+func (audit *AuditLog) SetTagger(tagger func(hostname string) []string) {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	audit.tagger = tagger
+}
+
+// Record appends an entry to the log. Recording to a nil log is a no-op, so
+// callers need not check whether auditing is enabled.
+func (audit *AuditLog) Record(event string, scope Scope, cmd string, decision string, detail string) error {
+	return audit.record(AuditEntry{
+		Event:    event,
+		Scope:    scope,
+		Command:  cmd,
+		Decision: decision,
+		Detail:   detail,
+	})
+}
+
+// RecordRequest records an execution request along with its metadata and
+// context.
+func (audit *AuditLog) RecordRequest(scope Scope, cmd string, meta RequestMetadata, context RequestContext) error {
+	return audit.record(AuditEntry{
+		Event:      AuditEventRequest,
+		Scope:      scope,
+		Command:    cmd,
+		RequestID:  meta.RequestID,
+		Reason:     meta.Reason,
+		WorkingDir: meta.WorkingDir,
+		Warnings:   context.Warnings,
+		Anomalies:  context.Anomalies,
+		Network:    context.Network,
+	})
+}
+
+// requestAudit records entries belonging to a single execution request.
+type requestAudit struct {
+	audit     *AuditLog
+	requestID string
+	approver  string
+}
+
+func (audit *AuditLog) forRequest(requestID string) requestAudit {
+	return requestAudit{audit: audit, requestID: requestID}
+}
+
+func (ra requestAudit) Record(event string, scope Scope, cmd string, decision string, detail string) error {
+	return ra.audit.record(AuditEntry{
+		Event:     event,
+		Scope:     scope,
+		Command:   cmd,
+		Decision:  decision,
+		Detail:    detail,
+		RequestID: ra.requestID,
+		Approver:  ra.approver,
+	})
+}
+
+// by returns a requestAudit recording that approver decided.
+func (ra requestAudit) by(approver string) requestAudit {
+	ra.approver = approver
+	return ra
+}
+
+func (audit *AuditLog) record(entry AuditEntry) error {
+	if audit == nil {
+		return nil
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if audit.tagger != nil {
+		entry.Tags = audit.tagger(entry.Scope.ServiceHostname)
+	}
+	if audit.file == nil {
+		entry.Time = time.Now()
+		for _, sink := range audit.sinks {
+			sink.Send(entry)
+		}
+		return nil
+	}
+
+	if audit.file.NeedsRotation() {
+		if err := audit.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := audit.append(entry); err != nil {
+		return err
+	}
+	audit.unsigned++
+	if audit.unsigned >= auditCheckpointInterval {
+		return audit.checkpoint()
+	}
+	return nil
+}
+
+func (audit *AuditLog) append(entry AuditEntry) (err error) {
+	entry.Seq = audit.lastSeq + 1
+	entry.Time = time.Now()
+	entry.PrevHash = audit.lastHash
+	if entry.Hash, err = entry.computeHash(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = audit.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	audit.lastSeq = entry.Seq
+	audit.lastHash = entry.Hash
+	for _, sink := range audit.sinks {
+		sink.Send(entry)
+	}
+	return nil
+}
+
+// checkpoint signs the current head of the chain.
+func (audit *AuditLog) checkpoint() error {
+	sig, err := audit.signer.Sign(rand.Reader, checkpointSignedData(audit.lastSeq, audit.lastHash))
+	if err != nil {
+		return fmt.Errorf("Failed to sign audit checkpoint: %s", err)
+	}
+	err = audit.append(AuditEntry{
+		Event:     AuditEventCheckpoint,
+		Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(sig)),
+	})
+	if err != nil {
+		return err
+	}
+	audit.unsigned = 0
+	return nil
+}
+
+func (audit *AuditLog) rotate() error {
+	if audit.unsigned > 0 {
+		if err := audit.checkpoint(); err != nil {
+			return err
+		}
+	}
+	return audit.file.Rotate()
+}
+
+// Close signs a final checkpoint, so that a log which does not end in a
+// checkpoint indicates truncation (or an unclean shutdown).
+func (audit *AuditLog) Close() error {
+	if audit == nil {
+		return nil
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	var err error
+	if audit.file != nil {
+		if audit.unsigned > 0 {
+			err = audit.checkpoint()
+		}
+		if cerr := audit.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for _, sink := range audit.sinks {
+		if cerr := sink.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type AuditVerification struct {
+	Entries     uint64
+	Checkpoints int
+	// Entries following the last valid checkpoint.
+	Unsigned int
+}
+
+// VerifyAuditLog checks the hash chain and checkpoint signatures of an audit
+// log. Rotated files may be verified together by concatenating them, oldest
+// first. It fails on the first modified, reordered or missing entry. A log whose
+// tail is not covered by a checkpoint is reported through Unsigned, since that
+// is what a truncated log looks like.
+func VerifyAuditLog(r io.Reader, pub ssh.PublicKey) (*AuditVerification, error) {
+	result := &AuditVerification{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxAgentPacketSize*16)
+	var prev *AuditEntry
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return result, fmt.Errorf("line %d: malformed entry: %s", line, err)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return result, err
+		}
+		if hash != entry.Hash {
+			return result, fmt.Errorf("line %d: entry %d was modified", line, entry.Seq)
+		}
+		if prev != nil {
+			if entry.Seq != prev.Seq+1 {
+				return result, fmt.Errorf("line %d: expected entry %d, found %d", line, prev.Seq+1, entry.Seq)
+			}
+			if entry.PrevHash != prev.Hash {
+				return result, fmt.Errorf("line %d: entry %d does not chain to entry %d", line, entry.Seq, prev.Seq)
+			}
+		}
+		result.Entries++
+
+		if entry.Event == AuditEventCheckpoint {
+			if err = verifyCheckpoint(entry, pub); err != nil {
+				return result, fmt.Errorf("line %d: %s", line, err)
+			}
+			result.Checkpoints++
+			result.Unsigned = 0
+		} else {
+			result.Unsigned++
+		}
+		prev = entry
+	}
+	return result, scanner.Err()
+}
+
+func verifyCheckpoint(entry *AuditEntry, pub ssh.PublicKey) error {
+	raw, err := base64.StdEncoding.DecodeString(entry.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed checkpoint signature: %s", err)
+	}
+	sig := new(ssh.Signature)
+	if err = ssh.Unmarshal(raw, sig); err != nil {
+		return fmt.Errorf("malformed checkpoint signature: %s", err)
+	}
+	if err = pub.Verify(checkpointSignedData(entry.Seq-1, entry.PrevHash), sig); err != nil {
+		return fmt.Errorf("invalid signature on checkpoint %d: %s", entry.Seq, err)
+	}
+	return nil
+}
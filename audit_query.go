@@ -0,0 +1,125 @@
+package guardianagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// AuditFilter selects audit log entries. Empty fields match any entry.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+
+	// Shell patterns matched against the client, and against the server
+	// both with and without its port.
+	Client string
+	Server string
+
+	// Exact decision (e.g. "denied") and event (e.g. "decision").
+	Decision string
+	Event    string
+
+	// Substring of the command.
+	Command string
+
+	// Include signed checkpoints, which are skipped unless Event selects
+	// them.
+	Checkpoints bool
+}
+
+// Matches reports whether entry is selected by the filter.
+func (filter *AuditFilter) Matches(entry *AuditEntry) bool {
+	if entry.Event == AuditEventCheckpoint && !filter.Checkpoints && filter.Event != AuditEventCheckpoint {
+		return false
+	}
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !entry.Time.Before(filter.Until) {
+		return false
+	}
+	if filter.Client != "" && !matchesPattern(filter.Client, entry.Scope.Client) {
+		return false
+	}
+	if filter.Server != "" {
+		host := entry.Scope.ServiceHostname
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !matchesPattern(filter.Server, entry.Scope.ServiceHostname) && !matchesPattern(filter.Server, host) {
+			return false
+		}
+	}
+	if filter.Decision != "" && entry.Decision != filter.Decision {
+		return false
+	}
+	if filter.Event != "" && entry.Event != filter.Event {
+		return false
+	}
+	if filter.Command != "" && !strings.Contains(entry.Command, filter.Command) {
+		return false
+	}
+	return true
+}
+
+func matchesPattern(pattern string, s string) bool {
+	matched, err := path.Match(pattern, s)
+	return err == nil && matched
+}
+
+// ParseAuditTime parses the bounds of audit queries: RFC 3339 times, local
+// dates ("2024-03-02") and times ("2024-03-02 15:04"), or durations before
+// now ("36h").
+func ParseAuditTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (expected e.g. 2024-03-02, \"2024-03-02 15:04\", RFC 3339 or a duration such as 24h)", s)
+}
+
+// AuditReader reads the entries of an audit log, one JSON object per line.
+// Unlike json.Decoder, it can be resumed after reaching the end of a file
+// which is still being written, even in the middle of a line.
+type AuditReader struct {
+	r       *bufio.Reader
+	partial string
+}
+
+func NewAuditReader(r io.Reader) *AuditReader {
+	return &AuditReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next entry, or io.EOF if there is no complete entry yet.
+func (reader *AuditReader) Next() (*AuditEntry, error) {
+	for {
+		line, err := reader.r.ReadString('\n')
+		if err != nil {
+			reader.partial += line
+			return nil, err
+		}
+		line = reader.partial + line
+		reader.partial = ""
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry AuditEntry
+		if err = json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("Failed to parse audit entry: %s", err)
+		}
+		return &entry, nil
+	}
+}
@@ -0,0 +1,87 @@
+package guardianagent
+
+import (
+	"sync"
+	"time"
+)
+
+type batchKey struct {
+	Client string
+	User   string
+	Batch  string
+}
+
+type batchGrant struct {
+	group    string
+	rule     *PolicyRule
+	maxHosts int
+	expires  time.Time
+	hosts    map[string]bool
+}
+
+// BatchApprovals tracks batches the user approved as a whole, e.g. a playbook
+// run across a group of hosts.
+type BatchApprovals struct {
+	mu     sync.Mutex
+	grants map[batchKey]*batchGrant
+}
+
+func NewBatchApprovals() *BatchApprovals {
+	return &BatchApprovals{grants: make(map[batchKey]*batchGrant)}
+}
+
+// Grant approves the batch described by meta for the hosts of its group that
+// rule applies to, up to the batch size, and counts scope's host towards it.
+func (batches *BatchApprovals) Grant(scope Scope, meta RequestMetadata, rule *PolicyRule) {
+	batches.mu.Lock()
+	defer batches.mu.Unlock()
+	batches.expire()
+	batches.grants[batchKey{scope.Client, scope.ServiceUsername, meta.Batch}] = &batchGrant{
+		group:    meta.BatchGroup,
+		rule:     rule,
+		maxHosts: meta.BatchSize,
+		expires:  time.Now().Add(rule.Window),
+		hosts:    map[string]bool{scope.ServiceHostname: true},
+	}
+}
+
+// Use checks whether cmd in scope is covered by an approved batch, and if so
+// counts the host towards the batch's limit. tags are the host's tags.
+func (batches *BatchApprovals) Use(scope Scope, tags []string, cmd string, meta RequestMetadata) bool {
+	if batches == nil || meta.Batch == "" {
+		return false
+	}
+	batches.mu.Lock()
+	defer batches.mu.Unlock()
+	batches.expire()
+	grant, ok := batches.grants[batchKey{scope.Client, scope.ServiceUsername, meta.Batch}]
+	if !ok || !hasAllTags(tags, []string{grant.group}) || !grant.rule.matches(scope, tags, cmd, false) {
+		return false
+	}
+	if !grant.hosts[scope.ServiceHostname] {
+		if len(grant.hosts) >= grant.maxHosts {
+			return false
+		}
+		grant.hosts[scope.ServiceHostname] = true
+	}
+	return true
+}
+
+// RevokeAll ends all batch approvals, and returns how many there were.
+func (batches *BatchApprovals) RevokeAll() int {
+	batches.mu.Lock()
+	defer batches.mu.Unlock()
+	batches.expire()
+	count := len(batches.grants)
+	batches.grants = make(map[batchKey]*batchGrant)
+	return count
+}
+
+func (batches *BatchApprovals) expire() {
+	now := time.Now()
+	for key, grant := range batches.grants {
+		if now.After(grant.expires) {
+			delete(batches.grants, key)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CatastrophicPattern matches commands whose effects would be catastrophic,
+// such as wiping a disk. Matching requests are never auto-approved, and
+// approving them takes typing a confirmation phrase.
+type CatastrophicPattern struct {
+	Name string `json:"Name" yaml:"name"`
+
+	// Regular expression (RE2 syntax) matched against anywhere in the
+	// command.
+	Pattern string `json:"Pattern" yaml:"pattern"`
+
+	re     *regexp.Regexp
+	source string
+}
+
+// CatastrophicRules adjusts the blocklist of catastrophic commands in a
+// system policy layer:
+//
+//   catastrophic:
+//     except: [fork-bomb]
+//     patterns:
+//       - name: drop-database
+//         pattern: '(?i)\bdrop\s+database\b'
+type CatastrophicRules struct {
+	// Drop all the built-in patterns, if set to false.
+	Builtin *bool `yaml:"builtin,omitempty"`
+
+	// Names of built-in patterns to drop.
+	Except []string `yaml:"except,omitempty"`
+
+	// Patterns to add.
+	Patterns []CatastrophicPattern `yaml:"patterns,omitempty"`
+}
+
+// builtinCatastrophic is the blocklist used unless system policy files drop
+// its patterns.
+var builtinCatastrophic = []CatastrophicPattern{
+	{Name: "rm-root", Pattern: `\brm\s(.*\s)?(-[a-zA-Z]*[rR][a-zA-Z]*|--recursive)\s(.*\s)?(/|/\*|~|~/|\$HOME/?|/(bin|boot|dev|etc|home|lib|lib64|opt|root|sbin|srv|usr|var)/?)(\s|[;&|]|$)`},
+	{Name: "rm-no-preserve-root", Pattern: `\brm\s.*--no-preserve-root`},
+	{Name: "mkfs", Pattern: `\b(mkfs(\.[a-z0-9]+)?|mke2fs|mkswap|wipefs)\s`},
+	{Name: "dd-device", Pattern: `\bdd\s.*\bof=/dev/(sd|hd|vd|xvd|nvme|mmcblk|disk|md|dm-|mapper/)`},
+	{Name: "overwrite-device", Pattern: `>\s*/dev/(sd|hd|vd|xvd|nvme|mmcblk|disk)`},
+	{Name: "shred-device", Pattern: `\bshred\s.*/dev/`},
+	{Name: "fork-bomb", Pattern: `(\b\w+|:)\s*\(\)\s*\{[^}]*\|[^}]*&[^}]*\}`},
+	{Name: "chmod-root", Pattern: `\bch(mod|own|grp)\s(.*\s)?(-[a-zA-Z]*R[a-zA-Z]*|--recursive)\s(.*\s)?/(\s|[;&|]|$)`},
+}
+
+func init() {
+	for i := range builtinCatastrophic {
+		builtinCatastrophic[i].re = regexp.MustCompile(builtinCatastrophic[i].Pattern)
+		builtinCatastrophic[i].source = "built-in blocklist"
+	}
+}
+
+func (rules *CatastrophicRules) validate() string {
+	for _, name := range rules.Except {
+		if builtinCatastrophicNamed(name) == nil {
+			return fmt.Sprintf("no built-in catastrophic pattern named %q", name)
+		}
+	}
+	for i := range rules.Patterns {
+		pattern := &rules.Patterns[i]
+		if pattern.Name == "" || pattern.Pattern == "" {
+			return "catastrophic patterns must specify a name and a pattern"
+		}
+		re, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return fmt.Sprintf("invalid catastrophic pattern %q: %s", pattern.Name, err)
+		}
+		pattern.re = re
+	}
+	return ""
+}
+
+func builtinCatastrophicNamed(name string) *CatastrophicPattern {
+	for i := range builtinCatastrophic {
+		if builtinCatastrophic[i].Name == name {
+			return &builtinCatastrophic[i]
+		}
+	}
+	return nil
+}
+
+// addCatastrophic merges the blocklist adjustments of a layer.
+func (sys *SystemPolicy) addCatastrophic(rules *CatastrophicRules, source string) {
+	if rules == nil {
+		return
+	}
+	if rules.Builtin != nil && !*rules.Builtin {
+		sys.NoBuiltinCatastrophic = true
+	}
+	sys.CatastrophicExcept = append(sys.CatastrophicExcept, rules.Except...)
+	for _, pattern := range rules.Patterns {
+		pattern.source = source
+		sys.Catastrophic = append(sys.Catastrophic, pattern)
+	}
+}
+
+// CatastrophicMatch returns the catastrophic pattern cmd, or a command it runs
+// through sudo, matches, if any: one added by the system policy, or a built-in
+// one it did not drop.
+func (sys *SystemPolicy) CatastrophicMatch(cmd string) *CatastrophicPattern {
+	for _, command := range restrictedCommands(cmd) {
+		if pattern := sys.catastrophicMatch(command); pattern != nil {
+			return pattern
+		}
+	}
+	return nil
+}
+
+func (sys *SystemPolicy) catastrophicMatch(cmd string) *CatastrophicPattern {
+	if sys != nil {
+		sys.mu.RLock()
+		defer sys.mu.RUnlock()
+		for i := range sys.Catastrophic {
+			if sys.Catastrophic[i].re.MatchString(cmd) {
+				return &sys.Catastrophic[i]
+			}
+		}
+		if sys.NoBuiltinCatastrophic {
+			return nil
+		}
+	}
+	for i := range builtinCatastrophic {
+		pattern := &builtinCatastrophic[i]
+		if sys != nil && containsString(sys.CatastrophicExcept, pattern.Name) {
+			continue
+		}
+		if pattern.re.MatchString(cmd) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// describeCatastrophic warns approvers of a request matching pattern.
+func describeCatastrophic(pattern *CatastrophicPattern, phrase string) string {
+	return fmt.Sprintf("\n  WARNING: this command looks catastrophic (%s, %s); approving it takes typing %q",
+		pattern.Name, pattern.source, phrase)
+}
+
+// catastrophicPhrase is what approving a catastrophic request in scope takes
+// typing.
+func catastrophicPhrase(scope Scope) string {
+	return "destroy " + scope.ServiceHostname
+}
+
+// confirmCatastrophic makes the approver type the confirmation phrase of a
+// catastrophic request they approved.
+func (policy *Policy) confirmCatastrophic(ctx context.Context, audit requestAudit, scope Scope, cmd string, pattern *CatastrophicPattern) error {
+	phrase := catastrophicPhrase(scope)
+	shown := displayScope(scope)
+	typed, err := policy.UI.Edit(ctx, fmt.Sprintf("'%s' on %s@%s matches the catastrophic pattern %s. Type %q to run it anyway:",
+		displayLine(cmd), shown.ServiceUsername, shown.ServiceHostname, pattern.Name, phrase), "")
+	if ctx.Err() != nil {
+		return policy.withdraw(audit, scope, cmd)
+	}
+	if err != nil {
+		audit.Record(AuditEventError, scope, cmd, "", err.Error())
+		return fmt.Errorf("Failed to get user approval: %s", err)
+	}
+	if strings.TrimSpace(typed) != phrase {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED (confirmation phrase not typed)",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "catastrophic pattern "+pattern.Name+" not confirmed")
+		return deny(DenialUser, "User did not confirm a catastrophic command")
+	}
+	audit.Record(AuditEventDecision, scope, cmd, "confirmed", "catastrophic pattern "+pattern.Name)
+	return nil
+}
@@ -0,0 +1,136 @@
+package guardianagent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Seconds from the NTP epoch (1900) to the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+const ntpTimeout = 5 * time.Second
+
+// ClockCheck compares the guardian's clock with an NTP server, since the
+// expiry of tokens, invitations and stored approvals, and the times in the
+// audit log, all depend on it.
+type ClockCheck struct {
+	server  string
+	maxSkew time.Duration
+	alert   func(msg string)
+
+	mu      sync.Mutex
+	offset  time.Duration
+	checked time.Time
+	err     error
+}
+
+// NewClockCheck checks the clock against server (host or host:port),
+// tolerating skews up to maxSkew, and calls alert whenever the clock is found
+// to be off by more.
+func NewClockCheck(server string, maxSkew time.Duration, alert func(msg string)) *ClockCheck {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	return &ClockCheck{server: server, maxSkew: maxSkew, alert: alert}
+}
+
+// Run checks the clock now and then every interval, forever.
+func (clock *ClockCheck) Run(interval time.Duration) {
+	for {
+		clock.Check()
+		time.Sleep(interval)
+	}
+}
+
+// Check queries the NTP server once.
+func (clock *ClockCheck) Check() {
+	offset, err := queryNTP(clock.server)
+	clock.mu.Lock()
+	wasSkewed := clock.skewed()
+	clock.offset, clock.err, clock.checked = offset, err, time.Now()
+	skewed := clock.skewed()
+	clock.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to check the clock against %s: %s", clock.server, err)
+		return
+	}
+	if skewed && !wasSkewed && clock.alert != nil {
+		clock.alert(clock.Warning())
+	}
+}
+
+func (clock *ClockCheck) skewed() bool {
+	if clock.err != nil || clock.checked.IsZero() {
+		return false
+	}
+	return clock.offset > clock.maxSkew || -clock.offset > clock.maxSkew
+}
+
+// Offset returns how far the clock was behind the NTP server (negative if it
+// is ahead) at the last successful check, if the skew exceeds the
+// tolerance.
+func (clock *ClockCheck) Offset() (time.Duration, bool) {
+	if clock == nil {
+		return 0, false
+	}
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.offset, clock.skewed()
+}
+
+// Warning describes the skew of the clock, if it exceeds the tolerance, for
+// approvers.
+func (clock *ClockCheck) Warning() string {
+	offset, skewed := clock.Offset()
+	if !skewed {
+		return ""
+	}
+	direction := "behind"
+	if offset < 0 {
+		direction, offset = "ahead of", -offset
+	}
+	return fmt.Sprintf("The guardian's clock is %s %s %s; expiry times are off by as much", offset.Round(time.Second), direction, clock.server)
+}
+
+// queryNTP returns the offset of the local clock to the NTP server, with a
+// single SNTP (RFC 4330) request.
+func queryNTP(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, ntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // No leap warning, version 4, client mode.
+	sent := time.Now()
+	if _, err = conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 || resp[0]&0x7 != 4 {
+		return 0, fmt.Errorf("invalid NTP response")
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("the NTP server is not synchronized")
+	}
+	serverReceived := ntpTime(resp[32:40])
+	serverSent := ntpTime(resp[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+func ntpTime(buf []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(buf[0:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(buf[4:8]))
+	return time.Unix(seconds, fraction*int64(time.Second)>>32)
+}
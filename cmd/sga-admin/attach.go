@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type attachCommand struct {
+	Name string `long:"name" description:"Approver name recorded in the audit log (defaults to the local user name)"`
+
+	ApproverSocket string `long:"approver-socket" description:"Attach to another user's guardian through its approver socket, as yourself"`
+
+	SSHKey bool `long:"ssh-key" description:"Log in to the approver socket with a key of your SSH agent, listed in the guardian's --approver-keys"`
+}
+
+type approversCommand struct{}
+
+func showAttachedPrompt(p guardianagent.AttachedPrompt, waiting int) {
+	fmt.Printf("\n%s\n", p.Question)
+	for i, choice := range p.Choices {
+		fmt.Printf("    %d) %s\n", i+1, choice)
+	}
+	if waiting > 0 {
+		fmt.Printf("(%d more waiting)\n", waiting)
+	}
+	if p.Forever > 0 {
+		fmt.Printf("\nAnswer (enter a number, or e.g. \"%d 8h\" to approve for 8 hours): ", p.Forever)
+	} else {
+		fmt.Print("\nAnswer (enter a number): ")
+	}
+}
+
+func (cmd *attachCommand) Execute(args []string) error {
+	var admin *guardianagent.AdminClient
+	var err error
+	if cmd.ApproverSocket != "" {
+		admin = guardianagent.NewAdminClient(os.ExpandEnv(cmd.ApproverSocket))
+	} else if admin, err = adminClient(); err != nil {
+		return err
+	}
+	name := cmd.Name
+	if cmd.SSHKey {
+		if cmd.ApproverSocket == "" {
+			return fmt.Errorf("--ssh-key requires --approver-socket")
+		}
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return fmt.Errorf("Failed to connect to the SSH agent: %s", err)
+		}
+		defer conn.Close()
+		if name, err = guardianagent.LoginApprover(admin, agent.NewClient(conn)); err != nil {
+			return err
+		}
+	} else if cmd.ApproverSocket != "" {
+		// The guardian identifies us by our UID.
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		name = "unix:" + u.Username
+	}
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		name = u.Username
+	}
+	query := "name=" + url.QueryEscape(name)
+
+	updates := make(chan guardianagent.AttachedPrompts)
+	errs := make(chan error, 1)
+	go func() {
+		version := -1
+		for {
+			var prompts guardianagent.AttachedPrompts
+			if err := admin.Do("GET", fmt.Sprintf("/approvers/prompts?%s&version=%d", query, version), nil, &prompts); err != nil {
+				errs <- err
+				return
+			}
+			version = prompts.Version
+			updates <- prompts
+		}
+	}()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	fmt.Printf("Attached as %s, waiting for requests (press Ctrl-D to detach)...\n", name)
+	var current *guardianagent.AttachedPrompt
+	var pending []guardianagent.AttachedPrompt
+	for {
+		select {
+		case prompts := <-updates:
+			pending = prompts.Prompts
+			found := false
+			for _, p := range pending {
+				if current != nil && p.ID == current.ID {
+					found = true
+				}
+			}
+			if current != nil && !found {
+				fmt.Println("\nThe request was answered elsewhere or withdrawn.")
+				current = nil
+			}
+			if current == nil && len(pending) > 0 {
+				current = &pending[0]
+				showAttachedPrompt(*current, len(pending)-1)
+			}
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if current == nil {
+				continue
+			}
+			fields := strings.Fields(line)
+			var req guardianagent.AdminAnswerRequest
+			req.ID = current.ID
+			if len(fields) > 0 {
+				req.Choice, err = strconv.Atoi(fields[0])
+			}
+			if len(fields) > 1 && err == nil {
+				req.TTL, err = time.ParseDuration(fields[1])
+			}
+			if len(fields) == 0 || len(fields) > 2 || err != nil {
+				err = nil
+				showAttachedPrompt(*current, len(pending)-1)
+				continue
+			}
+			if err = admin.Do("POST", "/approvers/answer?"+query, req, nil); err != nil {
+				fmt.Println(err)
+				err = nil
+				showAttachedPrompt(*current, len(pending)-1)
+				continue
+			}
+			fmt.Println("Answered.")
+			current = nil
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (cmd *approversCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var approvers []guardianagent.AttachedApprover
+	if err = admin.Do("GET", "/approvers", nil, &approvers); err != nil {
+		return err
+	}
+	for _, a := range approvers {
+		fmt.Printf("%s (last seen %s)\n", a.Name, a.LastSeen.Format(time.Kitchen))
+	}
+	return nil
+}
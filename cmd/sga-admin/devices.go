@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+)
+
+type pairCommand struct{}
+
+type devicesCommand struct{}
+
+type unpairCommand struct {
+	Args struct {
+		ID string `positional-arg-name:"device-id" required:"true"`
+	} `positional-args:"true"`
+}
+
+// showQRCode prints uri as a QR code with qrencode, if it is installed.
+func showQRCode(uri string) bool {
+	qrencode := exec.Command("qrencode", "-t", "ANSIUTF8", uri)
+	qrencode.Stdout = os.Stdout
+	qrencode.Stderr = os.Stderr
+	return qrencode.Run() == nil
+}
+
+func (cmd *pairCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var pairing guardianagent.PushPairing
+	if err = admin.Do("POST", "/devices/pair", nil, &pairing); err != nil {
+		return err
+	}
+	fmt.Println("Scan this code with the guardian app on your device:")
+	if !showQRCode(pairing.URI) {
+		fmt.Println("(install qrencode to show it as a QR code)")
+	}
+	fmt.Println(pairing.URI)
+	fmt.Printf("Waiting for the device (until %s)...\n", pairing.Expires.Format(time.Kitchen))
+	for time.Now().Before(pairing.Expires) {
+		var resp guardianagent.AdminPairingResponse
+		if err = admin.Do("GET", "/devices/pair?channel="+url.QueryEscape(pairing.Channel), nil, &resp); err != nil {
+			return err
+		}
+		if resp.Device != nil {
+			fmt.Printf("Paired %s (%s)\n", resp.Device.Name, resp.Device.ID)
+			return nil
+		}
+	}
+	return fmt.Errorf("The pairing code expired")
+}
+
+func (cmd *devicesCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var devices []guardianagent.PushDevice
+	if err = admin.Do("GET", "/devices", nil, &devices); err != nil {
+		return err
+	}
+	for _, d := range devices {
+		fmt.Printf("%s  %s (paired %s)\n", d.ID, d.Name, d.Paired.Format("2006-01-02"))
+	}
+	return nil
+}
+
+func (cmd *unpairCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	return admin.Do("DELETE", "/devices?id="+url.QueryEscape(cmd.Args.ID), nil, nil)
+}
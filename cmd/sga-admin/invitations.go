@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+)
+
+type inviteCommand struct {
+	Client string `long:"client" description:"Only accept the invitation from this client (intermediary) name"`
+
+	User string `long:"user" short:"u" description:"User on the target servers (any if unset)"`
+
+	Host string `long:"host" short:"H" description:"Target server as host[:port] (any if unset)"`
+
+	Tags []string `long:"tag" description:"Only cover hosts carrying this tag (may be repeated)"`
+
+	Commands []string `long:"command" short:"c" description:"Command the delegatee may run (may be repeated)"`
+
+	AllCommands bool `long:"all-commands" description:"Let the delegatee run any command"`
+
+	TTL time.Duration `long:"ttl" description:"Time until the invitation expires" default:"24h"`
+
+	MaxUses int `long:"max-uses" description:"Number of requests the invitation covers (unlimited if 0)" default:"0"`
+
+	Note string `long:"note" description:"Note on what the invitation is for"`
+
+	Output string `long:"output" short:"o" description:"File to write the invitation to, for the delegatee to install (standard output if unset)"`
+}
+
+type invitationsCommand struct{}
+
+type revokeInvitationCommand struct {
+	Args struct {
+		ID string `positional-arg-name:"invitation-id" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (cmd *inviteCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	host := cmd.Host
+	if host != "" {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "22")
+		}
+	}
+	req := guardianagent.AdminInvitationRequest{
+		Rule: guardianagent.PolicyRule{
+			Scope: guardianagent.Scope{
+				Client:          cmd.Client,
+				ServiceUsername: cmd.User,
+				ServiceHostname: host,
+			},
+			Tags:        cmd.Tags,
+			AllCommands: cmd.AllCommands,
+			Commands:    cmd.Commands,
+		},
+		TTL:     cmd.TTL,
+		MaxUses: cmd.MaxUses,
+		Note:    cmd.Note,
+	}
+	var file guardianagent.InvitationFile
+	if err = admin.Do("POST", "/invitations"+tenantQuery("?"), req, &file); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if cmd.Output == "" {
+		fmt.Println(string(buf))
+	} else if err = ioutil.WriteFile(cmd.Output, buf, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Invitation %s valid until %s; install it in ~/.ssh/sga_invitations/ on the intermediary\n",
+		file.ID, file.Expires.Format(time.RFC1123))
+	return nil
+}
+
+func (cmd *invitationsCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var invitations []guardianagent.Invitation
+	if err = admin.Do("GET", "/invitations"+tenantQuery("?"), nil, &invitations); err != nil {
+		return err
+	}
+	for _, i := range invitations {
+		what := "any command"
+		if !i.Rule.AllCommands {
+			what = strings.Join(i.Rule.Commands, "; ")
+		}
+		uses := fmt.Sprintf("%d uses", i.Uses)
+		if i.MaxUses > 0 {
+			uses = fmt.Sprintf("%d/%d uses", i.Uses, i.MaxUses)
+		}
+		fmt.Printf("%s  until %s, %s  %s -> %s@%s: %s\n", i.ID, i.Expires.Format("2006-01-02 15:04"), uses,
+			orAny(i.Rule.Scope.Client), orAny(i.Rule.Scope.ServiceUsername), orAny(i.Rule.Scope.ServiceHostname), what)
+		if i.Note != "" {
+			fmt.Printf("    %s\n", i.Note)
+		}
+	}
+	return nil
+}
+
+func (cmd *revokeInvitationCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	return admin.Do("DELETE", "/invitations?id="+url.QueryEscape(cmd.Args.ID)+tenantQuery("&"), nil, nil)
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+type credentialsCommand struct {
+	Since string `long:"since" description:"Only show credentials issued from this time on (e.g. 2024-03-02, or a duration ago such as 720h)"`
+
+	Until string `long:"until" description:"Only show credentials issued before this time"`
+
+	Client string `long:"client" description:"Only show credentials usable by clients matching this pattern"`
+
+	User string `long:"user" short:"u" description:"Only show credentials for users matching this pattern"`
+
+	Host string `long:"host" short:"H" description:"Only show credentials for servers matching this pattern, with or without the port"`
+
+	Kind string `long:"kind" description:"Only show credentials of this kind" choice:"token" choice:"invitation"`
+
+	Status string `long:"status" description:"Only show credentials with this status" choice:"active" choice:"used" choice:"expired" choice:"revoked"`
+
+	JSON bool `long:"json" description:"Print the credentials as JSON"`
+}
+
+func (cmd *credentialsCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{"since": cmd.Since, "until": cmd.Until, "client": cmd.Client,
+		"user": cmd.User, "server": cmd.Host, "kind": cmd.Kind, "status": cmd.Status} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if opts.Tenant != "" {
+		query.Set("tenant", opts.Tenant)
+	}
+	var credentials []guardianagent.IssuedCredential
+	if err = admin.Do("GET", "/credentials?"+query.Encode(), nil, &credentials); err != nil {
+		return err
+	}
+	if cmd.JSON {
+		buf, err := json.MarshalIndent(credentials, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tISSUED\tEXPIRES\tSTATUS\tUSES\tSCOPE\tCOMMANDS\tISSUER")
+	for _, c := range credentials {
+		what := strings.Join(c.Commands, "; ")
+		if c.AllCommands {
+			what = "any command"
+		}
+		uses := fmt.Sprint(c.Uses)
+		if c.MaxUses > 0 {
+			uses = fmt.Sprintf("%d/%d", c.Uses, c.MaxUses)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s -> %s@%s\t%s\t%s\n", c.ID, c.Kind, c.Issued.Format("2006-01-02 15:04"),
+			c.Expires.Format("2006-01-02 15:04"), c.Status(now), uses, orAny(c.Scope.Client), orAny(c.Scope.ServiceUsername),
+			orAny(c.Scope.ServiceHostname), what, c.Issuer)
+	}
+	return w.Flush()
+}
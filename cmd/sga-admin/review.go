@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+type reviewCommand struct{}
+
+// reviewEntry is a stored approval or remembered denial shown in the review
+// screen.
+type reviewEntry struct {
+	denial   bool
+	scope    guardianagent.Scope
+	command  string
+	template bool
+	origin   *guardianagent.RuleOrigin
+	lastUsed time.Time
+	deniedAt time.Time
+	expires  time.Time
+}
+
+func (entry *reviewEntry) describe() string {
+	command := entry.command
+	if command == "" {
+		command = "ANY COMMAND"
+	}
+	kind := "allow"
+	var details []string
+	if entry.denial {
+		kind = "deny "
+		details = append(details, "denied "+entry.deniedAt.Format("2006-01-02 15:04"))
+	} else {
+		if entry.template {
+			details = append(details, "template")
+		}
+		if entry.origin != nil && !entry.origin.Added.IsZero() {
+			details = append(details, fmt.Sprintf("added %s via %s", entry.origin.Added.Format("2006-01-02"), entry.origin.Via))
+		}
+		if !entry.lastUsed.IsZero() {
+			details = append(details, "used "+entry.lastUsed.Format("2006-01-02"))
+		}
+	}
+	if entry.expires.IsZero() {
+		details = append(details, "never expires")
+	} else {
+		details = append(details, "expires "+entry.expires.Format("2006-01-02 15:04"))
+	}
+	return fmt.Sprintf("%s  %s -> %s@%s: %s  [%s]", kind, entry.scope.Client, entry.scope.ServiceUsername,
+		entry.scope.ServiceHostname, command, strings.Join(details, ", "))
+}
+
+// reviewer is a full-screen view of the stored approvals and remembered
+// denials, in which they can be searched, deleted and given an expiry.
+type reviewer struct {
+	admin *guardianagent.AdminClient
+	in    *bufio.Reader
+
+	entries  []reviewEntry
+	shown    []int
+	selected int
+	top      int
+	filter   string
+	status   string
+}
+
+func (cmd *reviewCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return fmt.Errorf("review needs a terminal")
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+	// Use the alternate screen, and restore the original one on exit.
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?1049l\033[?25h")
+
+	r := &reviewer{admin: admin, in: bufio.NewReader(os.Stdin)}
+	if err = r.load(); err != nil {
+		return err
+	}
+	for {
+		r.draw()
+		key, err := r.readKey()
+		if err != nil {
+			return err
+		}
+		if !r.handle(key) {
+			return nil
+		}
+	}
+}
+
+func (r *reviewer) load() error {
+	var rules []guardianagent.StoredRule
+	if err := r.admin.Do("GET", "/rules"+tenantQuery("?"), nil, &rules); err != nil {
+		return err
+	}
+	var denials []guardianagent.RememberedDenial
+	if err := r.admin.Do("GET", "/denials"+tenantQuery("?"), nil, &denials); err != nil {
+		return err
+	}
+	r.entries = nil
+	for _, rule := range rules {
+		entry := reviewEntry{scope: rule.Scope, command: rule.Command, template: rule.Template, origin: rule.Origin, lastUsed: rule.LastUsed}
+		if rule.Origin != nil {
+			entry.expires = rule.Origin.Expires
+		}
+		r.entries = append(r.entries, entry)
+	}
+	for _, denial := range denials {
+		r.entries = append(r.entries, reviewEntry{denial: true, scope: denial.Scope, command: denial.Command,
+			deniedAt: denial.DeniedAt, expires: denial.Expires})
+	}
+	r.applyFilter()
+	return nil
+}
+
+func (r *reviewer) applyFilter() {
+	r.shown = nil
+	filter := strings.ToLower(r.filter)
+	for i := range r.entries {
+		if strings.Contains(strings.ToLower(r.entries[i].describe()), filter) {
+			r.shown = append(r.shown, i)
+		}
+	}
+	if r.selected >= len(r.shown) {
+		r.selected = len(r.shown) - 1
+	}
+	if r.selected < 0 {
+		r.selected = 0
+	}
+}
+
+func screenSize() (int, int) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 3 {
+		return 80, 24
+	}
+	return width, height
+}
+
+func fit(line string, width int) string {
+	if len(line) > width {
+		return line[:width]
+	}
+	return line
+}
+
+func (r *reviewer) draw() {
+	width, height := screenSize()
+	rows := height - 3
+	if r.selected < r.top {
+		r.top = r.selected
+	}
+	if r.selected >= r.top+rows {
+		r.top = r.selected - rows + 1
+	}
+
+	var out bytes.Buffer
+	out.WriteString("\033[H\033[2J")
+	header := fmt.Sprintf("Guardian policy review: %d of %d entries", len(r.shown), len(r.entries))
+	if r.filter != "" {
+		header += fmt.Sprintf(" matching %q", r.filter)
+	}
+	out.WriteString("\033[1m" + fit(header, width) + "\033[0m\r\n")
+	for row := 0; row < rows; row++ {
+		i := r.top + row
+		if i < len(r.shown) {
+			line := fit(r.entries[r.shown[i]].describe(), width)
+			if i == r.selected {
+				line = "\033[7m" + line + "\033[0m"
+			}
+			out.WriteString(line)
+		}
+		out.WriteString("\r\n")
+	}
+	out.WriteString(fit("up/down move  / search  t set expiry  d delete  r reload  q quit", width) + "\r\n")
+	out.WriteString(fit(r.status, width))
+	fmt.Print(out.String())
+}
+
+// readKey returns the next key pressed: a character, or the name of an arrow
+// or paging key.
+func (r *reviewer) readKey() (string, error) {
+	c, err := r.in.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	// Escape sequences of special keys arrive at once.
+	if c != 0x1b || r.in.Buffered() == 0 {
+		return string(c), nil
+	}
+	seq := make([]byte, 0, 4)
+	for r.in.Buffered() > 0 && len(seq) < 4 {
+		b, _ := r.in.ReadByte()
+		seq = append(seq, b)
+		if b >= 'A' && b <= 'Z' || b == '~' {
+			break
+		}
+	}
+	switch string(seq) {
+	case "[A", "OA":
+		return "up", nil
+	case "[B", "OB":
+		return "down", nil
+	case "[5~":
+		return "pgup", nil
+	case "[6~":
+		return "pgdn", nil
+	}
+	return "", nil
+}
+
+// readLine reads a line of input on the status line. It returns false if the
+// user canceled with escape or ^C.
+func (r *reviewer) readLine(prompt string) (string, bool) {
+	var line []byte
+	for {
+		r.status = prompt + string(line)
+		r.draw()
+		fmt.Print("\033[?25h")
+		c, err := r.in.ReadByte()
+		fmt.Print("\033[?25l")
+		if err != nil {
+			return "", false
+		}
+		switch {
+		case c == '\r' || c == '\n':
+			r.status = ""
+			return string(line), true
+		case c == 0x1b || c == 0x03:
+			// Drop the rest of an escape sequence.
+			for r.in.Buffered() > 0 {
+				r.in.ReadByte()
+			}
+			r.status = ""
+			return "", false
+		case c == 0x7f || c == 0x08:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		case c >= 0x20:
+			line = append(line, c)
+		}
+	}
+}
+
+// parseTTL parses a duration such as 12h or 30d.
+func parseTTL(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return ttl, nil
+}
+
+// handle acts on a key, and returns false to quit.
+func (r *reviewer) handle(key string) bool {
+	_, height := screenSize()
+	r.status = ""
+	switch key {
+	case "q", "\x03":
+		return false
+	case "up", "k":
+		r.selected--
+	case "down", "j":
+		r.selected++
+	case "pgup":
+		r.selected -= height - 3
+	case "pgdn":
+		r.selected += height - 3
+	case "/":
+		if filter, ok := r.readLine("Search: "); ok {
+			r.filter = filter
+			r.selected = 0
+		}
+	case "r":
+		r.reload("Reloaded")
+		return true
+	case "t":
+		if entry := r.current(); entry != nil {
+			r.setExpiry(entry)
+		}
+	case "d":
+		if entry := r.current(); entry != nil {
+			r.remove(entry)
+		}
+	}
+	r.applyFilter()
+	return true
+}
+
+func (r *reviewer) current() *reviewEntry {
+	if r.selected < 0 || r.selected >= len(r.shown) {
+		return nil
+	}
+	return &r.entries[r.shown[r.selected]]
+}
+
+func (r *reviewer) reload(status string) {
+	if err := r.load(); err != nil {
+		r.status = err.Error()
+		return
+	}
+	r.status = status
+}
+
+func (r *reviewer) path(entry *reviewEntry) string {
+	if entry.denial {
+		return "/denials" + tenantQuery("?")
+	}
+	return "/rules" + tenantQuery("?")
+}
+
+func (r *reviewer) setExpiry(entry *reviewEntry) {
+	prompt := "Expire in (e.g. 12h or 30d, empty for never): "
+	if entry.denial {
+		prompt = "Forget the denial in (e.g. 10m or 2h): "
+	}
+	input, ok := r.readLine(prompt)
+	if !ok {
+		return
+	}
+	req := guardianagent.AdminRuleRequest{Scope: entry.scope, Command: entry.command}
+	if input = strings.TrimSpace(input); input != "" || entry.denial {
+		ttl, err := parseTTL(input)
+		if err != nil {
+			r.status = err.Error()
+			return
+		}
+		req.Expires = time.Now().Add(ttl)
+	}
+	if err := r.admin.Do("PUT", r.path(entry), req, nil); err != nil {
+		r.status = err.Error()
+		return
+	}
+	r.reload("Expiry updated")
+}
+
+func (r *reviewer) remove(entry *reviewEntry) {
+	answer, ok := r.readLine("Delete this entry? (y/n) ")
+	if !ok || strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		return
+	}
+	req := guardianagent.AdminRuleRequest{Scope: entry.scope, Command: entry.command}
+	if err := r.admin.Do("DELETE", r.path(entry), req, nil); err != nil {
+		r.status = err.Error()
+		return
+	}
+	r.reload("Deleted")
+}
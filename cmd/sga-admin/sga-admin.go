@@ -0,0 +1,519 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	"github.com/howeyc/gopass"
+	flags "github.com/jessevdk/go-flags"
+)
+
+type tokenCommand struct {
+	Client string `long:"client" description:"Only accept the token from this client (intermediary) name"`
+
+	User string `long:"user" short:"u" required:"true" description:"User on the target server"`
+
+	Host string `long:"host" short:"H" required:"true" description:"Target server as host[:port]"`
+
+	TTL time.Duration `long:"ttl" description:"Time until the token expires" default:"10m"`
+
+	Args struct {
+		Command []string `positional-arg-name:"command" required:"true"`
+	} `positional-args:"true"`
+}
+
+type tokensCommand struct{}
+
+type keyCommand struct {
+	NoConfirm bool `long:"no-confirm" description:"Sign without asking"`
+
+	Lifetime time.Duration `long:"lifetime" description:"Stop offering and using the key after this long (e.g. 8h)"`
+
+	Destinations []string `long:"destination" short:"d" description:"Only sign in to hosts matching this pattern with the key (may be repeated)"`
+
+	Remove bool `long:"remove" description:"Remove the constraint on the key"`
+
+	Args struct {
+		Fingerprint string `positional-arg-name:"fingerprint" required:"true"`
+	} `positional-args:"true"`
+}
+
+type keysCommand struct{}
+
+type healthCommand struct{}
+
+type lockdownCommand struct {
+	Args struct {
+		Reason []string `positional-arg-name:"reason"`
+	} `positional-args:"true"`
+}
+
+type unlockCommand struct{}
+
+type reloadCommand struct{}
+
+type sessionsCommand struct {
+	Resources bool `long:"resources" description:"Show the goroutines, streams and buffered memory of each active session instead"`
+}
+
+type staleCommand struct {
+	Days int `long:"days" description:"List approvals neither used nor added for this many days" default:"90"`
+
+	Expire bool `long:"expire" description:"Remove the listed approvals from the personal policy"`
+}
+
+type exportCommand struct {
+	Args struct {
+		File string `positional-arg-name:"file" required:"true"`
+	} `positional-args:"true"`
+}
+
+type importCommand struct {
+	Args struct {
+		File string `positional-arg-name:"file" required:"true"`
+	} `positional-args:"true"`
+}
+
+type killCommand struct {
+	Client string `long:"client" description:"Terminate all sessions of this client (intermediary) name"`
+
+	Args struct {
+		ID string `positional-arg-name:"session-id"`
+	} `positional-args:"true"`
+}
+
+type options struct {
+	Version bool `long:"version" short:"V" description:"Display the version number and exit"`
+
+	Socket string `long:"socket" description:"Admin socket of the guardian"`
+
+	Guard string `long:"guard" short:"g" description:"Intermediary host of the guardian to manage, if several are running"`
+
+	Tenant string `long:"tenant" description:"Manage the approvals, denials, tokens, invitations and key constraints of this tenant of the guardian"`
+
+	Token tokenCommand `command:"token" description:"Pre-approve a command once, and print a token for the client to present (sga-ssh --approval-token)"`
+
+	Tokens tokensCommand `command:"tokens" description:"List outstanding one-time tokens"`
+
+	Invite inviteCommand `command:"invite" description:"Pre-approve a bounded delegation, and print an invitation for the delegatee to install"`
+
+	Invitations invitationsCommand `command:"invitations" description:"List active invitations and their uses"`
+
+	RevokeInvitation revokeInvitationCommand `command:"revoke-invitation" description:"Revoke an invitation"`
+
+	Credentials credentialsCommand `command:"credentials" description:"Query the ledger of issued tokens and invitations, including expired, used and revoked ones"`
+
+	Key keyCommand `command:"key" description:"Constrain the use of a key (SHA256 fingerprint) in ssh-agent passthrough mode"`
+
+	Keys keysCommand `command:"keys" description:"List key constraints"`
+
+	Sessions sessionsCommand `command:"sessions" description:"List active sessions"`
+
+	Kill killCommand `command:"kill" description:"Terminate a session, or all sessions of a client"`
+
+	Lockdown lockdownCommand `command:"lockdown" description:"Deny all requests, terminate all sessions and revoke all tokens until unlocked"`
+
+	Unlock unlockCommand `command:"unlock" description:"Release the lockdown"`
+
+	Reload reloadCommand `command:"reload" description:"Reread the configuration and the policy, applying the changes that can be applied without a restart (like SIGHUP)"`
+
+	Health healthCommand `command:"health" description:"Show the health of the guardian, and fail if it is not ready"`
+
+	Review reviewCommand `command:"review" description:"Browse, search, expire and delete stored approvals and remembered denials in a full-screen view"`
+
+	Stale staleCommand `command:"stale" description:"List (or remove) stored approvals that were not used for a while"`
+
+	Export exportCommand `command:"export" description:"Export the personal policy and command history to a passphrase-encrypted bundle"`
+
+	Import importCommand `command:"import" description:"Merge a bundle made by export into the personal policy and command history"`
+
+	Attach attachCommand `command:"attach" description:"Answer prompts from this terminal alongside the other approvers (requires --team)"`
+
+	Approvers approversCommand `command:"approvers" description:"List attached approvers"`
+
+	Pair pairCommand `command:"pair" description:"Pair a mobile device to answer prompts on (requires --push-relay)"`
+
+	Devices devicesCommand `command:"devices" description:"List paired mobile devices"`
+
+	Unpair unpairCommand `command:"unpair" description:"Remove a paired mobile device"`
+}
+
+var opts options
+
+func adminClient() (*guardianagent.AdminClient, error) {
+	if opts.Socket != "" {
+		return guardianagent.NewAdminClient(opts.Socket), nil
+	}
+	if opts.Guard != "" {
+		return guardianagent.NewAdminClient(guardianagent.AdminSocketPath(opts.Guard)), nil
+	}
+	sockets, _ := filepath.Glob(guardianagent.AdminSocketPath("*"))
+	switch len(sockets) {
+	case 0:
+		return nil, fmt.Errorf("No running guardian found")
+	case 1:
+		return guardianagent.NewAdminClient(sockets[0]), nil
+	default:
+		var names []string
+		for _, s := range sockets {
+			names = append(names, strings.TrimPrefix(filepath.Base(s), guardianagent.AdminSockPrefix))
+		}
+		return nil, fmt.Errorf("Several guardians are running (%s), select one with --guard", strings.Join(names, ", "))
+	}
+}
+
+// tenantQuery returns the query parameter selecting the tenant given with
+// --tenant, if any, starting with sep.
+func tenantQuery(sep string) string {
+	if opts.Tenant == "" {
+		return ""
+	}
+	return sep + "tenant=" + url.QueryEscape(opts.Tenant)
+}
+
+func (cmd *tokenCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	host := cmd.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	req := guardianagent.AdminTokenRequest{
+		Scope: guardianagent.Scope{
+			Client:          cmd.Client,
+			ServiceUsername: cmd.User,
+			ServiceHostname: host,
+		},
+		Command: strings.Join(cmd.Args.Command, " "),
+		TTL:     cmd.TTL,
+	}
+	var resp guardianagent.AdminTokenResponse
+	if err = admin.Do("POST", "/tokens"+tenantQuery("?"), req, &resp); err != nil {
+		return err
+	}
+	fmt.Println(resp.Token)
+	fmt.Fprintf(os.Stderr, "Token valid once until %s\n", resp.Expires.Format(time.Kitchen))
+	return nil
+}
+
+func (cmd *tokensCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var tokens []guardianagent.ApprovalToken
+	if err = admin.Do("GET", "/tokens"+tenantQuery("?"), nil, &tokens); err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		client := t.Scope.Client
+		if client == "" {
+			client = "*"
+		}
+		fmt.Printf("%s  %s -> %s@%s: %s\n", t.Expires.Format(time.Kitchen), client,
+			t.Scope.ServiceUsername, t.Scope.ServiceHostname, t.Command)
+	}
+	return nil
+}
+
+func (cmd *keyCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	if cmd.Remove {
+		return admin.Do("DELETE", "/keys?fingerprint="+url.QueryEscape(cmd.Args.Fingerprint)+tenantQuery("&"), nil, nil)
+	}
+	constraint := guardianagent.KeyConstraint{
+		Fingerprint:  cmd.Args.Fingerprint,
+		NoConfirm:    cmd.NoConfirm,
+		Destinations: cmd.Destinations,
+	}
+	if cmd.Lifetime > 0 {
+		constraint.Expires = time.Now().Add(cmd.Lifetime)
+	}
+	return admin.Do("POST", "/keys"+tenantQuery("?"), constraint, nil)
+}
+
+func (cmd *keysCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var constraints []guardianagent.KeyConstraint
+	if err = admin.Do("GET", "/keys"+tenantQuery("?"), nil, &constraints); err != nil {
+		return err
+	}
+	for _, c := range constraints {
+		var desc []string
+		if c.NoConfirm {
+			desc = append(desc, "no confirmation")
+		}
+		if !c.Expires.IsZero() {
+			desc = append(desc, "expires "+c.Expires.Format(time.RFC3339))
+		}
+		if len(c.Destinations) > 0 {
+			desc = append(desc, "destinations "+strings.Join(c.Destinations, ","))
+		}
+		fmt.Printf("%s  %s\n", c.Fingerprint, strings.Join(desc, ", "))
+	}
+	return nil
+}
+
+func (cmd *sessionsCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	if cmd.Resources {
+		var debug guardianagent.SessionDebug
+		if err = admin.Do("GET", "/debug/sessions", nil, &debug); err != nil {
+			return err
+		}
+		fmt.Printf("%d goroutines, %d bytes of heap\n", debug.Goroutines, debug.HeapAlloc)
+		for _, s := range debug.Sessions {
+			fmt.Printf("%d  %s  %s: %d goroutines, %d streams, %d bytes buffered at most (%d bytes out, %d in)\n",
+				s.ID, s.State, s.Client, s.Goroutines, s.Streams, s.Memory, s.BytesToServer, s.BytesFromServer)
+		}
+		return nil
+	}
+	var sessions []guardianagent.Session
+	if err = admin.Do("GET", "/sessions", nil, &sessions); err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		printSession(s)
+	}
+	return nil
+}
+
+func printSession(s guardianagent.Session) {
+	client := s.Scope.Client
+	if client == "" {
+		client = "-"
+	}
+	state := s.State
+	if s.Error != "" {
+		state += " (" + s.Error + ")"
+	}
+	fmt.Printf("%d  %s  %s  %s -> %s@%s: %s (%d bytes out, %d in)\n", s.ID, s.Started.Format(time.Kitchen), state,
+		client, s.Scope.ServiceUsername, s.Scope.ServiceHostname, s.Command, s.BytesToServer, s.BytesFromServer)
+}
+
+func (cmd *killCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	query := "?id=" + url.QueryEscape(cmd.Args.ID)
+	if cmd.Client != "" {
+		query = "?client=" + url.QueryEscape(cmd.Client)
+	} else if cmd.Args.ID == "" {
+		return fmt.Errorf("Specify a session ID or --client")
+	}
+	var killed []guardianagent.Session
+	if err = admin.Do("DELETE", "/sessions"+query, nil, &killed); err != nil {
+		return err
+	}
+	for _, s := range killed {
+		printSession(s)
+	}
+	fmt.Fprintf(os.Stderr, "Terminated %d session(s)\n", len(killed))
+	return nil
+}
+
+func (cmd *lockdownCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var state guardianagent.LockdownState
+	err = admin.Do("POST", "/lockdown", guardianagent.AdminLockdownRequest{Reason: strings.Join(cmd.Args.Reason, " ")}, &state)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Locked down since %s\n", state.Since.Format(time.Kitchen))
+	return nil
+}
+
+func (cmd *unlockCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	return admin.Do("DELETE", "/lockdown", nil, nil)
+}
+
+func (cmd *reloadCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var report guardianagent.ReloadReport
+	if err = admin.Do("POST", "/reload", nil, &report); err != nil {
+		return err
+	}
+	fmt.Println("Reloaded configuration and policy")
+	if len(report.Applied) > 0 {
+		fmt.Printf("Applied: %s\n", strings.Join(report.Applied, " "))
+	}
+	if len(report.RestartRequired) > 0 {
+		fmt.Printf("Restart sga-guard to apply: %s\n", strings.Join(report.RestartRequired, " "))
+	}
+	return nil
+}
+
+func (cmd *healthCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	var health guardianagent.Health
+	if err = admin.Do("GET", "/health", nil, &health); err != nil {
+		return err
+	}
+	fmt.Printf("Policy loaded:    %t\n", health.PolicyLoaded)
+	fmt.Printf("Prompts:          %t (%d pending", health.UIAvailable, health.PendingPrompts)
+	if health.PendingPrompts > 0 {
+		fmt.Printf(", oldest %s", health.OldestPrompt.Round(time.Second))
+	}
+	fmt.Printf(")\n")
+	fmt.Printf("Signing keys:     %d\n", health.Signers)
+	fmt.Printf("Pending requests: %d\n", health.PendingRequests)
+	fmt.Printf("Active sessions:  %d\n", health.ActiveSessions)
+	if !health.Ready {
+		return fmt.Errorf("Guardian is not ready:\n  %s", strings.Join(health.Problems, "\n  "))
+	}
+	fmt.Println("Ready")
+	return nil
+}
+
+func (cmd *staleCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	method := "GET"
+	if cmd.Expire {
+		method = "DELETE"
+	}
+	var rules []guardianagent.StaleRule
+	if err = admin.Do(method, fmt.Sprintf("/rules/stale?days=%d%s", cmd.Days, tenantQuery("&")), nil, &rules); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		command := r.Command
+		if command == "" {
+			command = "ANY COMMAND"
+		}
+		lastUsed := "never used"
+		if !r.LastUsed.IsZero() {
+			lastUsed = "last used " + r.LastUsed.Format("2006-01-02")
+		}
+		fmt.Printf("%s -> %s@%s: %s (%s)\n", r.Scope.Client, r.Scope.ServiceUsername, r.Scope.ServiceHostname, command, lastUsed)
+	}
+	if cmd.Expire {
+		fmt.Fprintf(os.Stderr, "Removed %d approval(s)\n", len(rules))
+	}
+	return nil
+}
+
+// bundlePassphrase returns the passphrase of store bundles, from
+// $SGA_BUNDLE_PASSPHRASE or else the terminal.
+func bundlePassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv("SGA_BUNDLE_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, "Bundle passphrase: ")
+	passphrase, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := gopass.GetPasswd()
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("Passphrases do not match")
+		}
+	}
+	return string(passphrase), nil
+}
+
+func (cmd *exportCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	passphrase, err := bundlePassphrase(true)
+	if err != nil {
+		return err
+	}
+	var resp guardianagent.AdminStoreRequest
+	if err = admin.Do("POST", "/store/export", guardianagent.AdminStoreRequest{Passphrase: passphrase}, &resp); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cmd.Args.File, resp.Bundle, 0600)
+}
+
+func (cmd *importCommand) Execute(args []string) error {
+	admin, err := adminClient()
+	if err != nil {
+		return err
+	}
+	bundle, err := ioutil.ReadFile(cmd.Args.File)
+	if err != nil {
+		return err
+	}
+	passphrase, err := bundlePassphrase(false)
+	if err != nil {
+		return err
+	}
+	var summary guardianagent.StoreImport
+	err = admin.Do("POST", "/store/import", guardianagent.AdminStoreRequest{Passphrase: passphrase, Bundle: bundle}, &summary)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported the store of %s (exported %s): %d rules added\n",
+		summary.Host, summary.Exported.Format(time.RFC3339), summary.Rules)
+	return nil
+}
+
+func main() {
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.SubcommandsOptional = true
+
+	_, err := parser.Parse()
+	if opts.Version {
+		fmt.Println(guardianagent.Version)
+		os.Exit(0)
+	}
+
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok {
+			if flagsErr.Type == flags.ErrHelp {
+				fmt.Println(flagsErr.Message)
+				os.Exit(0)
+			}
+			fmt.Fprintln(os.Stderr, flagsErr.Message)
+			os.Exit(255)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if parser.Active == nil {
+		parser.WriteHelp(os.Stderr)
+		os.Exit(255)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+)
+
+type queryCommand struct {
+	Since string `long:"since" description:"Only show entries from this time on (e.g. 2024-03-02, \"2024-03-02 15:04\", RFC 3339, or a duration ago such as 24h)"`
+
+	Until string `long:"until" description:"Only show entries before this time"`
+
+	Client string `long:"client" description:"Only show entries of clients matching this pattern (e.g. \"ci@*\")"`
+
+	Server string `long:"server" description:"Only show entries of servers matching this pattern, with or without the port"`
+
+	Decision string `long:"decision" description:"Only show entries with this decision (e.g. approved, auto-approved, denied, expired, withdrawn)"`
+
+	Event string `long:"event" description:"Only show entries of this event (connection, request, decision, handoff, error, policy or checkpoint)"`
+
+	Command string `long:"command" description:"Only show entries whose command contains this text"`
+
+	Format string `long:"format" description:"Output format" choice:"table" choice:"json" choice:"csv" default:"table"`
+
+	Follow bool `long:"follow" short:"f" description:"Keep showing new entries as they are written, like tail -f"`
+
+	CurrentOnly bool `long:"current-only" description:"Do not read rotated audit log files"`
+
+	Args struct {
+		AuditLog string `positional-arg-name:"audit-log"`
+	} `positional-args:"true"`
+}
+
+// How often the log is checked for new entries in follow mode.
+const followInterval = time.Second
+
+// auditPrinter writes entries in one of the output formats.
+type auditPrinter interface {
+	print(entry *guardianagent.AuditEntry) error
+	flush() error
+}
+
+type tablePrinter struct {
+	w *tabwriter.Writer
+}
+
+func (p *tablePrinter) print(entry *guardianagent.AuditEntry) error {
+	detail := entry.Detail
+	if entry.Approver != "" {
+		detail = strings.TrimSpace(detail + " (by " + entry.Approver + ")")
+	}
+	_, err := fmt.Fprintf(p.w, "%s\t%s\t%s\t%s@%s\t%s\t%s\t%s\n", entry.Time.Local().Format("2006-01-02 15:04:05"),
+		entry.Event, entry.Scope.Client, entry.Scope.ServiceUsername, entry.Scope.ServiceHostname,
+		entry.Decision, oneLine(entry.Command), oneLine(detail))
+	return err
+}
+
+func (p *tablePrinter) flush() error {
+	return p.w.Flush()
+}
+
+type jsonPrinter struct {
+	enc *json.Encoder
+}
+
+func (p *jsonPrinter) print(entry *guardianagent.AuditEntry) error {
+	return p.enc.Encode(entry)
+}
+
+func (p *jsonPrinter) flush() error {
+	return nil
+}
+
+type csvPrinter struct {
+	w *csv.Writer
+}
+
+var csvHeader = []string{"Time", "Seq", "Event", "RequestID", "Client", "User", "Server", "Command", "Decision", "Detail", "Approver", "Reason"}
+
+func (p *csvPrinter) print(entry *guardianagent.AuditEntry) error {
+	return p.w.Write([]string{entry.Time.Format(time.RFC3339), fmt.Sprint(entry.Seq), entry.Event, entry.RequestID,
+		entry.Scope.Client, entry.Scope.ServiceUsername, entry.Scope.ServiceHostname, entry.Command,
+		entry.Decision, entry.Detail, entry.Approver, entry.Reason})
+}
+
+func (p *csvPrinter) flush() error {
+	p.w.Flush()
+	return p.w.Error()
+}
+
+func oneLine(s string) string {
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+func (cmd *queryCommand) Execute(args []string) error {
+	logPath := cmd.Args.AuditLog
+	if logPath == "" {
+		logPath = os.ExpandEnv(defaultAuditLog)
+	}
+	filter := guardianagent.AuditFilter{
+		Client:   cmd.Client,
+		Server:   cmd.Server,
+		Decision: cmd.Decision,
+		Event:    cmd.Event,
+		Command:  cmd.Command,
+	}
+	var err error
+	if cmd.Since != "" {
+		if filter.Since, err = guardianagent.ParseAuditTime(cmd.Since); err != nil {
+			return err
+		}
+	}
+	if cmd.Until != "" {
+		if filter.Until, err = guardianagent.ParseAuditTime(cmd.Until); err != nil {
+			return err
+		}
+	}
+
+	var printer auditPrinter
+	switch cmd.Format {
+	case "json":
+		printer = &jsonPrinter{enc: json.NewEncoder(os.Stdout)}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		if err = w.Write(csvHeader); err != nil {
+			return err
+		}
+		printer = &csvPrinter{w: w}
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tEVENT\tCLIENT\tSERVER\tDECISION\tCOMMAND\tDETAIL")
+		printer = &tablePrinter{w: w}
+	}
+	show := func(reader *guardianagent.AuditReader) error {
+		for {
+			entry, err := reader.Next()
+			if err == io.EOF {
+				return printer.flush()
+			}
+			if err != nil {
+				return err
+			}
+			if filter.Matches(entry) {
+				if err = printer.print(entry); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if !cmd.CurrentOnly {
+		rotated, err := guardianagent.RotatedFiles(logPath)
+		if err != nil {
+			return err
+		}
+		for _, name := range rotated {
+			file, err := guardianagent.OpenLogFile(name)
+			if err != nil {
+				return err
+			}
+			err = show(guardianagent.NewAuditReader(file))
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	file, err := os.Open(logPath)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log: %s", err)
+	}
+	defer func() { file.Close() }()
+	reader := guardianagent.NewAuditReader(file)
+	if err = show(reader); err != nil || !cmd.Follow {
+		return err
+	}
+
+	for {
+		time.Sleep(followInterval)
+		if err = show(reader); err != nil {
+			return err
+		}
+		// Once the log is rotated, the rest of its entries are in the file
+		// we have open, and new ones are written to a new file.
+		current, err := os.Stat(logPath)
+		if err != nil {
+			continue
+		}
+		opened, err := file.Stat()
+		if err != nil || os.SameFile(current, opened) {
+			continue
+		}
+		next, err := os.Open(logPath)
+		if err != nil {
+			continue
+		}
+		if err = show(reader); err != nil {
+			next.Close()
+			return err
+		}
+		file.Close()
+		file, reader = next, guardianagent.NewAuditReader(next)
+		if err = show(reader); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+)
+
+type replayCommand struct {
+	Speed float64 `long:"speed" description:"Playback speed (e.g. 2 for twice as fast)" default:"1"`
+
+	MaxWait time.Duration `long:"max-wait" description:"Shorten longer pauses to this (0 to keep them)" default:"2s"`
+
+	Verify bool `long:"verify" description:"Check the recording against the audit log before playing it"`
+
+	AuditLog string `long:"audit-log" description:"Audit log to check the recording against" default:"$HOME/.ssh/sga_audit.log"`
+
+	PublicKey string `long:"pubkey" description:"Audit signing public key (defaults to <audit-log>.pub)"`
+
+	Identities []string `long:"identity" short:"i" description:"Key file (see keygen) to decrypt encrypted recordings with (may be repeated; it takes the keys of all of their recipients)"`
+
+	Args struct {
+		Recording string `positional-arg-name:"recording" required:"true"`
+	} `positional-args:"true"`
+}
+
+type recordingsCommand struct {
+	Dir string `long:"dir" description:"Directory of the recordings (defaults to ~/.ssh/sga_recordings)"`
+
+	Search string `long:"search" description:"Only list recordings whose command, server or output contain this text"`
+
+	Identities []string `long:"identity" short:"i" description:"Key file to decrypt encrypted recordings with when searching (may be repeated)"`
+}
+
+type keygenCommand struct {
+	Output string `long:"output" short:"o" description:"File to write the key to (standard output if unset)"`
+}
+
+type exportCommand struct {
+	Output string `long:"output" short:"o" description:"File to write the asciicast to (standard output if unset)"`
+
+	Identities []string `long:"identity" short:"i" description:"Key file to decrypt encrypted recordings with (may be repeated)"`
+
+	Args struct {
+		Recording string `positional-arg-name:"recording" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (cmd *keygenCommand) Execute(args []string) error {
+	id, err := guardianagent.GenerateRecordingIdentity()
+	if err != nil {
+		return err
+	}
+	if cmd.Output == "" {
+		_, err = os.Stdout.Write(id.Marshal())
+		return err
+	}
+	f, err := os.OpenFile(cmd.Output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(id.Marshal()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Recipient: %s\n", id.Recipient())
+	return nil
+}
+
+// loadRecording loads a recording, and the keys to read it with if it is
+// encrypted.
+func loadRecording(path string, identities []string) (*guardianagent.SessionRecording, error) {
+	rec, err := guardianagent.LoadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := loadIdentities(identities)
+	if err != nil {
+		return nil, err
+	}
+	rec.Unlock(ids)
+	return rec, nil
+}
+
+func loadIdentities(paths []string) ([]*guardianagent.RecordingIdentity, error) {
+	var ids []*guardianagent.RecordingIdentity
+	for _, path := range paths {
+		loaded, err := guardianagent.LoadRecordingIdentities(os.ExpandEnv(path))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, loaded...)
+	}
+	return ids, nil
+}
+
+func (cmd *exportCommand) Execute(args []string) error {
+	rec, err := loadRecording(cmd.Args.Recording, cmd.Identities)
+	if err != nil {
+		return err
+	}
+	if err = rec.Verify(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", rec.Name(), err)
+	}
+	if cmd.Output == "" {
+		return rec.ExportAsciicast(os.Stdout)
+	}
+	f, err := os.OpenFile(cmd.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = rec.ExportAsciicast(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (cmd *replayCommand) Execute(args []string) error {
+	rec, err := loadRecording(cmd.Args.Recording, cmd.Identities)
+	if err != nil {
+		return err
+	}
+	if cmd.Speed <= 0 {
+		return fmt.Errorf("--speed must be positive")
+	}
+	if cmd.Verify {
+		if err = verifyRecording(rec, os.ExpandEnv(cmd.AuditLog), cmd.PublicKey); err != nil {
+			return fmt.Errorf("%s: verification FAILED: %s", rec.Name(), err)
+		}
+		fmt.Printf("%s: matches request %s in the audit log\n", rec.Name(), rec.RequestID)
+	}
+	fmt.Fprintf(os.Stderr, "Replaying %s@%s: %s (recorded %s)\n", rec.User, rec.Server, rec.Command, rec.Started.Format(time.RFC1123))
+	return rec.Replay(os.Stdout, cmd.Speed, cmd.MaxWait)
+}
+
+// verifyRecording checks the recording against its own hash, and against the
+// hash reported to the guardian in its audit log, whose integrity it checks
+// too.
+func verifyRecording(rec *guardianagent.SessionRecording, logPath string, pubPath string) error {
+	if err := rec.Verify(); err != nil {
+		return err
+	}
+	if err := verifyAuditLog(logPath, pubPath, false); err != nil {
+		return err
+	}
+	_, r, closeAll, err := openAuditLog(logPath, false)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+	return guardianagent.FindRecordingInAudit(r, rec)
+}
+
+func (cmd *recordingsCommand) Execute(args []string) error {
+	dir := cmd.Dir
+	if dir == "" {
+		dir = guardianagent.RecordingsDir()
+	}
+	recordings, err := guardianagent.ListRecordings(dir)
+	if err != nil {
+		return err
+	}
+	ids, err := loadIdentities(cmd.Identities)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recordings {
+		if cmd.Search != "" {
+			rec.Unlock(ids)
+			found, err := rec.Contains(cmd.Search)
+			if err != nil {
+				// Encrypted recordings may not be readable with the keys at hand.
+				fmt.Fprintf(os.Stderr, "%s: %s\n", rec.Name(), err)
+				continue
+			}
+			if !found {
+				continue
+			}
+		}
+		fmt.Printf("%s  %s  %s  %s@%s: %s\n", rec.Name(), rec.Started.Format("2006-01-02 15:04"),
+			rec.Ended.Sub(rec.Started).Round(time.Second), rec.User, rec.Server, rec.Command)
+	}
+	return nil
+}
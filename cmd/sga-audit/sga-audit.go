@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	flags "github.com/jessevdk/go-flags"
+	"golang.org/x/crypto/ssh"
+)
+
+type verifyCommand struct {
+	PublicKey string `long:"pubkey" description:"Audit signing public key (defaults to <audit-log>.pub)"`
+
+	CurrentOnly bool `long:"current-only" description:"Do not verify rotated audit log files"`
+
+	Args struct {
+		AuditLog string `positional-arg-name:"audit-log"`
+	} `positional-args:"true"`
+}
+
+type options struct {
+	Version bool `long:"version" short:"V" description:"Display the version number and exit"`
+
+	Verify verifyCommand `command:"verify" description:"Verify the hash chain and signed checkpoints of an audit log"`
+
+	Query queryCommand `command:"query" description:"Show the audit log entries matching filters"`
+
+	Replay replayCommand `command:"replay" description:"Play back a session recorded by sga-ssh --record"`
+
+	Recordings recordingsCommand `command:"recordings" description:"List or search session recordings"`
+
+	Export exportCommand `command:"export" description:"Convert a session recording to an asciicast (v2), e.g. for asciinema"`
+
+	Keygen keygenCommand `command:"keygen" description:"Generate a key to encrypt session recordings to"`
+}
+
+const defaultAuditLog = "$HOME/.ssh/sga_audit.log"
+
+// openAuditLog opens the files of an audit log, oldest first, as a single
+// reader.
+func openAuditLog(logPath string, currentOnly bool) (files []string, r io.Reader, closeAll func(), err error) {
+	if !currentOnly {
+		if files, err = guardianagent.RotatedFiles(logPath); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	files = append(files, logPath)
+	var readers []io.Reader
+	var opened []io.Closer
+	closeAll = func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}
+	for _, name := range files {
+		file, err := guardianagent.OpenLogFile(name)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+		opened = append(opened, file)
+		readers = append(readers, file)
+	}
+	return files, io.MultiReader(readers...), closeAll, nil
+}
+
+// verifyAuditLog verifies the hash chain and signed checkpoints of an audit
+// log, with the public key at pubPath (<audit-log>.pub if empty).
+func verifyAuditLog(logPath string, pubPath string, currentOnly bool) error {
+	if pubPath == "" {
+		pubPath = logPath + ".pub"
+	}
+
+	pubBytes, err := ioutil.ReadFile(pubPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read audit public key: %s", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse audit public key %s: %s", pubPath, err)
+	}
+
+	files, r, closeAll, err := openAuditLog(logPath, currentOnly)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	result, err := guardianagent.VerifyAuditLog(r, pub)
+	if err != nil {
+		return fmt.Errorf("%s: verification FAILED after %d entries: %s", logPath, result.Entries, err)
+	}
+	fmt.Printf("%s: %d files, %d entries, %d signed checkpoints\n", logPath, len(files), result.Entries, result.Checkpoints)
+	if result.Unsigned > 0 {
+		return fmt.Errorf("%s: last %d entries are not covered by a signed checkpoint; the log may have been truncated or the guardian did not shut down cleanly",
+			logPath, result.Unsigned)
+	}
+	return nil
+}
+
+func (cmd *verifyCommand) Execute(args []string) error {
+	logPath := cmd.Args.AuditLog
+	if logPath == "" {
+		logPath = os.ExpandEnv(defaultAuditLog)
+	}
+	if err := verifyAuditLog(logPath, cmd.PublicKey, cmd.CurrentOnly); err != nil {
+		return err
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+func main() {
+	var opts options
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.SubcommandsOptional = true
+
+	_, err := parser.Parse()
+	if opts.Version {
+		fmt.Println(guardianagent.Version)
+		os.Exit(0)
+	}
+
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok {
+			if flagsErr.Type == flags.ErrHelp {
+				fmt.Println(flagsErr.Message)
+				os.Exit(0)
+			}
+			fmt.Fprintln(os.Stderr, flagsErr.Message)
+			os.Exit(255)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if parser.Active == nil {
+		parser.WriteHelp(os.Stderr)
+		os.Exit(255)
+	}
+}
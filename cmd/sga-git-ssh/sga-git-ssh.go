@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+)
+
+// sga-git-ssh is the ssh command of git (core.sshCommand or
+// GIT_SSH_COMMAND). It runs git operations on the repositories listed in the
+// sga.repo git config through the guardian, and others with ssh.
+func main() {
+	args := os.Args[1:]
+	for _, arg := range args {
+		// git checks whether its ssh command takes the options of OpenSSH
+		// by running it with -G.
+		if arg == "-G" {
+			run("ssh", args, nil)
+		}
+	}
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s [ssh options] [user@]host command\n", os.Args[0])
+		os.Exit(255)
+	}
+
+	// git passes the host and the command last.
+	host, cmd := args[len(args)-2], args[len(args)-1]
+	git, ok := guardianagent.ParseGitCommand(cmd)
+	if !ok || !throughGuardian(host, git.Repo) {
+		run("ssh", args, nil)
+	}
+	env := os.Environ()
+	if os.Getenv("SGA_GIT_RUN") == "" {
+		env = append(env, "SGA_GIT_RUN="+gitRunID())
+	}
+	sshProgram := os.Getenv("SGA_SSH")
+	if sshProgram == "" {
+		sshProgram = "sga-ssh"
+	}
+	run(sshProgram, args, env)
+}
+
+// throughGuardian reports whether the repository on host matches one of the
+// "host:repo" patterns of the sga.repo git config, or there are none.
+func throughGuardian(host string, repo string) bool {
+	out, err := exec.Command("git", "config", "--get-all", "sga.repo").Output()
+	patterns := strings.Fields(string(out))
+	if err != nil || len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if guardianagent.MatchesGitRepoPattern(pattern, host, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitRunID identifies the outermost git process running this one (e.g. a
+// push recursing into submodules), on Linux by its process ID and start
+// time, and elsewhere by the process ID of the parent.
+func gitRunID() string {
+	hostname, _ := os.Hostname()
+	pid := os.Getppid()
+	run := strconv.Itoa(pid)
+	for pid > 1 {
+		comm, ppid, start, ok := readProcStat(pid)
+		if !ok || !strings.HasPrefix(comm, "git") {
+			break
+		}
+		run = fmt.Sprintf("%d.%s", pid, start)
+		pid = ppid
+	}
+	sum := sha256.Sum256([]byte(hostname + "/" + run))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// readProcStat reads the command name, parent and start time of a process
+// from /proc.
+func readProcStat(pid int) (comm string, ppid int, start string, ok bool) {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", 0, "", false
+	}
+	// The command name is in parentheses, and may contain spaces.
+	open, end := bytes.IndexByte(buf, '('), bytes.LastIndexByte(buf, ')')
+	if open < 0 || end < open {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(string(buf[end+1:]))
+	if len(fields) < 20 {
+		return "", 0, "", false
+	}
+	ppid, err = strconv.Atoi(fields[1])
+	return string(buf[open+1 : end]), ppid, fields[19], err == nil
+}
+
+// run runs program with args, and exits with its status.
+func run(program string, args []string, env []string) {
+	cmd := exec.Command(program, args...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		os.Exit(ee.ExitCode())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(255)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	flags "github.com/jessevdk/go-flags"
+)
+
+func isHelp(err error) bool {
+	flagsErr, ok := err.(*flags.Error)
+	return ok && flagsErr.Type == flags.ErrHelp
+}
+
+// loadConfig sets the options of the config file, which may only be missing
+// if it was not asked for.
+func loadConfig(parser *flags.Parser, opts *options) error {
+	path := os.ExpandEnv(opts.Config)
+	explicit := !parser.FindOptionByLongName("config").IsSetDefault() || os.Getenv("SGA_GUARD_CONFIG") != ""
+	if _, err := os.Stat(path); os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err := flags.NewIniParser(parser).ParseFile(path); err != nil {
+		return fmt.Errorf("Failed to read config file: %s", err)
+	}
+	return nil
+}
+
+// checkConfig checks what can be checked of the options without starting
+// the guardian, reporting every problem found, and returns the exit status.
+func checkConfig(opts *options) int {
+	problems := 0
+	check := func(err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			problems++
+		}
+	}
+	// Files created as needed may be missing.
+	readable := func(name string, path string) {
+		path = os.ExpandEnv(path)
+		if !fileExists(path) {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			check(fmt.Errorf("%s: %s", name, err))
+			return
+		}
+		f.Close()
+	}
+
+	var verifier *guardianagent.PolicyVerifier
+	var err error
+	if opts.PolicySigners != "" {
+		verifier, err = guardianagent.NewPolicyVerifier(os.ExpandEnv(opts.PolicySigners), opts.PolicySignature == "warn")
+		check(err)
+	}
+	if path := os.ExpandEnv(opts.PolicyConfig); fileExists(path) {
+		_, err = guardianagent.NewStore(path)
+		check(err)
+	}
+	if fileExists(opts.SystemPolicy) {
+		_, err = guardianagent.LoadSystemPolicy(opts.SystemPolicy, verifier)
+		check(err)
+	}
+	readable("--known-hosts", opts.KnownHosts)
+	for _, spec := range opts.PromptEscalation {
+		_, _, err = guardianagent.ParseEscalation(spec)
+		check(err)
+	}
+	for _, spec := range opts.Listen {
+		check(guardianagent.ValidateListener(os.ExpandEnv(spec)))
+	}
+	for _, spec := range opts.AuditSinks {
+		var sink guardianagent.AuditSink
+		if sink, err = guardianagent.NewAuditSink(spec); err == nil {
+			sink.Close()
+		}
+		check(err)
+	}
+	if opts.AuditArchive != "" {
+		_, err = guardianagent.NewObjectStore(opts.AuditArchive)
+		check(err)
+	}
+	if opts.ApproverWeb != "" {
+		_, err = guardianagent.LoadApproverUsers(os.ExpandEnv(opts.ApproverWebUsers))
+		check(err)
+		if opts.ApproverWebCert != "" {
+			_, err = tls.LoadX509KeyPair(os.ExpandEnv(opts.ApproverWebCert), os.ExpandEnv(opts.ApproverWebKey))
+			check(err)
+		}
+	}
+	if opts.ApproverKeys != "" {
+		_, err = guardianagent.LoadApproverKeys(os.ExpandEnv(opts.ApproverKeys))
+		check(err)
+	}
+	if opts.StepUp == "duo" && opts.DuoHost == "" {
+		check(fmt.Errorf("--step-up duo requires --duo-host"))
+	}
+	if opts.StepUp == "okta" && opts.OktaOrg == "" {
+		check(fmt.Errorf("--step-up okta requires --okta-org"))
+	}
+	if opts.MatrixHomeserver != "" && opts.MatrixRoom == "" {
+		check(fmt.Errorf("--matrix-homeserver requires --matrix-room"))
+	}
+	if opts.SMTPServer != "" && (opts.EmailFrom == "" || len(opts.EmailTo) == 0) {
+		check(fmt.Errorf("--smtp-server requires --email-from and --email-to"))
+	}
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", problems)
+		return 255
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// sshOptionHandler collects the options of ssh given to sga-guard.
+func sshOptionHandler(sshOptions *[]string) func(string, flags.SplitArgument, []string) ([]string, error) {
+	return func(option string, arg flags.SplitArgument, args []string) ([]string, error) {
+		val, isSet := arg.Value()
+		sshFlagsWithValues := "bcDEeFIiLmOopQRWw"
+
+		if isSet {
+			*sshOptions = append(*sshOptions, fmt.Sprintf("-%s", option), val)
+		} else if strings.Contains(sshFlagsWithValues, option) {
+			*sshOptions = append(*sshOptions, fmt.Sprintf("-%s", option), args[0])
+			args = args[1:]
+		} else {
+			*sshOptions = append(*sshOptions, fmt.Sprintf("-%s", option))
+		}
+		return args, nil
+	}
+}
+
+// reparseOptions reads the command line and the config file again.
+func reparseOptions() (*options, error) {
+	var opts options
+	var sshOptions []string
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.UnknownOptionHandler = sshOptionHandler(&sshOptions)
+	parser.Parse()
+	if err := loadConfig(parser, &opts); err != nil {
+		return nil, err
+	}
+	if _, err := parser.Parse(); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+)
+
+// Options whose changes are applied by a reload. Changes to the others only
+// take effect after a restart.
+var liveOptions = map[string]bool{
+	"approve-pipelines":       true,
+	"asn-lookup":              true,
+	"audit-sink":              true,
+	"check-server-dns":        true,
+	"dns-negative-ttl":        true,
+	"dns-ttl":                 true,
+	"network-context":         true,
+	"policy-program":          true,
+	"policy-program-fallback": true,
+	"policy-program-timeout":  true,
+	"remember-denials":        true,
+	"system-policy":           true,
+}
+
+// changedOptions returns the long names of the options that differ.
+func changedOptions(old *options, next *options) []string {
+	var changed []string
+	var compare func(a reflect.Value, b reflect.Value)
+	compare = func(a reflect.Value, b reflect.Value) {
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if field.Anonymous {
+				compare(a.Field(i), b.Field(i))
+				continue
+			}
+			long := field.Tag.Get("long")
+			if long == "" || field.Tag.Get("no-ini") != "" {
+				continue
+			}
+			if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+				changed = append(changed, long)
+			}
+		}
+	}
+	compare(reflect.ValueOf(*old), reflect.ValueOf(*next))
+	sort.Strings(changed)
+	return changed
+}
+
+// reloader applies the changes of the live options to the running guardian,
+// whose current options are opts, and reports the others.
+type reloader struct {
+	ag       *guardianagent.Agent
+	opts     *options
+	verifier *guardianagent.PolicyVerifier
+	audit    *guardianagent.AuditLog
+	sinks    map[string]guardianagent.AuditSink
+}
+
+func (r *reloader) reload() (*guardianagent.ReloadReport, error) {
+	next, err := reparseOptions()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read configuration: %s", err)
+	}
+	report := &guardianagent.ReloadReport{}
+	changed := make(map[string]bool)
+	for _, option := range changedOptions(r.opts, next) {
+		if liveOptions[option] {
+			report.Applied = append(report.Applied, "--"+option)
+			changed[option] = true
+		} else {
+			report.RestartRequired = append(report.RestartRequired, "--"+option)
+		}
+	}
+
+	// Check what could fail before applying anything.
+	if changed["system-policy"] {
+		if _, err = guardianagent.LoadSystemPolicy(next.SystemPolicy, r.verifier); err != nil {
+			return nil, fmt.Errorf("Failed to load system policy: %s", err)
+		}
+	}
+	added := make(map[string]guardianagent.AuditSink)
+	if changed["audit-sink"] && r.audit != nil {
+		for _, spec := range next.AuditSinks {
+			if _, ok := r.sinks[spec]; ok {
+				continue
+			}
+			sink, err := guardianagent.NewAuditSink(spec)
+			if err != nil {
+				for _, sink := range added {
+					sink.Close()
+				}
+				return nil, err
+			}
+			added[spec] = sink
+		}
+	}
+
+	r.ag.Reconfigure(func() {
+		r.ag.SetApprovePipelines(next.ApprovePipelines)
+		if next.PolicyProgram == "" {
+			r.ag.SetPolicyProgram(nil)
+		} else {
+			r.ag.SetPolicyProgram(&guardianagent.PolicyProgram{
+				Command:  next.PolicyProgram,
+				Timeout:  next.PolicyProgramTimeout,
+				Fallback: next.PolicyProgramFallback,
+			})
+		}
+		if next.NetworkContext || next.ASNLookup {
+			r.ag.SetNetworkContext(next.ASNLookup)
+		} else {
+			r.ag.DisableNetworkContext()
+		}
+		if changed["dns-ttl"] || changed["dns-negative-ttl"] || changed["check-server-dns"] {
+			r.ag.SetDNS(next.DNSTTL, next.DNSNegativeTTL, next.CheckServerDNS)
+		}
+		r.ag.SetDenialMemory(next.RememberDenials)
+		r.ag.SetSystemPolicyDir(next.SystemPolicy)
+	})
+
+	if r.audit != nil {
+		keep := make(map[string]bool)
+		for _, spec := range next.AuditSinks {
+			keep[spec] = true
+		}
+		for spec, sink := range r.sinks {
+			if !keep[spec] {
+				if err := r.audit.RemoveSink(sink); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to close audit sink %s: %s\n", spec, err)
+				}
+				delete(r.sinks, spec)
+			}
+		}
+		for spec, sink := range added {
+			r.audit.AddSink(sink)
+			r.sinks[spec] = sink
+		}
+	}
+
+	r.opts.ApprovePipelines = next.ApprovePipelines
+	r.opts.PolicyProgram, r.opts.PolicyProgramTimeout, r.opts.PolicyProgramFallback = next.PolicyProgram, next.PolicyProgramTimeout, next.PolicyProgramFallback
+	r.opts.NetworkContext, r.opts.ASNLookup = next.NetworkContext, next.ASNLookup
+	r.opts.DNSTTL, r.opts.DNSNegativeTTL, r.opts.CheckServerDNS = next.DNSTTL, next.DNSNegativeTTL, next.CheckServerDNS
+	r.opts.RememberDenials = next.RememberDenials
+	r.opts.SystemPolicy = next.SystemPolicy
+	r.opts.AuditSinks = next.AuditSinks
+	return report, nil
+}
+
+func printReloadReport(report *guardianagent.ReloadReport) {
+	fmt.Fprintln(os.Stderr, "Reloaded configuration and policy")
+	if len(report.Applied) > 0 {
+		fmt.Fprintf(os.Stderr, "Applied: %s\n", strings.Join(report.Applied, " "))
+	}
+	if len(report.RestartRequired) > 0 {
+		fmt.Fprintf(os.Stderr, "Restart sga-guard to apply: %s\n", strings.Join(report.RestartRequired, " "))
+	}
+}
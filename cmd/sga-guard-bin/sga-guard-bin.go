@@ -1,13 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
 	"runtime"
-	"strings"
+	"syscall"
+	"time"
 
 	guardianagent "github.com/StanfordSNR/guardian-agent"
 	flags "github.com/jessevdk/go-flags"
@@ -22,14 +27,182 @@ type SSHCommand struct {
 type options struct {
 	guardianagent.CommonOptions
 
+	Config string `long:"config" env:"SGA_GUARD_CONFIG" no-ini:"true" description:"Config file setting any of the long options as <option> = <value> lines; options given on the command line override it" default:"$HOME/.ssh/sga_guard.conf"`
+
+	CheckConfig bool `long:"check-config" no-ini:"true" description:"Check the config file and the files and settings it refers to, then exit"`
+
+	PrintConfig bool `long:"print-config" no-ini:"true" description:"Print a config file with every option, its description and its current value, then exit"`
+
+	KnownHosts string `long:"known-hosts" description:"known_hosts file the keys of servers are checked against and added to" default:"$HOME/.ssh/known_hosts"`
+
 	SSHProgram string `long:"ssh" description:"ssh program to run when setting up session" default:"ssh"`
 
 	PolicyConfig string `long:"policy" description:"Policy config file" default:"$HOME/.ssh/sga_policy"`
 
+	SystemPolicy string `long:"system-policy" description:"Directory of read-only system policy files" default:"/etc/guardian-agent/policy.d"`
+
+	PolicySigners string `long:"policy-signers" description:"File of trusted keys (authorized_keys or allowed_signers format); if set, system policy files and packs must carry a valid <file>.sig signature"`
+
+	PolicySignature string `long:"policy-signature" description:"What to do with unsigned or tampered policy files when --policy-signers is set" choice:"require" choice:"warn" default:"require"`
+
+	PolicyURL string `long:"policy-url" description:"HTTPS URL of a centrally managed policy bundle, layered over the system policy"`
+
+	PolicyRefresh time.Duration `long:"policy-refresh" description:"Interval between checks for an updated policy bundle (0 to fetch only at startup)" default:"15m"`
+
+	PolicyCache string `long:"policy-cache" description:"Directory for the last known good policy bundle" default:"$HOME/.ssh/sga_policy_cache"`
+
+	LDAPURL string `long:"ldap-url" description:"LDAP server (e.g. ldaps://ldap.corp) to resolve the %group and +netgroup patterns of system policies from, with ldapsearch, instead of getent"`
+
+	LDAPBase string `long:"ldap-base" description:"Search base of --ldap-url"`
+
+	GroupCache time.Duration `long:"group-cache" description:"How long to cache directory groups used in policies" default:"5m"`
+
+	ApproverPAM string `long:"approver-pam" description:"Authenticate the approver with this PAM service (e.g. sga, or login) before honoring interactive approvals; requires pamtester"`
+
+	ApproverGrace time.Duration `long:"approver-grace" description:"Do not authenticate the approver again for this long after a successful authentication" default:"0"`
+
+	StepUp string `long:"step-up" description:"Require completing a push challenge before high-risk approvals are honored" choice:"duo" choice:"okta"`
+
+	StepUpFor []string `long:"step-up-for" description:"Kind of approval that requires the step-up: once, forever, any, batch or unusual (may be repeated; forever, any, batch and unusual by default)"`
+
+	StepUpUser string `long:"step-up-user" description:"Duo user name or Okta login of the approver (defaults to the local user name)"`
+
+	DuoHost string `long:"duo-host" description:"API hostname of the Duo Auth API application, whose integration and secret keys are in $SGA_DUO_IKEY and $SGA_DUO_SKEY"`
+
+	OktaOrg string `long:"okta-org" description:"URL of the Okta organization, whose API token is in $SGA_OKTA_TOKEN"`
+
+	PromptEscalation []string `long:"prompt-escalation" description:"When unanswered prompts of a risk tier ring and show an urgent notification, e.g. high:10s,1m (0 disables a step; may be repeated; normal:30s,2m and high:10s,1m by default)"`
+
+	PromptSound string `long:"prompt-sound" description:"Sound file played (with paplay, or afplay on macOS) instead of ringing the terminal bell for unanswered prompts"`
+
+	ScreenLock bool `long:"screen-lock" description:"Defer prompts while the desktop session is locked (logind on Linux, Quartz on macOS)"`
+
+	ScreenLockMaxWait time.Duration `long:"screen-lock-max-wait" description:"Deny requests whose prompt was deferred for this long by --screen-lock (0 to wait until unlocked)" default:"0"`
+
+	PushRelay string `long:"push-relay" description:"URL of a push relay through which prompts are also sent to mobile devices paired with sga-admin pair"`
+
+	PushTimeout time.Duration `long:"push-timeout" description:"Stop waiting for an answer from paired devices after this long" default:"5m"`
+
+	Team bool `long:"team" description:"Also show prompts to approvers attached with sga-admin attach, so that a team can share guard duty"`
+
+	ApproverWeb string `long:"approver-web" description:"Serve a web UI for approvers on host:port (implies --team)"`
+
+	ApproverWebUsers string `long:"approver-web-users" description:"htpasswd file of the web UI's approvers, with bcrypt hashes (htpasswd -B)"`
+
+	ApproverWebCert string `long:"approver-web-cert" description:"TLS certificate of the approver web UI"`
+
+	ApproverWebKey string `long:"approver-web-key" description:"TLS key of the approver web UI"`
+
+	ApproverSocket string `long:"approver-socket" description:"Unix socket through which other local users attach as approvers with sga-admin attach --approver-socket (implies --team)"`
+
+	ApproverSocketUsers []string `long:"approver-socket-user" description:"Local user, %group or +netgroup allowed to attach through --approver-socket (can be repeated; only yourself if unset)"`
+
+	ApproverKeys string `long:"approver-keys" description:"authorized_keys file of approvers logging in with an SSH key through --approver-socket, named by the comment of each key"`
+
+	MatrixHomeserver string `long:"matrix-homeserver" description:"URL of a Matrix homeserver through which prompts are also posted to --matrix-room, as the bot whose access token is in $SGA_MATRIX_TOKEN"`
+
+	MatrixRoom string `long:"matrix-room" description:"ID of the private, unencrypted Matrix room to post prompts to"`
+
+	MatrixApprovers []string `long:"matrix-approver" description:"Matrix user ID allowed to answer prompts (can be repeated; anyone in the room if unset)"`
+
+	TelegramChat string `long:"telegram-chat" description:"ID of a Telegram chat to which prompts are also posted, by the bot whose token is in $SGA_TELEGRAM_TOKEN"`
+
+	TelegramApprovers []string `long:"telegram-approver" description:"Telegram user name or ID allowed to answer prompts (can be repeated; anyone in the chat if unset)"`
+
+	ChatTimeout time.Duration `long:"chat-timeout" description:"Stop waiting for an answer in the Matrix or Telegram chat after this long" default:"10m"`
+
+	RememberDenials time.Duration `long:"remember-denials" description:"Deny repeated requests without prompting for this long after they were denied (e.g. 10m, 0 to disable)" default:"0"`
+
+	NetworkContext bool `long:"network-context" description:"Show the network location (address, private or public network) of the client and server in prompts and the audit log"`
+
+	ASNLookup bool `long:"asn-lookup" description:"Also show the AS and country of public addresses, looked up in the DNS of Team Cymru's IP to ASN service (implies --network-context)"`
+
+	ApprovePipelines bool `long:"approve-pipelines" description:"Approve pipelines and command lists (joined with |, &&, || or ;) if the policy allows each of their commands"`
+
+	PolicyProgram string `long:"policy-program" description:"Command (run with /bin/sh -c) deciding each request after the system policy's denials, given the request as JSON on stdin and answering {\"decision\": \"allow\", \"deny\" or \"ask\", \"reason\": ...} on stdout"`
+
+	PolicyProgramTimeout time.Duration `long:"policy-program-timeout" description:"Time --policy-program gets to decide" default:"2s"`
+
+	PolicyProgramFallback string `long:"policy-program-fallback" description:"Decision taken if --policy-program fails or times out" choice:"ask" choice:"deny" default:"ask"`
+
+	CheckServerDNS bool `long:"check-server-dns" description:"Warn in prompts about servers whose names do not resolve on this host"`
+
+	DNSTTL time.Duration `long:"dns-ttl" description:"Cache the resolution of server names for this long (0 to disable)" default:"1m"`
+
+	DNSNegativeTTL time.Duration `long:"dns-negative-ttl" description:"Cache failures to resolve server names for this long (0 to disable)" default:"10s"`
+
+	NTPServer string `long:"ntp-server" description:"Check the clock against this NTP server (e.g. pool.ntp.org) at startup and periodically, and warn while it is off"`
+
+	MaxClockSkew time.Duration `long:"max-clock-skew" description:"Clock skew tolerated by --ntp-server" default:"30s"`
+
+	ClockCheckInterval time.Duration `long:"clock-check-interval" description:"How often --ntp-server is queried" default:"1h"`
+
+	AgentPassthrough bool `long:"agent-passthrough" description:"Also act as an ssh-agent on the intermediary, asking to approve every signature"`
+
+	Listen []string `long:"listen" description:"Also accept requests on unix:<path>, tcp:<host:port>, systemd:<n>, fd:<n> or ssh:[user@]<jumphost>:<path>, with options ,client=<name>, ,tenant=<name> (serve it with the tenant's own policy and keys), ,ask, ,trusted or ,mode=<perm> (TCP and ssh listeners confirm every request unless trusted; may be repeated)"`
+
+	SessionMaxGoroutines int `long:"session-max-goroutines" description:"Terminate sessions served by more goroutines than this while they are proxied (0 for no limit)" default:"0"`
+
+	SessionMaxMemory int64 `long:"session-max-memory" description:"Bytes buffered for each session's streams, at least 786432 (0 for the default of 256 KiB per stream)" default:"0"`
+
+	SessionMaxBytes int64 `long:"session-max-bytes" description:"Terminate sessions relaying more bytes than this to and from the server before the handoff (0 for no limit)" default:"0"`
+
+	PromptQueue int `long:"prompt-queue" description:"Requests waiting for approval at once; further identical requests wait for the first one's answer (0 for no limit)" default:"32"`
+
+	PromptQueueOverflow string `long:"prompt-queue-overflow" description:"Request denied when --prompt-queue is full" choice:"oldest" choice:"newest" default:"oldest"`
+
+	NoForward bool `long:"no-forward" description:"Only serve the --listen listeners, without forwarding to an intermediary (which is then not given), e.g. when started by sga-supervisor"`
+
+	IdleExit time.Duration `long:"idle-exit" description:"Exit once no connection was served and no prompt shown for this long (0 to never exit)" default:"0"`
+
+	Noise bool `long:"noise" description:"Accept connections encrypted end to end to the guardian's key, which is printed, from clients given it with sga-ssh --guard-key"`
+
+	NoiseRequired bool `long:"noise-required" description:"Refuse connections which are not encrypted to the guardian's key (implies --noise)"`
+
+	AdminSocket string `long:"admin-socket" description:"Socket for the admin API used by sga-admin (defaults to a per-host socket in $XDG_RUNTIME_DIR or $HOME; \"none\" to disable)"`
+
+	AuditLog string `long:"audit-log" description:"Audit log file (empty to disable)" default:"$HOME/.ssh/sga_audit.log"`
+
+	AuditMaxSize int64 `long:"audit-max-size" description:"Rotate the audit log when it exceeds this many megabytes (0 to disable)" default:"10"`
+
+	AuditMaxAge time.Duration `long:"audit-max-age" description:"Rotate the audit log when it is older than this (e.g. 24h, 0 to disable)" default:"0"`
+
+	AuditRetention time.Duration `long:"audit-retention" description:"Delete rotated audit logs older than this (0 to keep forever)" default:"0"`
+
+	AuditKeep int `long:"audit-keep" description:"Maximum number of rotated audit logs to keep (0 for no limit)" default:"0"`
+
+	AuditCompress bool `long:"audit-compress" description:"Gzip rotated audit logs"`
+
+	AuditArchive string `long:"audit-archive" description:"Upload rotated audit logs and the audit public key to this object store, e.g. s3://bucket/prefix?sse=aws:kms&tag=retention=7y, gs://bucket/prefix or file:///mnt/evidence"`
+
+	RecordingRecipients []string `long:"recording-recipient" description:"Encrypt the session recordings the system policy requires to this recipient (see sga-audit keygen), e.g. your own, in addition to those of its record rules (may be repeated)"`
+
+	AuditSinks []string `long:"audit-sink" description:"Also export audit entries to a SIEM, e.g. cef+tcp://siem:514 or ecs+https://es:9200/sga/_bulk (may be repeated)"`
+
+	SMTPServer string `long:"smtp-server" description:"SMTP server (host:port) for email notifications"`
+
+	SMTPUser string `long:"smtp-user" description:"SMTP username (the password is read from $SGA_SMTP_PASSWORD)"`
+
+	EmailFrom string `long:"email-from" description:"Sender address of email notifications"`
+
+	EmailTo []string `long:"email-to" description:"Recipient of email notifications (may be repeated)"`
+
+	EmailAlertSeverity int `long:"email-alert-severity" description:"Immediately email audit events of at least this severity: 5 for denials, 6 for approvals of any command, 7 for errors (0 to disable)" default:"5"`
+
+	EmailDigest time.Duration `long:"email-digest" description:"Interval between emailed activity digests (0 to disable)" default:"24h"`
+
+	SlackWebhook string `long:"slack-webhook" description:"Slack incoming webhook URL to post decisions and errors to"`
+
+	Statsd string `long:"statsd" description:"statsd server (host:port) to count requests, decisions and errors in"`
+
+	StatsdPrefix string `long:"statsd-prefix" description:"Prefix of statsd metric names" default:"sga"`
+
 	RemoteStubName string `long:"stub" description:"Remote stub executable path" default:"$SHELL -l -c \"exec sga-stub\""`
 
 	PromptType string `long:"prompt" description:"Type of prompt to use." choice:"DISPLAY" choice:"TERMINAL" default:"DISPLAY"`
 
+	Quiet bool `long:"quiet" description:"Only show prompts, final decisions and alerts"`
+
 	SSHCommand SSHCommand `positional-args:"true" required:"true"`
 }
 
@@ -37,22 +210,24 @@ func main() {
 	var opts options
 	var parser = flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
 	var sshOptions []string
-	parser.UnknownOptionHandler = func(option string, arg flags.SplitArgument, args []string) ([]string, error) {
-		val, isSet := arg.Value()
-		sshFlagsWithValues := "bcDEeFIiLmOopQRWw"
-
-		if isSet {
-			sshOptions = append(sshOptions, fmt.Sprintf("-%s", option), val)
-		} else if strings.Contains(sshFlagsWithValues, option) {
-			sshOptions = append(sshOptions, fmt.Sprintf("-%s", option), args[0])
-			args = args[1:]
-		} else {
-			sshOptions = append(sshOptions, fmt.Sprintf("-%s", option))
-		}
-		return args, nil
-	}
+	parser.UnknownOptionHandler = sshOptionHandler(&sshOptions)
 
 	_, err := parser.Parse()
+	if !isHelp(err) {
+		if err := loadConfig(parser, &opts); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		// Options on the command line override the config file.
+		sshOptions = nil
+		_, err = parser.Parse()
+	}
+	// Without forwarding, there is no intermediary to name.
+	if opts.CheckConfig || opts.PrintConfig || opts.NoForward {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrRequired {
+			err = nil
+		}
+	}
 
 	if opts.Version {
 		fmt.Println(guardianagent.Version)
@@ -72,7 +247,22 @@ func main() {
 		os.Exit(255)
 	}
 
+	if opts.PrintConfig {
+		flags.NewIniParser(parser).Write(os.Stdout, flags.IniIncludeComments|flags.IniIncludeDefaults|flags.IniCommentDefaults)
+		os.Exit(0)
+	}
+	if opts.CheckConfig {
+		os.Exit(checkConfig(&opts))
+	}
+
 	readableName := opts.SSHCommand.UserHost
+	if opts.NoForward {
+		if len(opts.Listen) == 0 {
+			fmt.Fprintln(os.Stderr, "--no-forward requires --listen")
+			os.Exit(255)
+		}
+		readableName = "local"
+	}
 	if parser.FindOptionByShortName('l').IsSet() {
 		readableName = opts.Username + "@" + readableName
 		sshOptions = append(sshOptions, "-l", opts.Username)
@@ -95,22 +285,384 @@ func main() {
 	}
 
 	opts.PolicyConfig = os.ExpandEnv(opts.PolicyConfig)
+	guardianagent.SetKnownHostsFile(os.ExpandEnv(opts.KnownHosts))
+	var verifier *guardianagent.PolicyVerifier
+	if opts.PolicySigners != "" {
+		verifier, err = guardianagent.NewPolicyVerifier(os.ExpandEnv(opts.PolicySigners), opts.PolicySignature == "warn")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+	}
+	var groups guardianagent.GroupSource = guardianagent.GetentSource{}
+	if opts.LDAPURL != "" {
+		groups = &guardianagent.LDAPSource{URL: opts.LDAPURL, Base: opts.LDAPBase}
+	}
+	guardianagent.SetGroupResolver(guardianagent.NewGroupResolver(groups, opts.GroupCache))
+
 	var ag *guardianagent.Agent
 	if opts.PromptType == "DISPLAY" {
 		if (runtime.GOOS == "linux") && (os.Getenv("DISPLAY") == "") {
-			fmt.Fprintln(os.Stderr, `DISPLAY environment variable is not set. Using terminal for user prompts.`)
+			if !opts.Quiet {
+				fmt.Fprintln(os.Stderr, `DISPLAY environment variable is not set. Using terminal for user prompts.`)
+			}
 			opts.PromptType = "TERMINAL"
 		} else {
-			ag, err = guardianagent.NewGuardian(opts.PolicyConfig, guardianagent.Display)
+			ag, err = guardianagent.NewGuardian(opts.PolicyConfig, opts.SystemPolicy, verifier, guardianagent.Display)
 		}
 	}
 	if opts.PromptType == "TERMINAL" {
-		ag, err = guardianagent.NewGuardian(opts.PolicyConfig, guardianagent.Terminal)
+		ag, err = guardianagent.NewGuardian(opts.PolicyConfig, opts.SystemPolicy, verifier, guardianagent.Terminal)
 	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err)
 		os.Exit(255)
 	}
+
+	if opts.AgentPassthrough {
+		ag.SetAgentPassthrough(true)
+	}
+
+	ag.SetSessionLimits(guardianagent.SessionLimits{
+		MaxGoroutines: opts.SessionMaxGoroutines,
+		MaxMemory:     opts.SessionMaxMemory,
+		MaxBytes:      opts.SessionMaxBytes,
+	})
+	if err = ag.SetPromptQueue(opts.PromptQueue, opts.PromptQueueOverflow); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(255)
+	}
+	ag.SetApprovePipelines(opts.ApprovePipelines)
+	if opts.PolicyProgram != "" {
+		ag.SetPolicyProgram(&guardianagent.PolicyProgram{
+			Command:  opts.PolicyProgram,
+			Timeout:  opts.PolicyProgramTimeout,
+			Fallback: opts.PolicyProgramFallback,
+		})
+	}
+	ag.SetDNS(opts.DNSTTL, opts.DNSNegativeTTL, opts.CheckServerDNS)
+	if opts.NetworkContext || opts.ASNLookup {
+		ag.SetNetworkContext(opts.ASNLookup)
+	}
+
+	if opts.RememberDenials > 0 {
+		ag.SetDenialMemory(opts.RememberDenials)
+	}
+
+	escalation := make(map[string]guardianagent.Escalation)
+	for tier, esc := range guardianagent.DefaultEscalation {
+		escalation[tier] = esc
+	}
+	for _, spec := range opts.PromptEscalation {
+		tier, esc, err := guardianagent.ParseEscalation(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		escalation[tier] = esc
+	}
+	ag.SetPromptEscalation(escalation, opts.PromptSound)
+
+	if opts.ScreenLock {
+		ag.SetScreenLockAware(opts.ScreenLockMaxWait)
+	}
+
+	if opts.PushRelay != "" {
+		if err = ag.SetPushApprover(opts.PushRelay, opts.PushTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+	}
+
+	if opts.StepUp != "" {
+		login := opts.StepUpUser
+		if login == "" {
+			if u, err := user.Current(); err == nil {
+				login = u.Username
+			}
+		}
+		var factor guardianagent.StepUpFactor
+		if opts.StepUp == "duo" {
+			factor, err = guardianagent.NewDuoFactor(opts.DuoHost, os.Getenv("SGA_DUO_IKEY"), os.Getenv("SGA_DUO_SKEY"), login)
+		} else {
+			factor, err = guardianagent.NewOktaFactor(opts.OktaOrg, os.Getenv("SGA_OKTA_TOKEN"), login)
+		}
+		kinds := opts.StepUpFor
+		if len(kinds) == 0 {
+			kinds = guardianagent.DefaultStepUpKinds
+		}
+		if err == nil {
+			err = ag.SetStepUp(factor, kinds)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+	}
+
+	if opts.Team || opts.ApproverWeb != "" || opts.ApproverSocket != "" {
+		ag.SetTeamMode()
+	}
+
+	if opts.MatrixHomeserver != "" {
+		matrix, err := guardianagent.NewMatrixApprover(opts.MatrixHomeserver, opts.MatrixRoom, os.Getenv("SGA_MATRIX_TOKEN"), opts.MatrixApprovers, opts.ChatTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		ag.AddRemoteApprover(matrix)
+	}
+
+	if opts.TelegramChat != "" {
+		telegram, err := guardianagent.NewTelegramApprover(os.Getenv("SGA_TELEGRAM_TOKEN"), opts.TelegramChat, opts.TelegramApprovers, opts.ChatTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		ag.AddRemoteApprover(telegram)
+	}
+
+	if opts.ApproverPAM != "" {
+		if err = ag.SetApproverAuth(opts.ApproverPAM, opts.ApproverGrace); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+	}
+
+	var audit *guardianagent.AuditLog
+	auditSinks := make(map[string]guardianagent.AuditSink)
+	if opts.AuditLog != "" {
+		rotation := guardianagent.RotationPolicy{
+			MaxSize:   opts.AuditMaxSize * 1024 * 1024,
+			MaxAge:    opts.AuditMaxAge,
+			Retention: opts.AuditRetention,
+			MaxFiles:  opts.AuditKeep,
+			Compress:  opts.AuditCompress,
+		}
+		if opts.AuditArchive != "" {
+			if rotation.Archive, err = guardianagent.NewObjectStore(opts.AuditArchive); err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(255)
+			}
+		}
+		audit, err = guardianagent.OpenAuditLog(os.ExpandEnv(opts.AuditLog), rotation)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(255)
+		}
+		if rotation.Archive != nil {
+			// Verifiers need the public key to check the archived logs.
+			pubPath := os.ExpandEnv(opts.AuditLog) + ".pub"
+			if err = guardianagent.PutFile(rotation.Archive, filepath.Base(pubPath), pubPath); err != nil {
+				log.Printf("%s", err)
+			}
+		}
+		for _, spec := range opts.AuditSinks {
+			sink, err := guardianagent.NewAuditSink(spec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(255)
+			}
+			audit.AddSink(sink)
+			auditSinks[spec] = sink
+		}
+		if opts.SMTPServer != "" {
+			notifier, err := guardianagent.NewEmailNotifier(guardianagent.EmailConfig{
+				Server:         opts.SMTPServer,
+				From:           opts.EmailFrom,
+				To:             opts.EmailTo,
+				Username:       opts.SMTPUser,
+				Password:       os.Getenv("SGA_SMTP_PASSWORD"),
+				AlertSeverity:  opts.EmailAlertSeverity,
+				DigestInterval: opts.EmailDigest,
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(255)
+			}
+			audit.AddSink(notifier)
+		}
+		ag.SetAuditLog(audit)
+	}
+	if err = ag.SetRecordingRecipients(opts.RecordingRecipients); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(255)
+	}
+	if opts.Noise || opts.NoiseRequired {
+		key, err := ag.EnableNoise(opts.NoiseRequired)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		fmt.Fprintf(os.Stderr, "Guardian key: %s\n", key)
+	}
+	// After the audit log is set up, which records a skewed clock.
+	if opts.NTPServer != "" {
+		ag.SetClockCheck(opts.NTPServer, opts.MaxClockSkew, opts.ClockCheckInterval)
+	}
+	if opts.SlackWebhook != "" {
+		ag.AddHook(guardianagent.NewSlackHook(opts.SlackWebhook))
+	}
+	if opts.Statsd != "" {
+		hook, err := guardianagent.NewStatsdHook(opts.Statsd, opts.StatsdPrefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(255)
+		}
+		ag.AddHook(hook)
+	}
+	if opts.PolicyURL != "" {
+		remote, err := guardianagent.NewRemotePolicy(opts.PolicyURL, os.ExpandEnv(opts.PolicyCache), opts.PolicyRefresh, verifier)
+		if err == nil {
+			err = ag.SetRemotePolicy(remote)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(255)
+		}
+	}
+	var adminListener net.Listener
+	if opts.AdminSocket != "none" {
+		if opts.AdminSocket == "" {
+			opts.AdminSocket = guardianagent.AdminSocketPath(readableName)
+		}
+		opts.AdminSocket = os.ExpandEnv(opts.AdminSocket)
+		if conn, err := guardianagent.DialSocket(opts.AdminSocket); err == nil {
+			conn.Close()
+			fmt.Fprintf(os.Stderr, "Another guardian is using the admin socket %s\n", opts.AdminSocket)
+			os.Exit(255)
+		}
+		// Clean up after a guardian that did not exit cleanly.
+		os.Remove(opts.AdminSocket)
+		adminListener, _, err = guardianagent.CreateSocket(opts.AdminSocket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create admin socket: %s\n", err)
+			os.Exit(255)
+		}
+		go ag.ServeAdmin(adminListener)
+	}
+	var webListener net.Listener
+	if opts.ApproverWeb != "" {
+		users, err := guardianagent.LoadApproverUsers(os.ExpandEnv(opts.ApproverWebUsers))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		webListener, err = net.Listen("tcp", opts.ApproverWeb)
+		if err == nil && opts.ApproverWebCert != "" {
+			var cert tls.Certificate
+			cert, err = tls.LoadX509KeyPair(os.ExpandEnv(opts.ApproverWebCert), os.ExpandEnv(opts.ApproverWebKey))
+			if err == nil {
+				webListener = tls.NewListener(webListener, &tls.Config{Certificates: []tls.Certificate{cert}})
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to serve the approver web UI: %s\n", err)
+			os.Exit(255)
+		}
+		go ag.ServeApproverWeb(webListener, users)
+	}
+	var approverListener net.Listener
+	if opts.ApproverSocket != "" {
+		var keys *guardianagent.ApproverKeys
+		if opts.ApproverKeys != "" {
+			keys, err = guardianagent.LoadApproverKeys(os.ExpandEnv(opts.ApproverKeys))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(255)
+			}
+		}
+		opts.ApproverSocket = os.ExpandEnv(opts.ApproverSocket)
+		os.Remove(opts.ApproverSocket)
+		approverListener, _, err = guardianagent.CreateSocket(opts.ApproverSocket)
+		if err == nil {
+			// Approvers are identified by their UID or key, not by who can
+			// connect.
+			err = os.Chmod(opts.ApproverSocket, 0666)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create approver socket: %s\n", err)
+			os.Exit(255)
+		}
+		go ag.ServeApprovers(approverListener, keys, opts.ApproverSocketUsers)
+	}
+	var listeners []*guardianagent.Listener
+	for _, spec := range opts.Listen {
+		listener, err := guardianagent.ParseListener(os.ExpandEnv(spec))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(255)
+		}
+		if tunnel, ok := listener.Source.(*guardianagent.ReverseTunnel); ok {
+			tunnel.SSHProgram = opts.SSHProgram
+		}
+		if listener.Tenant != "" {
+			if _, err = ag.AddTenant(listener.Tenant); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(255)
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+	shutdown := func() {
+		if adminListener != nil {
+			adminListener.Close()
+		}
+		if webListener != nil {
+			webListener.Close()
+		}
+		if approverListener != nil {
+			approverListener.Close()
+		}
+		for _, listener := range listeners {
+			listener.Source.(net.Listener).Close()
+		}
+		ag.Close()
+	}
+
+	// Make sure the audit log ends with a signed checkpoint.
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		shutdown()
+		os.Exit(255)
+	}()
+
+	reload := &reloader{ag: ag, opts: &opts, verifier: verifier, audit: audit, sinks: auditSinks}
+	ag.SetReloader(reload.reload)
+	hupch := make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+	go func() {
+		for range hupch {
+			report, err := ag.Reload()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to reload: %s\n", err)
+				continue
+			}
+			printReloadReport(report)
+		}
+	}()
+
+	if opts.IdleExit > 0 {
+		go func() {
+			for range time.Tick(time.Second) {
+				if ag.Idle() >= opts.IdleExit {
+					log.Printf("Exiting after being idle for %s", opts.IdleExit)
+					shutdown()
+					os.Exit(0)
+				}
+			}
+		}()
+	}
+
+	if opts.NoForward {
+		err = ag.ListenAndServe(listeners...)
+		log.Printf("Error listening: %s", err)
+		shutdown()
+		os.Exit(255)
+	}
+
 	sshFwd := guardianagent.SSHFwd{
 		SSHProgram:         opts.SSHProgram,
 		SSHArgs:            sshOptions,
@@ -119,25 +671,20 @@ func main() {
 		RemoteStubName:     opts.RemoteStubName,
 	}
 
-	fmt.Printf("Connecting to %s to set up forwarding...\n", readableName)
+	if !opts.Quiet {
+		fmt.Printf("Connecting to %s to set up forwarding...\n", readableName)
+	}
 	if err = sshFwd.SetupForwarding(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err)
 		os.Exit(255)
 	}
 
-	fmt.Printf("Forwarding to %s setup successfully. Waiting for incoming requests...\n", readableName)
-
-	var c net.Conn
-	for {
-		c, err = sshFwd.Accept()
-		if err != nil {
-			log.Printf("Error forwarding: %s", err)
-			os.Exit(255)
-		}
-		go func() {
-			if err = ag.HandleConnection(c); err != nil {
-				log.Printf("Error forwarding: %s", err)
-			}
-		}()
+	if !opts.Quiet {
+		fmt.Printf("Forwarding to %s setup successfully. Waiting for incoming requests...\n", readableName)
 	}
+
+	err = ag.ListenAndServe(append(listeners, &guardianagent.Listener{Name: readableName, Source: &sshFwd})...)
+	log.Printf("Error forwarding: %s", err)
+	shutdown()
+	os.Exit(255)
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	flags "github.com/jessevdk/go-flags"
+)
+
+type options struct {
+	Recursive bool `short:"r" description:"Recursively copy entire directories"`
+
+	Preserve bool `short:"p" description:"Preserve modification times, access times, and modes"`
+
+	Quiet bool `short:"q" description:"Disable the progress meter and the list of requested transfers"`
+
+	Port string `short:"P" description:"Port to connect to on the remote host"`
+
+	Limit string `short:"l" description:"Limit the used bandwidth, in Kbit/s"`
+
+	SSHOptions []string `short:"o" description:"SSH Options (as supported by sga-ssh)"`
+
+	SSHProgram string `long:"ssh" env:"SGA_SSH" description:"The guardian-aware ssh program scp runs" default:"sga-ssh"`
+
+	SCPProgram string `long:"scp" description:"The scp program" default:"scp"`
+}
+
+func main() {
+	var opts options
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.Usage = "[OPTIONS] source ... target"
+	args, err := parser.Parse()
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			fmt.Println(flagsErr.Message)
+			os.Exit(0)
+		}
+		fail(err)
+	}
+	if len(args) < 2 {
+		fail(fmt.Errorf("expected a source and a target"))
+	}
+
+	transfers, err := requestedTransfers(args[:len(args)-1], args[len(args)-1])
+	if err != nil {
+		fail(err)
+	}
+	if !opts.Quiet {
+		for _, transfer := range transfers {
+			fmt.Fprintf(os.Stderr, "%s: requesting approval for %s\n", os.Args[0], transfer)
+		}
+	}
+
+	scpArgs := []string{"-S", opts.SSHProgram}
+	if usesSFTPByDefault(opts.SCPProgram) {
+		scpArgs = append(scpArgs, "-O")
+	}
+	if opts.Recursive {
+		scpArgs = append(scpArgs, "-r")
+	}
+	if opts.Preserve {
+		scpArgs = append(scpArgs, "-p")
+	}
+	if opts.Quiet {
+		scpArgs = append(scpArgs, "-q")
+	}
+	if opts.Port != "" {
+		scpArgs = append(scpArgs, "-P", opts.Port)
+	}
+	if opts.Limit != "" {
+		scpArgs = append(scpArgs, "-l", opts.Limit)
+	}
+	for _, sshOption := range opts.SSHOptions {
+		scpArgs = append(scpArgs, "-o", sshOption)
+	}
+	scp := exec.Command(opts.SCPProgram, append(append(scpArgs, "--"), args...)...)
+	scp.Stdin = os.Stdin
+	scp.Stdout = os.Stdout
+	scp.Stderr = os.Stderr
+	err = scp.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		os.Exit(ee.ExitCode())
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// requestedTransfers describes the execution requests the copy makes: a
+// download from each remote source, or an upload of all sources to a remote
+// target.
+func requestedTransfers(sources []string, target string) ([]string, error) {
+	var transfers []string
+	to, upload := guardianagent.ParseSCPOperand(target)
+	for _, source := range sources {
+		from, ok := guardianagent.ParseSCPOperand(source)
+		if !ok {
+			continue
+		}
+		if upload {
+			return nil, fmt.Errorf("copies between remote hosts are not supported through the guardian; copy through this host instead")
+		}
+		scp := guardianagent.SCPCommand{Direction: guardianagent.TransferDownload, Path: from.Path}
+		transfers = append(transfers, fmt.Sprintf("%s on %s", scp.Transfer(), from.UserHost))
+	}
+	if upload {
+		scp := guardianagent.SCPCommand{Direction: guardianagent.TransferUpload, Path: to.Path}
+		transfers = append(transfers, fmt.Sprintf("%s on %s", scp.Transfer(), to.UserHost))
+	}
+	return transfers, nil
+}
+
+// usesSFTPByDefault reports whether scp supports -O, i.e. whether it is
+// OpenSSH 9.0 or later, which use the SFTP protocol unless told otherwise.
+// The guardian only recognizes transfers with the original scp protocol.
+func usesSFTPByDefault(program string) bool {
+	out, _ := exec.Command(program, "-O").CombinedOutput()
+	return len(out) > 0 && !bytes.Contains(out, []byte("option -- "))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], strings.TrimSpace(err.Error()))
+	os.Exit(255)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	flags "github.com/jessevdk/go-flags"
+)
+
+type options struct {
+	BatchFile string `short:"b" description:"Read commands from this file instead of stdin"`
+
+	Recursive bool `short:"r" description:"Recursively copy entire directories"`
+
+	Preserve bool `short:"p" description:"Preserve modification times, access times, and modes"`
+
+	Quiet bool `short:"q" description:"Disable the progress meter"`
+
+	Port string `short:"P" description:"Port to connect to on the remote host"`
+
+	Limit string `short:"l" description:"Limit the used bandwidth, in Kbit/s"`
+
+	SSHOptions []string `short:"o" description:"SSH Options (as supported by sga-ssh)"`
+
+	Server string `long:"server" env:"SGA_SFTP_SERVER" description:"Path of the sftp server on the remote host, which is run as a command"`
+
+	SSHProgram string `long:"ssh" env:"SGA_SSH" description:"The guardian-aware ssh program sftp runs" default:"sga-ssh"`
+
+	SFTPProgram string `long:"sftp" description:"The sftp program" default:"sftp"`
+
+	Destination struct {
+		Destination string `positional-arg-name:"[user@]host[:path]"`
+	} `positional-args:"true" required:"true"`
+}
+
+func main() {
+	var opts options
+	opts.Server = guardianagent.DefaultSFTPServer
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			fmt.Println(flagsErr.Message)
+			os.Exit(0)
+		}
+		fail(err)
+	}
+	// sftp requests the server as a subsystem unless given its path, and
+	// subsystems cannot be run through the guardian.
+	if !guardianagent.ParseSFTPCommand(opts.Server) {
+		fail(fmt.Errorf("--server must be the path of an sftp-server executable"))
+	}
+
+	destination := opts.Destination.Destination
+	if !opts.Quiet {
+		host := strings.SplitN(destination, ":", 2)[0]
+		if remote, ok := guardianagent.ParseSCPOperand(destination); ok {
+			host = remote.UserHost
+		}
+		fmt.Fprintf(os.Stderr, "%s: requesting approval for an SFTP session on %s\n", os.Args[0], host)
+	}
+
+	sftpArgs := []string{"-S", opts.SSHProgram, "-s", opts.Server}
+	if opts.BatchFile != "" {
+		sftpArgs = append(sftpArgs, "-b", opts.BatchFile)
+	}
+	if opts.Recursive {
+		sftpArgs = append(sftpArgs, "-r")
+	}
+	if opts.Preserve {
+		sftpArgs = append(sftpArgs, "-p")
+	}
+	if opts.Quiet {
+		sftpArgs = append(sftpArgs, "-q")
+	}
+	if opts.Port != "" {
+		sftpArgs = append(sftpArgs, "-P", opts.Port)
+	}
+	if opts.Limit != "" {
+		sftpArgs = append(sftpArgs, "-l", opts.Limit)
+	}
+	for _, sshOption := range opts.SSHOptions {
+		sftpArgs = append(sftpArgs, "-o", sshOption)
+	}
+	sftp := exec.Command(opts.SFTPProgram, append(sftpArgs, "--", destination)...)
+	sftp.Stdin = os.Stdin
+	sftp.Stdout = os.Stdout
+	sftp.Stderr = os.Stderr
+	err := sftp.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		os.Exit(ee.ExitCode())
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], strings.TrimSpace(err.Error()))
+	os.Exit(255)
+}
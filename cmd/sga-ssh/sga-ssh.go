@@ -9,8 +9,10 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
@@ -39,10 +41,56 @@ type options struct {
 	// Flags provided for compatibility with SCP (supporting only default values)
 	DisableXForwarding bool `short:"x" hidden:"true"`
 
+	Quiet bool `short:"q" hidden:"true"`
+
+	// Passed by sftp when it runs the sftp subsystem, which sga-sftp avoids.
+	Subsystem bool `short:"s" hidden:"true"`
+
 	// Flags provided for compatibility with Mosh (supporting only default values)
 	ControlPath string `short:"S" hidden:"true" default:"none" choice:"none"`
 
 	SSHOptions []string `short:"o" description:"SSH Options (partially supported)"`
+
+	ApprovalToken string `long:"approval-token" env:"SGA_APPROVAL_TOKEN" description:"One-time approval token issued by the guardian (sga-admin token)"`
+
+	Invitation string `long:"invitation" env:"SGA_INVITATION" description:"Invitation file issued by the guardian (sga-admin invite); by default, a matching invitation in ~/.ssh/sga_invitations is presented"`
+
+	Reason string `long:"reason" env:"SGA_REASON" description:"Reason for running the command (e.g. a ticket ID), shown to the approver"`
+
+	WorkingDir string `long:"workdir" env:"SGA_WORKDIR" description:"Directory on the server the command is intended to run in, shown to the approver"`
+
+	Batch string `long:"batch" env:"SGA_BATCH" description:"Batch ID (e.g. a hash of the inventory) of a run across many hosts, which can be approved as a whole"`
+
+	BatchGroup string `long:"batch-group" env:"SGA_BATCH_GROUP" description:"Host tag of the group the batch runs on"`
+
+	BatchSize int `long:"batch-size" env:"SGA_BATCH_SIZE" description:"Number of hosts the batch runs on"`
+
+	GitRun string `long:"git-run" env:"SGA_GIT_RUN" description:"ID of the git command the connection belongs to (set by sga-git-ssh), whose other connections can be approved along with the first"`
+
+	Record string `long:"record" env:"SGA_RECORD" description:"Record the session's output to this directory (e.g. ~/.ssh/sga_recordings) as an asciicast, for sga-audit replay or asciinema"`
+
+	RecordRecipients []string `long:"record-recipient" env:"SGA_RECORD_RECIPIENTS" env-delim:"," description:"Encrypt recordings to this recipient (see sga-audit keygen); it takes the keys of all recipients to read them (may be repeated)"`
+
+	RecordUpload string `long:"record-upload" env:"SGA_RECORD_UPLOAD" description:"Also upload recordings to this object store, e.g. s3://bucket/prefix?sse=aws:kms, gs://bucket/prefix or file:///mnt/evidence"`
+
+	GuardKey string `long:"guard-key" env:"SGA_GUARD_KEY" description:"Public key of the guardian (as printed by sga-guard --noise), to encrypt the connection to it end to end"`
+
+	ConnectTimeout time.Duration `long:"connect-timeout" env:"SGA_CONNECT_TIMEOUT" description:"Timeout of each attempt to connect to the server (also -o ConnectTimeout=<seconds>; 0 for none)" default:"15s"`
+
+	BannerTimeout time.Duration `long:"banner-timeout" env:"SGA_BANNER_TIMEOUT" description:"Timeout of waiting for the server to identify itself once connected (0 for none)" default:"15s"`
+
+	ConnectAttempts int `long:"connect-attempts" env:"SGA_CONNECT_ATTEMPTS" description:"Attempts to connect to the server, with exponential backoff (also -o ConnectionAttempts=<n>)" default:"3"`
+}
+
+// Options passed by scp and sftp, with the only values supported.
+var compatOptions = map[string]string{
+	"forwardagent":        "no",
+	"permitlocalcommand":  "no",
+	"clearallforwardings": "yes",
+	"remotecommand":       "none",
+	"requesttty":          "no",
+	"forwardx11":          "no",
+	"controlmaster":       "no",
 }
 
 func main() {
@@ -72,35 +120,71 @@ func main() {
 		os.Exit(255)
 	}
 
+	if opts.Subsystem {
+		fmt.Fprintf(os.Stderr, "%s: subsystems cannot be run through the guardian; use sga-sftp for sftp\n", os.Args[0])
+		os.Exit(255)
+	}
+
 	var proxyCommand string
+	var resolveOptions []string
 	for _, sshOption := range opts.SSHOptions {
-		parts := strings.SplitN(sshOption, "=", 2)
-		// These flags are supported for compatibility with SCP, but only default values are permitted.
-		if parts[0] == "ForwardAgent" || parts[0] == "PermitLocalCommand" {
-			if len(parts) < 2 || strings.ToLower(parts[1]) != "no" {
-				fmt.Fprintf(os.Stderr, "%s: unsupported option: %s", os.Args[0], strings.Join(parts, "="))
-				os.Exit(255)
+		// As with ssh, the value may follow an "=" or whitespace
+		// (e.g. sftp passes "-oForwardX11 no").
+		parts := strings.SplitN(strings.TrimSpace(sshOption), "=", 2)
+		if len(parts) == 1 {
+			parts = strings.Fields(sshOption)
+			if len(parts) > 2 {
+				parts = []string{parts[0], strings.Join(parts[1:], " ")}
 			}
-			continue
+		}
+		keyword := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
 		}
 
-		if parts[0] == "ClearAllForwardings" {
-			if len(parts) > 1 && strings.ToLower(parts[1]) != "yes" {
-				fmt.Fprintf(os.Stderr, "%s: unsupported option: %s", os.Args[0], strings.Join(parts, "="))
+		switch keyword {
+		case "proxycommand":
+			proxyCommand = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: invalid port: %s\n", os.Args[0], value)
 				os.Exit(255)
 			}
-			continue
-		}
-
-		if parts[0] == "ProxyCommand" {
-			if len(parts) == 2 {
-				proxyCommand = parts[1]
+			opts.Port = port
+			resolveOptions = append(resolveOptions, "-o", "Port="+value)
+		case "user":
+			opts.Username = value
+			resolveOptions = append(resolveOptions, "-o", "User="+value)
+		case "connecttimeout":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: invalid connect timeout: %s\n", os.Args[0], value)
+				os.Exit(255)
+			}
+			opts.ConnectTimeout = time.Duration(seconds) * time.Second
+		case "connectionattempts":
+			attempts, err := strconv.Atoi(value)
+			if err != nil || attempts < 1 {
+				fmt.Fprintf(os.Stderr, "%s: invalid connection attempts: %s\n", os.Args[0], value)
+				os.Exit(255)
+			}
+			opts.ConnectAttempts = attempts
+		case "batchmode":
+			// Approvals are never asked for on the intermediary.
+		case "sendenv":
+			// git passes SendEnv=GIT_PROTOCOL; without it, servers fall back
+			// to protocol version 0.
+		default:
+			// These options are supported for compatibility with scp and
+			// sftp, but only default values are permitted.
+			want, ok := compatOptions[keyword]
+			if !ok || (value == "" && keyword != "clearallforwardings") || (value != "" && !strings.EqualFold(value, want)) {
+				fmt.Fprintf(os.Stderr, "%s: unsupported option: %s\n", os.Args[0], sshOption)
+				os.Exit(255)
 			}
-			continue
 		}
-
-		fmt.Fprintf(os.Stderr, "%s: unsupported option: %s", os.Args[0], sshOption)
-		os.Exit(255)
 	}
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -120,7 +204,7 @@ func main() {
 	}
 
 	var host string
-	host, opts.Port, opts.Username = resolveRemote(parser, &opts, opts.SSHCommand.UserHost)
+	host, opts.Port, opts.Username = resolveRemote(parser, &opts, opts.SSHCommand.UserHost, resolveOptions)
 
 	var cmd string
 	if len(opts.SSHCommand.Rest) > 0 {
@@ -138,6 +222,42 @@ func main() {
 		ProxyCommand: proxyCommand,
 		ForceTty:     len(opts.ForceTTY) == 2,
 		StdinNull:    opts.StdinNull,
+
+		ApprovalToken: opts.ApprovalToken,
+		Invitation:    findInvitation(opts.Invitation, opts.Username, fmt.Sprintf("%s:%d", host, opts.Port), cmd),
+		Reason:        opts.Reason,
+		WorkingDir:    opts.WorkingDir,
+		Batch:         opts.Batch,
+		BatchGroup:    opts.BatchGroup,
+		BatchSize:     opts.BatchSize,
+		GitRun:        opts.GitRun,
+		RecordDir:     os.ExpandEnv(opts.Record),
+
+		RecordRecipients: opts.RecordRecipients,
+		GuardKey:         opts.GuardKey,
+		Connect: guardianagent.ConnectOptions{
+			Timeout:       opts.ConnectTimeout,
+			BannerTimeout: opts.BannerTimeout,
+			Attempts:      opts.ConnectAttempts,
+		},
+	}
+	if opts.GuardKey != "" {
+		if _, err = guardianagent.ParseNoisePublicKey(opts.GuardKey); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+			os.Exit(255)
+		}
+	}
+	for _, recipient := range opts.RecordRecipients {
+		if _, err = guardianagent.ParseRecordingRecipient(recipient); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+			os.Exit(255)
+		}
+	}
+	if opts.RecordUpload != "" {
+		if sshCmd.RecordStore, err = guardianagent.NewObjectStore(opts.RecordUpload); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+			os.Exit(255)
+		}
 	}
 	err = guardianagent.RunSSHCommand(sshCmd)
 	if err == nil {
@@ -155,8 +275,34 @@ func main() {
 
 }
 
-func resolveRemote(parser *flags.Parser, opts *options, userAndHost string) (host string, port int, username string) {
-	sshCommandLine := []string{"-G", userAndHost}
+// findInvitation returns the token of the invitation in path, or of the
+// first installed invitation covering the request.
+func findInvitation(path string, user string, hostPort string, cmd string) string {
+	if path != "" {
+		file, err := guardianagent.LoadInvitationFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return ""
+		}
+		return file.Token
+	}
+	paths, _ := filepath.Glob(filepath.Join(guardianagent.InvitationsDir(), "*"))
+	for _, path := range paths {
+		file, err := guardianagent.LoadInvitationFile(path)
+		if err != nil {
+			log.Printf("%s", err)
+			continue
+		}
+		if file.Covers(user, hostPort, cmd) {
+			log.Printf("Presenting invitation %s", file.ID)
+			return file.Token
+		}
+	}
+	return ""
+}
+
+func resolveRemote(parser *flags.Parser, opts *options, userAndHost string, sshOptions []string) (host string, port int, username string) {
+	sshCommandLine := append([]string{"-G", userAndHost}, sshOptions...)
 	if !parser.FindOptionByLongName("port").IsSetDefault() {
 		sshCommandLine = append(sshCommandLine, fmt.Sprintf("-p %d", opts.Port))
 	}
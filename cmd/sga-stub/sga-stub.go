@@ -3,14 +3,100 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/StanfordSNR/guardian-agent"
+	flags "github.com/jessevdk/go-flags"
 )
 
+type options struct {
+	Debug bool `long:"debug" description:"Show debug information"`
+
+	GuardKey string `long:"guard-key" env:"SGA_GUARD_KEY" description:"Public key of the guardian, to encrypt the connection to it end to end"`
+
+	HostKey string `long:"host-key" description:"Host key presented to ssh in ProxyCommand mode (generated if missing)" default:"$HOME/.ssh/sga_proxy_host_key"`
+
+	Config string `long:"config" description:"ssh config deciding which hosts go through the guardian (SGAGuardian yes/no) and their ProxyJump" default:"$HOME/.ssh/config"`
+
+	OriginalHost string `long:"original-host" description:"The host as given to ssh (%n), which Host blocks of the ssh config match"`
+
+	User string `short:"l" long:"user" description:"The user ssh logs in as (%r), for Match user blocks of the ssh config"`
+
+	ConnectTimeout time.Duration `long:"connect-timeout" env:"SGA_CONNECT_TIMEOUT" description:"Timeout of each attempt to connect to the server (0 for none)" default:"15s"`
+
+	BannerTimeout time.Duration `long:"banner-timeout" env:"SGA_BANNER_TIMEOUT" description:"Timeout of waiting for the server to identify itself once connected (0 for none)" default:"15s"`
+
+	ConnectAttempts int `long:"connect-attempts" env:"SGA_CONNECT_ATTEMPTS" description:"Attempts to connect to the server, with exponential backoff" default:"3"`
+
+	Proxy struct {
+		Host string `positional-arg-name:"host"`
+		Port string `positional-arg-name:"port"`
+	} `positional-args:"true"`
+}
+
 func main() {
+	var opts options
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.Usage = "[OPTIONS] [host port]\n\nWith a host and port, run as the ProxyCommand of ssh, e.g.:\n  ProxyCommand sga-stub --original-host %n -l %r %h %p"
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			fmt.Println(flagsErr.Message)
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(255)
+	}
+	if opts.Proxy.Host == "" {
+		runStub()
+		return
+	}
+
+	if !opts.Debug {
+		log.SetOutput(ioutil.Discard)
+	}
+	port := opts.Proxy.Port
+	if port == "" {
+		port = "22"
+	}
+	config, err := guardianagent.LookupSSHConfig(os.ExpandEnv(opts.Config), guardianagent.SSHDestination{
+		Host:         opts.Proxy.Host,
+		OriginalHost: opts.OriginalHost,
+		Port:         port,
+		User:         opts.User,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(255)
+	}
+	err = guardianagent.RunProxyCommand(guardianagent.ProxyCommand{
+		HostPort:    net.JoinHostPort(opts.Proxy.Host, port),
+		GuardKey:    opts.GuardKey,
+		HostKeyPath: os.ExpandEnv(opts.HostKey),
+		Direct:      strings.EqualFold(config[guardianagent.SSHConfigGuardianKeyword], "no"),
+		ProxyJump:   config["proxyjump"],
+		Connect: guardianagent.ConnectOptions{
+			Timeout:       opts.ConnectTimeout,
+			BannerTimeout: opts.BannerTimeout,
+			Attempts:      opts.ConnectAttempts,
+		},
+		In:  os.Stdin,
+		Out: os.Stdout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(255)
+	}
+}
+
+// runStub links the socket forwarded by sga-guard to the permanent location
+// clients look for it at.
+func runStub() {
 	tempSocket := path.Join(guardianagent.UserTempDir(), fmt.Sprintf("guard.%d", os.Getpid()))
 	defer os.Remove(tempSocket)
 	_, err := fmt.Println(tempSocket)
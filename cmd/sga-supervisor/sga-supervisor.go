@@ -0,0 +1,88 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	guardianagent "github.com/StanfordSNR/guardian-agent"
+	flags "github.com/jessevdk/go-flags"
+)
+
+type options struct {
+	Version bool `long:"version" short:"V" description:"Display the version number and exit"`
+
+	Debug bool `long:"debug" description:"Show debug information"`
+
+	Program string `long:"guard-program" description:"Guardian program run for each user" default:"sga-guard-bin"`
+
+	GuardArgs []string `long:"guard-arg" description:"Argument given to every guardian, e.g. --prompt=DISPLAY, in addition to the user's own config file (may be repeated)"`
+
+	Env []string `long:"env" description:"Variable (NAME=value) added to the environment of every guardian, e.g. DISPLAY=:0 (may be repeated)"`
+
+	RuntimeBase string `long:"runtime-base" description:"Directory of the users' runtime directories, named by UID; a guardian is supervised while the user's exists" default:"/run/user"`
+
+	Users []string `long:"user" description:"User, %group or +netgroup a guardian is run for (may be repeated; every user from --min-uid on if unset)"`
+
+	MinUID int `long:"min-uid" description:"Lowest UID a guardian is run for when no --user is given" default:"1000"`
+
+	IdleExit time.Duration `long:"idle-exit" description:"Stop a guardian once it was idle for this long; it is started again on the next request (0 to keep it running until logout)" default:"30m"`
+
+	ScanInterval time.Duration `long:"scan-interval" description:"How often logins and logouts are checked for" default:"5s"`
+}
+
+func main() {
+	var opts options
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	_, err := parser.Parse()
+	if opts.Version {
+		fmt.Println(guardianagent.Version)
+		os.Exit(0)
+	}
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			fmt.Println(flagsErr.Message)
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(255)
+	}
+
+	log.SetFlags(log.LstdFlags)
+	if !opts.Debug {
+		log.SetOutput(ioutil.Discard)
+	}
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "sga-supervisor must run as root to start guardians as each user")
+		os.Exit(255)
+	}
+
+	sup := &guardianagent.Supervisor{
+		Program:      opts.Program,
+		Args:         opts.GuardArgs,
+		Env:          opts.Env,
+		RuntimeBase:  opts.RuntimeBase,
+		Users:        opts.Users,
+		MinUID:       opts.MinUID,
+		IdleExit:     opts.IdleExit,
+		ScanInterval: opts.ScanInterval,
+	}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		sup.Stop()
+		os.Exit(0)
+	}()
+	if err = sup.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(255)
+	}
+}
@@ -0,0 +1,177 @@
+package guardianagent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Stored approvals may be command templates, in which whole shell words are
+// placeholders such as {{select}}, matching any value of their type: e.g.
+// `psql -h db1 -c "{{select}}"` allows every read-only query of db1, and
+// still prompts for other statements. Commands matched against templates may
+// not contain substitutions, redirections, globs or further commands, so that
+// what the placeholders match is all the command may vary in.
+var placeholderTypes = map[string]func(string) bool{
+	// A single SQL SELECT query of a grammar without function calls, which
+	// cannot write (see isReadOnlySelect).
+	"select": isReadOnlySelect,
+
+	// A non-negative integer.
+	"int": regexp.MustCompile(`^[0-9]+$`).MatchString,
+
+	// A name, such as a host, database or branch name, which is not an
+	// option.
+	"word": regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@:-]*$`).MatchString,
+
+	// A relative or absolute path without "..", which is not an option.
+	"path": func(s string) bool {
+		return pathSyntax.MatchString(s) && !containsString(strings.Split(s, "/"), "..")
+	},
+}
+
+var (
+	placeholderSyntax = regexp.MustCompile(`^\{\{([a-z]+)\}\}$`)
+	pathSyntax        = regexp.MustCompile(`^[A-Za-z0-9_./][A-Za-z0-9_./@:-]*$`)
+)
+
+// shellWord is a word of a command, unquoted, and where it is in the command.
+type shellWord struct {
+	value      string
+	start, end int
+}
+
+// splitShellWords splits cmd into its words, honoring quotes and backslashes.
+// It fails if cmd contains anything but words: substitutions, redirections,
+// globs, brace expansions (unless braces are allowed, for templates), or
+// further commands.
+func splitShellWords(cmd string, braces bool) ([]shellWord, bool) {
+	var words []shellWord
+	var word *shellWord
+	var quote byte
+	add := func(i int, s string) {
+		if word == nil {
+			words = append(words, shellWord{start: i})
+			word = &words[len(words)-1]
+		}
+		word.value += s
+		word.end = i + 1
+	}
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+				word.end = i + 1
+			} else {
+				add(i, string(c))
+			}
+		case quote == '"':
+			switch {
+			case c == '"':
+				quote = 0
+				word.end = i + 1
+			case c == '$' || c == '`':
+				return nil, false
+			case c == '\\' && i+1 < len(cmd) && strings.IndexByte("$`\"\\", cmd[i+1]) >= 0:
+				add(i+1, string(cmd[i+1]))
+				i++
+			default:
+				add(i, string(c))
+			}
+		case c == ' ' || c == '\t':
+			word = nil
+		case c == '\'' || c == '"':
+			quote = c
+			add(i, "")
+		case c == '\\':
+			if i+1 >= len(cmd) || cmd[i+1] == '\n' {
+				return nil, false
+			}
+			add(i+1, string(cmd[i+1]))
+			i++
+		case (c == '{' || c == '}') && braces:
+			add(i, string(c))
+		case strings.IndexByte("\n;|&<>()$`*?[]{}~#!", c) >= 0:
+			return nil, false
+		default:
+			add(i, string(c))
+		}
+	}
+	if quote != 0 {
+		return nil, false
+	}
+	return words, true
+}
+
+// isTemplate reports whether cmd has placeholders.
+func isTemplate(cmd string) bool {
+	words, ok := splitShellWords(cmd, true)
+	if !ok {
+		return false
+	}
+	for _, word := range words {
+		if placeholderType(word.value) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func placeholderType(word string) func(string) bool {
+	m := placeholderSyntax.FindStringSubmatch(word)
+	if m == nil {
+		return nil
+	}
+	return placeholderTypes[m[1]]
+}
+
+// matchTemplate reports whether cmd is an instance of template.
+func matchTemplate(template string, cmd string) bool {
+	templateWords, ok := splitShellWords(template, true)
+	if !ok {
+		return false
+	}
+	words, ok := splitShellWords(cmd, false)
+	if !ok || len(words) != len(templateWords) {
+		return false
+	}
+	for i, word := range words {
+		if valid := placeholderType(templateWords[i].value); valid != nil {
+			if !valid(word.value) {
+				return false
+			}
+		} else if word.value != templateWords[i].value {
+			return false
+		}
+	}
+	return true
+}
+
+// SuggestTemplate returns the template generalizing cmd to any read-only
+// query in place of its SELECT statements, or "" if cmd has none. Commands
+// with words looking like placeholders have none, so that they cannot add
+// placeholders of their own to the template.
+func SuggestTemplate(cmd string) string {
+	words, ok := splitShellWords(cmd, false)
+	if !ok {
+		return ""
+	}
+	for _, word := range words {
+		if placeholderSyntax.MatchString(word.value) {
+			return ""
+		}
+	}
+	template := ""
+	last := 0
+	for _, word := range words {
+		if isReadOnlySelect(word.value) {
+			template += cmd[last:word.start] + `"{{select}}"`
+			last = word.end
+		}
+	}
+	if last == 0 {
+		return ""
+	}
+	return template + cmd[last:]
+}
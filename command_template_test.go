@@ -0,0 +1,94 @@
+package guardianagent
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		cmd      string
+		want     bool
+	}{
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c "SELECT id FROM users"`, true},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c 'select 1'`, true},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c "DELETE FROM users"`, false},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db2 -c "select 1"`, false},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c "select 1" -o /tmp/out`, false},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c "select 1" > /tmp/out`, false},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c "$(rm -rf ~)"`, false},
+		{`psql -h db1 -c "{{select}}"`, `psql -h db1 -c "select 1"; reboot`, false},
+		{`tail -n {{int}} /var/log/syslog`, `tail -n 100 /var/log/syslog`, true},
+		{`tail -n {{int}} /var/log/syslog`, `tail -n -1 /var/log/syslog`, false},
+		{`git checkout {{word}}`, `git checkout main`, true},
+		{`git checkout {{word}}`, `git checkout --force`, false},
+		{`cat {{path}}`, `cat logs/app.log`, true},
+		{`cat {{path}}`, `cat ../../etc/shadow`, false},
+		{`cat {{path}}`, `cat *`, false},
+		{`cat {{path}}`, `cat -A /etc/shadow`, false},
+		{`cat {{unknown}}`, `cat x`, false},
+	}
+	for _, test := range tests {
+		if got := matchTemplate(test.template, test.cmd); got != test.want {
+			t.Errorf("matchTemplate(%q, %q) = %v, want %v", test.template, test.cmd, got, test.want)
+		}
+	}
+}
+
+func TestSuggestTemplate(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`psql -h db1 -c "select id from users"`, `psql -h db1 -c "{{select}}"`},
+		{`psql -h db1 -c 'select 1' -c 'select 2'`, `psql -h db1 -c "{{select}}" -c "{{select}}"`},
+		{`psql -h db1 -c "delete from users"`, ""},
+		{`psql -h db1 -c "select count(*) from users"`, ""},
+		{`psql -h db1 -c "select 1" "{{path}}"`, ""},
+		{`psql -h db1 -c "select 1" > out`, ""},
+	}
+	for _, test := range tests {
+		if got := SuggestTemplate(test.cmd); got != test.want {
+			t.Errorf("SuggestTemplate(%q) = %q, want %q", test.cmd, got, test.want)
+		}
+	}
+}
+
+func TestStoredCommandsAreNotTemplates(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "policy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := Scope{Client: "me@laptop", ServiceUsername: "app", ServiceHostname: "db1:22"}
+	origin := RuleOrigin{Added: time.Now(), Via: "terminal"}
+	if err = store.AllowCommand(scope, `cat "{{path}}"`, origin); err != nil {
+		t.Fatal(err)
+	}
+	if store.IsAllowed(scope, "cat /etc/shadow") {
+		t.Errorf("a command approved as is was matched as a template")
+	}
+	if !store.IsAllowed(scope, `cat "{{path}}"`) {
+		t.Errorf("a command approved as is was not allowed")
+	}
+
+	if err = store.AllowTemplate(scope, `psql -c "{{select}}"`, origin); err != nil {
+		t.Fatal(err)
+	}
+	if !store.IsAllowed(scope, `psql -c "select 1"`) {
+		t.Errorf("an instance of a stored template was not allowed")
+	}
+	if err = store.AllowTemplate(scope, "psql -l", origin); err == nil {
+		t.Errorf("a template without placeholders was stored")
+	}
+
+	// Templates survive saving and loading the policy, as templates.
+	loaded, err := NewStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.IsAllowed(scope, `psql -c "select 1"`) || loaded.IsAllowed(scope, "cat /etc/shadow") {
+		t.Errorf("templates were not stored apart from commands")
+	}
+}
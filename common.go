@@ -48,25 +48,54 @@ type AgentForwardingNoticeMsg struct {
 	Client string
 }
 
+// MsgNoiseHandshake carries the messages of the handshake of an encrypted
+// control channel, see DialNoise. It is numbered like
+// MsgAgentForwardingNotice, out of the range of the ssh-agent messages the
+// control channel also carries.
+const MsgNoiseHandshake = 207
+
 const MsgExecutionRequest = 1
 const MsgExecutionDenied = 2
 const MsgExecutionApproved = 3
+
+// MsgExecutionPending is sent periodically (with an empty payload) while a
+// decision is pending, to keep the control channel from being dropped as
+// idle. It is only sent to clients that set a request ID in their metadata.
+const MsgExecutionPending = 4
 const MsgHandoffComplete = 10
 const MsgHandoffFailed = 11
 
+// MsgSessionRecorded reports the hash of a recording of a delegated session,
+// for the guardian to record in its audit log, once the session ended. It is
+// answered with MsgAgentSuccess.
+const MsgSessionRecorded = 12
+
 const MaxAgentPacketSize = 10 * 1024
 
 type ExecutionApprovedMessage struct {
+	// The command the client may run, which the approver may have modified.
+	Command string
+
+	// RequestMetadata echoing the request ID, only sent to clients which set
+	// one.
+	Metadata []byte `ssh:"rest"`
 }
 
 type ExecutionDeniedMessage struct {
 	Reason string
+
+	// As in ExecutionApprovedMessage.
+	Metadata []byte `ssh:"rest"`
 }
 
 type ExecutionRequestMessage struct {
 	User    string
 	Command string
 	Server  string
+
+	// Optional RequestMetadata. Clients only send it when needed, so that
+	// requests remain readable by older guardians.
+	Metadata []byte `ssh:"rest"`
 }
 
 type HandoffCompleteMessage struct {
@@ -77,6 +106,11 @@ type HandoffFailedMessage struct {
 	Msg string
 }
 
+type SessionRecordedMessage struct {
+	RequestID string
+	Hash      string
+}
+
 type CustomConn struct {
 	net.Conn
 	RemoteAddress net.Addr
@@ -238,13 +272,29 @@ func md5String(md5Sum [16]byte) string {
 	return md5Str
 }
 
+// known_hosts file of the host keys of servers, if not the user's.
+var knownHostsPath string
+
+// SetKnownHostsFile checks the keys of servers against, and adds them to,
+// the known_hosts file at path instead of ~/.ssh/known_hosts.
+func SetKnownHostsFile(path string) {
+	knownHostsPath = path
+}
+
+func knownHostsFile(curuser *user.User) string {
+	if knownHostsPath != "" {
+		return knownHostsPath
+	}
+	return path.Join(curuser.HomeDir, ".ssh", "known_hosts")
+}
+
 func HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey, ui UI) error {
 	curuser, err := user.Current()
 	if err != nil {
 		return fmt.Errorf("Failed to get current user: %s", err)
 	}
 	keyFingerprintStr := md5String(md5.Sum(key.Marshal()))
-	knownHostsPath := path.Join(curuser.HomeDir, ".ssh", "known_hosts")
+	knownHostsPath := knownHostsFile(curuser)
 	if kh, err := knownhosts.New(knownHostsPath); err == nil {
 		if err = kh(hostname, remote, key); err == nil {
 			return nil
@@ -255,12 +305,12 @@ func HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey, ui UI)
 		}
 
 		if kErr, ok := err.(*knownhosts.KeyError); ok && len(kErr.Want) > 0 {
-			ui.Alert(fmt.Sprintf(warningRemoteHostChanged, key.Type(), keyFingerprintStr, knownHostsPath))
+			ui.Alert(fmt.Sprintf(warningRemoteHostChanged, key.Type(), keyFingerprintStr, displayLine(knownHostsPath)))
 			return kErr
 		}
 	}
 
-	if ui.Confirm(fmt.Sprintf(promptToTrustHost, hostname, key.Type(), keyFingerprintStr)) {
+	if ui.Confirm(fmt.Sprintf(promptToTrustHost, displayLine(hostname), key.Type(), keyFingerprintStr)) {
 		return putHostKey(knownHostsPath, knownhosts.Normalize(hostname), key)
 	}
 
@@ -282,7 +332,7 @@ func getKeyFileAuth(keyPath string, ui UI) (ssh.Signer, error) {
 		Headers: p.Headers,
 	}
 	if x509.IsEncryptedPEMBlock(&pBlock) {
-		password, err := ui.AskPassword(fmt.Sprintf("Enter passphrase for key '%s':", keyPath))
+		password, err := ui.AskPassword(fmt.Sprintf("Enter passphrase for key '%s':", displayLine(keyPath)))
 		rawkey, err := ssh.ParsePrivateKeyWithPassphrase(buf, []byte(password))
 		if err != nil {
 			return nil, err
@@ -298,9 +348,7 @@ func getKeyFileAuth(keyPath string, ui UI) (ssh.Signer, error) {
 }
 
 func getAuth(username string, host string, homeDir string, ui UI) []ssh.AuthMethod {
-	passwordAuthMethod := ssh.PasswordCallback(func() (string, error) {
-		return ui.AskPassword(fmt.Sprintf("%s@%s password:", username, host))
-	})
+	passwordAuthMethod := passwordAuth(username, host, ui)
 	realAgentPath := os.Getenv("SSH_AUTH_SOCK")
 	if realAgentPath != "" {
 		realAgent, err := net.Dial("unix", realAgentPath)
@@ -316,9 +364,21 @@ func getAuth(username string, host string, homeDir string, ui UI) []ssh.AuthMeth
 		}
 	}
 
+	return []ssh.AuthMethod{ssh.PublicKeys(getKeyFileSigners(path.Join(homeDir, ".ssh"), ui)...), passwordAuthMethod}
+}
+
+// passwordAuth asks the user for the password of username at host.
+func passwordAuth(username string, host string, ui UI) ssh.AuthMethod {
+	return ssh.PasswordCallback(func() (string, error) {
+		return ui.AskPassword(fmt.Sprintf("%s@%s password:", displayLine(username), displayLine(host)))
+	})
+}
+
+// getKeyFileSigners loads the default key files in keyDir, e.g. ~/.ssh.
+func getKeyFileSigners(keyDir string, ui UI) []ssh.Signer {
 	var signers []ssh.Signer
 	for _, keyFile := range []string{"identity", "id_dsa", "id_rsa", "id_ecdsa", "id_ed25519"} {
-		keyPath := path.Join(homeDir, ".ssh", keyFile)
+		keyPath := path.Join(keyDir, keyFile)
 		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
 			continue
 		}
@@ -329,5 +389,5 @@ func getAuth(username string, host string, homeDir string, ui UI) []ssh.AuthMeth
 		}
 		signers = append(signers, signer)
 	}
-	return []ssh.AuthMethod{ssh.PublicKeys(signers...), passwordAuthMethod}
+	return signers
 }
@@ -0,0 +1,238 @@
+package guardianagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of issued credentials.
+const (
+	CredentialToken      = "token"
+	CredentialInvitation = "invitation"
+)
+
+// Status of issued credentials.
+const (
+	CredentialActive  = "active"
+	CredentialUsed    = "used"
+	CredentialExpired = "expired"
+	CredentialRevoked = "revoked"
+)
+
+// IssuedCredential is a one-time token or an invitation the guardian issued,
+// as recorded in its ledger. Secrets are never recorded.
+type IssuedCredential struct {
+	ID          string
+	Kind        string
+	Scope       Scope
+	Tags        []string `json:",omitempty"`
+	AllCommands bool     `json:",omitempty"`
+	Commands    []string `json:",omitempty"`
+	Note        string   `json:",omitempty"`
+
+	// Who issued it, e.g. "unix:alice".
+	Issuer string `json:",omitempty"`
+
+	Issued  time.Time
+	Expires time.Time
+
+	// Unlimited if 0; tokens are used once.
+	MaxUses  int `json:",omitempty"`
+	Uses     int
+	LastUsed *time.Time `json:",omitempty"`
+	Revoked  *time.Time `json:",omitempty"`
+}
+
+// Status tells whether the credential can still be used at now.
+func (cred *IssuedCredential) Status(now time.Time) string {
+	switch {
+	case cred.Revoked != nil:
+		return CredentialRevoked
+	case cred.MaxUses > 0 && cred.Uses >= cred.MaxUses:
+		return CredentialUsed
+	case !now.Before(cred.Expires):
+		return CredentialExpired
+	}
+	return CredentialActive
+}
+
+// ledgerEvent is a line of the ledger file.
+type ledgerEvent struct {
+	Time  time.Time
+	Event string // "issued", "used" or "revoked"
+	ID    string
+	Kind  string
+
+	// The credential, for "issued" events.
+	Credential *IssuedCredential `json:",omitempty"`
+}
+
+// CredentialLedger records the credentials the guardian issued, and their
+// uses and revocations, in an append-only file next to the personal policy,
+// so that they can be queried after they expired.
+type CredentialLedger struct {
+	mu          sync.Mutex
+	path        string
+	credentials []*IssuedCredential
+}
+
+// NewCredentialLedger loads the ledger saved at path, if any.
+func NewCredentialLedger(path string) (*CredentialLedger, error) {
+	ledger := &CredentialLedger{path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read credential ledger: %s", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var event ledgerEvent
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("Failed to parse credential ledger %s, line %d: %s", path, line, err)
+		}
+		ledger.apply(&event)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read credential ledger: %s", err)
+	}
+	return ledger, nil
+}
+
+func (ledger *CredentialLedger) find(kind string, id string) *IssuedCredential {
+	for i := len(ledger.credentials) - 1; i >= 0; i-- {
+		if cred := ledger.credentials[i]; cred.Kind == kind && cred.ID == id {
+			return cred
+		}
+	}
+	return nil
+}
+
+func (ledger *CredentialLedger) apply(event *ledgerEvent) {
+	if event.Event == "issued" {
+		if event.Credential != nil {
+			ledger.credentials = append(ledger.credentials, event.Credential)
+		}
+		return
+	}
+	cred := ledger.find(event.Kind, event.ID)
+	if cred == nil {
+		return
+	}
+	at := event.Time
+	switch event.Event {
+	case "used":
+		cred.Uses++
+		cred.LastUsed = &at
+	case "revoked":
+		if cred.Revoked == nil {
+			cred.Revoked = &at
+		}
+	}
+}
+
+// record applies an event and appends it to the ledger file. Failures are
+// logged, since the credentials themselves are kept elsewhere.
+func (ledger *CredentialLedger) record(event ledgerEvent) {
+	if ledger == nil {
+		return
+	}
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	event.Time = time.Now()
+	ledger.apply(&event)
+	buf, err := json.Marshal(event)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(ledger.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err == nil {
+			_, err = f.Write(append(buf, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record %s %s in the credential ledger: %s", event.Kind, event.ID, err)
+	}
+}
+
+func (ledger *CredentialLedger) issued(cred IssuedCredential) {
+	cred.Issuer = localApprover()
+	ledger.record(ledgerEvent{Event: "issued", ID: cred.ID, Kind: cred.Kind, Credential: &cred})
+}
+
+func (ledger *CredentialLedger) used(kind string, id string) {
+	ledger.record(ledgerEvent{Event: "used", ID: id, Kind: kind})
+}
+
+func (ledger *CredentialLedger) revoked(kind string, id string) {
+	ledger.record(ledgerEvent{Event: "revoked", ID: id, Kind: kind})
+}
+
+// CredentialFilter selects issued credentials. Empty fields match any.
+type CredentialFilter struct {
+	// Bounds of the time of issue.
+	Since time.Time
+	Until time.Time
+
+	// Shell patterns matched against the scope of the credential, the
+	// server both with and without its port. Credentials for any client,
+	// user or server match any pattern.
+	Client string
+	User   string
+	Server string
+
+	Kind   string
+	Status string
+}
+
+// Matches reports whether cred is selected by the filter at now.
+func (filter *CredentialFilter) Matches(cred *IssuedCredential, now time.Time) bool {
+	if !filter.Since.IsZero() && cred.Issued.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !cred.Issued.Before(filter.Until) {
+		return false
+	}
+	if filter.Client != "" && cred.Scope.Client != "" && !matchesPattern(filter.Client, cred.Scope.Client) {
+		return false
+	}
+	if filter.User != "" && cred.Scope.ServiceUsername != "" && !matchesPattern(filter.User, cred.Scope.ServiceUsername) {
+		return false
+	}
+	if filter.Server != "" && cred.Scope.ServiceHostname != "" {
+		host := cred.Scope.ServiceHostname
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !matchesPattern(filter.Server, cred.Scope.ServiceHostname) && !matchesPattern(filter.Server, host) {
+			return false
+		}
+	}
+	if filter.Kind != "" && cred.Kind != filter.Kind {
+		return false
+	}
+	return filter.Status == "" || cred.Status(now) == filter.Status
+}
+
+// Query returns the credentials selected by filter, oldest first.
+func (ledger *CredentialLedger) Query(filter CredentialFilter) []IssuedCredential {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	now := time.Now()
+	found := []IssuedCredential{}
+	for _, cred := range ledger.credentials {
+		if filter.Matches(cred, now) {
+			found = append(found, *cred)
+		}
+	}
+	return found
+}
@@ -2,6 +2,7 @@ package guardianagent
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,10 +12,10 @@ import (
 	"os/exec"
 	"os/signal"
 	"os/user"
-	"path"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/hashicorp/yamux"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -28,44 +29,57 @@ type SSHCommand struct {
 	ProxyCommand string
 	StdinNull    bool
 	ForceTty     bool
-}
 
-type client struct {
-	SSHCommand
+	// One-time approval token issued by the guardian, if any.
+	ApprovalToken string
 
-	agentConn        net.Conn
-	sshClient        *ssh.Client
-	session          *ssh.Session
-	stdin            io.WriteCloser
-	stdout           io.Reader
-	stderr           io.Reader
-	oldTerminalState *terminal.State
-}
+	// Invitation issued by the guardian, if any, as "<id>.<secret>".
+	Invitation string
 
-func (c *client) connectToAgent() error {
-	locations := []string{path.Join(UserRuntimeDir(), AgentGuardSockName)}
-	for _, loc := range locations {
-		sock, err := net.Dial("unix", loc)
-		if err != nil {
-			continue
-		}
-		query := AgentCExtensionMsg{
-			ExtensionType: AgentGuardExtensionType,
-		}
+	// Justification and intended working directory shown to the approver.
+	Reason     string
+	WorkingDir string
 
-		err = WriteControlPacket(sock, MsgAgentCExtension, ssh.Marshal(query))
-		if err != nil {
-			continue
-		}
+	// Batch the command belongs to, see RequestMetadata.
+	Batch      string
+	BatchGroup string
+	BatchSize  int
 
-		msgNum, _, err := ReadControlPacket(sock)
-		if err == nil && msgNum == MsgAgentSuccess {
-			c.agentConn = sock
-			return nil
-		}
-		sock.Close()
-	}
-	return fmt.Errorf("Failed to connect to agent guard. Did you setup agent guard forwarding to this host?")
+	// Git run the command belongs to, see RequestMetadata.
+	GitRun string
+
+	// Directory to record the session's output to, if set.
+	RecordDir string
+
+	// Where to upload recordings to, if set.
+	RecordStore ObjectStore
+
+	// Recipients to encrypt recordings to, in addition to those the
+	// guardian requires.
+	RecordRecipients []string
+
+	// Public key of the guardian, to encrypt the control channel to, if
+	// set. See DialNoise.
+	GuardKey string
+
+	// Timeouts and retries of connecting to the server. Retries are
+	// reported on stderr unless Connect.OnRetry is set.
+	Connect ConnectOptions
+}
+
+type client struct {
+	SSHCommand
+
+	guardian            *GuardianClient
+	requestID           string
+	recording           string
+	recordingRecipients []string
+	sshClient           *ssh.Client
+	session             *ssh.Session
+	stdin               io.WriteCloser
+	stdout              io.Reader
+	stderr              io.Reader
+	oldTerminalState    *terminal.State
 }
 
 type settableWriter struct {
@@ -102,12 +116,12 @@ func (c *client) Close() error {
 	if c.session != nil {
 		c.session.Close()
 	}
-	if c.agentConn != nil {
-		c.agentConn.Close()
-	}
 	if c.sshClient != nil {
 		c.sshClient.Close()
 	}
+	if c.guardian != nil {
+		c.guardian.Close()
+	}
 	return nil
 }
 
@@ -198,6 +212,7 @@ func (c *client) startCommand(conn *ssh.Client, cmd string) (err error) {
 		if err := c.session.RequestPty(os.Getenv("TERM"), h, w, modes); err != nil {
 			return fmt.Errorf("request for pseudo terminal failed: %s", err)
 		}
+		c.relayWindowChanges()
 		if terminal.IsTerminal(int(os.Stdin.Fd())) {
 			oldState, err := terminal.MakeRaw(int(os.Stdin.Fd()))
 			if err != nil {
@@ -229,25 +244,35 @@ func (c *client) startCommand(conn *ssh.Client, cmd string) (err error) {
 }
 
 func (c *client) resume() error {
+	var stdin io.Reader = os.Stdin
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	recorder := c.startRecording()
+	if recorder != nil {
+		stdin = io.TeeReader(os.Stdin, recorder.Input())
+		stdout, stderr = io.MultiWriter(os.Stdout, recorder), io.MultiWriter(os.Stderr, recorder)
+	}
 	go func() {
 		if !c.StdinNull {
-			io.Copy(c.stdin, os.Stdin)
+			io.Copy(c.stdin, stdin)
 		}
 		c.stdin.Close()
 	}()
 	done := make(chan error)
 	go func() {
-		_, err := io.Copy(os.Stdout, c.stdout)
+		_, err := io.Copy(stdout, c.stdout)
 		done <- err
 	}()
 	go func() {
-		_, err := io.Copy(os.Stderr, c.stderr)
+		_, err := io.Copy(stderr, c.stderr)
 		done <- err
 	}()
 
 	errExec := c.session.Wait()
 	errOut1 := <-done
 	errOut2 := <-done
+	if recorder != nil {
+		c.finishRecording(recorder)
+	}
 	if errExec != nil {
 		return errExec
 	}
@@ -333,7 +358,7 @@ func (c *client) connectToServer() (reader io.ReadCloser, writer io.WriteCloser,
 		}()
 		return reader, writer, nil
 	} else {
-		serverConn, err := net.Dial("tcp", c.HostPort)
+		serverConn, err := net.DialTimeout("tcp", c.HostPort, c.Connect.Timeout)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to connect to %s: %s", c.HostPort, err)
 		}
@@ -341,18 +366,94 @@ func (c *client) connectToServer() (reader io.ReadCloser, writer io.WriteCloser,
 	}
 }
 
+// startRecording starts recording the session, fully if the user asked
+// for it, or as the guardian requires. Recording failures are reported, but
+// do not stop the session.
+func (c *client) startRecording() *SessionRecorder {
+	dir, mode := c.RecordDir, RecordingFull
+	if dir == "" {
+		if c.recording == "" || c.recording == RecordingNone {
+			return nil
+		}
+		dir, mode = RecordingsDir(), c.recording
+		fmt.Fprintf(os.Stderr, "The guardian requires recording this session%s\n", strings.TrimPrefix(describeRecording(mode), "\nThe session will be recorded"))
+	}
+	info := SessionRecording{
+		RequestID: c.requestID,
+		User:      c.Username,
+		Server:    c.HostPort,
+		Command:   c.Cmd,
+		Mode:      mode,
+
+		Recipients: mergeRecipients(c.recordingRecipients, c.RecordRecipients),
+	}
+	if c.Cmd == "" || c.ForceTty {
+		info.Width, info.Height, _ = terminal.GetSize(int(os.Stdin.Fd()))
+	}
+	recorder, err := NewSessionRecorder(dir, info)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return nil
+	}
+	return recorder
+}
+
+// finishRecording closes the recording and, for delegated sessions, reports
+// its hash to the guardian.
+func (c *client) finishRecording(recorder *SessionRecorder) {
+	rec, err := recorder.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return
+	}
+	if c.RecordStore != nil {
+		if err = rec.Upload(c.RecordStore); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
+	if rec.RequestID == "" {
+		return
+	}
+	guardian, err := DialGuardian(context.Background(), c.GuardKey)
+	if err == nil {
+		defer guardian.Close()
+		err = guardian.ReportRecording(context.Background(), rec.RequestID, rec.Hash)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to report recording %s to the guardian: %s\n", rec.Name(), err)
+	}
+}
+
 // Run starts a delegated session.
 func RunSSHCommand(cmd SSHCommand) error {
 	cli := client{SSHCommand: cmd}
 	defer cli.Close()
-	if cli.connectToAgent() == nil {
-		return cli.runDelegated()
+	var err error
+	cli.guardian, err = DialGuardian(context.Background(), cmd.GuardKey)
+	if err == ErrNoGuardian {
+		return cli.runDirect()
+	}
+	if err != nil {
+		return err
+	}
+	return cli.runDelegated()
+}
+
+// startPreconnection starts connecting to the server, see preconnection.
+func (c *client) startPreconnection() *preconnection {
+	opts := c.Connect
+	if opts.OnRetry == nil {
+		opts.OnRetry = func(err error, attempt int, wait time.Duration) {
+			fmt.Fprintf(os.Stderr, "%s; retrying in %s (attempt %d of %d)...\n", err, wait, attempt+1, opts.Attempts)
+		}
 	}
-	return cli.runDirect()
+	return startPreconnection(func() (io.Reader, io.WriteCloser, error) {
+		return c.connectToServer()
+	}, opts)
 }
 
 func (c *client) runDirect() error {
-	serverReader, serverWriter, err := c.connectToServer()
+	serverReader, serverWriter, err := c.startPreconnection().take()
 	if err != nil {
 		return err
 	}
@@ -403,273 +504,80 @@ func (c *client) runDirect() error {
 }
 
 func (c *client) runDelegated() error {
-	serverReader, serverWriter, err := c.connectToServer()
+	requestID, err := NewRequestID()
 	if err != nil {
 		return err
 	}
-
-	execReq := ExecutionRequestMessage{
+	// Connect to the server while the approval prompt is open, and withdraw
+	// the request if it is unreachable.
+	pre := c.startPreconnection()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pre.cancelOnFailure(ctx, cancel)
+	c.requestID = requestID
+	log.Printf("Requesting approval, request ID %s", requestID)
+	c.guardian.OnReconnect = func(error) {
+		fmt.Fprintf(os.Stderr, "Lost connection to the guardian while waiting for approval, reconnecting...\n")
+	}
+	approval, err := c.guardian.RequestExecution(ctx, ExecutionRequest{
 		User:    c.Username,
 		Command: c.Cmd,
 		Server:  c.HostPort,
+		Metadata: RequestMetadata{
+			Token:      c.ApprovalToken,
+			Invitation: c.Invitation,
+			Reason:     c.Reason,
+			WorkingDir: c.WorkingDir,
+			Batch:      c.Batch,
+			BatchGroup: c.BatchGroup,
+			BatchSize:  c.BatchSize,
+			GitRun:     c.GitRun,
+			RequestID:  requestID,
+		},
+	})
+	if denied, ok := err.(*DeniedError); ok {
+		if explanation := denied.Explanation(); explanation != "" {
+			fmt.Fprintln(os.Stderr, explanation)
+		}
 	}
-
-	execReqPacket := ssh.Marshal(execReq)
-	err = WriteControlPacket(c.agentConn, MsgExecutionRequest, execReqPacket)
-	if err != nil {
-		return fmt.Errorf("failed to send MsgExecutionRequest to agent: %s", err)
-	}
-
-	// Wait for response before opening data connection
-	msgNum, msg, err := ReadControlPacket(c.agentConn)
-	if err != nil {
-		return fmt.Errorf("failed to get approval from agent: %s", err)
-	}
-	switch msgNum {
-	case MsgExecutionApproved:
-		break
-	case MsgExecutionDenied:
-		var denyMsg ExecutionDeniedMessage
-		ssh.Unmarshal(msg, &denyMsg)
-		return fmt.Errorf("execution denied by agent: %s", denyMsg.Reason)
-	default:
-		return fmt.Errorf("failed to get approval from agent, unknown reply: %d", msgNum)
-	}
-
-	ymux, err := yamux.Client(c.agentConn, nil)
-	control, err := ymux.Open()
-	if err != nil {
-		return fmt.Errorf("failed to get control stream: %s", err)
-	}
-	// Proceed with approval
-	agentData, err := ymux.Open()
-	if err != nil {
-		return fmt.Errorf("failed to get data stream: %s", err)
-	}
-	pt, err := ymux.Open()
 	if err != nil {
-		return fmt.Errorf("failed to get transport stream: %s", err)
-	}
-	agentTransport := CustomConn{Conn: pt}
-
-	sshClientConn, sshPipe := net.Pipe()
-
-	// Initially, the SSH connection is wired to the agent data,
-	// and the server connection is wired to the agent transport.
-	sshOut := settableWriter{w: agentData}
-	serverOut := settableWriter{w: &agentTransport}
-	// To be used to buffer traffic that needs to be replayed to the client
-	// after the handoff (since the transport layer might deliver to the agent
-	// packets that the server has sent after msgNewKeys).
-	bufferedTraffic := new(bytes.Buffer)
-	bufferedOffset := 0
-
-	runningRoutines := sync.WaitGroup{}
-	defer runningRoutines.Wait()
-
-	runningRoutines.Add(1)
-	go func() {
-		defer runningRoutines.Done()
-
-		_, err := io.Copy(&sshOut, sshPipe)
-		if err != nil {
-			log.Printf("Error copying outgoing SSH data: %s", err)
-		} else {
-			log.Printf("Finished copying outgoing SSH data")
-		}
-		sshOut.mu.Lock()
-		sshOut.Close()
-		sshOut.w = nil
-		sshOut.mu.Unlock()
-	}()
-
-	agentDone := make(chan error, 1)
-	runningRoutines.Add(1)
-	go func() {
-		defer runningRoutines.Done()
-		_, err := io.Copy(sshPipe, agentData)
-		if debugClient {
-			log.Printf("Finished copying ssh data from agent: %s", err)
-		}
-		if err != nil {
-			sshPipe.Close()
-			agentDone <- fmt.Errorf("failed to read ssh data from agent: %s", err)
-			return
-		}
-
-		serverOut.mu.Lock()
-		defer serverOut.mu.Unlock()
-
-		handoffByte, err := getHandoffNextTransportByte(control)
-
-		if err != nil {
-			agentDone <- err
-			sshPipe.Close()
-			return
-		}
-
-		syncBufferedTraffic(bufferedTraffic, bufferedOffset, handoffByte)
-		n, err := bufferedTraffic.WriteTo(sshPipe)
-		if err != nil {
-			agentDone <- fmt.Errorf("failed to backfill traffic from server to client: %s", err)
-			sshPipe.Close()
-			return
-		}
-		if debugClient {
-			log.Printf("Backfilled %d bytes from server to client", n)
-		}
-
-		agentDone <- nil
-
-		if serverOut.werr != nil {
-			io.Copy(sshPipe, serverReader)
-			sshPipe.Close()
-		} else {
-			agentTransport.Close()
-			serverOut.w = sshPipe
-		}
-
-	}()
-
-	runningRoutines.Add(1)
-	go func() {
-		defer runningRoutines.Done()
-		_, err := io.Copy(&serverOut, serverReader)
-		if debugClient {
-			log.Printf("Finished copying transport data to agent")
-		}
-		serverOut.Close()
-		if err != nil && err != os.ErrClosed && err != yamux.ErrStreamClosed {
-			log.Printf("To agent transport forwarding failed: %s", err)
-		}
-	}()
-	fromAgentTransportDone := make(chan error, 1)
-
-	runningRoutines.Add(1)
-	go func() {
-		defer runningRoutines.Done()
-
-		_, err := io.Copy(serverWriter, &agentTransport)
-		if debugClient {
-			log.Printf("Finished copying transport data from agent")
-		}
-
-		sshOut.mu.Lock()
-		if sshOut.w != nil {
-			sshOut.Close()
-			sshOut.w = serverWriter
-		} else {
-			if cw, ok := serverWriter.(CloseWriter); ok {
-				log.Printf("CloseWrite serverWriter")
-				cw.CloseWrite()
-			} else {
-				log.Printf("Close serverWriter")
-				serverWriter.Close()
-			}
-		}
-		sshOut.mu.Unlock()
-
-		if err != nil {
-			fromAgentTransportDone <- fmt.Errorf("failed to copy data from agent to server: %s", err)
-		} else {
-			fromAgentTransportDone <- nil
-		}
-	}()
-
-	doHandoffOnKex := make(chan chan error, 1)
-	kexCallback := func() {
-		if debugClient {
-			log.Printf("KexCallback called")
-		}
-		var done chan error
-		select {
-		case done = <-doHandoffOnKex:
-			break
-		default:
-			return
-		}
-
-		if debugClient {
-			log.Printf("Starting transport rewiring")
-		}
-
-		if err = <-fromAgentTransportDone; err != nil {
-			done <- fmt.Errorf("failed to forward agent transport data: %s", err)
-			return
+		pre.close()
+		if connErr := pre.failed(); connErr != nil {
+			return connErr
 		}
-
-		go func() {
-			done <- <-agentDone
-		}()
-	}
-
-	config := ssh.ClientConfig{
-		Config: ssh.Config{
-			KexCallback: kexCallback,
-		},
-		HostKeyCallback:          ssh.InsecureIgnoreHostKey(),
-		DeferHostKeyVerification: true,
+		return err
 	}
-
-	cc, chans, reqs, err := ssh.NewClientConn(sshClientConn, c.HostPort, &config)
+	serverReader, serverWriter, err := pre.take()
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %s", c.HostPort, err)
+		return err
 	}
-
-	c.sshClient = ssh.NewClient(cc, chans, reqs)
-	if c.sshClient == nil {
-		return fmt.Errorf("failed to connect to [%s]: %v", c.HostPort, err)
+	c.recording = approval.Recording
+	c.recordingRecipients = approval.RecordingRecipients
+	if approval.Command != c.Cmd {
+		log.Printf("Command was modified by the approver to: %s", approval.Command)
+		fmt.Fprintf(os.Stderr, "Command was modified by the approver to: %s\n", approval.Command)
+		// E.g. shells limited in duration, which still need a terminal.
+		if c.Cmd == "" {
+			c.ForceTty = true
+		}
+		c.Cmd = approval.Command
 	}
-	defer c.sshClient.Close()
 
-	if err = c.startCommand(c.sshClient, c.Cmd); err != nil {
-		return fmt.Errorf("failed to run command: %s", err)
+	c.sshClient, err = c.guardian.Handoff(context.Background(), c.HostPort, serverReader, serverWriter, func(sshClient *ssh.Client) error {
+		return c.startCommand(sshClient, c.Cmd)
+	})
+	if closed, ok := err.(*ClosedBeforeHandoffError); ok {
+		// The connection may close with an error right after the command
+		// exited; its exit status (or signal) is still reported if the
+		// server sent it.
+		errExec := c.resume()
+		if _, ok := errExec.(*ssh.ExitError); ok || errExec == nil || closed.Err == nil {
+			return errExec
+		}
+		return closed.Err
 	}
-
-	ok, _, err := c.sshClient.SendRequest(ssh.NoMoreSessionRequestName, true, nil)
 	if err != nil {
-		return fmt.Errorf("failed to send %s: %s", ssh.NoMoreSessionRequestName, err)
-	}
-	if !ok {
-		log.Printf("%s request denied, continuing", ssh.NoMoreSessionRequestName)
-	}
-
-	handoffComplete := make(chan error, 1)
-	doHandoffOnKex <- handoffComplete
-
-	if debugClient {
-		log.Printf("Initiating Handoff Key Exchange")
-	}
-
-	// First start buffering traffic from the server, since packets
-	// sent by ther server after msgNewKeys might need to replayed
-	// to the client after the handoff.
-	serverOut.mu.Lock()
-	serverOut.w = io.MultiWriter(bufferedTraffic, serverOut.w)
-	bufferedOffset = agentTransport.BytesWritten()
-	serverOut.mu.Unlock()
-
-	c.sshClient.RequestKeyChange()
-	errChan := make(chan error)
-	go func() {
-		errChan <- c.sshClient.Wait()
-	}()
-
-	select {
-	case err = <-handoffComplete:
-		if err != nil {
-			return err
-		}
-		if debugClient {
-			log.Printf("Handoff Complete")
-		}
-	case err = <-errChan:
-		if debugClient {
-			log.Printf("Command finished before handoff: %s", err)
-		}
-		if err != nil {
-			return err
-		}
+		return err
 	}
 	return c.resume()
 }
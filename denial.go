@@ -0,0 +1,70 @@
+package guardianagent
+
+// Codes classifying denials, sent to clients in the denial field of the
+// response metadata along with the free-text reason.
+const (
+	// A system policy rule or key constraint denies the request.
+	DenialPolicy = "POLICY_DENY"
+
+	// The approver rejected the request, now or recently.
+	DenialUser = "USER_DENY"
+
+	// Nobody decided in time, e.g. because the approver's screen stayed
+	// locked.
+	DenialTimeout = "TIMEOUT"
+
+	// The client exceeded a quota.
+	DenialRateLimit = "RATE_LIMIT"
+
+	// The request ID was reused for another request, or to run an approved
+	// request twice.
+	DenialChallengeInvalid = "CHALLENGE_INVALID"
+
+	// The guardian is locked down.
+	DenialLockdown = "LOCKDOWN"
+
+	// The guardian failed to decide, e.g. because the prompt could not be
+	// shown.
+	DenialError = "ERROR"
+)
+
+// Denial is the error returned for denied requests.
+type Denial struct {
+	Code   string
+	Detail string
+}
+
+func (denial *Denial) Error() string {
+	return denial.Detail
+}
+
+func deny(code string, detail string) error {
+	return &Denial{Code: code, Detail: detail}
+}
+
+// denialCode classifies the error a request was denied with.
+func denialCode(err error) string {
+	if denial, ok := err.(*Denial); ok {
+		return denial.Code
+	}
+	return DenialError
+}
+
+// explainDenial tells users of the client what they can do about a denial.
+func explainDenial(code string) string {
+	switch code {
+	case DenialPolicy:
+		return "The guardian's policy does not allow this command; ask its owner to change the policy."
+	case DenialUser:
+		return "The approver rejected the request."
+	case DenialTimeout:
+		return "Nobody approved the request in time; try again when the approver is available."
+	case DenialRateLimit:
+		return "This host exceeded a quota of the guardian; try again later, or ask its owner to raise the quota."
+	case DenialChallengeInvalid:
+		return "The request ID was already used; retry the command as a new request."
+	case DenialLockdown:
+		return "The guardian is locked down; ask its owner to unlock it."
+	}
+	return ""
+}
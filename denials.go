@@ -0,0 +1,140 @@
+package guardianagent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type denialKey struct {
+	Scope   Scope
+	Command string
+}
+
+// RememberedDenial is a denial in the cache, as listed by DenialCache.List.
+type RememberedDenial struct {
+	Scope Scope
+
+	// Empty for a request to run any command.
+	Command string
+
+	DeniedAt time.Time
+	Expires  time.Time
+}
+
+// DenialCache remembers interactive denials for a while, so that a delegatee
+// retrying a denied command does not prompt the user over and over again.
+type DenialCache struct {
+	period time.Duration
+
+	mu      sync.Mutex
+	denials map[denialKey]*RememberedDenial
+}
+
+func NewDenialCache(period time.Duration) *DenialCache {
+	return &DenialCache{period: period, denials: make(map[denialKey]*RememberedDenial)}
+}
+
+// empty returns a new cache remembering denials for as long as cache, or nil
+// if cache is nil.
+func (cache *DenialCache) empty() *DenialCache {
+	if cache == nil {
+		return nil
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return NewDenialCache(cache.period)
+}
+
+// SetPeriod sets how long denials made from then on are remembered.
+func (cache *DenialCache) SetPeriod(period time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.period = period
+}
+
+// Remember records the denial of cmd in scope. An empty cmd stands for a
+// request to run any command.
+func (cache *DenialCache) Remember(scope Scope, cmd string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := time.Now()
+	for key, denial := range cache.denials {
+		if now.After(denial.Expires) {
+			delete(cache.denials, key)
+		}
+	}
+	cache.denials[denialKey{scope, cmd}] = &RememberedDenial{Scope: scope, Command: cmd, DeniedAt: now, Expires: now.Add(cache.period)}
+}
+
+// DeniedAt returns when cmd was last denied in scope, if the denial is still
+// remembered.
+func (cache *DenialCache) DeniedAt(scope Scope, cmd string) (time.Time, bool) {
+	if cache == nil {
+		return time.Time{}, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	denial, ok := cache.denials[denialKey{scope, cmd}]
+	if !ok || time.Now().After(denial.Expires) {
+		return time.Time{}, false
+	}
+	return denial.DeniedAt, true
+}
+
+// List returns the remembered denials.
+func (cache *DenialCache) List() []RememberedDenial {
+	if cache == nil {
+		return nil
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := time.Now()
+	var denials []RememberedDenial
+	for _, denial := range cache.denials {
+		if !now.After(denial.Expires) {
+			denials = append(denials, *denial)
+		}
+	}
+	sort.Slice(denials, func(i, j int) bool { return denials[i].DeniedAt.Before(denials[j].DeniedAt) })
+	return denials
+}
+
+// Forget drops the denial of cmd in scope, and reports whether there was one.
+func (cache *DenialCache) Forget(scope Scope, cmd string) bool {
+	if cache == nil {
+		return false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	_, ok := cache.denials[denialKey{scope, cmd}]
+	delete(cache.denials, denialKey{scope, cmd})
+	return ok
+}
+
+// SetExpiry changes until when the denial of cmd in scope is remembered, and
+// reports whether there was one.
+func (cache *DenialCache) SetExpiry(scope Scope, cmd string, expires time.Time) bool {
+	if cache == nil {
+		return false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	denial, ok := cache.denials[denialKey{scope, cmd}]
+	if ok {
+		denial.Expires = expires
+	}
+	return ok
+}
+
+func describeAgo(t time.Time) string {
+	d := time.Since(t)
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds ago", int(d.Seconds()))
+	}
+	return fmt.Sprintf("%d minutes ago", int(d.Minutes()))
+}
@@ -0,0 +1,273 @@
+package guardianagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory groups can be used in policies with the syntax of sudoers:
+//
+//   %<group>     in the user of a scope: members of a Unix group
+//   +<netgroup>  in the user of a scope: users of a netgroup
+//   +<netgroup>  in tag patterns: hosts of a netgroup
+//
+// They are resolved when policies are evaluated, through the name service
+// (getent, which covers NIS and directories configured in nsswitch.conf) or
+// directly from an LDAP server, and cached for a while.
+
+// NetgroupTriple is a member of a netgroup. Empty fields match anything, and
+// "-" nothing.
+type NetgroupTriple struct {
+	Host   string
+	User   string
+	Domain string
+}
+
+// GroupSource looks up directory groups.
+type GroupSource interface {
+	Netgroup(name string) ([]NetgroupTriple, error)
+	GroupMembers(name string) ([]string, error)
+}
+
+// GetentSource looks up groups with getent(1).
+type GetentSource struct{}
+
+var netgroupTripleSyntax = regexp.MustCompile(`\(\s*([^,()]*?)\s*,\s*([^,()]*?)\s*,\s*([^,()]*?)\s*\)`)
+
+func (GetentSource) Netgroup(name string) ([]NetgroupTriple, error) {
+	out, err := exec.Command("getent", "netgroup", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up netgroup %s: %s", name, err)
+	}
+	var triples []NetgroupTriple
+	for _, m := range netgroupTripleSyntax.FindAllStringSubmatch(string(out), -1) {
+		triples = append(triples, NetgroupTriple{Host: m[1], User: m[2], Domain: m[3]})
+	}
+	return triples, nil
+}
+
+func (GetentSource) GroupMembers(name string) ([]string, error) {
+	out, err := exec.Command("getent", "group", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up group %s: %s", name, err)
+	}
+	// name:password:gid:member,member,...
+	fields := strings.SplitN(strings.TrimSpace(string(out)), ":", 4)
+	if len(fields) < 4 || fields[3] == "" {
+		return nil, nil
+	}
+	return strings.Split(fields[3], ","), nil
+}
+
+// LDAPSource looks up RFC 2307 groups (nisNetgroup and posixGroup entries)
+// with ldapsearch(1), binding anonymously or with the options in ldap.conf.
+type LDAPSource struct {
+	URL  string
+	Base string
+}
+
+// Nested netgroups are followed up to this depth.
+const maxNetgroupDepth = 8
+
+func (source *LDAPSource) search(filter string, attrs ...string) (map[string][]string, error) {
+	args := append([]string{"-x", "-LLL", "-H", source.URL, "-b", source.Base, filter}, attrs...)
+	out, err := exec.Command("ldapsearch", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search %s for %s: %s", source.URL, filter, err)
+	}
+	return parseLDIF(out), nil
+}
+
+func (source *LDAPSource) Netgroup(name string) ([]NetgroupTriple, error) {
+	return source.netgroup(name, 0)
+}
+
+func (source *LDAPSource) netgroup(name string, depth int) ([]NetgroupTriple, error) {
+	if depth > maxNetgroupDepth {
+		return nil, fmt.Errorf("netgroup %s is nested too deeply", name)
+	}
+	entry, err := source.search(fmt.Sprintf("(&(objectClass=nisNetgroup)(cn=%s))", ldapEscape(name)),
+		"nisNetgroupTriple", "memberNisNetgroup")
+	if err != nil {
+		return nil, err
+	}
+	var triples []NetgroupTriple
+	for _, value := range entry["nisNetgroupTriple"] {
+		for _, m := range netgroupTripleSyntax.FindAllStringSubmatch(value, -1) {
+			triples = append(triples, NetgroupTriple{Host: m[1], User: m[2], Domain: m[3]})
+		}
+	}
+	for _, member := range entry["memberNisNetgroup"] {
+		nested, err := source.netgroup(member, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		triples = append(triples, nested...)
+	}
+	return triples, nil
+}
+
+func (source *LDAPSource) GroupMembers(name string) ([]string, error) {
+	entry, err := source.search(fmt.Sprintf("(&(objectClass=posixGroup)(cn=%s))", ldapEscape(name)), "memberUid")
+	if err != nil {
+		return nil, err
+	}
+	return entry["memberUid"], nil
+}
+
+var ldapEscaper = strings.NewReplacer(`\`, `\5c`, `*`, `\2a`, `(`, `\28`, `)`, `\29`, "\x00", `\00`)
+
+func ldapEscape(s string) string {
+	return ldapEscaper.Replace(s)
+}
+
+// parseLDIF collects the attribute values of the entries in LDIF output.
+func parseLDIF(ldif []byte) map[string][]string {
+	// Unfold continuation lines first.
+	ldif = bytes.Replace(ldif, []byte("\n "), nil, -1)
+	attrs := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(ldif))
+	for scanner.Scan() {
+		line := scanner.Text()
+		sep := strings.Index(line, ":")
+		if sep <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line[:sep], line[sep+1:]
+		if strings.HasPrefix(value, ":") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		attrs[name] = append(attrs[name], strings.TrimSpace(value))
+	}
+	return attrs
+}
+
+// GroupResolver answers membership questions from a GroupSource, caching the
+// groups for ttl. If a lookup fails, the previous answer is used, if any.
+type GroupResolver struct {
+	source GroupSource
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	netgroups map[string]cachedNetgroup
+	groups    map[string]cachedGroup
+}
+
+type cachedNetgroup struct {
+	triples []NetgroupTriple
+	fetched time.Time
+}
+
+type cachedGroup struct {
+	members []string
+	fetched time.Time
+}
+
+func NewGroupResolver(source GroupSource, ttl time.Duration) *GroupResolver {
+	return &GroupResolver{
+		source:    source,
+		ttl:       ttl,
+		netgroups: make(map[string]cachedNetgroup),
+		groups:    make(map[string]cachedGroup),
+	}
+}
+
+var (
+	directoryMu sync.RWMutex
+	directory   = NewGroupResolver(GetentSource{}, 5*time.Minute)
+)
+
+// SetGroupResolver replaces the resolver of directory groups used in
+// policies, which by default uses getent. Like the system's name service, it
+// is shared by the whole process.
+func SetGroupResolver(resolver *GroupResolver) {
+	directoryMu.Lock()
+	defer directoryMu.Unlock()
+	directory = resolver
+}
+
+func groupResolver() *GroupResolver {
+	directoryMu.RLock()
+	defer directoryMu.RUnlock()
+	return directory
+}
+
+func (resolver *GroupResolver) netgroup(name string) []NetgroupTriple {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	cached, ok := resolver.netgroups[name]
+	if ok && time.Since(cached.fetched) < resolver.ttl {
+		return cached.triples
+	}
+	triples, err := resolver.source.Netgroup(name)
+	if err != nil {
+		log.Printf("%s", err)
+		return cached.triples
+	}
+	resolver.netgroups[name] = cachedNetgroup{triples: triples, fetched: time.Now()}
+	return triples
+}
+
+func (resolver *GroupResolver) groupMembers(name string) []string {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	cached, ok := resolver.groups[name]
+	if ok && time.Since(cached.fetched) < resolver.ttl {
+		return cached.members
+	}
+	members, err := resolver.source.GroupMembers(name)
+	if err != nil {
+		log.Printf("%s", err)
+		return cached.members
+	}
+	resolver.groups[name] = cachedGroup{members: members, fetched: time.Now()}
+	return members
+}
+
+func netgroupFieldMatches(field string, value string) bool {
+	return field == "" || (field != "-" && strings.EqualFold(field, value))
+}
+
+// HostInNetgroup reports whether host (without port) is in the netgroup,
+// under its full or short name.
+func (resolver *GroupResolver) HostInNetgroup(host string, netgroup string) bool {
+	short := strings.SplitN(host, ".", 2)[0]
+	for _, triple := range resolver.netgroup(netgroup) {
+		if netgroupFieldMatches(triple.Host, host) || netgroupFieldMatches(triple.Host, short) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserInGroup reports whether user belongs to a group given as %<group> or
+// +<netgroup>.
+func (resolver *GroupResolver) UserInGroup(user string, group string) bool {
+	switch {
+	case strings.HasPrefix(group, "%"):
+		for _, member := range resolver.groupMembers(group[1:]) {
+			if member == user {
+				return true
+			}
+		}
+	case strings.HasPrefix(group, "+"):
+		for _, triple := range resolver.netgroup(group[1:]) {
+			if netgroupFieldMatches(triple.User, user) {
+				return true
+			}
+		}
+	}
+	return false
+}
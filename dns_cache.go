@@ -0,0 +1,108 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSCache caches the resolution of server names, including failures, so
+// that requests to the same servers do not wait on the DNS again. Go's
+// resolver does not report the TTL of records, so answers are kept for TTL,
+// and failures for NegativeTTL.
+type DNSCache struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	resolver net.Resolver
+	mu       sync.Mutex
+	entries  map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+func NewDNSCache(ttl time.Duration, negativeTTL time.Duration) *DNSCache {
+	return &DNSCache{TTL: ttl, NegativeTTL: negativeTTL, entries: make(map[string]*dnsEntry)}
+}
+
+// LookupIPAddr resolves host, from the cache if possible. Without a cache,
+// it resolves host with the default resolver.
+func (cache *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if cache == nil {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	now := time.Now()
+	cache.mu.Lock()
+	entry, ok := cache.entries[host]
+	cache.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	addrs, err := cache.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	ttl := cache.TTL
+	if err != nil {
+		ttl = cache.NegativeTTL
+	}
+	// Lookups cut short by the caller say nothing about the name.
+	if ttl > 0 && ctx.Err() == nil {
+		cache.mu.Lock()
+		cache.expire(now)
+		cache.entries[host] = &dnsEntry{addrs: addrs, err: err, expires: now.Add(ttl)}
+		cache.mu.Unlock()
+	}
+	return addrs, err
+}
+
+func (cache *DNSCache) expire(now time.Time) {
+	for host, entry := range cache.entries {
+		if !now.Before(entry.expires) {
+			delete(cache.entries, host)
+		}
+	}
+}
+
+// describeResolutionError explains why a name did not resolve, in terms an
+// approver understands.
+func describeResolutionError(err error) string {
+	dnsErr, ok := err.(*net.DNSError)
+	switch {
+	case !ok:
+		return err.Error()
+	case dnsErr.IsNotFound:
+		return "no such host"
+	case dnsErr.IsTimeout:
+		return "the DNS lookup timed out"
+	case dnsErr.IsTemporary:
+		return "temporary DNS failure: " + dnsErr.Err
+	}
+	return dnsErr.Err
+}
+
+// serverResolutionWarning warns approvers about servers whose names do not
+// resolve on the guardian's host, e.g. misspelled ones.
+func serverResolutionWarning(cache *DNSCache, server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), networkLookupTimeout)
+	defer cancel()
+	if _, err := cache.LookupIPAddr(ctx, host); err != nil {
+		return fmt.Sprintf("server %s does not resolve (%s); the intermediary may still reach it through its own DNS or a jump host",
+			host, describeResolutionError(err))
+	}
+	return ""
+}
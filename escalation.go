@@ -0,0 +1,131 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Risk tiers of prompts.
+const (
+	RiskNormal = "normal"
+	RiskHigh   = "high"
+)
+
+// Escalation says when an unanswered prompt draws attention to itself: first
+// with a bell (or sound), then with an urgent desktop notification. Zero
+// durations disable a step.
+type Escalation struct {
+	Bell   time.Duration
+	Urgent time.Duration
+}
+
+// DefaultEscalation is the escalation of prompts per risk tier.
+var DefaultEscalation = map[string]Escalation{
+	RiskNormal: {Bell: 30 * time.Second, Urgent: 2 * time.Minute},
+	RiskHigh:   {Bell: 10 * time.Second, Urgent: time.Minute},
+}
+
+// ParseEscalation parses an escalation such as "high:10s,1m" (a bell after
+// 10 seconds, and an urgent notification after a minute), and returns its
+// tier.
+func ParseEscalation(spec string) (string, Escalation, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || (parts[0] != RiskNormal && parts[0] != RiskHigh) {
+		return "", Escalation{}, fmt.Errorf("invalid escalation %q (expected %s:<bell>,<urgent> or %s:<bell>,<urgent>)", spec, RiskNormal, RiskHigh)
+	}
+	durations := strings.Split(parts[1], ",")
+	if len(durations) != 2 {
+		return "", Escalation{}, fmt.Errorf("invalid escalation %q (expected <tier>:<bell>,<urgent>)", spec)
+	}
+	var steps [2]time.Duration
+	for i, s := range durations {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d < 0 {
+			return "", Escalation{}, fmt.Errorf("invalid escalation %q: bad duration %q", spec, s)
+		}
+		steps[i] = d
+	}
+	return parts[0], Escalation{Bell: steps[0], Urgent: steps[1]}, nil
+}
+
+// escalate escalates prompt until ctx is done.
+func (ui *monitoredUI) escalate(ctx context.Context, prompt Prompt) {
+	risk := prompt.Risk
+	if risk == "" {
+		risk = RiskNormal
+	}
+	esc := ui.escalation[risk]
+	start := time.Now()
+	steps := []struct {
+		after time.Duration
+		do    func()
+	}{
+		{esc.Bell, ui.ring},
+		{esc.Urgent, func() {
+			ui.ring()
+			notifyUrgent("Guardian Agent request waiting", firstLine(prompt.Question))
+		}},
+	}
+	for _, step := range steps {
+		if step.after <= 0 {
+			continue
+		}
+		wait := time.NewTimer(step.after - time.Since(start))
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return
+		}
+		// Nobody would notice while the screen is locked.
+		if err := ui.screen.Wait(ctx); err != nil {
+			return
+		}
+		step.do()
+	}
+}
+
+// ring plays the prompt sound, or rings the terminal bell.
+func (ui *monitoredUI) ring() {
+	if ui.sound == "" {
+		fmt.Fprint(os.Stderr, "\a")
+		return
+	}
+	player := "paplay"
+	if runtime.GOOS == "darwin" {
+		player = "afplay"
+	}
+	if err := exec.Command(player, ui.sound).Run(); err != nil {
+		log.Printf("Failed to play %s: %s", ui.sound, err)
+		fmt.Fprint(os.Stderr, "\a")
+	}
+}
+
+// notifyUrgent shows an urgent desktop notification.
+func notifyUrgent(title string, msg string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q sound name \"Sosumi\"", msg, title))
+	case "linux":
+		cmd = exec.Command("notify-send", "--urgency=critical", "--app-name=sga-guard", title, msg)
+	default:
+		return
+	}
+	if err := cmd.Run(); err != nil {
+		log.Printf("Failed to show notification: %s", err)
+	}
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
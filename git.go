@@ -0,0 +1,121 @@
+package guardianagent
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	GitFetch = "fetch"
+	GitPush  = "push"
+)
+
+// GitCommand is the server side of a git operation over ssh, e.g.
+// "git-receive-pack 'infra/dns.git'".
+type GitCommand struct {
+	Operation string
+	Repo      string
+}
+
+var gitServices = map[string]string{
+	"git-upload-pack":    GitFetch,
+	"git-upload-archive": GitFetch,
+	"git-receive-pack":   GitPush,
+}
+
+// ParseGitCommand recognizes the commands git runs on the server for fetches
+// (git-upload-pack, git-upload-archive) and pushes (git-receive-pack).
+func ParseGitCommand(cmd string) (*GitCommand, bool) {
+	args := strings.Fields(cmd)
+	if len(args) >= 3 && path.Base(args[0]) == "git" {
+		// "git upload-pack 'repo'"
+		args = append([]string{"git-" + args[1]}, args[2:]...)
+	}
+	if len(args) != 2 {
+		return nil, false
+	}
+	op, ok := gitServices[path.Base(args[0])]
+	if !ok {
+		return nil, false
+	}
+	return &GitCommand{Operation: op, Repo: unquoteSCPPath(args[1])}, true
+}
+
+func (git *GitCommand) String() string {
+	if git.Operation == GitPush {
+		return fmt.Sprintf("git push to %s", git.Repo)
+	}
+	return fmt.Sprintf("git fetch from %s", git.Repo)
+}
+
+// GitRule matches git operations (fetch, push or both, if empty) on
+// repositories matching any of Repos (or any repository, if empty). Patterns
+// use path.Match syntax and are matched with and without a ".git" suffix,
+// ignoring leading "/" and "~/".
+type GitRule struct {
+	Operation string   `json:"Operation,omitempty" yaml:"operation,omitempty"`
+	Repos     []string `json:"Repos,omitempty" yaml:"repos,omitempty"`
+}
+
+func (rule *GitRule) validate() string {
+	if rule.Operation != "" && rule.Operation != GitFetch && rule.Operation != GitPush {
+		return fmt.Sprintf("invalid git operation %q (expected %s or %s)", rule.Operation, GitFetch, GitPush)
+	}
+	for _, repo := range rule.Repos {
+		if _, err := path.Match(repo, ""); err != nil {
+			return fmt.Sprintf("invalid repository pattern %q", repo)
+		}
+	}
+	return ""
+}
+
+func (rule *GitRule) matches(cmd string) bool {
+	git, ok := ParseGitCommand(cmd)
+	if !ok || (rule.Operation != "" && rule.Operation != git.Operation) {
+		return false
+	}
+	return len(rule.Repos) == 0 || matchesRepo(rule.Repos, git.Repo)
+}
+
+// MatchesGitRepoPattern reports whether repo on host matches a pattern of
+// sga-git-ssh's sga.repo config, "host:repo". The host may contain the
+// wildcards of the ssh config, and the repository is matched as in GitRule.
+func MatchesGitRepoPattern(pattern string, host string, repo string) bool {
+	i := strings.LastIndex(pattern, ":")
+	if i < 0 {
+		return false
+	}
+	host = host[strings.LastIndex(host, "@")+1:]
+	return matchesSSHPatternList(pattern[:i], host) && matchesRepo([]string{pattern[i+1:]}, repo)
+}
+
+func matchesRepo(patterns []string, repo string) bool {
+	repo = normalizeRepo(repo)
+	for _, pattern := range patterns {
+		pattern = normalizeRepo(pattern)
+		for _, candidate := range []string{repo, repo + ".git"} {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule *GitRule) describe() string {
+	what := "git operations"
+	if rule.Operation != "" {
+		what = "git " + rule.Operation + "es"
+	}
+	if len(rule.Repos) > 0 {
+		what += " on " + strings.Join(rule.Repos, ", ")
+	}
+	return what
+}
+
+func normalizeRepo(repo string) string {
+	repo = strings.TrimPrefix(repo, "~/")
+	repo = strings.TrimLeft(repo, "/")
+	return strings.TrimSuffix(path.Clean(repo), ".git")
+}
@@ -0,0 +1,101 @@
+package guardianagent
+
+import (
+	"sync"
+	"time"
+)
+
+// GitRunWindow is how long the user approves the rest of a git run for. Its
+// connections follow each other within seconds.
+const GitRunWindow = 2 * time.Minute
+
+type gitRunKey struct {
+	Client string
+	User   string
+	Host   string
+	Run    string
+}
+
+type gitRunGrant struct {
+	operation string
+	expires   time.Time
+}
+
+// GitRuns tracks git runs on intermediaries (e.g. a push, which connects to
+// the server again for each submodule) whose further operations on the same
+// server the user approved along with the first. Approving a push covers
+// fetches too, but approving a fetch covers only fetches.
+type GitRuns struct {
+	mu     sync.Mutex
+	grants map[gitRunKey]*gitRunGrant
+}
+
+func NewGitRuns() *GitRuns {
+	return &GitRuns{grants: make(map[gitRunKey]*gitRunGrant)}
+}
+
+func gitRunKeyOf(scope Scope, meta RequestMetadata) gitRunKey {
+	return gitRunKey{scope.Client, scope.ServiceUsername, scope.ServiceHostname, meta.GitRun}
+}
+
+// Grant approves the operations of the git run of meta on scope's server
+// for GitRunWindow.
+func (runs *GitRuns) Grant(scope Scope, cmd string, meta RequestMetadata) {
+	git, ok := ParseGitCommand(cmd)
+	if !ok {
+		return
+	}
+	runs.mu.Lock()
+	defer runs.mu.Unlock()
+	runs.expire()
+	runs.grants[gitRunKeyOf(scope, meta)] = &gitRunGrant{
+		operation: git.Operation,
+		expires:   time.Now().Add(GitRunWindow),
+	}
+}
+
+// Use checks whether cmd is a git operation covered by an approval of its
+// git run.
+func (runs *GitRuns) Use(scope Scope, cmd string, meta RequestMetadata) bool {
+	if runs == nil || meta.GitRun == "" {
+		return false
+	}
+	git, ok := ParseGitCommand(cmd)
+	if !ok {
+		return false
+	}
+	runs.mu.Lock()
+	defer runs.mu.Unlock()
+	runs.expire()
+	grant, ok := runs.grants[gitRunKeyOf(scope, meta)]
+	return ok && (grant.operation == GitPush || git.Operation == GitFetch)
+}
+
+// Offered reports whether the rest of the git run of meta may be approved
+// along with cmd.
+func (runs *GitRuns) Offered(cmd string, meta RequestMetadata) bool {
+	_, git := ParseGitCommand(cmd)
+	return runs != nil && meta.GitRun != "" && git
+}
+
+// RevokeAll ends all git run approvals, and returns how many there were.
+func (runs *GitRuns) RevokeAll() int {
+	if runs == nil {
+		return 0
+	}
+	runs.mu.Lock()
+	defer runs.mu.Unlock()
+	runs.expire()
+	count := len(runs.grants)
+	runs.grants = make(map[gitRunKey]*gitRunGrant)
+	return count
+}
+
+func (runs *GitRuns) expire() {
+	now := time.Now()
+	for key, grant := range runs.grants {
+		if now.After(grant.expires) {
+			delete(runs.grants, key)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoGuardian is returned by DialGuardian when no guardian can be reached.
+var ErrNoGuardian = errors.New("Failed to connect to agent guard. Did you setup agent guard forwarding to this host?")
+
+// DeniedError is returned for requests the guardian denied.
+type DeniedError struct {
+	RequestID string
+
+	// One of the Denial codes; empty for older guardians.
+	Code   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("execution denied by agent (%s, request %s): %s", e.Code, e.RequestID, e.Reason)
+	}
+	return fmt.Sprintf("execution denied by agent (request %s): %s", e.RequestID, e.Reason)
+}
+
+// Explanation tells users what they can do about the denial, if anything.
+func (e *DeniedError) Explanation() string {
+	return explainDenial(e.Code)
+}
+
+// UnsupportedError is returned when the guardian does not support a
+// request, e.g. since it is older than the client.
+type UnsupportedError struct {
+	What string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("the guardian does not support %s", e.What)
+}
+
+// ClosedBeforeHandoffError is returned by Handoff, along with the client,
+// when the connection to the server ended before it was handed off, e.g.
+// since the command exited right away. Err is the error the connection
+// ended with, if any.
+type ClosedBeforeHandoffError struct {
+	Err error
+}
+
+func (e *ClosedBeforeHandoffError) Error() string {
+	if e.Err == nil {
+		return "the connection to the server closed before the handoff"
+	}
+	return fmt.Sprintf("the connection to the server closed before the handoff: %s", e.Err)
+}
+
+// GuardianClient speaks the control protocol with the guardian, for tools
+// running commands on its behalf, like sga-ssh.
+type GuardianClient struct {
+	// Called when the connection was lost while waiting for a decision,
+	// before reconnecting.
+	OnReconnect func(err error)
+
+	guardKey string
+	routines sync.WaitGroup
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// DialGuardian connects to the guardian forwarded to this host, encrypting
+// the connection to guardKey if set (see DialNoise). The socket is looked up
+// in $SGA_GUARD_SOCK, then in the runtime directory.
+func DialGuardian(ctx context.Context, guardKey string) (*GuardianClient, error) {
+	gc := &GuardianClient{guardKey: guardKey}
+	var err error
+	if gc.conn, err = dialGuardianConn(ctx, guardKey); err != nil {
+		return nil, err
+	}
+	return gc, nil
+}
+
+func dialGuardianConn(ctx context.Context, guardKey string) (net.Conn, error) {
+	locations := []string{path.Join(UserRuntimeDir(), AgentGuardSockName)}
+	// E.g. the socket of a reverse tunnel on a jump host.
+	if sock := os.Getenv("SGA_GUARD_SOCK"); sock != "" {
+		locations = append([]string{sock}, locations...)
+	}
+	var dialer net.Dialer
+	for _, loc := range locations {
+		sock, err := dialer.DialContext(ctx, "unix", loc)
+		if err != nil {
+			continue
+		}
+		stop := closeOnCancel(ctx, sock)
+		if guardKey != "" {
+			encrypted, err := DialNoise(sock, guardKey)
+			if err != nil {
+				stop()
+				sock.Close()
+				return nil, fmt.Errorf("Failed to connect to agent guard at %s: %s", loc, err)
+			}
+			sock = encrypted
+		}
+		query := AgentCExtensionMsg{
+			ExtensionType: AgentGuardExtensionType,
+		}
+		err = WriteControlPacket(sock, MsgAgentCExtension, ssh.Marshal(query))
+		var msgNum byte
+		if err == nil {
+			msgNum, _, err = ReadControlPacket(sock)
+		}
+		stop()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil && msgNum == MsgAgentSuccess {
+			return sock, nil
+		}
+		sock.Close()
+	}
+	return nil, ErrNoGuardian
+}
+
+// closeOnCancel closes conn if ctx is done before the returned function is
+// called, to interrupt the calls blocked on it.
+func closeOnCancel(ctx context.Context, conn io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (gc *GuardianClient) current() net.Conn {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.conn
+}
+
+// Close closes the connection, and waits for the session handed off over it,
+// if any, to end.
+func (gc *GuardianClient) Close() error {
+	err := gc.current().Close()
+	gc.routines.Wait()
+	return err
+}
+
+// SendForwardingNotice names the client, for forwarders of connections to
+// the guardian which do not name their clients themselves.
+func (gc *GuardianClient) SendForwardingNotice(ctx context.Context, client string) error {
+	conn := gc.current()
+	defer closeOnCancel(ctx, conn)()
+	err := WriteControlPacket(conn, MsgAgentForwardingNotice, ssh.Marshal(AgentForwardingNoticeMsg{Client: client}))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ExecutionRequest asks the guardian to run a command on a server.
+type ExecutionRequest struct {
+	User    string
+	Server  string
+	Command string
+
+	// Sent along with the request. A request ID is chosen if it has none.
+	Metadata RequestMetadata
+}
+
+// Approval is the guardian's approval of an ExecutionRequest.
+type Approval struct {
+	RequestID string
+
+	// The command to run, which the approver may have modified.
+	Command string
+
+	// Recording of the session the guardian requires, if any, and the
+	// recipients to encrypt it to.
+	Recording           string
+	RecordingRecipients []string
+}
+
+// Number of times to reconnect to the guardian while waiting for a decision,
+// and the delay before the first attempt, which doubles on each attempt.
+const approvalReconnectAttempts = 6
+const approvalReconnectDelay = 2 * time.Second
+
+// RequestExecution sends an execution request and waits for the decision,
+// returning a *DeniedError if the request is denied. Guardians that support
+// it send keepalives while the decision is pending; if the connection is lost
+// after that, the request is resent, with the same request ID, on a new
+// connection to resume waiting for the same decision.
+func (gc *GuardianClient) RequestExecution(ctx context.Context, req ExecutionRequest) (*Approval, error) {
+	if req.Metadata.RequestID == "" {
+		id, err := NewRequestID()
+		if err != nil {
+			return nil, err
+		}
+		req.Metadata.RequestID = id
+	}
+	requestID := req.Metadata.RequestID
+	execReqPacket := ssh.Marshal(ExecutionRequestMessage{
+		User:     req.User,
+		Command:  req.Command,
+		Server:   req.Server,
+		Metadata: req.Metadata.Marshal(),
+	})
+
+	msgNum, msg, err := gc.awaitDecision(ctx, execReqPacket)
+	if err != nil {
+		return nil, err
+	}
+	switch msgNum {
+	case MsgExecutionApproved:
+		approval := &Approval{RequestID: requestID, Command: req.Command}
+		// Older guardians send an empty approval.
+		if len(msg) > 0 {
+			var approvedMsg ExecutionApprovedMessage
+			if err = ssh.Unmarshal(msg, &approvedMsg); err != nil {
+				return nil, fmt.Errorf("failed to parse approval from agent: %s", err)
+			}
+			if err = checkResponseID(approvedMsg.Metadata, requestID); err != nil {
+				return nil, err
+			}
+			if respMeta, err := ParseRequestMetadata(approvedMsg.Metadata); err == nil {
+				approval.Recording = respMeta.Recording
+				approval.RecordingRecipients = respMeta.RecordingRecipients
+			}
+			if approvedMsg.Command != "" {
+				approval.Command = approvedMsg.Command
+			}
+		}
+		return approval, nil
+	case MsgExecutionDenied:
+		var denyMsg ExecutionDeniedMessage
+		ssh.Unmarshal(msg, &denyMsg)
+		denied := &DeniedError{RequestID: requestID, Reason: denyMsg.Reason}
+		// Older guardians send no denial code.
+		if respMeta, err := ParseRequestMetadata(denyMsg.Metadata); err == nil {
+			denied.Code = respMeta.Denial
+		}
+		return nil, denied
+	}
+	return nil, fmt.Errorf("failed to get approval from agent, unknown reply: %d", msgNum)
+}
+
+func (gc *GuardianClient) awaitDecision(ctx context.Context, execReqPacket []byte) (msgNum byte, msg []byte, err error) {
+	resumable := false
+	delay := approvalReconnectDelay
+	for attempt := 0; ; attempt++ {
+		conn := gc.current()
+		stop := closeOnCancel(ctx, conn)
+		err = WriteControlPacket(conn, MsgExecutionRequest, execReqPacket)
+		for err == nil {
+			msgNum, msg, err = ReadControlPacket(conn)
+			if err != nil || msgNum != MsgExecutionPending {
+				break
+			}
+			// Only rely on keepalives once the guardian has shown it sends them.
+			resumable = true
+			conn.SetReadDeadline(time.Now().Add(3 * pendingKeepAliveInterval))
+		}
+		stop()
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		if err == nil {
+			conn.SetReadDeadline(time.Time{})
+			return msgNum, msg, nil
+		}
+		if !resumable || attempt == approvalReconnectAttempts {
+			return 0, nil, fmt.Errorf("failed to get approval from agent: %s", err)
+		}
+		log.Printf("Lost connection to guardian while waiting for approval: %s", err)
+		if gc.OnReconnect != nil {
+			gc.OnReconnect(err)
+		}
+		conn.Close()
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if conn, err = dialGuardianConn(ctx, gc.guardKey); err != nil {
+			log.Printf("%s", err)
+			continue
+		}
+		gc.mu.Lock()
+		gc.conn = conn
+		gc.mu.Unlock()
+	}
+}
+
+// checkResponseID makes sure a response echoing a request ID belongs to the
+// request with the given ID. Older guardians do not echo it.
+func checkResponseID(respMeta []byte, id string) error {
+	if len(respMeta) == 0 {
+		return nil
+	}
+	meta, err := ParseRequestMetadata(respMeta)
+	if err != nil {
+		return err
+	}
+	if meta.RequestID != id {
+		return fmt.Errorf("agent responded to request %s instead of %s", meta.RequestID, id)
+	}
+	return nil
+}
+
+// ReportRecording reports the hash of the recording of a session, for the
+// guardian to record in its audit log.
+func (gc *GuardianClient) ReportRecording(ctx context.Context, requestID string, hash string) error {
+	conn := gc.current()
+	defer closeOnCancel(ctx, conn)()
+	err := WriteControlPacket(conn, MsgSessionRecorded, ssh.Marshal(SessionRecordedMessage{RequestID: requestID, Hash: hash}))
+	var msgNum byte
+	if err == nil {
+		msgNum, _, err = ReadControlPacket(conn)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil && msgNum != MsgAgentSuccess {
+		err = &UnsupportedError{What: "recordings"}
+	}
+	return err
+}
+
+// SSHAgent returns the ssh-agent of the guardian, if it runs with
+// --agent-passthrough, which asks to approve every signature.
+func (gc *GuardianClient) SSHAgent() agent.ExtendedAgent {
+	return agent.NewClient(gc.current())
+}
+
+// Handoff runs an approved command: it connects to the server over
+// serverReader and serverWriter through the guardian, which authenticates,
+// calls start to start the command, e.g. in a new session, and then takes
+// over the connection once the guardian hands it off. It returns the client,
+// which talks to the server directly from then on, and which the caller must
+// close before closing the GuardianClient.
+func (gc *GuardianClient) Handoff(ctx context.Context, hostPort string, serverReader io.Reader, serverWriter io.WriteCloser, start func(*ssh.Client) error) (*ssh.Client, error) {
+	defer closeOnCancel(ctx, gc.current())()
+	sshClient, err := gc.handoff(hostPort, serverReader, serverWriter, start)
+	if ctx.Err() != nil {
+		return sshClient, ctx.Err()
+	}
+	return sshClient, err
+}
+
+func (gc *GuardianClient) handoff(hostPort string, serverReader io.Reader, serverWriter io.WriteCloser, start func(*ssh.Client) error) (*ssh.Client, error) {
+	ymux, err := yamux.Client(gc.current(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to multiplex agent connection: %s", err)
+	}
+	control, err := ymux.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get control stream: %s", err)
+	}
+	// Proceed with approval
+	agentData, err := ymux.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data stream: %s", err)
+	}
+	pt, err := ymux.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transport stream: %s", err)
+	}
+	agentTransport := CustomConn{Conn: pt}
+
+	sshClientConn, sshPipe := net.Pipe()
+
+	// Initially, the SSH connection is wired to the agent data,
+	// and the server connection is wired to the agent transport.
+	sshOut := settableWriter{w: agentData}
+	serverOut := settableWriter{w: &agentTransport}
+	// To be used to buffer traffic that needs to be replayed to the client
+	// after the handoff (since the transport layer might deliver to the agent
+	// packets that the server has sent after msgNewKeys).
+	bufferedTraffic := new(bytes.Buffer)
+	bufferedOffset := 0
+
+	gc.routines.Add(1)
+	go func() {
+		defer gc.routines.Done()
+
+		_, err := io.Copy(&sshOut, sshPipe)
+		if err != nil {
+			log.Printf("Error copying outgoing SSH data: %s", err)
+		} else {
+			log.Printf("Finished copying outgoing SSH data")
+		}
+		sshOut.mu.Lock()
+		sshOut.Close()
+		sshOut.w = nil
+		sshOut.mu.Unlock()
+	}()
+
+	agentDone := make(chan error, 1)
+	gc.routines.Add(1)
+	go func() {
+		defer gc.routines.Done()
+		_, err := io.Copy(sshPipe, agentData)
+		if debugClient {
+			log.Printf("Finished copying ssh data from agent: %s", err)
+		}
+		if err != nil {
+			sshPipe.Close()
+			agentDone <- fmt.Errorf("failed to read ssh data from agent: %s", err)
+			return
+		}
+
+		serverOut.mu.Lock()
+		defer serverOut.mu.Unlock()
+
+		handoffByte, err := getHandoffNextTransportByte(control)
+
+		if err != nil {
+			agentDone <- err
+			sshPipe.Close()
+			return
+		}
+
+		syncBufferedTraffic(bufferedTraffic, bufferedOffset, handoffByte)
+		n, err := bufferedTraffic.WriteTo(sshPipe)
+		if err != nil {
+			agentDone <- fmt.Errorf("failed to backfill traffic from server to client: %s", err)
+			sshPipe.Close()
+			return
+		}
+		if debugClient {
+			log.Printf("Backfilled %d bytes from server to client", n)
+		}
+
+		agentDone <- nil
+
+		if serverOut.werr != nil {
+			io.Copy(sshPipe, serverReader)
+			sshPipe.Close()
+		} else {
+			agentTransport.Close()
+			serverOut.w = sshPipe
+		}
+
+	}()
+
+	gc.routines.Add(1)
+	go func() {
+		defer gc.routines.Done()
+		_, err := io.Copy(&serverOut, serverReader)
+		if debugClient {
+			log.Printf("Finished copying transport data to agent")
+		}
+		serverOut.Close()
+		if err != nil && err != os.ErrClosed && err != yamux.ErrStreamClosed {
+			log.Printf("To agent transport forwarding failed: %s", err)
+		}
+	}()
+	fromAgentTransportDone := make(chan error, 1)
+
+	gc.routines.Add(1)
+	go func() {
+		defer gc.routines.Done()
+
+		_, err := io.Copy(serverWriter, &agentTransport)
+		if debugClient {
+			log.Printf("Finished copying transport data from agent")
+		}
+
+		sshOut.mu.Lock()
+		if sshOut.w != nil {
+			sshOut.Close()
+			sshOut.w = serverWriter
+		} else {
+			if cw, ok := serverWriter.(CloseWriter); ok {
+				log.Printf("CloseWrite serverWriter")
+				cw.CloseWrite()
+			} else {
+				log.Printf("Close serverWriter")
+				serverWriter.Close()
+			}
+		}
+		sshOut.mu.Unlock()
+
+		if err != nil {
+			fromAgentTransportDone <- fmt.Errorf("failed to copy data from agent to server: %s", err)
+		} else {
+			fromAgentTransportDone <- nil
+		}
+	}()
+
+	doHandoffOnKex := make(chan chan error, 1)
+	kexCallback := func() {
+		if debugClient {
+			log.Printf("KexCallback called")
+		}
+		var done chan error
+		select {
+		case done = <-doHandoffOnKex:
+			break
+		default:
+			return
+		}
+
+		if debugClient {
+			log.Printf("Starting transport rewiring")
+		}
+
+		if err := <-fromAgentTransportDone; err != nil {
+			done <- fmt.Errorf("failed to forward agent transport data: %s", err)
+			return
+		}
+
+		go func() {
+			done <- <-agentDone
+		}()
+	}
+
+	config := ssh.ClientConfig{
+		Config: ssh.Config{
+			KexCallback: kexCallback,
+		},
+		HostKeyCallback:          ssh.InsecureIgnoreHostKey(),
+		DeferHostKeyVerification: true,
+	}
+
+	cc, chans, reqs, err := ssh.NewClientConn(sshClientConn, hostPort, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %s", hostPort, err)
+	}
+
+	sshClient := ssh.NewClient(cc, chans, reqs)
+	if sshClient == nil {
+		return nil, fmt.Errorf("failed to connect to [%s]: %v", hostPort, err)
+	}
+
+	if err = start(sshClient); err != nil {
+		return sshClient, fmt.Errorf("failed to run command: %s", err)
+	}
+
+	ok, _, err := sshClient.SendRequest(ssh.NoMoreSessionRequestName, true, nil)
+	if err != nil {
+		return sshClient, fmt.Errorf("failed to send %s: %s", ssh.NoMoreSessionRequestName, err)
+	}
+	if !ok {
+		log.Printf("%s request denied, continuing", ssh.NoMoreSessionRequestName)
+	}
+
+	handoffComplete := make(chan error, 1)
+	doHandoffOnKex <- handoffComplete
+
+	if debugClient {
+		log.Printf("Initiating Handoff Key Exchange")
+	}
+
+	// First start buffering traffic from the server, since packets
+	// sent by ther server after msgNewKeys might need to replayed
+	// to the client after the handoff.
+	serverOut.mu.Lock()
+	serverOut.w = io.MultiWriter(bufferedTraffic, serverOut.w)
+	bufferedOffset = agentTransport.BytesWritten()
+	serverOut.mu.Unlock()
+
+	sshClient.RequestKeyChange()
+	errChan := make(chan error)
+	go func() {
+		errChan <- sshClient.Wait()
+	}()
+
+	select {
+	case err = <-handoffComplete:
+		if err != nil {
+			return sshClient, err
+		}
+		if debugClient {
+			log.Printf("Handoff Complete")
+		}
+		return sshClient, nil
+	case err = <-errChan:
+		if debugClient {
+			log.Printf("Command finished before handoff: %s", err)
+		}
+		return sshClient, &ClosedBeforeHandoffError{Err: err}
+	}
+}
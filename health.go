@@ -0,0 +1,209 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// A prompt left unanswered for longer than this makes the guardian unready,
+// since it blocks all other prompts.
+const maxPromptAge = 15 * time.Minute
+
+// Health describes the state of the guardian, for supervisors.
+type Health struct {
+	Ready bool
+	// Reasons the guardian is not ready.
+	Problems []string
+
+	PolicyLoaded bool
+	UIAvailable  bool
+	// Keys available for signing in to servers, from the local ssh-agent or
+	// key files.
+	Signers int
+
+	PendingPrompts int
+	OldestPrompt   time.Duration `json:",omitempty"`
+	// Prompts are deferred until the screen is unlocked.
+	ScreenLocked    bool `json:",omitempty"`
+	ActiveSessions  int
+	PendingRequests int
+	Lockdown        *LockdownState `json:",omitempty"`
+	// How far the clock is off, if more than tolerated.
+	ClockOffset time.Duration `json:",omitempty"`
+}
+
+// Health checks the guardian's dependencies.
+func (agent *Agent) Health() Health {
+	var health Health
+	problem := func(format string, args ...interface{}) {
+		health.Problems = append(health.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, err := os.Stat(agent.policyConfigPath); err != nil {
+		problem("policy store: %s", err)
+	} else {
+		health.PolicyLoaded = true
+	}
+	if err := agent.ui.Available(); err != nil {
+		problem("prompts: %s", err)
+	} else {
+		health.UIAvailable = true
+	}
+	health.Signers = countSigners()
+	if health.Signers == 0 {
+		problem("no keys in the local ssh-agent or key files")
+	}
+	health.PendingPrompts, health.OldestPrompt = agent.ui.pending()
+	health.ScreenLocked = agent.ui.screen.Locked()
+	// Prompts waiting for the approver to come back are expected.
+	if health.OldestPrompt > maxPromptAge && !health.ScreenLocked {
+		problem("a prompt has been waiting for %s", health.OldestPrompt.Round(time.Second))
+	}
+	if state := agent.policy.Lockdown.Active(); state != nil {
+		health.Lockdown = state
+		problem("locked down since %s: %s", state.Since.Format(time.RFC3339), state.Reason)
+	}
+	if offset, skewed := agent.policy.Clock.Offset(); skewed {
+		health.ClockOffset = offset
+		problem("%s", agent.policy.Clock.Warning())
+	}
+	health.ActiveSessions = agent.policy.Sessions.Count()
+	health.PendingRequests = agent.pending.Count()
+	health.Ready = len(health.Problems) == 0
+	return health
+}
+
+func countSigners() int {
+	if realAgentPath := os.Getenv("SSH_AUTH_SOCK"); realAgentPath != "" {
+		if realAgent, err := net.Dial("unix", realAgentPath); err == nil {
+			defer realAgent.Close()
+			if keys, err := agent.NewClient(realAgent).List(); err == nil && len(keys) > 0 {
+				return len(keys)
+			}
+		}
+	}
+	// Only check that key files exist, since loading them may require a
+	// passphrase.
+	curuser, err := user.Current()
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, keyFile := range []string{"identity", "id_dsa", "id_rsa", "id_ecdsa", "id_ed25519"} {
+		if _, err := os.Stat(curuser.HomeDir + "/.ssh/" + keyFile); err == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// monitoredUI tracks the prompts waiting for the user, and defers them while
+// the screen is locked.
+type monitoredUI struct {
+	UI
+
+	// If set, prompts wait for the screen to be unlocked.
+	screen *ScreenLock
+
+	// Prompts are also shown by these, e.g. on paired mobile devices.
+	remotes []RemoteApprover
+
+	// Unanswered prompts ring after a while, and then show an urgent
+	// notification, per risk tier.
+	escalation map[string]Escalation
+	sound      string
+
+	mu      sync.Mutex
+	started map[*time.Time]bool
+}
+
+func newMonitoredUI(ui UI) *monitoredUI {
+	return &monitoredUI{UI: ui, escalation: DefaultEscalation, started: make(map[*time.Time]bool)}
+}
+
+func (ui *monitoredUI) track() func() {
+	start := time.Now()
+	ui.mu.Lock()
+	ui.started[&start] = true
+	ui.mu.Unlock()
+	return func() {
+		ui.mu.Lock()
+		delete(ui.started, &start)
+		ui.mu.Unlock()
+	}
+}
+
+func (ui *monitoredUI) pending() (int, time.Duration) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	var oldest time.Duration
+	for start := range ui.started {
+		if age := time.Since(*start); age > oldest {
+			oldest = age
+		}
+	}
+	return len(ui.started), oldest
+}
+
+// Available reports whether prompts can be shown at all.
+func (ui *monitoredUI) Available() error {
+	switch ui.UI.(type) {
+	case *FancyTerminalUI:
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("standard input is not a terminal")
+		}
+	case *AskPassUI:
+		if _, err := exec.LookPath("ssh-askpass"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ui *monitoredUI) Ask(ctx context.Context, prompt Prompt) (int, error) {
+	defer ui.track()()
+	escalating, stop := context.WithCancel(ctx)
+	defer stop()
+	go ui.escalate(escalating, prompt)
+	ask := func(ctx context.Context) (int, error) {
+		if err := ui.screen.Wait(ctx); err != nil {
+			return 0, err
+		}
+		return ui.UI.Ask(ctx, prompt)
+	}
+	// Locked screens do not hold up remote approvers.
+	return raceApprovers(ctx, prompt, ask, ui.remotes)
+}
+
+func (ui *monitoredUI) Confirm(msg string) bool {
+	defer ui.track()()
+	if err := ui.screen.Wait(context.Background()); err != nil {
+		return false
+	}
+	return ui.UI.Confirm(msg)
+}
+
+func (ui *monitoredUI) AskPassword(msg string) (string, error) {
+	defer ui.track()()
+	if err := ui.screen.Wait(context.Background()); err != nil {
+		return "", err
+	}
+	return ui.UI.AskPassword(msg)
+}
+
+func (ui *monitoredUI) Edit(ctx context.Context, msg string, text string) (string, error) {
+	defer ui.track()()
+	if err := ui.screen.Wait(ctx); err != nil {
+		return "", err
+	}
+	return ui.UI.Edit(ctx, msg, text)
+}
@@ -0,0 +1,274 @@
+package guardianagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Approved requests needed before the hour of a request is judged.
+const historyMinApprovals = 20
+
+// More requests than this from a client within historyBurstWindow are a burst.
+const historyBurstLimit = 10
+const historyBurstWindow = time.Minute
+
+// clientHistory is what is known of the past requests of a client.
+type clientHistory struct {
+	// Binaries approved per server (host:port), with the last approval.
+	Binaries map[string]map[string]time.Time
+
+	// Approved requests by hour of the day (local time).
+	Hours [24]int
+
+	Approvals int
+
+	// Times of the recent requests, for burst detection.
+	recent []time.Time
+}
+
+// History records the commands approved for each client, to flag requests
+// that differ from the client's usual behavior. It is saved next to the
+// personal policy.
+type History struct {
+	mu      sync.Mutex
+	path    string
+	clients map[string]*clientHistory
+}
+
+// NewHistory loads the history saved at path, if any.
+func NewHistory(path string) (*History, error) {
+	history := &History{path: path, clients: make(map[string]*clientHistory)}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read command history: %s", err)
+	}
+	if err = json.Unmarshal(buf, &history.clients); err != nil {
+		return nil, fmt.Errorf("Failed to parse command history %s: %s", path, err)
+	}
+	return history, nil
+}
+
+func (history *History) client(name string) *clientHistory {
+	client, ok := history.clients[name]
+	if !ok {
+		client = &clientHistory{Binaries: make(map[string]map[string]time.Time)}
+		history.clients[name] = client
+	}
+	return client
+}
+
+// commandBinary returns the name of the program cmd runs, skipping
+// environment assignments.
+func commandBinary(cmd string) string {
+	for _, field := range strings.Fields(cmd) {
+		if strings.Contains(field, "=") && !strings.HasPrefix(field, "=") {
+			continue
+		}
+		return path.Base(field)
+	}
+	return ""
+}
+
+// Anomalies counts the request and describes how it differs from the
+// client's history.
+func (history *History) Anomalies(scope Scope, cmd string) []string {
+	if history == nil {
+		return nil
+	}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	now := time.Now()
+	client := history.client(scope.Client)
+	cutoff := now.Add(-historyBurstWindow)
+	for len(client.recent) > 0 && client.recent[0].Before(cutoff) {
+		client.recent = client.recent[1:]
+	}
+	client.recent = append(client.recent, now)
+
+	var anomalies []string
+	if binary := commandBinary(cmd); binary != "" {
+		ranElsewhere := false
+		for _, binaries := range client.Binaries {
+			if _, ok := binaries[binary]; ok {
+				ranElsewhere = true
+			}
+		}
+		if !ranElsewhere {
+			anomalies = append(anomalies, fmt.Sprintf("first time %s has asked to run %s", scope.Client, binary))
+		} else if _, ok := client.Binaries[scope.ServiceHostname][binary]; !ok {
+			anomalies = append(anomalies, fmt.Sprintf("first time %s has asked to run %s on %s", scope.Client, binary, scope.ServiceHostname))
+		}
+	}
+	if client.Approvals >= historyMinApprovals && client.Hours[now.Hour()] == 0 {
+		anomalies = append(anomalies, fmt.Sprintf("%s has never made requests at this hour (%02d:00)", scope.Client, now.Hour()))
+	}
+	if len(client.recent) > historyBurstLimit {
+		anomalies = append(anomalies, fmt.Sprintf("burst of %d requests from %s in the last %s", len(client.recent), scope.Client, historyBurstWindow))
+	}
+	return anomalies
+}
+
+// Hosts returns the servers requests were approved for.
+func (history *History) Hosts() []string {
+	if history == nil {
+		return nil
+	}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	var hosts []string
+	for _, client := range history.clients {
+		for host := range client.Binaries {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// HistorySummary is what the history knows of a client and the program a
+// request runs.
+type HistorySummary struct {
+	Approvals int `json:"approvals"`
+
+	// Last approval of the program on the server, and on any server.
+	LastApprovedOnHost *time.Time `json:"last_approved_on_host,omitempty"`
+	LastApproved       *time.Time `json:"last_approved,omitempty"`
+}
+
+// Summary summarizes the history of the client of scope with the program cmd
+// runs.
+func (history *History) Summary(scope Scope, cmd string) HistorySummary {
+	var summary HistorySummary
+	if history == nil {
+		return summary
+	}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	client, ok := history.clients[scope.Client]
+	if !ok {
+		return summary
+	}
+	summary.Approvals = client.Approvals
+	binary := commandBinary(cmd)
+	for host, binaries := range client.Binaries {
+		at, ok := binaries[binary]
+		if !ok {
+			continue
+		}
+		if host == scope.ServiceHostname {
+			summary.LastApprovedOnHost = &at
+		}
+		if summary.LastApproved == nil || at.After(*summary.LastApproved) {
+			last := at
+			summary.LastApproved = &last
+		}
+	}
+	return summary
+}
+
+// RecordApproval adds an approved request to the history.
+func (history *History) RecordApproval(scope Scope, cmd string) error {
+	if history == nil {
+		return nil
+	}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	now := time.Now()
+	client := history.client(scope.Client)
+	if binary := commandBinary(cmd); binary != "" {
+		binaries, ok := client.Binaries[scope.ServiceHostname]
+		if !ok {
+			binaries = make(map[string]time.Time)
+			client.Binaries[scope.ServiceHostname] = binaries
+		}
+		binaries[binary] = now
+	}
+	client.Hours[now.Hour()]++
+	client.Approvals++
+	return history.save()
+}
+
+// Export returns the saved form of the history.
+func (history *History) Export() ([]byte, error) {
+	if history == nil {
+		return nil, nil
+	}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	return json.Marshal(history.clients)
+}
+
+// Import merges an exported history into this one.
+func (history *History) Import(buf []byte) error {
+	if history == nil || len(buf) == 0 {
+		return nil
+	}
+	var clients map[string]*clientHistory
+	if err := json.Unmarshal(buf, &clients); err != nil {
+		return fmt.Errorf("Failed to parse command history: %s", err)
+	}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	for name, imported := range clients {
+		client := history.client(name)
+		for host, binaries := range imported.Binaries {
+			if client.Binaries[host] == nil {
+				client.Binaries[host] = make(map[string]time.Time)
+			}
+			for binary, last := range binaries {
+				if last.After(client.Binaries[host][binary]) {
+					client.Binaries[host][binary] = last
+				}
+			}
+		}
+		for hour, count := range imported.Hours {
+			client.Hours[hour] += count
+		}
+		client.Approvals += imported.Approvals
+	}
+	return history.save()
+}
+
+func (history *History) save() error {
+	buf, err := json.Marshal(history.clients)
+	if err != nil {
+		return err
+	}
+	tmpPath := history.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("Failed to save command history: %s", err)
+	}
+	return os.Rename(tmpPath, history.path)
+}
+
+// RequestContext is what the guardian found out about a request, beyond what
+// the client sent.
+type RequestContext struct {
+	// Mismatches between the client's name and its address.
+	Warnings  []string
+	Anomalies []string
+	Network   string
+}
+
+// describe formats the context shown to approvers.
+func (context *RequestContext) describe() string {
+	var desc string
+	for _, warning := range context.Warnings {
+		desc += fmt.Sprintf("\n  WARNING: %s", displayLine(warning))
+	}
+	if context.Network != "" {
+		desc += fmt.Sprintf("\n  Network: %s", displayLine(context.Network))
+	}
+	for _, anomaly := range context.Anomalies {
+		desc += fmt.Sprintf("\n  UNUSUAL: %s", displayLine(anomaly))
+	}
+	return desc
+}
@@ -0,0 +1,87 @@
+package guardianagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const slackQueueSize = 64
+
+// SlackHook posts decisions and errors to a Slack incoming webhook.
+type SlackHook struct {
+	url   string
+	queue chan string
+	done  chan struct{}
+}
+
+func NewSlackHook(webhookURL string) *SlackHook {
+	hook := &SlackHook{
+		url:   webhookURL,
+		queue: make(chan string, slackQueueSize),
+		done:  make(chan struct{}),
+	}
+	go hook.run()
+	return hook
+}
+
+func (hook *SlackHook) OnRequest(entry AuditEntry) {}
+
+func (hook *SlackHook) OnDecision(entry AuditEntry) {
+	what := "any command"
+	if entry.Command != "" {
+		what = fmt.Sprintf("`%s`", entry.Command)
+	}
+	text := fmt.Sprintf("*%s*: %s by %s on %s@%s", entry.Decision, what,
+		entry.Scope.Client, entry.Scope.ServiceUsername, entry.Scope.ServiceHostname)
+	if entry.Detail != "" {
+		text += fmt.Sprintf(" (%s)", entry.Detail)
+	}
+	if entry.Approver != "" {
+		text += " by " + entry.Approver
+	}
+	hook.post(text)
+}
+
+func (hook *SlackHook) OnHandoff(entry AuditEntry) {}
+
+func (hook *SlackHook) OnError(entry AuditEntry) {
+	hook.post(fmt.Sprintf("*error* for %s on %s@%s: %s",
+		entry.Scope.Client, entry.Scope.ServiceUsername, entry.Scope.ServiceHostname, entry.Detail))
+}
+
+func (hook *SlackHook) post(text string) {
+	select {
+	case hook.queue <- text:
+	default:
+		log.Printf("Slack hook is not keeping up, dropped message")
+	}
+}
+
+func (hook *SlackHook) run() {
+	defer close(hook.done)
+	client := http.Client{Timeout: 10 * time.Second}
+	for text := range hook.queue {
+		body, _ := json.Marshal(struct {
+			Text string `json:"text"`
+		}{text})
+		resp, err := client.Post(hook.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Failed to post to Slack: %s", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Failed to post to Slack: %s", resp.Status)
+		}
+	}
+}
+
+func (hook *SlackHook) Close() error {
+	close(hook.queue)
+	<-hook.done
+	return nil
+}
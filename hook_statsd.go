@@ -0,0 +1,50 @@
+package guardianagent
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+var statsdNameSanitizer = strings.NewReplacer(" ", "_", ".", "_", ":", "_", "|", "_", "@", "_")
+
+// StatsdHook counts requests, decisions, handoffs and errors in statsd, as
+// <prefix>.requests, <prefix>.decisions.<decision> (e.g. sga.decisions.denied),
+// <prefix>.handoffs.<outcome> and <prefix>.errors.
+type StatsdHook struct {
+	conn   net.Conn
+	prefix string
+}
+
+func NewStatsdHook(addr string, prefix string) (*StatsdHook, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to statsd at %s: %s", addr, err)
+	}
+	return &StatsdHook{conn: conn, prefix: prefix}, nil
+}
+
+func (hook *StatsdHook) OnRequest(entry AuditEntry) {
+	hook.count("requests")
+}
+
+func (hook *StatsdHook) OnDecision(entry AuditEntry) {
+	hook.count("decisions." + statsdNameSanitizer.Replace(entry.Decision))
+}
+
+func (hook *StatsdHook) OnHandoff(entry AuditEntry) {
+	hook.count("handoffs." + statsdNameSanitizer.Replace(entry.Decision))
+}
+
+func (hook *StatsdHook) OnError(entry AuditEntry) {
+	hook.count("errors")
+}
+
+func (hook *StatsdHook) count(name string) {
+	// Metrics are best effort; UDP writes do not block.
+	fmt.Fprintf(hook.conn, "%s.%s:1|c", hook.prefix, name)
+}
+
+func (hook *StatsdHook) Close() error {
+	return hook.conn.Close()
+}
@@ -0,0 +1,49 @@
+package guardianagent
+
+import (
+	"io"
+)
+
+// Hook receives the events of the approval flow, for custom notifications or
+// telemetry. Hooks are called synchronously while the event is recorded, so
+// they must not block.
+type Hook interface {
+	OnRequest(entry AuditEntry)
+	OnDecision(entry AuditEntry)
+	OnHandoff(entry AuditEntry)
+	OnError(entry AuditEntry)
+}
+
+// AddHook registers hook for all subsequent events. Hooks are attached to the
+// audit log, so AddHook must be called after SetAuditLog; without an audit
+// log, events are only passed to hooks.
+func (agent *Agent) AddHook(hook Hook) {
+	if agent.policy.Audit == nil {
+		agent.SetAuditLog(NewEventLog())
+	}
+	agent.policy.Audit.AddSink(hookSink{hook: hook})
+}
+
+type hookSink struct {
+	hook Hook
+}
+
+func (sink hookSink) Send(entry AuditEntry) {
+	switch entry.Event {
+	case AuditEventRequest:
+		sink.hook.OnRequest(entry)
+	case AuditEventDecision:
+		sink.hook.OnDecision(entry)
+	case AuditEventHandoff:
+		sink.hook.OnHandoff(entry)
+	case AuditEventError:
+		sink.hook.OnError(entry)
+	}
+}
+
+func (sink hookSink) Close() error {
+	if closer, ok := sink.hook.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package guardianagent
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Look-alikes of Latin letters, by the letter they pass for, after which
+// server names are compared (see hostSkeleton).
+var hostLookalikes = map[rune]rune{
+	'0': 'o', '1': 'l',
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i', 'ј': 'j', 'к': 'k',
+	'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's',
+	'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ɡ': 'g', 'ӏ': 'l',
+	// Greek.
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Latin.
+	'ı': 'i', 'ł': 'l', 'ø': 'o', 'ß': 'b',
+}
+
+var hostDigitsSyntax = regexp.MustCompile(`[0-9]+`)
+
+// hostConfusableWarning warns about requests for a server never approved
+// before whose name looks like, or is a typo away from, that of a server
+// which was, e.g. prod-db.examp1e.com for prod-db.example.com.
+func (policy *Policy) hostConfusableWarning(server string) string {
+	known := policy.History.Hosts()
+	for _, rule := range policy.Store.Rules() {
+		known = append(known, rule.Scope.ServiceHostname)
+	}
+	lookalike, how := confusableHost(server, known)
+	if lookalike == "" {
+		return ""
+	}
+	return fmt.Sprintf("server %s %s %s, which was approved before; make sure it is the intended server",
+		hostName(server), how, hostName(lookalike))
+}
+
+// confusableHost returns the server among known whose name server's looks
+// like, and how, if server is not known itself.
+func confusableHost(server string, known []string) (string, string) {
+	host := hostName(server)
+	if host == "" || net.ParseIP(host) != nil {
+		return "", ""
+	}
+	var candidates []string
+	for _, k := range known {
+		k = hostName(k)
+		if k == host || decodeHost(k) == decodeHost(host) {
+			return "", ""
+		}
+		if k != "" && net.ParseIP(k) == nil {
+			candidates = append(candidates, k)
+		}
+	}
+	sort.Strings(candidates)
+	skeleton := hostSkeleton(host)
+	for _, k := range candidates {
+		if hostSkeleton(k) == skeleton {
+			return k, "looks like"
+		}
+	}
+	for _, k := range candidates {
+		// Servers numbered alike, such as web1 and web2, are expected to
+		// be distinct.
+		if hostDigitsSyntax.ReplaceAllString(k, "#") == hostDigitsSyntax.ReplaceAllString(host, "#") {
+			continue
+		}
+		if len(k) >= 6 && editDistance(host, k) == 1 {
+			return k, "differs by one character from"
+		}
+	}
+	return "", ""
+}
+
+// hostName returns the lowercase name of server (host:port).
+func hostName(server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// decodeHost decodes the punycode labels of host.
+func decodeHost(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if strings.HasPrefix(label, "xn--") {
+			if decoded, ok := decodePunycode(label[4:]); ok {
+				labels[i] = decoded
+			}
+		}
+	}
+	return strings.ToLower(strings.Join(labels, "."))
+}
+
+// hostSkeleton decodes host and maps look-alike characters to the letters
+// they pass for, so that names which look the same compare equal.
+func hostSkeleton(host string) string {
+	var buf strings.Builder
+	for _, r := range decodeHost(host) {
+		if lookalike, ok := hostLookalikes[r]; ok {
+			r = lookalike
+		}
+		buf.WriteRune(r)
+	}
+	skeleton := buf.String()
+	skeleton = strings.Replace(skeleton, "rn", "m", -1)
+	skeleton = strings.Replace(skeleton, "vv", "w", -1)
+	return skeleton
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and
+// transpositions of adjacent characters turning a into b.
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// decodePunycode decodes a punycode label (RFC 3492), without its "xn--"
+// prefix.
+func decodePunycode(s string) (string, bool) {
+	const (
+		base        = 36
+		tmin        = 1
+		tmax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+	adapt := func(delta int, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / points
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+	var output []rune
+	if pos := strings.LastIndexByte(s, '-'); pos >= 0 {
+		for _, r := range s[:pos] {
+			if r >= 0x80 {
+				return "", false
+			}
+			output = append(output, r)
+		}
+		s = s[pos+1:]
+	}
+	n, bias, i := initialN, initialBias, 0
+	for k := 0; k < len(s); {
+		oldi, w := i, 1
+		for t := base; ; t += base {
+			if k >= len(s) {
+				return "", false
+			}
+			c := s[k]
+			k++
+			var digit int
+			switch {
+			case c >= 'a' && c <= 'z':
+				digit = int(c - 'a')
+			case c >= 'A' && c <= 'Z':
+				digit = int(c - 'A')
+			case c >= '0' && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", false
+			}
+			i += digit * w
+			if i > 1<<30 {
+				return "", false
+			}
+			threshold := t - bias
+			if threshold < tmin {
+				threshold = tmin
+			} else if threshold > tmax {
+				threshold = tmax
+			}
+			if digit < threshold {
+				break
+			}
+			w *= base - threshold
+			if w > 1<<30 {
+				return "", false
+			}
+		}
+		bias = adapt(i-oldi, len(output)+1, oldi == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > 0x10ffff {
+			return "", false
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), true
+}
@@ -0,0 +1,262 @@
+package guardianagent
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invitation is a bounded delegation the user prepared in advance: requests
+// matching its rule are auto-approved until it expires or has been used
+// MaxUses times.
+type Invitation struct {
+	ID      string
+	Rule    PolicyRule
+	Issued  time.Time
+	Expires time.Time
+	Note    string `json:",omitempty"`
+
+	// Unlimited if 0.
+	MaxUses int `json:",omitempty"`
+	Uses    int
+
+	// SHA-256 of the secret the client presents.
+	SecretHash string `json:",omitempty"`
+}
+
+// InvitationFile is what the delegatee installs on the intermediary, for
+// sga-ssh to present with matching requests.
+type InvitationFile struct {
+	ID          string
+	Token       string
+	Scope       Scope
+	AllCommands bool     `json:",omitempty"`
+	Commands    []string `json:",omitempty"`
+	Expires     time.Time
+	MaxUses     int    `json:",omitempty"`
+	Note        string `json:",omitempty"`
+}
+
+// InvitationsDir is where sga-ssh looks for installed invitations.
+func InvitationsDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "sga_invitations")
+}
+
+// LoadInvitationFile reads an installed invitation.
+func LoadInvitationFile(path string) (*InvitationFile, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read invitation: %s", err)
+	}
+	var file InvitationFile
+	if err = json.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("Failed to parse invitation %s: %s", path, err)
+	}
+	return &file, nil
+}
+
+// Covers reports whether the invitation seems to cover a request, so that
+// sga-ssh presents it. Only the guardian knows the tags of hosts.
+func (file *InvitationFile) Covers(user string, hostPort string, cmd string) bool {
+	if !time.Now().Before(file.Expires) ||
+		(file.Scope.ServiceUsername != "" && file.Scope.ServiceUsername != user) ||
+		(file.Scope.ServiceHostname != "" && file.Scope.ServiceHostname != hostPort) {
+		return false
+	}
+	if file.AllCommands {
+		return true
+	}
+	for _, c := range file.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// Invitations holds the invitations the user issued, saved to a file so
+// that their use counts survive restarts.
+type Invitations struct {
+	mu          sync.Mutex
+	path        string
+	invitations []*Invitation
+	ledger      *CredentialLedger
+}
+
+// NewInvitations loads the invitations saved at path, if any, and records
+// the invitations it issues in ledger, if set.
+func NewInvitations(path string, ledger *CredentialLedger) (*Invitations, error) {
+	invitations := &Invitations{path: path, ledger: ledger}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return invitations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read invitations: %s", err)
+	}
+	if err = json.Unmarshal(buf, &invitations.invitations); err != nil {
+		return nil, fmt.Errorf("Failed to parse invitations: %s", err)
+	}
+	for _, invitation := range invitations.invitations {
+		invitation.Rule.source = "invitation " + invitation.ID
+	}
+	return invitations, nil
+}
+
+func (invitations *Invitations) save() error {
+	buf, err := json.MarshalIndent(invitations.invitations, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := invitations.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("Failed to save invitations: %s", err)
+	}
+	return os.Rename(tmpPath, invitations.path)
+}
+
+func invitationSecretHash(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Issue creates an invitation auto-approving requests matching rule until
+// ttl elapses, at most maxUses times if set.
+func (invitations *Invitations) Issue(rule PolicyRule, ttl time.Duration, maxUses int, note string) (*InvitationFile, error) {
+	if !rule.AllCommands && len(rule.Commands) == 0 {
+		return nil, fmt.Errorf("an invitation must allow some commands")
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(buf[:4])
+	secret := base64.RawURLEncoding.EncodeToString(buf[4:])
+	now := time.Now()
+	invitation := &Invitation{
+		ID:         id,
+		Rule:       rule,
+		Issued:     now,
+		Expires:    now.Add(ttl),
+		Note:       note,
+		MaxUses:    maxUses,
+		SecretHash: invitationSecretHash(secret),
+	}
+	invitation.Rule.source = "invitation " + id
+
+	invitations.mu.Lock()
+	defer invitations.mu.Unlock()
+	invitations.expire()
+	invitations.invitations = append(invitations.invitations, invitation)
+	if err := invitations.save(); err != nil {
+		return nil, err
+	}
+	invitations.ledger.issued(IssuedCredential{
+		ID:          id,
+		Kind:        CredentialInvitation,
+		Scope:       rule.Scope,
+		Tags:        rule.Tags,
+		AllCommands: rule.AllCommands,
+		Commands:    rule.Commands,
+		Note:        note,
+		Issued:      now,
+		Expires:     invitation.Expires,
+		MaxUses:     maxUses,
+	})
+	return &InvitationFile{
+		ID:          id,
+		Token:       id + "." + secret,
+		Scope:       rule.Scope,
+		AllCommands: rule.AllCommands,
+		Commands:    rule.Commands,
+		Expires:     invitation.Expires,
+		MaxUses:     maxUses,
+		Note:        note,
+	}, nil
+}
+
+// Use checks whether the invitation presented with token covers cmd in
+// scope, and if so counts the use against its limit. tags are the host's
+// tags.
+func (invitations *Invitations) Use(token string, scope Scope, tags []string, cmd string) (*Invitation, error) {
+	if invitations == nil || token == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed invitation")
+	}
+	invitations.mu.Lock()
+	defer invitations.mu.Unlock()
+	invitations.expire()
+	for _, invitation := range invitations.invitations {
+		if invitation.ID != parts[0] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(invitation.SecretHash), []byte(invitationSecretHash(parts[1]))) != 1 {
+			return nil, fmt.Errorf("invalid secret for invitation %s", invitation.ID)
+		}
+		if !invitation.Rule.matches(scope, tags, cmd, false) {
+			return nil, nil
+		}
+		invitation.Uses++
+		used := *invitation
+		if err := invitations.save(); err != nil {
+			return nil, err
+		}
+		invitations.ledger.used(CredentialInvitation, invitation.ID)
+		return &used, nil
+	}
+	return nil, fmt.Errorf("unknown or expired invitation %s", parts[0])
+}
+
+// List returns the active invitations, without their secrets.
+func (invitations *Invitations) List() []Invitation {
+	invitations.mu.Lock()
+	defer invitations.mu.Unlock()
+	invitations.expire()
+	list := make([]Invitation, 0, len(invitations.invitations))
+	for _, invitation := range invitations.invitations {
+		i := *invitation
+		i.SecretHash = ""
+		list = append(list, i)
+	}
+	return list
+}
+
+// Revoke removes the invitation with the given ID.
+func (invitations *Invitations) Revoke(id string) error {
+	invitations.mu.Lock()
+	defer invitations.mu.Unlock()
+	for i, invitation := range invitations.invitations {
+		if invitation.ID == id {
+			invitations.invitations = append(invitations.invitations[:i], invitations.invitations[i+1:]...)
+			invitations.ledger.revoked(CredentialInvitation, id)
+			return invitations.save()
+		}
+	}
+	return fmt.Errorf("no invitation %s", id)
+}
+
+// expire drops invitations which expired or were used up. They are saved
+// with the next change.
+func (invitations *Invitations) expire() {
+	now := time.Now()
+	live := invitations.invitations[:0]
+	for _, invitation := range invitations.invitations {
+		if now.Before(invitation.Expires) && (invitation.MaxUses == 0 || invitation.Uses < invitation.MaxUses) {
+			live = append(live, invitation)
+		}
+	}
+	invitations.invitations = live
+}
@@ -0,0 +1,53 @@
+package guardianagent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// KeyConstraint restricts the use of a key in ssh-agent passthrough mode,
+// similarly to the constraints of ssh-add. Keys without a constraint must be
+// confirmed on every use.
+type KeyConstraint struct {
+	// SHA256 fingerprint of the key, as printed by ssh-keygen -l.
+	Fingerprint string `yaml:"fingerprint" json:"Fingerprint"`
+
+	// Sign without asking the user.
+	NoConfirm bool `yaml:"no-confirm,omitempty" json:"NoConfirm,omitempty"`
+
+	// The key is neither offered nor used after this time.
+	Expires time.Time `yaml:"expires,omitempty" json:"Expires,omitempty"`
+
+	// If set, the key may only be used to sign in to these hosts (patterns
+	// of host or host:port, as in tags).
+	Destinations []string `yaml:"destinations,omitempty" json:"Destinations,omitempty"`
+}
+
+func (constraint *KeyConstraint) validate() string {
+	if !strings.HasPrefix(constraint.Fingerprint, "SHA256:") {
+		return fmt.Sprintf("invalid key fingerprint %q (expected SHA256:...)", constraint.Fingerprint)
+	}
+	for _, pattern := range constraint.Destinations {
+		if _, err := compileHostPattern(pattern); err != nil {
+			return fmt.Sprintf("invalid destination pattern %q", pattern)
+		}
+	}
+	return ""
+}
+
+func (constraint *KeyConstraint) expired(now time.Time) bool {
+	return !constraint.Expires.IsZero() && now.After(constraint.Expires)
+}
+
+// allowsDestination reports whether the key may sign in to hostPort, which is
+// empty if the destination is unknown.
+func (constraint *KeyConstraint) allowsDestination(hostPort string) bool {
+	if len(constraint.Destinations) == 0 {
+		return true
+	}
+	if hostPort == "" {
+		return false
+	}
+	return matchesHostPattern(constraint.Destinations, hostPort)
+}
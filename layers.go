@@ -0,0 +1,562 @@
+package guardianagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolicyRule matches requests in a system policy layer. Empty scope fields
+// match any value. If Tags are set, the rule only matches hosts carrying all of
+// them.
+type PolicyRule struct {
+	Scope       Scope         `json:"Scope" yaml:"scope"`
+	Tags        []string      `json:"Tags,omitempty" yaml:"tags,omitempty"`
+	AllCommands bool          `json:"AllCommands" yaml:"all-commands,omitempty"`
+	Commands    []string      `json:"Commands" yaml:"commands,omitempty"`
+	SCP         *TransferRule `json:"SCP,omitempty" yaml:"scp,omitempty"`
+	Rsync       *TransferRule `json:"Rsync,omitempty" yaml:"rsync,omitempty"`
+	Git         *GitRule      `json:"Git,omitempty" yaml:"git,omitempty"`
+
+	// Command templates (see command_template.go), in the allow rules of
+	// the personal policy. Commands are never read as templates.
+	Templates []string `json:"Templates,omitempty" yaml:"templates,omitempty"`
+
+	// Kinds of shell constructs (see ShellRedirection etc.) commands must
+	// contain to match, in restrictive rules.
+	Metacharacters []string `json:"Metacharacters,omitempty" yaml:"metacharacters,omitempty"`
+
+	// Limits of batch rules, see SystemPolicy.Batch.
+	MaxHosts int           `json:"MaxHosts,omitempty" yaml:"max-hosts,omitempty"`
+	Window   time.Duration `json:"Window,omitempty" yaml:"window,omitempty"`
+
+	// Who may approve requests matching approve rules, see
+	// SystemPolicy.Approve.
+	Approvers []string `json:"Approvers,omitempty" yaml:"approvers,omitempty"`
+
+	// How sessions matching record rules are recorded, and who it takes to
+	// read the recordings, see SystemPolicy.Record.
+	Recording  string   `json:"Recording,omitempty" yaml:"recording,omitempty"`
+	Recipients []string `json:"Recipients,omitempty" yaml:"recipients,omitempty"`
+
+	// How the approvals of the personal policy were made: Origin for all
+	// commands, Origins per command.
+	Origin  *RuleOrigin           `json:"Origin,omitempty" yaml:"origin,omitempty"`
+	Origins map[string]RuleOrigin `json:"Origins,omitempty" yaml:"origins,omitempty"`
+
+	source string
+}
+
+// SystemPolicy is the read-only policy maintained by the administrator. Its
+// deny rules take precedence over anything the user approves interactively or
+// has stored in their personal policy.
+type SystemPolicy struct {
+	Allow []PolicyRule
+	Deny  []PolicyRule
+
+	// Requests matching a prompt rule are never auto-approved.
+	Prompt []PolicyRule
+
+	// Batch rules let the user approve all matching requests of a batch (e.g.
+	// an Ansible playbook run) on up to MaxHosts hosts for Window at once.
+	Batch []PolicyRule
+
+	// Requests matching an approve rule may only be approved interactively
+	// by one of its Approvers.
+	Approve []PolicyRule
+
+	// The first record rule matching a request decides how its session is
+	// recorded, by the client: not at all if none does, and which keys the
+	// recording is encrypted to.
+	Record []PolicyRule
+
+	// Limits on what clients may request.
+	Quotas []ClientQuota
+
+	// Catastrophic patterns added to the built-in ones, the names of
+	// built-in ones dropped, and whether all of them are.
+	Catastrophic          []CatastrophicPattern
+	CatastrophicExcept    []string
+	NoBuiltinCatastrophic bool
+
+	// Host patterns by tag.
+	Tags map[string][]string
+
+	// Problems with policy signatures that were tolerated in warn-only mode.
+	Warnings []string
+
+	verifier *PolicyVerifier
+	mu       sync.RWMutex
+
+	// Tags by host name, see tagsFor.
+	tagCacheMu   sync.Mutex
+	tagCache     map[string][]string
+	tagCacheTime time.Time
+}
+
+func (rule *PolicyRule) matchesScope(scope Scope, tags []string) bool {
+	return (rule.Scope.Client == "" || rule.Scope.Client == scope.Client) &&
+		matchesUser(rule.Scope.ServiceUsername, scope.ServiceUsername) &&
+		(rule.Scope.ServiceHostname == "" || rule.Scope.ServiceHostname == scope.ServiceHostname) &&
+		hasAllTags(tags, rule.Tags)
+}
+
+// matches reports whether the rule covers cmd in scope. Restrictive rules
+// (deny and prompt rules) match transfers if they cover any of the
+// transferred paths, others only if they cover all of them.
+func (rule *PolicyRule) matches(scope Scope, tags []string, cmd string, restrictive bool) bool {
+	return rule.matchesScope(scope, tags) && rule.matchesCommand(cmd, restrictive)
+}
+
+func (rule *PolicyRule) matchesCommand(cmd string, restrictive bool) bool {
+	if rule.AllCommands {
+		return true
+	}
+	if rule.SCP != nil || rule.Rsync != nil {
+		return rule.matchesTransfer(cmd, restrictive)
+	}
+	if rule.Git != nil {
+		return rule.Git.matches(cmd)
+	}
+	if len(rule.Metacharacters) > 0 {
+		return hasShellConstructs(cmd, rule.Metacharacters)
+	}
+	for _, c := range rule.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *PolicyRule) matchesTransfer(cmd string, restrictive bool) bool {
+	if scp, ok := ParseSCPCommand(cmd); ok && rule.SCP != nil {
+		return rule.SCP.matches(scp.Transfer(), restrictive)
+	}
+	if rsync, ok := ParseRsyncCommand(cmd); ok && rule.Rsync != nil {
+		return rule.Rsync.matches(rsync.Transfer(), restrictive)
+	}
+	return false
+}
+
+// LoadSystemPolicy reads all policy layers in dir, in lexical order. A
+// missing directory yields an empty policy. If verifier is not nil, the
+// signatures of all layers and included packs are checked.
+func LoadSystemPolicy(dir string, verifier *PolicyVerifier) (*SystemPolicy, error) {
+	sys := &SystemPolicy{verifier: verifier, Tags: make(map[string][]string)}
+	if dir == "" {
+		return sys, nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(filepath.Base(name), ".") ||
+			strings.HasSuffix(name, policySignatureSuffix) {
+			continue
+		}
+		if err = sys.loadFile(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sys, nil
+}
+
+// Include loads the rule packs matching patterns, which may contain globs and
+// environment variables and are resolved relative to baseDir.
+func (sys *SystemPolicy) Include(patterns []string, baseDir string) error {
+	return sys.include(patterns, baseDir, nil)
+}
+
+func (sys *SystemPolicy) include(patterns []string, baseDir string, parents []string) error {
+	for _, pattern := range patterns {
+		pattern = os.ExpandEnv(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid include %s: %s", pattern, err)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("Included policy pack %s not found", pattern)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err = sys.loadFile(name, parents); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sys *SystemPolicy) loadFile(name string, parents []string) error {
+	name = filepath.Clean(name)
+	for _, parent := range parents {
+		if parent == name {
+			return fmt.Errorf("Policy include cycle: %s -> %s", strings.Join(parents, " -> "), name)
+		}
+	}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if sys.verifier != nil {
+		if err = sys.verifier.Verify(name, buf); err != nil {
+			if !sys.verifier.WarnOnly {
+				return err
+			}
+			log.Printf("Warning: %s", err)
+			sys.Warnings = append(sys.Warnings, err.Error())
+		}
+	}
+	layer, err := parsePolicyFile(name, buf, false)
+	if err != nil {
+		return err
+	}
+	if layer.legacy {
+		log.Printf("%s uses the deprecated JSON policy format", name)
+	}
+	for _, rule := range layer.Allow {
+		rule.source = name
+		sys.Allow = append(sys.Allow, rule)
+	}
+	for _, rule := range layer.Deny {
+		rule.source = name
+		sys.Deny = append(sys.Deny, rule)
+	}
+	for _, rule := range layer.Prompt {
+		rule.source = name
+		sys.Prompt = append(sys.Prompt, rule)
+	}
+	for _, rule := range layer.Batch {
+		rule.source = name
+		sys.Batch = append(sys.Batch, rule)
+	}
+	for _, rule := range layer.Approve {
+		rule.source = name
+		sys.Approve = append(sys.Approve, rule)
+	}
+	for _, rule := range layer.Record {
+		rule.source = name
+		sys.Record = append(sys.Record, rule)
+	}
+	for _, quota := range layer.Quotas {
+		quota.source = name
+		sys.Quotas = append(sys.Quotas, quota)
+	}
+	sys.addCatastrophic(layer.Catastrophic, name)
+	sys.AddTags(layer.Tags)
+	return sys.include(layer.Include, filepath.Dir(name), append(parents, name))
+}
+
+// Replace atomically swaps in the rules of a freshly loaded policy.
+func (sys *SystemPolicy) Replace(other *SystemPolicy) {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	sys.Allow = other.Allow
+	sys.Deny = other.Deny
+	sys.Prompt = other.Prompt
+	sys.Batch = other.Batch
+	sys.Approve = other.Approve
+	sys.Record = other.Record
+	sys.Quotas = other.Quotas
+	sys.Catastrophic = other.Catastrophic
+	sys.CatastrophicExcept = other.CatastrophicExcept
+	sys.NoBuiltinCatastrophic = other.NoBuiltinCatastrophic
+	sys.Tags = other.Tags
+	sys.Warnings = other.Warnings
+	sys.clearTagCache()
+}
+
+// QuotasFor returns the quotas applying to client.
+func (sys *SystemPolicy) QuotasFor(client string) []ClientQuota {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	var quotas []ClientQuota
+	for _, quota := range sys.Quotas {
+		if quota.matches(client) {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas
+}
+
+// Denies returns the deny rule matching the request, if any.
+func (sys *SystemPolicy) Denies(scope Scope, cmd string) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Deny {
+		if sys.Deny[i].matches(scope, tags, cmd, true) {
+			return &sys.Deny[i]
+		}
+	}
+	return nil
+}
+
+// DeniesAny returns a deny rule restricting any command in scope, which makes
+// it impossible to allow all commands in that scope.
+func (sys *SystemPolicy) DeniesAny(scope Scope) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Deny {
+		if sys.Deny[i].matchesScope(scope, tags) {
+			return &sys.Deny[i]
+		}
+	}
+	return nil
+}
+
+func (sys *SystemPolicy) Allows(scope Scope, cmd string) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Allow {
+		if sys.Allow[i].matches(scope, tags, cmd, false) {
+			return &sys.Allow[i]
+		}
+	}
+	return nil
+}
+
+func (sys *SystemPolicy) AllowsAll(scope Scope) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Allow {
+		if sys.Allow[i].AllCommands && sys.Allow[i].matchesScope(scope, tags) {
+			return &sys.Allow[i]
+		}
+	}
+	return nil
+}
+
+// AlwaysAsks returns the prompt rule matching the request, if any. Such
+// requests must be approved interactively, every time.
+func (sys *SystemPolicy) AlwaysAsks(scope Scope, cmd string) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Prompt {
+		if sys.Prompt[i].matches(scope, tags, cmd, true) {
+			return &sys.Prompt[i]
+		}
+	}
+	return nil
+}
+
+// AlwaysAsksAny returns a prompt rule covering any command in scope.
+func (sys *SystemPolicy) AlwaysAsksAny(scope Scope) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Prompt {
+		if sys.Prompt[i].matchesScope(scope, tags) {
+			return &sys.Prompt[i]
+		}
+	}
+	return nil
+}
+
+// RequiredApprovers returns the approve rule matching the request (any
+// command in scope if cmd is empty), if any.
+func (sys *SystemPolicy) RequiredApprovers(scope Scope, cmd string) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Approve {
+		if (cmd == "" && sys.Approve[i].matchesScope(scope, tags)) || (cmd != "" && sys.Approve[i].matches(scope, tags, cmd, true)) {
+			return &sys.Approve[i]
+		}
+	}
+	return nil
+}
+
+// RecordingFor returns the record rule matching the request, if any.
+func (sys *SystemPolicy) RecordingFor(scope Scope, cmd string) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Record {
+		if sys.Record[i].matches(scope, tags, cmd, true) {
+			return &sys.Record[i]
+		}
+	}
+	return nil
+}
+
+// describeApprovers tells who may approve requests matching an approve rule,
+// for prompts.
+func (rule *PolicyRule) describeApprovers() string {
+	return fmt.Sprintf("\nOnly %s may approve this request (system policy %s).", strings.Join(rule.Approvers, ", "), rule.source)
+}
+
+// AllowsBatch returns the batch rule permitting batch approvals of cmd in
+// scope, if any.
+func (sys *SystemPolicy) AllowsBatch(scope Scope, cmd string) *PolicyRule {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	tags := sys.tagsFor(scope.ServiceHostname)
+	for i := range sys.Batch {
+		if sys.Batch[i].matches(scope, tags, cmd, false) {
+			return &sys.Batch[i]
+		}
+	}
+	return nil
+}
+
+func overlaps(a string, b string) bool {
+	return a == "" || b == "" || a == b
+}
+
+func (rule *PolicyRule) overlapsScope(scope Scope) bool {
+	// User patterns are assumed to overlap.
+	return overlaps(rule.Scope.Client, scope.Client) &&
+		(overlaps(rule.Scope.ServiceUsername, scope.ServiceUsername) ||
+			isUserPattern(rule.Scope.ServiceUsername) || isUserPattern(scope.ServiceUsername)) &&
+		overlaps(rule.Scope.ServiceHostname, scope.ServiceHostname)
+}
+
+func (rule *PolicyRule) describe() string {
+	what := "any command"
+	if rule.SCP != nil {
+		what = rule.SCP.describe("SCP")
+	} else if rule.Rsync != nil {
+		what = rule.Rsync.describe("rsync")
+	} else if rule.Git != nil {
+		what = rule.Git.describe()
+	} else if len(rule.Metacharacters) > 0 {
+		what = fmt.Sprintf("commands with shell metacharacters (%s)", strings.Join(rule.Metacharacters, ", "))
+	} else if !rule.AllCommands {
+		what = fmt.Sprintf("'%s'", strings.Join(rule.Commands, "', '"))
+	}
+	return fmt.Sprintf("%s for %s on %s@%s (%s)", what, orAny(rule.Scope.Client),
+		orAny(rule.Scope.ServiceUsername), orAny(rule.Scope.ServiceHostname), rule.source)
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+// Conflicts lists system allow rules and stored user approvals that are
+// overridden by system deny rules.
+func (sys *SystemPolicy) Conflicts(store *Store) []string {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	var conflicts []string
+	for i := range sys.Deny {
+		deny := &sys.Deny[i]
+		for j := range sys.Allow {
+			allow := &sys.Allow[j]
+			if !allow.overlapsScope(deny.Scope) {
+				continue
+			}
+			if rulesIntersect(allow, deny) {
+				conflicts = append(conflicts, fmt.Sprintf("system allow of %s is overridden by system deny of %s",
+					allow.describe(), deny.describe()))
+			}
+		}
+		store.mutex.RLock()
+		for scope, allowed := range store.rules {
+			if !deny.matchesScope(scope, sys.tagsFor(scope.ServiceHostname)) {
+				continue
+			}
+			if rulesIntersect(&PolicyRule{AllCommands: allowed.AllCommands, Commands: allowed.Commands}, deny) {
+				conflicts = append(conflicts, fmt.Sprintf("stored approval for %s on %s@%s is overridden by system deny of %s",
+					scope.Client, scope.ServiceUsername, scope.ServiceHostname, deny.describe()))
+			}
+		}
+		store.mutex.RUnlock()
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// rulesIntersect reports whether some command may match both rules. Two
+// transfer or git rules are assumed to intersect.
+func rulesIntersect(a *PolicyRule, b *PolicyRule) bool {
+	switch {
+	case a.AllCommands || b.AllCommands:
+		return true
+	case len(a.Commands) == 0 && len(b.Commands) == 0:
+		// Both match transfers or git operations.
+		return true
+	case len(a.Commands) == 0:
+		return anyMatches(a, b.Commands)
+	case len(b.Commands) == 0:
+		return anyMatches(b, a.Commands)
+	default:
+		return commandsIntersect(a.Commands, b.Commands)
+	}
+}
+
+func anyMatches(rule *PolicyRule, commands []string) bool {
+	for _, cmd := range commands {
+		if rule.matchesCommand(cmd, true) {
+			return true
+		}
+	}
+	return false
+}
+
+func commandsIntersect(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
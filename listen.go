@@ -0,0 +1,244 @@
+package guardianagent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnSource is anything connections to the guardian can be accepted from,
+// such as a net.Listener or SSHFwd.
+type ConnSource interface {
+	Accept() (net.Conn, error)
+}
+
+// Listener is a source of connections, along with the policy overrides for
+// the connections accepted from it.
+type Listener struct {
+	Name   string
+	Source ConnSource
+
+	// Client names the connections which do not announce themselves with an
+	// AgentForwardingNotice.
+	Client string
+
+	// Confirm every request from the listener, as with system prompt rules.
+	AlwaysAsk bool
+
+	// The tenant (see AddTenant) the connections are served for, if any.
+	Tenant string
+}
+
+// ParseListener creates a listener from a spec of the form
+// <kind>:<address>[,<option>...], where the kind is one of:
+//
+//   unix:<path>         a socket only accessible by the current user
+//   tcp:<host:port>
+//   systemd:<n>         the n-th socket passed by systemd socket activation
+//   fd:<n>              a listening socket inherited as file descriptor n,
+//                       e.g. from a Supervisor
+//   ssh:[user@]host:<path>  a socket on a jump host, see ReverseTunnel
+//
+// and the options are client=<name>, tenant=<name> (serve the connections with
+// the policy and keys of a tenant), ask (confirm every request), trusted and,
+// for ssh listeners, mode=<octal permissions of the socket>. TCP and ssh
+// listeners confirm every request unless they are marked trusted, since any
+// local user (or, depending on the address, remote host) can connect to
+// them.
+func ParseListener(spec string) (*Listener, error) {
+	if err := ValidateListener(spec); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(spec, ",")
+	kindAddr := strings.SplitN(parts[0], ":", 2)
+	if len(kindAddr) != 2 || kindAddr[1] == "" {
+		return nil, fmt.Errorf("invalid listener %q, expected <kind>:<address>", spec)
+	}
+	listener := &Listener{Name: parts[0]}
+	var err error
+	switch kindAddr[0] {
+	case "unix":
+		listener.Source, _, err = CreateSocket(kindAddr[1])
+	case "tcp":
+		listener.Source, err = net.Listen("tcp", kindAddr[1])
+		listener.AlwaysAsk = true
+	case "systemd":
+		listener.Source, err = systemdListener(kindAddr[1])
+	case "fd":
+		listener.Source, err = fdListener(kindAddr[1])
+	case "ssh":
+		hostPath := strings.SplitN(kindAddr[1], ":", 2)
+		if len(hostPath) != 2 {
+			return nil, fmt.Errorf("invalid listener %q, expected ssh:[user@]host:<path>", spec)
+		}
+		listener.Source, err = NewReverseTunnel(hostPath[0], hostPath[1], 0600)
+		listener.Client = hostPath[0]
+		listener.AlwaysAsk = true
+	default:
+		return nil, fmt.Errorf("unsupported listener kind %q", kindAddr[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %s: %s", parts[0], err)
+	}
+	for _, option := range parts[1:] {
+		switch {
+		case strings.HasPrefix(option, "client="):
+			listener.Client = strings.TrimPrefix(option, "client=")
+		case strings.HasPrefix(option, "tenant="):
+			listener.Tenant = strings.TrimPrefix(option, "tenant=")
+		case option == "ask":
+			listener.AlwaysAsk = true
+		case option == "trusted":
+			listener.AlwaysAsk = false
+		case strings.HasPrefix(option, "mode="):
+			tunnel, ok := listener.Source.(*ReverseTunnel)
+			mode, err := strconv.ParseUint(strings.TrimPrefix(option, "mode="), 8, 32)
+			if !ok || err != nil || mode&^0777 != 0 {
+				return nil, fmt.Errorf("invalid listener option %q", option)
+			}
+			tunnel.Mode = os.FileMode(mode)
+		default:
+			return nil, fmt.Errorf("unsupported listener option %q", option)
+		}
+	}
+	return listener, nil
+}
+
+// ValidateListener checks a listener spec (see ParseListener) without
+// listening.
+func ValidateListener(spec string) error {
+	parts := strings.Split(spec, ",")
+	kindAddr := strings.SplitN(parts[0], ":", 2)
+	if len(kindAddr) != 2 || kindAddr[1] == "" {
+		return fmt.Errorf("invalid listener %q, expected <kind>:<address>", spec)
+	}
+	switch kindAddr[0] {
+	case "unix":
+	case "tcp":
+		if _, _, err := net.SplitHostPort(kindAddr[1]); err != nil {
+			return fmt.Errorf("invalid listener %q: %s", spec, err)
+		}
+	case "systemd":
+		if n, err := strconv.Atoi(kindAddr[1]); err != nil || n < 0 {
+			return fmt.Errorf("invalid socket index %q", kindAddr[1])
+		}
+	case "fd":
+		if n, err := strconv.Atoi(kindAddr[1]); err != nil || n < 3 {
+			return fmt.Errorf("invalid file descriptor %q", kindAddr[1])
+		}
+	case "ssh":
+		if len(strings.SplitN(kindAddr[1], ":", 2)) != 2 {
+			return fmt.Errorf("invalid listener %q, expected ssh:[user@]host:<path>", spec)
+		}
+	default:
+		return fmt.Errorf("unsupported listener kind %q", kindAddr[0])
+	}
+	for _, option := range parts[1:] {
+		switch {
+		case strings.HasPrefix(option, "client="), option == "ask", option == "trusted":
+		case strings.HasPrefix(option, "tenant="):
+			if !tenantNameSyntax.MatchString(strings.TrimPrefix(option, "tenant=")) {
+				return fmt.Errorf("invalid listener option %q", option)
+			}
+		case strings.HasPrefix(option, "mode="):
+			mode, err := strconv.ParseUint(strings.TrimPrefix(option, "mode="), 8, 32)
+			if kindAddr[0] != "ssh" || err != nil || mode&^0777 != 0 {
+				return fmt.Errorf("invalid listener option %q", option)
+			}
+		default:
+			return fmt.Errorf("unsupported listener option %q", option)
+		}
+	}
+	return nil
+}
+
+// systemdListener returns a socket passed by systemd (see sd_listen_fds(3)).
+func systemdListener(index string) (net.Listener, error) {
+	n, err := strconv.Atoi(index)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid socket index %q", index)
+	}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("no sockets were passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n >= count {
+		return nil, fmt.Errorf("systemd passed no socket %d", n)
+	}
+	// Passed sockets start at file descriptor 3.
+	file := os.NewFile(uintptr(3+n), "systemd-socket-"+index)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// fdListener returns the listening socket inherited as file descriptor fd.
+func fdListener(fd string) (net.Listener, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < 3 {
+		return nil, fmt.Errorf("invalid file descriptor %q", fd)
+	}
+	file := os.NewFile(uintptr(n), "fd-"+fd)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// ListenAndServe serves the connections accepted from all listeners, until
+// accepting from one of them fails.
+func (agent *Agent) ListenAndServe(listeners ...*Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *Listener) {
+			errs <- agent.serve(listener)
+		}(listener)
+	}
+	return <-errs
+}
+
+func (agent *Agent) serve(listener *Listener) error {
+	for {
+		conn, err := listener.Source.Accept()
+		if err != nil {
+			return fmt.Errorf("Failed to accept connection on %s: %s", listener.Name, err)
+		}
+		agent.connectionStarted()
+		go func() {
+			defer agent.connectionFinished()
+			if err := agent.handleConnection(conn, listener); err != nil {
+				log.Printf("Error handling connection on %s: %s", listener.Name, err)
+			}
+		}()
+	}
+}
+
+func (agent *Agent) connectionStarted() {
+	agent.activeMu.Lock()
+	defer agent.activeMu.Unlock()
+	agent.active++
+}
+
+func (agent *Agent) connectionFinished() {
+	agent.activeMu.Lock()
+	defer agent.activeMu.Unlock()
+	agent.active--
+	if agent.active == 0 {
+		agent.idleSince = time.Now()
+	}
+}
+
+// Idle returns how long the agent has served no connection and shown no
+// prompt, or 0 if it is busy, e.g. for it to exit when unused.
+func (agent *Agent) Idle() time.Duration {
+	if prompts, _ := agent.ui.pending(); prompts > 0 {
+		return 0
+	}
+	agent.activeMu.Lock()
+	defer agent.activeMu.Unlock()
+	if agent.active > 0 {
+		return 0
+	}
+	return time.Since(agent.idleSince)
+}
@@ -0,0 +1,123 @@
+package guardianagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// LockdownState describes an engaged lockdown.
+type LockdownState struct {
+	Since  time.Time
+	Reason string
+}
+
+// Lockdown makes the guardian deny every request until it is explicitly
+// released, e.g. when a client machine is reported compromised. It is saved
+// to a file, so that restarting the guardian does not release it.
+type Lockdown struct {
+	mu    sync.Mutex
+	path  string
+	state *LockdownState
+}
+
+// NewLockdown loads the lockdown saved at path, if any.
+func NewLockdown(path string) (*Lockdown, error) {
+	lockdown := &Lockdown{path: path}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lockdown, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read lockdown state: %s", err)
+	}
+	lockdown.state = new(LockdownState)
+	if err = json.Unmarshal(buf, lockdown.state); err != nil {
+		// Stay locked down, since the file only exists while engaged.
+		lockdown.state = &LockdownState{Since: time.Now(), Reason: "unreadable lockdown state"}
+	}
+	return lockdown, nil
+}
+
+// Engage locks the guardian down, unless it already is.
+func (lockdown *Lockdown) Engage(reason string) (LockdownState, error) {
+	lockdown.mu.Lock()
+	defer lockdown.mu.Unlock()
+	if lockdown.state != nil {
+		return *lockdown.state, nil
+	}
+	state := &LockdownState{Since: time.Now(), Reason: reason}
+	// Deny requests even if the state cannot be saved.
+	lockdown.state = state
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return *state, err
+	}
+	if err = ioutil.WriteFile(lockdown.path, buf, 0600); err != nil {
+		return *state, fmt.Errorf("Failed to save lockdown state: %s", err)
+	}
+	return *state, nil
+}
+
+// Release ends the lockdown.
+func (lockdown *Lockdown) Release() error {
+	lockdown.mu.Lock()
+	defer lockdown.mu.Unlock()
+	if err := os.Remove(lockdown.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove lockdown state: %s", err)
+	}
+	lockdown.state = nil
+	return nil
+}
+
+// Active returns the lockdown state, or nil if the guardian is not locked
+// down.
+func (lockdown *Lockdown) Active() *LockdownState {
+	if lockdown == nil {
+		return nil
+	}
+	lockdown.mu.Lock()
+	defer lockdown.mu.Unlock()
+	if lockdown.state == nil {
+		return nil
+	}
+	state := *lockdown.state
+	return &state
+}
+
+// Deny reports an error if the guardian is locked down.
+func (lockdown *Lockdown) Deny() error {
+	if state := lockdown.Active(); state != nil {
+		return deny(DenialLockdown, fmt.Sprintf("Guardian is locked down since %s", state.Since.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// Lock engages the lockdown, terminates all active sessions and revokes all
+// outstanding one-time tokens, batch and git run approvals.
+func (agent *Agent) Lock(reason string) (LockdownState, error) {
+	state, err := agent.policy.Lockdown.Engage(reason)
+	for _, session := range agent.policy.Sessions.KillAll() {
+		agent.policy.Audit.forRequest(session.RequestID).Record(AuditEventHandoff, session.Scope, session.Command, "terminated",
+			"session terminated by lockdown")
+	}
+	tokens := agent.policy.Tokens.RevokeAll()
+	batches := agent.policy.Batches.RevokeAll() + agent.policy.GitRuns.RevokeAll()
+	agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "",
+		fmt.Sprintf("lockdown engaged (%s), revoked %d tokens and %d batch approvals", reason, tokens, batches))
+	// Alerts may block until acknowledged.
+	go agent.policy.UI.Alert(fmt.Sprintf("Guardian LOCKED DOWN: %s\nAll requests will be denied until it is unlocked with sga-admin unlock.", reason))
+	return state, err
+}
+
+// Unlock releases the lockdown.
+func (agent *Agent) Unlock() error {
+	if err := agent.policy.Lockdown.Release(); err != nil {
+		return err
+	}
+	agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "lockdown released")
+	return nil
+}
@@ -0,0 +1,229 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of each DNS lookup made to describe the network context of a
+// request.
+const networkLookupTimeout = 2 * time.Second
+
+var specialNetworks = []struct {
+	cidr string
+	desc string
+}{
+	{"127.0.0.0/8", "loopback"},
+	{"::1/128", "loopback"},
+	{"10.0.0.0/8", "private, RFC 1918"},
+	{"172.16.0.0/12", "private, RFC 1918"},
+	{"192.168.0.0/16", "private, RFC 1918"},
+	{"fc00::/7", "private, unique local"},
+	{"100.64.0.0/10", "carrier-grade NAT"},
+	{"169.254.0.0/16", "link-local"},
+	{"fe80::/10", "link-local"},
+}
+
+// ipClass describes the kind of network ip belongs to, and reports whether it
+// is public.
+func ipClass(ip net.IP) (string, bool) {
+	for _, special := range specialNetworks {
+		_, network, _ := net.ParseCIDR(special.cidr)
+		if network.Contains(ip) {
+			return special.desc, false
+		}
+	}
+	return "public", true
+}
+
+// NetworkLocator describes where the client and server of requests are on the
+// network, so that approvers notice requests from unexpected networks.
+type NetworkLocator struct {
+	// Look up the AS and country of public addresses, in the DNS zones of
+	// Team Cymru's IP to ASN mapping service.
+	LookupASN bool
+
+	// Cache of the resolution of server names, if set.
+	DNS *DNSCache
+
+	resolver net.Resolver
+	mu       sync.Mutex
+	asns     map[string]string
+}
+
+func NewNetworkLocator(lookupASN bool) *NetworkLocator {
+	return &NetworkLocator{LookupASN: lookupASN, asns: make(map[string]string)}
+}
+
+// Describe returns the network context of a request from client to server
+// (host:port). peer is the address the request came from, if it came over
+// the network; otherwise the client's name is resolved.
+func (locator *NetworkLocator) Describe(peer net.Addr, client string, server string) string {
+	if locator == nil {
+		return ""
+	}
+	var clientDesc string
+	if tcpAddr, ok := peer.(*net.TCPAddr); ok {
+		clientDesc = locator.describeIP(tcpAddr.IP)
+	} else {
+		host := client[strings.LastIndex(client, "@")+1:]
+		clientDesc = locator.describeHost(host)
+	}
+	serverHost, _, err := net.SplitHostPort(server)
+	if err != nil {
+		serverHost = server
+	}
+	return fmt.Sprintf("client %s; server %s", clientDesc, locator.describeHost(serverHost))
+}
+
+func (locator *NetworkLocator) describeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return locator.describeIP(ip)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), networkLookupTimeout)
+	defer cancel()
+	var addrs []net.IPAddr
+	var err error
+	if locator.DNS != nil {
+		addrs, err = locator.DNS.LookupIPAddr(ctx, host)
+	} else {
+		addrs, err = locator.resolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s (unresolved: %s)", host, describeResolutionError(err))
+	}
+	if len(addrs) == 0 {
+		return host + " (unresolved)"
+	}
+	return host + " " + locator.describeIP(addrs[0].IP)
+}
+
+func (locator *NetworkLocator) describeIP(ip net.IP) string {
+	class, public := ipClass(ip)
+	if public && locator.LookupASN {
+		if asn := locator.lookupASN(ip); asn != "" {
+			class += ", " + asn
+		}
+	}
+	return fmt.Sprintf("%s (%s)", ip, class)
+}
+
+// lookupASN returns the AS and country of ip, e.g. "AS64500 EXAMPLE-NET, US".
+func (locator *NetworkLocator) lookupASN(ip net.IP) string {
+	var query string
+	if ip4 := ip.To4(); ip4 != nil {
+		query = fmt.Sprintf("%d.%d.%d.%d.origin.asn.cymru.com", ip4[3], ip4[2], ip4[1], ip4[0])
+	} else {
+		var nibbles []string
+		for i := len(ip) - 1; i >= 0; i-- {
+			nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip[i]&0xf, ip[i]>>4))
+		}
+		query = strings.Join(nibbles, ".") + ".origin6.asn.cymru.com"
+	}
+	locator.mu.Lock()
+	cached, ok := locator.asns[query]
+	locator.mu.Unlock()
+	if ok {
+		return cached
+	}
+
+	// Answers are of the form "64500 | 192.0.2.0/24 | US | arin | 2001-01-01".
+	fields := locator.lookupCymru(query)
+	if len(fields) < 3 {
+		return ""
+	}
+	asn := strings.Fields(fields[0])[0]
+	desc := fmt.Sprintf("AS%s, %s", asn, fields[2])
+	// And "64500 | US | arin | 2001-01-01 | EXAMPLE-NET - Example, US".
+	if names := locator.lookupCymru("AS" + asn + ".asn.cymru.com"); len(names) >= 5 {
+		name := strings.SplitN(names[4], " ", 2)[0]
+		desc = fmt.Sprintf("AS%s %s, %s", asn, name, fields[2])
+	}
+	locator.mu.Lock()
+	locator.asns[query] = desc
+	locator.mu.Unlock()
+	return desc
+}
+
+func (locator *NetworkLocator) lookupCymru(name string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), networkLookupTimeout)
+	defer cancel()
+	txts, err := locator.resolver.LookupTXT(ctx, name)
+	if err != nil || len(txts) == 0 {
+		return nil
+	}
+	fields := strings.Split(txts[0], "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if fields[0] == "" {
+		return nil
+	}
+	return fields
+}
+
+// verifyClientName checks the host name a client announced against the
+// address it connected from, with forward and reverse DNS, and describes the
+// mismatches. Only TCP connections from other hosts can be checked.
+func verifyClientName(peer net.Addr, client string) []string {
+	tcpAddr, ok := peer.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.IsLoopback() {
+		return nil
+	}
+	peerIP := tcpAddr.IP
+	host := strings.TrimSuffix(strings.ToLower(client[strings.LastIndex(client, "@")+1:]), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.Equal(peerIP) {
+			return []string{fmt.Sprintf("client claims to be %s but connected from %s", host, peerIP)}
+		}
+		return nil
+	}
+
+	var warnings []string
+	ctx, cancel := context.WithTimeout(context.Background(), 2*networkLookupTimeout)
+	defer cancel()
+	resolves := func(name string) ([]net.IPAddr, bool) {
+		addrs, _ := net.DefaultResolver.LookupIPAddr(ctx, name)
+		for _, addr := range addrs {
+			if addr.IP.Equal(peerIP) {
+				return addrs, true
+			}
+		}
+		return addrs, false
+	}
+	if addrs, ok := resolves(host); !ok {
+		if len(addrs) == 0 {
+			warnings = append(warnings, fmt.Sprintf("client claims to be %s, which does not resolve, but connected from %s", host, peerIP))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("client claims to be %s, which resolves to %s, but connected from %s", host, addrs[0].IP, peerIP))
+		}
+	}
+
+	names, _ := net.DefaultResolver.LookupAddr(ctx, peerIP.String())
+	var confirmed []string
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if _, ok := resolves(name); ok {
+			confirmed = append(confirmed, name)
+		}
+	}
+	switch {
+	case len(names) == 0:
+		warnings = append(warnings, fmt.Sprintf("%s has no reverse DNS", peerIP))
+	case len(confirmed) == 0:
+		warnings = append(warnings, fmt.Sprintf("reverse DNS of %s (%s) does not resolve back to it", peerIP, strings.Join(names, ", ")))
+	default:
+		found := false
+		for _, name := range confirmed {
+			found = found || name == host
+		}
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("reverse DNS of %s is %s, not %s", peerIP, strings.Join(confirmed, ", "), host))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,385 @@
+package guardianagent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Clients which know the guardian's public key encrypt the control channel
+// end to end with Noise_IK_25519_ChaChaPoly_BLAKE2s, so that the sshds and
+// jump hosts a forwarded socket passes through can neither read nor modify
+// it. The handshake is carried in MsgNoiseHandshake packets; everything
+// after it in Noise transport messages, each prefixed by its 2-byte length.
+const (
+	noiseProtocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+	noiseKeyPrefix    = "sga-guard-"
+	noiseMaxMessage   = 65535
+)
+
+// NoiseKey is the static key pair of the guardian.
+type NoiseKey struct {
+	public  []byte
+	private []byte
+}
+
+// LoadNoiseKey reads the guardian's key from path, generating it if there
+// is none yet.
+func LoadNoiseKey(path string) (*NoiseKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := newNoiseKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.RawURLEncoding.EncodeToString(key.private) + "\n"
+		if err = ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return nil, fmt.Errorf("Failed to save Noise key: %s", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Noise key: %s", err)
+	}
+	private, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(private) != 32 {
+		return nil, fmt.Errorf("Invalid Noise key in %s", path)
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Noise key in %s", path)
+	}
+	return &NoiseKey{public: public, private: private}, nil
+}
+
+func newNoiseKeyPair() (*NoiseKey, error) {
+	private := make([]byte, 32)
+	if _, err := rand.Read(private); err != nil {
+		return nil, fmt.Errorf("Failed to generate key: %s", err)
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &NoiseKey{public: public, private: private}, nil
+}
+
+// Public returns the public key, for clients to pin.
+func (key *NoiseKey) Public() string {
+	return noiseKeyPrefix + base64.RawURLEncoding.EncodeToString(key.public)
+}
+
+// ParseNoisePublicKey decodes a public key, as returned by Public.
+func ParseNoisePublicKey(s string) ([]byte, error) {
+	public, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, noiseKeyPrefix))
+	if !strings.HasPrefix(s, noiseKeyPrefix) || err != nil || len(public) != 32 {
+		return nil, fmt.Errorf("invalid guardian key %q", s)
+	}
+	return public, nil
+}
+
+// noiseCipher is a CipherState of the Noise framework.
+type noiseCipher struct {
+	key   []byte
+	nonce uint64
+}
+
+func (c *noiseCipher) nonceBytes() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	return nonce
+}
+
+func (c *noiseCipher) encrypt(ad []byte, plaintext []byte) []byte {
+	if c.key == nil {
+		return plaintext
+	}
+	aead, _ := chacha20poly1305.New(c.key)
+	out := aead.Seal(nil, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+	return out
+}
+
+func (c *noiseCipher) decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	if c.key == nil {
+		return ciphertext, nil
+	}
+	aead, _ := chacha20poly1305.New(c.key)
+	out, err := aead.Open(nil, c.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt Noise message")
+	}
+	c.nonce++
+	return out, nil
+}
+
+// noiseHandshake is the SymmetricState of the Noise framework, along with
+// the keys of an IK handshake.
+type noiseHandshake struct {
+	cipher noiseCipher
+	ck     []byte
+	h      []byte
+
+	s, e   *NoiseKey
+	rs, re []byte
+}
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func noiseHKDF(ck []byte, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(newBlake2s, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(newBlake2s, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+	mac = hmac.New(newBlake2s, temp)
+	mac.Write(append(append([]byte{}, out1...), 2))
+	return out1, mac.Sum(nil)
+}
+
+// newNoiseHandshake initializes an IK handshake with the responder's static
+// key rs, which the initiator knows in advance.
+func newNoiseHandshake(s *NoiseKey, rs []byte) *noiseHandshake {
+	hs := &noiseHandshake{s: s, rs: rs}
+	sum := blake2s.Sum256([]byte(noiseProtocolName))
+	hs.h = sum[:]
+	hs.ck = hs.h
+	hs.mixHash([]byte(AgentGuardExtensionType))
+	return hs
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	h := newBlake2s()
+	h.Write(hs.h)
+	h.Write(data)
+	hs.h = h.Sum(nil)
+}
+
+func (hs *noiseHandshake) mixKey(ikm []byte) {
+	hs.ck, hs.cipher.key = noiseHKDF(hs.ck, ikm)
+	hs.cipher.nonce = 0
+}
+
+func (hs *noiseHandshake) mixDH(private []byte, public []byte) error {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return fmt.Errorf("Invalid Noise handshake key")
+	}
+	hs.mixKey(shared)
+	return nil
+}
+
+func (hs *noiseHandshake) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := hs.cipher.encrypt(hs.h, plaintext)
+	hs.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := hs.cipher.decrypt(hs.h, ciphertext)
+	if err == nil {
+		hs.mixHash(ciphertext)
+	}
+	return plaintext, err
+}
+
+// split returns the ciphers of the initiator and the responder.
+func (hs *noiseHandshake) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	return &noiseCipher{key: k1}, &noiseCipher{key: k2}
+}
+
+// initiate returns the first handshake message: -> e, es, s, ss.
+func (hs *noiseHandshake) initiate() ([]byte, error) {
+	var err error
+	if hs.e, err = newNoiseKeyPair(); err != nil {
+		return nil, err
+	}
+	hs.mixHash(hs.e.public)
+	msg := append([]byte{}, hs.e.public...)
+	if err = hs.mixDH(hs.e.private, hs.rs); err != nil {
+		return nil, err
+	}
+	msg = append(msg, hs.encryptAndHash(hs.s.public)...)
+	if err = hs.mixDH(hs.s.private, hs.rs); err != nil {
+		return nil, err
+	}
+	return append(msg, hs.encryptAndHash(nil)...), nil
+}
+
+// respond reads the first handshake message and returns the second:
+// <- e, ee, se.
+func (hs *noiseHandshake) respond(msg []byte) ([]byte, error) {
+	if len(msg) != 32+32+16+16 {
+		return nil, fmt.Errorf("Invalid Noise handshake message")
+	}
+	hs.re = msg[:32]
+	hs.mixHash(hs.re)
+	if err := hs.mixDH(hs.s.private, hs.re); err != nil {
+		return nil, err
+	}
+	var err error
+	if hs.rs, err = hs.decryptAndHash(msg[32:80]); err != nil {
+		return nil, err
+	}
+	if err = hs.mixDH(hs.s.private, hs.rs); err != nil {
+		return nil, err
+	}
+	if _, err = hs.decryptAndHash(msg[80:]); err != nil {
+		return nil, err
+	}
+
+	if hs.e, err = newNoiseKeyPair(); err != nil {
+		return nil, err
+	}
+	hs.mixHash(hs.e.public)
+	reply := append([]byte{}, hs.e.public...)
+	if err = hs.mixDH(hs.e.private, hs.re); err != nil {
+		return nil, err
+	}
+	if err = hs.mixDH(hs.e.private, hs.rs); err != nil {
+		return nil, err
+	}
+	return append(reply, hs.encryptAndHash(nil)...), nil
+}
+
+// finish reads the second handshake message, on the initiator's side.
+func (hs *noiseHandshake) finish(msg []byte) error {
+	if len(msg) != 32+16 {
+		return fmt.Errorf("Invalid Noise handshake message")
+	}
+	hs.re = msg[:32]
+	hs.mixHash(hs.re)
+	if err := hs.mixDH(hs.e.private, hs.re); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.s.private, hs.re); err != nil {
+		return err
+	}
+	_, err := hs.decryptAndHash(msg[32:])
+	return err
+}
+
+// noiseConn sends and receives Noise transport messages over a connection.
+type noiseConn struct {
+	net.Conn
+
+	readMu  sync.Mutex
+	recv    *noiseCipher
+	pending []byte
+
+	writeMu sync.Mutex
+	send    *noiseCipher
+}
+
+func (conn *noiseConn) Read(p []byte) (int, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+	for len(conn.pending) == 0 {
+		var size [2]byte
+		if _, err := io.ReadFull(conn.Conn, size[:]); err != nil {
+			return 0, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn.Conn, msg); err != nil {
+			return 0, err
+		}
+		var err error
+		if conn.pending, err = conn.recv.decrypt(nil, msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+func (conn *noiseConn) Write(p []byte) (int, error) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	for written := 0; written < len(p); {
+		n := len(p) - written
+		if n > noiseMaxMessage-chacha20poly1305.Overhead {
+			n = noiseMaxMessage - chacha20poly1305.Overhead
+		}
+		msg := conn.send.encrypt(nil, p[written:written+n])
+		frame := make([]byte, 2, 2+len(msg))
+		binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+		if _, err := conn.Conn.Write(append(frame, msg...)); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
+
+// DialNoise performs the handshake with the guardian with the public key
+// guardKey over conn, and returns the encrypted connection. The client's
+// static key is generated for the connection, since clients are
+// identified by policy rather than by key.
+func DialNoise(conn net.Conn, guardKey string) (net.Conn, error) {
+	rs, err := ParseNoisePublicKey(guardKey)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newNoiseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	hs := newNoiseHandshake(s, rs)
+	// The pre-message of IK: the guardian's static key, known in advance.
+	hs.mixHash(rs)
+	msg, err := hs.initiate()
+	if err != nil {
+		return nil, err
+	}
+	if err = WriteControlPacket(conn, MsgNoiseHandshake, msg); err != nil {
+		return nil, err
+	}
+	msgNum, reply, err := ReadControlPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msgNum != MsgNoiseHandshake {
+		return nil, fmt.Errorf("the guardian does not support encrypted connections")
+	}
+	if err = hs.finish(reply); err != nil {
+		return nil, fmt.Errorf("Failed to authenticate the guardian: %s", err)
+	}
+	send, recv := hs.split()
+	return &noiseConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// acceptNoise answers the handshake message msg of a client, and returns
+// the encrypted connection.
+func (key *NoiseKey) acceptNoise(conn net.Conn, msg []byte) (net.Conn, error) {
+	hs := newNoiseHandshake(key, nil)
+	// The pre-message of IK: our static key, which the client pinned.
+	hs.mixHash(key.public)
+	reply, err := hs.respond(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err = WriteControlPacket(conn, MsgNoiseHandshake, reply); err != nil {
+		return nil, err
+	}
+	recv, send := hs.split()
+	return &noiseConn{Conn: conn, send: send, recv: recv}, nil
+}
@@ -0,0 +1,205 @@
+package guardianagent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EmailConfig struct {
+	Server   string
+	From     string
+	To       []string
+	Username string
+	Password string
+
+	// Entries with at least this severity are sent immediately (0 disables
+	// alerts). Severities follow the CEF scale used by the SIEM sinks: denials
+	// are 5, approvals of any command 6, and errors 7.
+	AlertSeverity int
+
+	// Interval between activity digests (0 disables the digest).
+	DigestInterval time.Duration
+}
+
+// EmailNotifier is an AuditSink which mails alerts on high-risk decisions and
+// a periodic digest of delegation activity per client and server.
+type EmailNotifier struct {
+	config EmailConfig
+
+	mu     sync.Mutex
+	digest map[digestKey]*digestCounts
+	since  time.Time
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type digestKey struct {
+	Client string
+	Server string
+}
+
+type digestCounts struct {
+	Approved     int
+	AutoApproved int
+	Denied       int
+	Errors       int
+}
+
+func NewEmailNotifier(config EmailConfig) (*EmailNotifier, error) {
+	if config.Server == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email notifications require an SMTP server, a sender and at least one recipient")
+	}
+	if _, _, err := net.SplitHostPort(config.Server); err != nil {
+		return nil, fmt.Errorf("invalid SMTP server %s: %s", config.Server, err)
+	}
+	notifier := &EmailNotifier{
+		config: config,
+		digest: make(map[digestKey]*digestCounts),
+		since:  time.Now(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go notifier.run()
+	return notifier, nil
+}
+
+func (notifier *EmailNotifier) Send(entry AuditEntry) {
+	if entry.Event == AuditEventCheckpoint {
+		return
+	}
+	if notifier.config.AlertSeverity > 0 && auditSeverity(&entry) >= notifier.config.AlertSeverity {
+		go notifier.alert(entry)
+	}
+	if notifier.config.DigestInterval == 0 {
+		return
+	}
+
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	key := digestKey{
+		Client: entry.Scope.Client,
+		Server: entry.Scope.ServiceUsername + "@" + entry.Scope.ServiceHostname,
+	}
+	counts, ok := notifier.digest[key]
+	if !ok {
+		counts = &digestCounts{}
+		notifier.digest[key] = counts
+	}
+	switch {
+	case entry.Event == AuditEventError:
+		counts.Errors++
+	case entry.Event != AuditEventDecision:
+	case entry.Decision == "denied":
+		counts.Denied++
+	case entry.Decision == "auto-approved":
+		counts.AutoApproved++
+	default:
+		counts.Approved++
+	}
+}
+
+func (notifier *EmailNotifier) alert(entry AuditEntry) {
+	subject := fmt.Sprintf("[guardian-agent] %s %s: %s on %s@%s", entry.Event, entry.Decision,
+		entry.Scope.Client, entry.Scope.ServiceUsername, entry.Scope.ServiceHostname)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Time:     %s\n", entry.Time.Format(time.RFC1123))
+	fmt.Fprintf(&body, "Client:   %s\n", entry.Scope.Client)
+	fmt.Fprintf(&body, "Server:   %s@%s\n", entry.Scope.ServiceUsername, entry.Scope.ServiceHostname)
+	if len(entry.Tags) > 0 {
+		fmt.Fprintf(&body, "Tags:     %s\n", strings.Join(entry.Tags, ", "))
+	}
+	if entry.Command != "" {
+		fmt.Fprintf(&body, "Command:  %s\n", entry.Command)
+	} else if entry.Event == AuditEventDecision {
+		fmt.Fprintf(&body, "Command:  ANY COMMAND\n")
+	}
+	fmt.Fprintf(&body, "Decision: %s\n", entry.Decision)
+	if entry.Detail != "" {
+		fmt.Fprintf(&body, "Detail:   %s\n", entry.Detail)
+	}
+	fmt.Fprintf(&body, "Audit entry %d (%s)\n", entry.Seq, entry.Hash)
+	if err := notifier.mail(subject, body.String()); err != nil {
+		log.Printf("Failed to send email alert: %s", err)
+	}
+}
+
+func (notifier *EmailNotifier) run() {
+	defer close(notifier.done)
+	if notifier.config.DigestInterval == 0 {
+		<-notifier.stop
+		return
+	}
+	ticker := time.NewTicker(notifier.config.DigestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			notifier.sendDigest()
+		case <-notifier.stop:
+			notifier.sendDigest()
+			return
+		}
+	}
+}
+
+func (notifier *EmailNotifier) sendDigest() {
+	notifier.mu.Lock()
+	digest := notifier.digest
+	since := notifier.since
+	notifier.digest = make(map[digestKey]*digestCounts)
+	notifier.since = time.Now()
+	notifier.mu.Unlock()
+
+	if len(digest) == 0 {
+		return
+	}
+	keys := make([]digestKey, 0, len(digest))
+	for k := range digest {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Client != keys[j].Client {
+			return keys[i].Client < keys[j].Client
+		}
+		return keys[i].Server < keys[j].Server
+	})
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Delegation activity from %s to %s\n\n", since.Format(time.RFC1123), time.Now().Format(time.RFC1123))
+	fmt.Fprintf(&body, "%-30s %-30s %8s %8s %8s %8s\n", "CLIENT", "SERVER", "APPROVED", "AUTO", "DENIED", "ERRORS")
+	for _, k := range keys {
+		c := digest[k]
+		fmt.Fprintf(&body, "%-30s %-30s %8d %8d %8d %8d\n", k.Client, k.Server, c.Approved, c.AutoApproved, c.Denied, c.Errors)
+	}
+	if err := notifier.mail("[guardian-agent] Delegation activity digest", body.String()); err != nil {
+		log.Printf("Failed to send email digest: %s", err)
+	}
+}
+
+func (notifier *EmailNotifier) mail(subject string, body string) error {
+	host, _, _ := net.SplitHostPort(notifier.config.Server)
+	var auth smtp.Auth
+	if notifier.config.Username != "" {
+		auth = smtp.PlainAuth("", notifier.config.Username, notifier.config.Password, host)
+	}
+	hostname, _ := os.Hostname()
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nX-Mailer: guardian-agent on %s\r\n\r\n%s",
+		notifier.config.From, strings.Join(notifier.config.To, ", "), subject,
+		time.Now().Format(time.RFC1123Z), hostname, strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(notifier.config.Server, auth, notifier.config.From, notifier.config.To, []byte(msg))
+}
+
+// Close sends any pending digest.
+func (notifier *EmailNotifier) Close() error {
+	close(notifier.stop)
+	<-notifier.done
+	return nil
+}
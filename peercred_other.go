@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package guardianagent
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUID is not supported on this platform.
+func peerUID(conn net.Conn) (int, error) {
+	return 0, fmt.Errorf("identifying the peers of sockets is not supported on this platform")
+}
@@ -0,0 +1,154 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Interval between MsgExecutionPending keepalives, well below common NAT
+// idle timeouts.
+const pendingKeepAliveInterval = 15 * time.Second
+
+// How long a decision is kept for clients that retry the request, after the
+// approver made it.
+const pendingDecisionGrace = 2 * time.Minute
+
+// How long an undecided request is kept after its client disconnected, before
+// its prompt is withdrawn. It exceeds the time sga-ssh keeps trying to
+// reconnect.
+const pendingAbandonGrace = 150 * time.Second
+
+type pendingDecision struct {
+	scope  Scope
+	cmd    string
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// Connections waiting for the decision.
+	waiters int
+
+	approved  string
+	err       error
+	delivered bool
+}
+
+// PendingDecisions tracks approval requests by request ID, so that a client
+// which retries a request (e.g. after reconnecting) while the approver is still
+// deciding waits for the same decision instead of prompting again, and a retry
+// after the decision gets the same answer.
+type PendingDecisions struct {
+	mu      sync.Mutex
+	pending map[string]*pendingDecision
+}
+
+func NewPendingDecisions() *PendingDecisions {
+	return &PendingDecisions{pending: make(map[string]*pendingDecision)}
+}
+
+// Await returns the decision for the request with the given ID, starting it
+// with decide unless it is already known. If keepAlive is set, keepalives are
+// written to conn while waiting; if that fails, the decision stays pending for
+// a later reconnection and errClientGone is returned. If no client reconnects
+// within pendingAbandonGrace, the context passed to decide is canceled. An
+// approval is delivered to a single connection, so that it cannot run twice;
+// later retries are denied.
+func (decisions *PendingDecisions) Await(conn net.Conn, id string, scope Scope, cmd string, keepAlive bool, decide func(ctx context.Context) (string, error)) (string, error) {
+	decisions.mu.Lock()
+	p, ok := decisions.pending[id]
+	if ok && (p.scope != scope || p.cmd != cmd) {
+		decisions.mu.Unlock()
+		return "", deny(DenialChallengeInvalid, fmt.Sprintf("request ID %s was already used for another request", id))
+	}
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		p = &pendingDecision{scope: scope, cmd: cmd, done: make(chan struct{}), cancel: cancel}
+		decisions.pending[id] = p
+		go func() {
+			p.approved, p.err = decide(ctx)
+			cancel()
+			close(p.done)
+			time.AfterFunc(pendingDecisionGrace, func() { decisions.remove(id, p) })
+		}()
+	}
+	p.waiters++
+	decisions.mu.Unlock()
+	defer decisions.leave(p)
+
+	if !keepAlive {
+		<-p.done
+		return decisions.deliver(p)
+	}
+	// Let the client know right away that keepalives will follow.
+	keepalive := time.NewTicker(pendingKeepAliveInterval)
+	defer keepalive.Stop()
+	for err := WriteControlPacket(conn, MsgExecutionPending, nil); ; {
+		if err != nil {
+			return "", errClientGone
+		}
+		select {
+		case <-p.done:
+			return decisions.deliver(p)
+		case <-keepalive.C:
+			err = WriteControlPacket(conn, MsgExecutionPending, nil)
+		}
+	}
+}
+
+// Count returns the number of requests waiting for a decision.
+func (decisions *PendingDecisions) Count() int {
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	count := 0
+	for _, p := range decisions.pending {
+		select {
+		case <-p.done:
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+// leave is called when a connection stops waiting for a decision, and
+// withdraws the decision if no connection waits for it any more for a while.
+func (decisions *PendingDecisions) leave(p *pendingDecision) {
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	p.waiters--
+	if p.waiters > 0 {
+		return
+	}
+	time.AfterFunc(pendingAbandonGrace, func() {
+		decisions.mu.Lock()
+		defer decisions.mu.Unlock()
+		if p.waiters == 0 {
+			p.cancel()
+		}
+	})
+}
+
+func (decisions *PendingDecisions) deliver(p *pendingDecision) (string, error) {
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	if p.err != nil {
+		return "", p.err
+	}
+	if p.delivered {
+		return "", deny(DenialChallengeInvalid, "request was already approved")
+	}
+	p.delivered = true
+	return p.approved, nil
+}
+
+func (decisions *PendingDecisions) remove(id string, p *pendingDecision) {
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	if decisions.pending[id] == p {
+		delete(decisions.pending, id)
+	}
+}
+
+var errClientGone = fmt.Errorf("client disconnected while waiting for a decision")
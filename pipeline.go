@@ -0,0 +1,135 @@
+package guardianagent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PipelineStage is a command of a shell pipeline or command list, and the
+// operator joining it to the previous one ("" for the first).
+type PipelineStage struct {
+	Operator string
+	Command  string
+}
+
+// ParsePipeline splits cmd into the commands of a pipeline or command list
+// joined with "|", "&&", "||" and ";", honoring quotes. Single commands are
+// not pipelines, and neither are commands with constructs which could hide
+// further commands from the split: substitutions, subshells, groups,
+// background jobs and newlines.
+func ParsePipeline(cmd string) ([]PipelineStage, bool) {
+	var stages []PipelineStage
+	var current string
+	operator := ""
+	var quote byte
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			if i+1 >= len(cmd) || cmd[i+1] == '\n' {
+				return nil, false
+			}
+			current += cmd[i : i+2]
+			i++
+			continue
+		case c == '`' || c == '\n' || (c == '$' && i+1 < len(cmd) && cmd[i+1] == '('):
+			return nil, false
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == ')' || c == '{' || c == '}':
+			return nil, false
+		case c == '&' && ((i > 0 && (cmd[i-1] == '>' || cmd[i-1] == '<')) || (i+1 < len(cmd) && cmd[i+1] == '>')):
+			// Redirections such as "2>&1" and "&>".
+		case c == '|' || c == '&' || c == ';':
+			next := c
+			if i+1 < len(cmd) && cmd[i+1] == c && c != ';' {
+				i++
+			} else if c == '&' || (c == '|' && i+1 < len(cmd) && cmd[i+1] == '&') {
+				// Background jobs, and "|&".
+				return nil, false
+			} else {
+				next = 0
+			}
+			stage := strings.TrimSpace(current)
+			if stage == "" {
+				return nil, false
+			}
+			stages = append(stages, PipelineStage{Operator: operator, Command: stage})
+			operator, current = string(c), ""
+			if next != 0 {
+				operator += string(next)
+			}
+			continue
+		}
+		current += string(c)
+	}
+	stage := strings.TrimSpace(current)
+	if quote != 0 || len(stages) == 0 {
+		return nil, false
+	}
+	if stage == "" {
+		// A trailing ";" ends the last command.
+		if operator != ";" {
+			return nil, false
+		}
+	} else {
+		stages = append(stages, PipelineStage{Operator: operator, Command: stage})
+	}
+	if len(stages) < 2 {
+		return nil, false
+	}
+	return stages, true
+}
+
+// stageApprovals returns what allows each stage of a pipeline in scope, or
+// "" for stages nothing allows.
+func (policy *Policy) stageApprovals(scope Scope, stages []PipelineStage) []string {
+	approvals := make([]string, len(stages))
+	for i, stage := range stages {
+		if rule := policy.System.Allows(scope, stage.Command); rule != nil {
+			approvals[i] = "system policy " + rule.source
+		} else if policy.Store.IsAllowed(scope, stage.Command) {
+			approvals[i] = "stored policy" + originSuffix(policy.Store.Origin(scope, stage.Command))
+		}
+	}
+	return approvals
+}
+
+func allStagesApproved(approvals []string) bool {
+	for _, approval := range approvals {
+		if approval == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// describePipeline shows approvers the stages of a pipeline, and which of
+// them are allowed.
+func describePipeline(stages []PipelineStage, approvals []string) string {
+	desc := "\n  Pipeline:"
+	for i, stage := range stages {
+		status := "NOT ALLOWED"
+		if approvals[i] != "" {
+			status = "allowed by " + approvals[i]
+		}
+		desc += fmt.Sprintf("\n    %-2s %s  [%s]", stage.Operator, displayLine(stage.Command), displayLine(status))
+	}
+	return desc
+}
+
+func describeStageApprovals(stages []PipelineStage, approvals []string) string {
+	var parts []string
+	for i, stage := range stages {
+		parts = append(parts, fmt.Sprintf("'%s' (%s)", stage.Command, approvals[i]))
+	}
+	return "pipeline of " + strings.Join(parts, ", ")
+}
@@ -1,89 +1,871 @@
 package guardianagent
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 type Policy struct {
-	Store *Store
-	UI    UI
+	Store  *Store
+	System *SystemPolicy
+	UI     UI
+	Audit  *AuditLog
+
+	// If set, interactive denials are repeated without prompting.
+	Denials *DenialCache
+
+	// One-time approvals issued through the admin API.
+	Tokens *ApprovalTokens
+
+	// Delegations the user prepared in advance.
+	Invitations *Invitations
+
+	// Every token and invitation issued, for queries.
+	Ledger *CredentialLedger
+
+	// Batches approved as a whole.
+	Batches *BatchApprovals
+
+	// Git runs whose further operations were approved along with the first.
+	GitRuns *GitRuns
+
+	// While engaged, every request is denied.
+	Lockdown *Lockdown
+
+	// Active sessions, and usage of the client quotas.
+	Sessions *Sessions
+	Quotas   *QuotaUsage
+
+	// Past approvals, against which requests are checked for anomalies.
+	History *History
+
+	// If set, the network context of requests is shown and audited.
+	Network *NetworkLocator
+
+	// Cache of the resolution of server names. If CheckServerDNS is set,
+	// approvers are warned about servers whose names do not resolve.
+	DNS            *DNSCache
+	CheckServerDNS bool
+
+	// If set, approvers are warned while the clock is off.
+	Clock *ClockCheck
+
+	// Address of the connection requests come from, if it is a network
+	// connection.
+	Peer net.Addr
+
+	// Mismatches between the name the client announced and Peer.
+	ClientWarnings []string
+
+	// If set, every request is confirmed as if a system prompt rule matched
+	// it, e.g. for connections from less trusted listeners.
+	AlwaysAsk bool
+
+	// If set, the approver is authenticated before interactive approvals are
+	// honored.
+	Approver *ApproverAuth
+
+	// If set, high-risk approvals also require a second factor.
+	StepUp *StepUp
+
+	// If set, pipelines and command lists (see ParsePipeline) are approved
+	// if each of their commands is allowed.
+	ApprovePipelines bool
+
+	// If set, consulted for every request, after the system policy's
+	// denials.
+	Program *PolicyProgram
+
+	// If set, bounds the requests waiting for the approver.
+	Prompts *PromptQueue
+
+	// The tenant requests are made for, if the guardian serves several.
+	Tenant *Tenant
 }
 
-func (policy *Policy) RequestApproval(scope Scope, cmd string) error {
-	if policy.Store.IsAllowed(scope, cmd) {
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED by policy",
-			scope.Client, cmd, scope.ServiceUsername,
-			scope.ServiceHostname))
-		return nil
+type approvalChoice int
+
+const (
+	choiceDisallow approvalChoice = iota
+	choiceAllowOnce
+	choiceAllowForever
+	choiceAllowAll
+	choiceModify
+	choiceAllowBatch
+	choiceAllowGitRun
+	choiceAllowTemplate
+)
+
+// RequestApproval decides whether cmd may run in scope, asking the user if
+// necessary, and returns the command to run, which the user may have narrowed
+// down. The prompt is withdrawn if ctx is canceled.
+func (policy *Policy) RequestApproval(ctx context.Context, scope Scope, cmd string, meta RequestMetadata) (string, error) {
+	policy = policy.forRequest(meta.RequestID, scope)
+	quotas := policy.System.QuotasFor(scope.Client)
+	approved, err := policy.requestApproval(ctx, scope, cmd, meta, quotas)
+	if err == nil {
+		policy.Quotas.recordApproval(quotas, scope.Client)
+		if err := policy.History.RecordApproval(scope, approved); err != nil {
+			log.Printf("%s %s", requestTag(meta.RequestID, scope), err)
+		}
 	}
-	question := fmt.Sprintf("Allow %s to run '%s' on %s@%s?",
-		scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname)
+	return approved, err
+}
 
-	prompt := Prompt{
-		Question: question,
-		Choices: []string{
-			"Disallow", "Allow once", "Allow forever",
-			fmt.Sprintf("Allow %s to run any command on %s@%s forever",
-				scope.Client, scope.ServiceUsername, scope.ServiceHostname),
-		},
+func (policy *Policy) requestApproval(ctx context.Context, scope Scope, cmd string, meta RequestMetadata, quotas []ClientQuota) (approved string, err error) {
+	audit := policy.Audit.forRequest(meta.RequestID)
+	warnings := policy.ClientWarnings
+	if warning := policy.Clock.Warning(); warning != "" {
+		warnings = append(warnings[:len(warnings):len(warnings)], warning)
 	}
-	resp, err := policy.UI.Ask(prompt)
-	if err != nil {
-		return fmt.Errorf("Failed to get user approval: %s", err)
+	if warning := policy.hostConfusableWarning(scope.ServiceHostname); warning != "" {
+		warnings = append(warnings[:len(warnings):len(warnings)], warning)
 	}
-
-	switch resp {
-	case 2:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED by user",
+	if policy.CheckServerDNS {
+		if warning := serverResolutionWarning(policy.DNS, scope.ServiceHostname); warning != "" {
+			warnings = append(warnings[:len(warnings):len(warnings)], warning)
+		}
+	}
+	context := RequestContext{
+		Warnings:  warnings,
+		Anomalies: policy.History.Anomalies(scope, cmd),
+		Network:   policy.Network.Describe(policy.Peer, scope.Client, scope.ServiceHostname),
+	}
+	policy.Audit.RecordRequest(scope, cmd, meta, context)
+	if err := policy.Lockdown.Deny(); err != nil {
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "lockdown")
+		return "", err
+	}
+	stages, _ := ParsePipeline(cmd)
+	if rule := policy.deniedBy(scope, cmd); rule != nil {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED by system policy %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, rule.source))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "system policy "+rule.source)
+		return "", deny(DenialPolicy, "Request denied by system policy")
+	}
+	if err := policy.Quotas.checkRequest(quotas, scope.Client, policy.Sessions.CountClient(scope.Client)); err != nil {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED: %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, err))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", err.Error())
+		return "", err
+	}
+	decision := policy.consultProgram(audit, scope, cmd, meta, context)
+	if decision.Decision == ProgramDeny {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED by %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, describeProgramDecision(decision)))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", describeProgramDecision(decision))
+		return "", deny(DenialPolicy, "Request denied by policy program")
+	}
+	// Catastrophic commands are always confirmed interactively.
+	catastrophic := policy.System.CatastrophicMatch(cmd)
+	alwaysAsk := policy.AlwaysAsk || catastrophic != nil
+	for _, command := range restrictedCommands(cmd) {
+		alwaysAsk = alwaysAsk || policy.System.AlwaysAsks(scope, command) != nil
+	}
+	// Tokens pre-approve requests on behalf of the user, so they cannot stand
+	// in for the approvers an approve rule requires.
+	if !alwaysAsk && policy.System.RequiredApprovers(scope, cmd) == nil && policy.Tokens.Redeem(meta.Token, scope, cmd) {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED by one-time token",
 			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
-		err = nil
-	case 3:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s PERMANENTLY APPROVED by user",
+		audit.Record(AuditEventDecision, scope, cmd, "approved", "one-time token")
+		return cmd, nil
+	}
+	if rule := policy.System.Allows(scope, cmd); rule != nil && !alwaysAsk {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED by system policy %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, rule.source))
+		audit.Record(AuditEventDecision, scope, cmd, "auto-approved", "system policy "+rule.source)
+		return cmd, nil
+	}
+	if decision.Decision == ProgramAllow && !alwaysAsk {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED by %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, describeProgramDecision(decision)))
+		audit.Record(AuditEventDecision, scope, cmd, "auto-approved", describeProgramDecision(decision))
+		return cmd, nil
+	}
+	// Nor can invitations, which the user issues like tokens.
+	if !alwaysAsk && meta.Invitation != "" && policy.System.RequiredApprovers(scope, cmd) == nil {
+		invitation, err := policy.Invitations.Use(meta.Invitation, scope, policy.System.TagsFor(scope.ServiceHostname), cmd)
+		if err != nil {
+			policy.UI.Alert(fmt.Sprintf("Request by %s presented a bad invitation: %s", displayLine(scope.Client), displayLine(err.Error())))
+		}
+		if invitation != nil {
+			uses := fmt.Sprintf("use %d", invitation.Uses)
+			if invitation.MaxUses > 0 {
+				uses += fmt.Sprintf(" of %d", invitation.MaxUses)
+			}
+			policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED by invitation %s (%s)",
+				scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, invitation.ID, uses))
+			audit.Record(AuditEventDecision, scope, cmd, "auto-approved", fmt.Sprintf("invitation %s (%s)", invitation.ID, uses))
+			return cmd, nil
+		}
+	}
+	if policy.Store.IsAllowed(scope, cmd) && !alwaysAsk {
+		return policy.approveStored(audit, scope, cmd), nil
+	}
+	var stageApprovals []string
+	if len(stages) > 0 {
+		stageApprovals = policy.stageApprovals(scope, stages)
+	}
+	if policy.ApprovePipelines && !alwaysAsk && len(stages) > 0 && allStagesApproved(stageApprovals) {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED as a pipeline of allowed commands",
 			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
-		err = policy.Store.AllowCommand(scope, cmd)
-	case 4:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s PERMANENTLY APPROVED by user",
-			scope.Client, scope.ServiceUsername, scope.ServiceHostname))
-		err = policy.Store.AllowAll(scope)
+		audit.Record(AuditEventDecision, scope, cmd, "auto-approved", describeStageApprovals(stages, stageApprovals))
+		for _, stage := range stages {
+			if policy.Store.IsAllowed(scope, stage.Command) {
+				if err := policy.Store.MarkUsed(scope, stage.Command); err != nil {
+					log.Printf("%s", err)
+				}
+			}
+		}
+		return cmd, nil
+	}
+	if !alwaysAsk && policy.Batches.Use(scope, policy.System.TagsFor(scope.ServiceHostname), cmd, meta) {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED as part of batch %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, meta.Batch))
+		audit.Record(AuditEventDecision, scope, cmd, "auto-approved", "batch "+meta.Batch)
+		return cmd, nil
+	}
+	if !alwaysAsk && policy.GitRuns.Use(scope, cmd, meta) {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED as part of git run %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, meta.GitRun))
+		audit.Record(AuditEventDecision, scope, cmd, "auto-approved", "git run "+meta.GitRun)
+		return cmd, nil
+	}
+	if at, ok := policy.Denials.DeniedAt(scope, cmd); ok {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED (recently denied %s)",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, describeAgo(at)))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "recently denied "+describeAgo(at))
+		return "", deny(DenialUser, "User recently rejected the same request")
+	}
+	if err := policy.Quotas.checkPrompt(quotas, scope.Client); err != nil {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED: %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, err))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", err.Error())
+		return "", err
+	}
+	entry, ctx, err := policy.Prompts.enter(ctx, scope, cmd, meta.RequestID)
+	if err != nil {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED: %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, err))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "prompt queue full")
+		return "", err
+	}
+	defer entry.leave()
+	// Identical requests are answered by a single prompt: the first one
+	// prompts, and the others wait for its answer.
+	if leader := entry.waitLeader(ctx); leader != nil {
+		approved, err = policy.shareAnswer(audit, scope, cmd, leader)
+		entry.decided(approved, err)
+		return approved, err
+	}
+	identical := entry.gather(ctx)
+	if entry.isOverflowed() {
+		return "", policy.overflow(audit, scope, cmd)
+	}
+	if ctx.Err() != nil {
+		return "", policy.withdraw(audit, scope, cmd)
+	}
+	shown := displayScope(scope)
+	question := fmt.Sprintf("Allow %s to %s on %s@%s%s?%s%s",
+		shown.Client, describeCommand(cmd), shown.ServiceUsername, shown.ServiceHostname, policy.tagSuffix(scope), meta.describe(),
+		context.describe())
+	if identical > 1 {
+		question += fmt.Sprintf("\n  Identical requests: %d (answered together)", identical)
+	}
+
+	if len(stages) > 0 {
+		question += describePipeline(stages, stageApprovals)
+	}
+	question += describeEscapes(scope, cmd)
+	question += describeSudo(cmd)
+	constructs, highlights := describeShellConstructs(cmd)
+	question += constructs
+
+	if rule := policy.System.RecordingFor(scope, cmd); rule != nil {
+		question += describeRecording(rule.Recording)
+	}
+
+	if catastrophic != nil {
+		question += describeCatastrophic(catastrophic, catastrophicPhrase(scope))
+	}
+
+	prompt := Prompt{Question: question, Highlights: highlights}
+	approveRule := policy.System.RequiredApprovers(scope, cmd)
+	if approveRule != nil {
+		prompt.Question += approveRule.describeApprovers()
+		prompt.Approvers = approveRule.Approvers
+	}
+	// Requests which are unusual, or must always be confirmed, escalate
+	// sooner.
+	if alwaysAsk || len(context.Anomalies) > 0 || len(context.Warnings) > 0 {
+		prompt.Risk = RiskHigh
+	}
+	var actions []approvalChoice
+	offer := func(action approvalChoice, text string) {
+		actions = append(actions, action)
+		prompt.Choices = append(prompt.Choices, text)
+		switch action {
+		case choiceAllowOnce:
+			prompt.Once = len(actions)
+		case choiceAllowForever:
+			prompt.Forever = len(actions)
+		}
+	}
+	offer(choiceDisallow, "Disallow")
+	if cmd == "" {
+		offer(choiceAllowOnce, "Allow a shell session once (for a purpose and duration)")
+	} else {
+		offer(choiceAllowOnce, "Allow once")
+	}
+	// Permanent approvals would be pointless for requests that must always be
+	// confirmed, and allowing any command is not an option if the system
+	// policy denies some, or requires approvers for some that may not be
+	// those of this request.
+	// Shells are approved for a purpose and a duration, which stored
+	// approvals could not capture.
+	if !alwaysAsk && cmd != "" {
+		offer(choiceAllowForever, "Allow forever")
+	}
+	// Read-only queries may be approved as a template, so that other such
+	// queries do not prompt again.
+	template := SuggestTemplate(cmd)
+	if !alwaysAsk && template != "" {
+		offer(choiceAllowTemplate, fmt.Sprintf("Allow any read-only query forever: %s", displayLine(template)))
+	}
+	allApproveRule := policy.System.RequiredApprovers(scope, "")
+	if !alwaysAsk && policy.System.DeniesAny(scope) == nil && (allApproveRule == nil || allApproveRule == approveRule) {
+		offer(choiceAllowAll, fmt.Sprintf("Allow %s to run any command on %s@%s forever",
+			shown.Client, shown.ServiceUsername, shown.ServiceHostname))
+	}
+	offer(choiceModify, "Allow a modified command once")
+	batchRule := policy.batchRule(scope, cmd, meta)
+	if !alwaysAsk && batchRule != nil {
+		offer(choiceAllowBatch, fmt.Sprintf("Allow batch %s on up to %d hosts in %s for %s",
+			displayLine(meta.Batch), meta.BatchSize, displayLine(meta.BatchGroup), batchRule.Window))
+	}
+	if !alwaysAsk && policy.GitRuns.Offered(cmd, meta) {
+		offer(choiceAllowGitRun, fmt.Sprintf("Allow the rest of this git run on %s@%s for %s",
+			shown.ServiceUsername, shown.ServiceHostname, GitRunWindow))
+	}
+	askCtx, answer := withPromptAnswer(ctx)
+	resp, err := policy.UI.Ask(askCtx, prompt)
+	if entry.isOverflowed() {
+		return "", policy.overflow(audit, scope, cmd)
+	}
+	if ctx.Err() != nil {
+		return "", policy.withdraw(audit, scope, cmd)
+	}
+	if err == errScreenLocked {
+		return "", policy.expire(audit, scope, cmd)
+	}
+	if err != nil {
+		audit.Record(AuditEventError, scope, cmd, "", err.Error())
+		return "", fmt.Errorf("Failed to get user approval: %s", err)
+	}
+	action := choiceDisallow
+	if resp > 0 && resp <= len(actions) {
+		action = actions[resp-1]
+	}
+	// Shells are approved for a purpose each, and catastrophic commands
+	// confirmed each, so their approvals are not shared.
+	defer func() {
+		if (cmd != "" && catastrophic == nil) || err != nil {
+			entry.decided(approved, err)
+		}
+	}()
+	by := "user"
+	origin := policy.origin(meta.RequestID)
+	approver := answer.Approver()
+	if approver != "" {
+		by, origin.Via = approver, approver
+	} else {
+		approver = localApprover()
+	}
+	audit = audit.by(approver)
+	if answer.Approver() == "" && action != choiceDisallow {
+		if err := policy.authenticateApprover(audit, scope, cmd); err != nil {
+			return "", err
+		}
+	}
+	if action != choiceDisallow {
+		if err := policy.authorizeApprover(audit, scope, cmd, approveRule, approver); err != nil {
+			return "", err
+		}
+	}
+	if action == choiceAllowAll {
+		if err := policy.authorizeApprover(audit, scope, cmd, allApproveRule, approver); err != nil {
+			return "", err
+		}
+	}
+	if kind, ok := stepUpKindOf[action]; ok {
+		if err := policy.stepUp(ctx, audit, scope, cmd, stepUpKinds(kind, context)...); err != nil {
+			return "", err
+		}
+	}
+	if catastrophic != nil && action != choiceDisallow {
+		if err := policy.confirmCatastrophic(ctx, audit, scope, cmd, catastrophic); err != nil {
+			return "", err
+		}
+	}
+
+	switch action {
+	case choiceAllowOnce:
+		if cmd == "" {
+			return policy.approveShell(ctx, audit, scope, meta, by)
+		}
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED by %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, cmd, "approved", "allow once")
+		return cmd, nil
+	case choiceModify:
+		return policy.approveModified(ctx, audit, scope, cmd)
+	case choiceAllowBatch:
+		policy.UI.Inform(fmt.Sprintf("Batch %s by %s on up to %d hosts in %s APPROVED by %s",
+			meta.Batch, scope.Client, meta.BatchSize, meta.BatchGroup, by))
+		audit.Record(AuditEventDecision, scope, cmd, "approved", fmt.Sprintf("batch %s: up to %d hosts in %s for %s (%s)",
+			meta.Batch, meta.BatchSize, meta.BatchGroup, batchRule.Window, batchRule.source))
+		policy.Batches.Grant(scope, meta, batchRule)
+		return cmd, nil
+	case choiceAllowGitRun:
+		policy.UI.Inform(fmt.Sprintf("Git run %s by %s on %s@%s APPROVED by %s",
+			meta.GitRun, scope.Client, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, cmd, "approved", fmt.Sprintf("git run %s for %s", meta.GitRun, GitRunWindow))
+		policy.GitRuns.Grant(scope, cmd, meta)
+		return cmd, nil
+	case choiceAllowForever:
+		if ttl := answer.TTL(); ttl > 0 {
+			origin.Expires = time.Now().Add(ttl)
+			policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED for %s by %s",
+				scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, ttl, by))
+			audit.Record(AuditEventDecision, scope, cmd, "approved", "allow for "+ttl.String())
+			return cmd, policy.Store.AllowCommand(scope, cmd, origin)
+		}
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s PERMANENTLY APPROVED by %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, cmd, "approved", "allow forever")
+		return cmd, policy.Store.AllowCommand(scope, cmd, origin)
+	case choiceAllowTemplate:
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s PERMANENTLY APPROVED as template '%s' by %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, template, by))
+		audit.Record(AuditEventDecision, scope, cmd, "approved", "allow template forever: "+template)
+		return cmd, policy.Store.AllowTemplate(scope, template, origin)
+	case choiceAllowAll:
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s PERMANENTLY APPROVED by %s",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, cmd, "approved", "allow any command forever")
+		return cmd, policy.Store.AllowAll(scope, origin)
 	default:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED by user",
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED by %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "")
+		policy.Denials.Remember(scope, cmd)
+		return "", deny(DenialUser, "User rejected client request")
+	}
+}
+
+// forRequest returns a copy of the policy whose UI messages are tagged with the
+// request.
+func (policy *Policy) forRequest(id string, scope Scope) *Policy {
+	tagged := *policy
+	tagged.UI = taggedUI{UI: policy.UI, tag: requestTag(id, scope)}
+	return &tagged
+}
+
+// approveStored approves a request allowed by the personal policy.
+func (policy *Policy) approveStored(audit requestAudit, scope Scope, cmd string) string {
+	origin := originSuffix(policy.Store.Origin(scope, cmd))
+	policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s AUTO-APPROVED by policy%s",
+		scope.Client, cmd, scope.ServiceUsername,
+		scope.ServiceHostname, origin))
+	audit.Record(AuditEventDecision, scope, cmd, "auto-approved", "stored policy"+origin)
+	if err := policy.Store.MarkUsed(scope, cmd); err != nil {
+		log.Printf("%s", err)
+	}
+	return cmd
+}
+
+// shareAnswer applies the answer to an identical request (see PromptQueue) to
+// a request that waited for it.
+func (policy *Policy) shareAnswer(audit requestAudit, scope Scope, cmd string, leader *queuedPrompt) (string, error) {
+	if leader.denial != nil {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED along with identical request %s",
+			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, leader.requestID))
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "identical to request "+leader.requestID)
+		return "", leader.denial
+	}
+	policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED along with identical request %s",
+		scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, leader.requestID))
+	audit.Record(AuditEventDecision, scope, cmd, "approved", "identical to request "+leader.requestID)
+	return leader.approved, nil
+}
+
+// overflow records that a request was denied to make room in the prompt
+// queue.
+func (policy *Policy) overflow(audit requestAudit, scope Scope, cmd string) error {
+	policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED (too many requests waiting for approval)",
+		scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
+	audit.Record(AuditEventDecision, scope, cmd, "denied", "prompt queue overflow")
+	return deny(DenialRateLimit, "Too many requests were waiting for approval")
+}
+
+// withdraw records that the prompt for a request was withdrawn, since its
+// client went away before the user decided.
+func (policy *Policy) withdraw(audit requestAudit, scope Scope, cmd string) error {
+	policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s WITHDRAWN (client disconnected)",
+		scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
+	audit.Record(AuditEventDecision, scope, cmd, "withdrawn", "client disconnected")
+	return deny(DenialError, "Request withdrawn after the client disconnected")
+}
+
+// expire records that a request was denied because its prompt was deferred
+// for too long while the screen was locked.
+func (policy *Policy) expire(audit requestAudit, scope Scope, cmd string) error {
+	policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s DENIED (the screen stayed locked)",
+		scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
+	audit.Record(AuditEventDecision, scope, cmd, "denied", "screen locked")
+	return deny(DenialTimeout, "Nobody approved the request while the approver's screen was locked")
+}
+
+// deniedBy returns the system deny rule matching cmd, or any command of it if
+// it is a pipeline or runs commands through sudo (see restrictedCommands).
+func (policy *Policy) deniedBy(scope Scope, cmd string) *PolicyRule {
+	for _, command := range restrictedCommands(cmd) {
+		if rule := policy.System.Denies(scope, command); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// batchRule returns the batch rule under which the request's batch may be
+// approved as a whole, if any.
+func (policy *Policy) batchRule(scope Scope, cmd string, meta RequestMetadata) *PolicyRule {
+	if policy.Batches == nil || meta.Batch == "" || meta.BatchGroup == "" || meta.BatchSize <= 0 {
+		return nil
+	}
+	if !hasAllTags(policy.System.TagsFor(scope.ServiceHostname), []string{meta.BatchGroup}) {
+		return nil
+	}
+	rule := policy.System.AllowsBatch(scope, cmd)
+	if rule == nil || meta.BatchSize > rule.MaxHosts {
+		return nil
+	}
+	return rule
+}
+
+// approveModified lets the user narrow down the requested command. The edited
+// command is subject to the system deny rules like any other.
+func (policy *Policy) approveModified(ctx context.Context, audit requestAudit, scope Scope, cmd string) (string, error) {
+	shown := displayScope(scope)
+	edited, err := policy.UI.Edit(ctx, fmt.Sprintf("Command for %s to run on %s@%s:",
+		shown.Client, shown.ServiceUsername, shown.ServiceHostname), cmd)
+	if ctx.Err() != nil {
+		return "", policy.withdraw(audit, scope, cmd)
+	}
+	if err != nil {
+		audit.Record(AuditEventError, scope, cmd, "", err.Error())
+		return "", fmt.Errorf("Failed to get user approval: %s", err)
+	}
+	if edited == "" {
+		audit.Record(AuditEventDecision, scope, cmd, "denied", "modification abandoned")
+		return "", deny(DenialUser, "User rejected client request")
+	}
+	if rule := policy.deniedBy(scope, edited); rule != nil {
+		policy.UI.Inform(fmt.Sprintf("Modified command '%s' on %s@%s DENIED by system policy %s",
+			edited, scope.ServiceUsername, scope.ServiceHostname, rule.source))
+		audit.Record(AuditEventDecision, scope, edited, "denied", "system policy "+rule.source)
+		return "", deny(DenialPolicy, "Request denied by system policy")
+	}
+	if pattern := policy.System.CatastrophicMatch(edited); edited != cmd && pattern != nil {
+		if err := policy.confirmCatastrophic(ctx, audit, scope, edited, pattern); err != nil {
+			return "", err
+		}
+	}
+	if edited == cmd {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED by user",
 			scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname))
-		err = errors.New("User rejected client request")
+		audit.Record(AuditEventDecision, scope, cmd, "approved", "allow once")
+		return cmd, nil
 	}
+	policy.UI.Inform(fmt.Sprintf("Request by %s to run '%s' on %s@%s APPROVED by user as '%s'",
+		scope.Client, cmd, scope.ServiceUsername, scope.ServiceHostname, edited))
+	audit.Record(AuditEventDecision, scope, edited, "approved", fmt.Sprintf("allow once, modified from '%s'", cmd))
+	return edited, nil
+}
 
-	return err
+// RequestSignature asks the user whether the client may have key sign data,
+// which is normally that of a public key authentication in ssh-agent
+// passthrough mode. If the connection was bound to a session (see
+// session-bind@openssh.com), hostKey is the key of the server, and
+// scope.ServiceHostname its name, if known.
+func (policy *Policy) RequestSignature(scope Scope, key ssh.PublicKey, hostKey ssh.PublicKey, data []byte) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	desc := fmt.Sprintf("signature with %s key %s", key.Type(), fingerprint)
+	var details string
+	scope.ServiceUsername, details = describeSignedData(data)
+	policy = policy.forRequest("", scope)
+	policy.Audit.Record(AuditEventRequest, scope, desc, "", details)
+	if err := policy.Lockdown.Deny(); err != nil {
+		policy.Audit.Record(AuditEventDecision, scope, desc, "denied", "lockdown")
+		return err
+	}
+	if scope.ServiceHostname != "" {
+		if rule := policy.System.DeniesAny(scope); rule != nil {
+			policy.UI.Inform(fmt.Sprintf("Request by %s for a %s to sign in to %s DENIED by system policy %s",
+				scope.Client, desc, scope.ServiceHostname, rule.source))
+			policy.Audit.Record(AuditEventDecision, scope, desc, "denied", "system policy "+rule.source)
+			return deny(DenialPolicy, "Request denied by system policy")
+		}
+	}
+	if constraint, ok := policy.Store.KeyConstraint(fingerprint); ok {
+		if constraint.expired(time.Now()) {
+			policy.Audit.Record(AuditEventDecision, scope, desc, "denied", "key expired")
+			return deny(DenialPolicy, "Key has expired")
+		}
+		if !constraint.allowsDestination(scope.ServiceHostname) {
+			policy.UI.Inform(fmt.Sprintf("Request by %s for a %s DENIED: destination %q not allowed for this key",
+				scope.Client, desc, scope.ServiceHostname))
+			policy.Audit.Record(AuditEventDecision, scope, desc, "denied", "destination not allowed for key")
+			return deny(DenialPolicy, "Destination not allowed for key")
+		}
+		if constraint.NoConfirm && !policy.AlwaysAsk {
+			policy.Audit.Record(AuditEventDecision, scope, desc, "auto-approved", "key constraint")
+			return nil
+		}
+	}
+	var destination string
+	switch {
+	case scope.ServiceHostname != "":
+		destination = " on " + scope.ServiceHostname
+	case hostKey != nil:
+		destination = fmt.Sprintf(" on an unknown host with %s key %s", hostKey.Type(), ssh.FingerprintSHA256(hostKey))
+	}
+	shown := displayScope(scope)
+	question := fmt.Sprintf("Allow %s to make a %s?\n%s", shown.Client, desc, details)
+	if scope.ServiceUsername != "" {
+		question = fmt.Sprintf("Allow %s to sign in as %s%s with %s key %s?\n%s",
+			shown.Client, shown.ServiceUsername, displayLine(destination), key.Type(), fingerprint, details)
+	}
+	audit := policy.Audit.forRequest("")
+	prompt := Prompt{Question: question, Choices: []string{"Disallow", "Allow once"}, Once: 2}
+	approveRule := policy.System.RequiredApprovers(scope, "")
+	if approveRule != nil {
+		prompt.Question += approveRule.describeApprovers()
+		prompt.Approvers = approveRule.Approvers
+	}
+	ctx, answer := withPromptAnswer(context.Background())
+	resp, err := policy.UI.Ask(ctx, prompt)
+	if err == errScreenLocked {
+		return policy.expire(audit, scope, desc)
+	}
+	if err != nil {
+		audit.Record(AuditEventError, scope, desc, "", err.Error())
+		return fmt.Errorf("Failed to get user approval: %s", err)
+	}
+	by := "user"
+	approver := answer.Approver()
+	if approver != "" {
+		by = approver
+	} else {
+		approver = localApprover()
+	}
+	audit = audit.by(approver)
+	if resp != 2 {
+		policy.UI.Inform(fmt.Sprintf("Request by %s for a %s DENIED by %s", scope.Client, desc, by))
+		audit.Record(AuditEventDecision, scope, desc, "denied", "")
+		return deny(DenialUser, "User rejected signature request")
+	}
+	if answer.Approver() == "" {
+		if err := policy.authenticateApprover(audit, scope, desc); err != nil {
+			return err
+		}
+	}
+	if err := policy.authorizeApprover(audit, scope, desc, approveRule, approver); err != nil {
+		return err
+	}
+	if err := policy.stepUp(ctx, audit, scope, desc, StepUpOnce); err != nil {
+		return err
+	}
+	policy.UI.Inform(fmt.Sprintf("Request by %s for a %s APPROVED by %s", scope.Client, desc, by))
+	audit.Record(AuditEventDecision, scope, desc, "approved", "allow once")
+	return nil
 }
 
-func (policy *Policy) RequestApprovalForAllCommands(scope Scope) error {
-	if policy.Store.AreAllAllowed(scope) {
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s AUTO-APPROVED by policy",
-			scope.Client, scope.ServiceUsername, scope.ServiceHostname))
+func (policy *Policy) RequestApprovalForAllCommands(scope Scope, requestID string) error {
+	policy = policy.forRequest(requestID, scope)
+	audit := policy.Audit.forRequest(requestID)
+	if err := policy.Lockdown.Deny(); err != nil {
+		audit.Record(AuditEventDecision, scope, "", "denied", "lockdown")
+		return err
+	}
+	if rule := policy.System.DeniesAny(scope); rule != nil {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s DENIED by system policy %s",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, rule.source))
+		audit.Record(AuditEventDecision, scope, "", "denied", "system policy "+rule.source)
+		return deny(DenialPolicy, "Request denied by system policy")
+	}
+	alwaysAsk := policy.AlwaysAsk || policy.System.AlwaysAsksAny(scope) != nil
+	if rule := policy.System.AllowsAll(scope); rule != nil && !alwaysAsk {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s AUTO-APPROVED by system policy %s",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, rule.source))
+		audit.Record(AuditEventDecision, scope, "", "auto-approved", "system policy "+rule.source)
+		return nil
+	}
+	if policy.Store.AreAllAllowed(scope) && !alwaysAsk {
+		origin := originSuffix(policy.Store.Origin(scope, ""))
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s AUTO-APPROVED by policy%s",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, origin))
+		audit.Record(AuditEventDecision, scope, "", "auto-approved", "stored policy, any command"+origin)
+		if err := policy.Store.MarkUsed(scope, ""); err != nil {
+			log.Printf("%s", err)
+		}
 		return nil
 	}
-	question := fmt.Sprintf("Can't enforce permission for a single command. Allow %s to run ANY COMMAND on %s@%s?",
-		scope.Client, scope.ServiceUsername, scope.ServiceHostname)
+	if at, ok := policy.Denials.DeniedAt(scope, ""); ok {
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s DENIED (recently denied %s)",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, describeAgo(at)))
+		audit.Record(AuditEventDecision, scope, "", "denied", "recently denied "+describeAgo(at))
+		return deny(DenialUser, "User recently rejected approval escalation")
+	}
+	shown := displayScope(scope)
+	question := fmt.Sprintf("Can't enforce permission for a single command. Allow %s to run ANY COMMAND on %s@%s%s?",
+		shown.Client, shown.ServiceUsername, shown.ServiceHostname, policy.tagSuffix(scope))
 
 	prompt := Prompt{
 		Question: question,
-		Choices:  []string{"Disallow", "Allow once", "Allow forever"},
+		Choices:  []string{"Disallow", "Allow once"},
+		Once:     2,
+		Risk:     RiskHigh,
+	}
+	approveRule := policy.System.RequiredApprovers(scope, "")
+	if approveRule != nil {
+		prompt.Question += approveRule.describeApprovers()
+		prompt.Approvers = approveRule.Approvers
+	}
+	if !alwaysAsk {
+		prompt.Choices = append(prompt.Choices, "Allow forever")
+		prompt.Forever = 3
+	}
+	ctx, answer := withPromptAnswer(context.Background())
+	resp, err := policy.UI.Ask(ctx, prompt)
+	if err == errScreenLocked {
+		return policy.expire(audit, scope, "")
+	}
+	if err == nil && (resp < 1 || resp > len(prompt.Choices)) {
+		err = fmt.Errorf("invalid choice %d", resp)
+	}
+	if err != nil {
+		audit.Record(AuditEventError, scope, "", "", err.Error())
+		return fmt.Errorf("Failed to get user approval: %s", err)
+	}
+	by := "user"
+	origin := policy.origin(requestID)
+	approver := answer.Approver()
+	if approver != "" {
+		by, origin.Via = approver, approver
+	} else {
+		approver = localApprover()
+	}
+	audit = audit.by(approver)
+	if answer.Approver() == "" && (resp == 2 || resp == 3) {
+		if err := policy.authenticateApprover(audit, scope, ""); err != nil {
+			return err
+		}
+	}
+	if resp == 2 || resp == 3 {
+		if err := policy.authorizeApprover(audit, scope, "", approveRule, approver); err != nil {
+			return err
+		}
+	}
+	if resp == 2 || resp == 3 {
+		kinds := []string{StepUpAny}
+		if resp == 3 {
+			kinds = append(kinds, StepUpForever)
+		}
+		if err := policy.stepUp(ctx, audit, scope, "", kinds...); err != nil {
+			return err
+		}
 	}
-	resp, err := policy.UI.Ask(prompt)
 
 	switch resp {
 	case 2:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s APPROVED by user",
-			scope.Client, scope.ServiceUsername, scope.ServiceHostname))
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s APPROVED by %s",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, "", "approved", "allow once, any command")
 		err = nil
 	case 3:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s PERMANENTLY APPROVED by user",
-			scope.Client, scope.ServiceUsername, scope.ServiceHostname))
-		err = policy.Store.AllowAll(scope)
-	default:
-		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s DENIED by user",
-			scope.Client, scope.ServiceUsername, scope.ServiceHostname))
-		err = errors.New("User rejected approval escalation")
+		if ttl := answer.TTL(); ttl > 0 {
+			origin.Expires = time.Now().Add(ttl)
+			policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s APPROVED for %s by %s",
+				scope.Client, scope.ServiceUsername, scope.ServiceHostname, ttl, by))
+			audit.Record(AuditEventDecision, scope, "", "approved", "allow any command for "+ttl.String())
+		} else {
+			policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s PERMANENTLY APPROVED by %s",
+				scope.Client, scope.ServiceUsername, scope.ServiceHostname, by))
+			audit.Record(AuditEventDecision, scope, "", "approved", "allow any command forever")
+		}
+		err = policy.Store.AllowAll(scope, origin)
+	case 1:
+		policy.UI.Inform(fmt.Sprintf("Request by %s to run ANY COMMAND on %s@%s DENIED by %s",
+			scope.Client, scope.ServiceUsername, scope.ServiceHostname, by))
+		audit.Record(AuditEventDecision, scope, "", "denied", "any command")
+		policy.Denials.Remember(scope, "")
+		err = deny(DenialUser, "User rejected approval escalation")
 	}
 
 	return err
 }
+
+// authenticateApprover makes sure the approver is the user, if approver
+// authentication is enabled, before an approval is honored.
+func (policy *Policy) authenticateApprover(audit requestAudit, scope Scope, cmd string) error {
+	err := policy.Approver.Authenticate(policy.UI)
+	if err == nil {
+		return nil
+	}
+	policy.UI.Alert(fmt.Sprintf("Approval of the request by %s DENIED: %s", displayLine(scope.Client), displayLine(err.Error())))
+	audit.Record(AuditEventDecision, scope, cmd, "denied", "approver authentication failed: "+err.Error())
+	return deny(DenialUser, "Approver authentication failed")
+}
+
+// authorizeApprover makes sure the approver may approve the request, if an
+// approve rule of the system policy restricts who may.
+func (policy *Policy) authorizeApprover(audit requestAudit, scope Scope, cmd string, rule *PolicyRule, approver string) error {
+	if rule == nil || MayApprove(rule.Approvers, approver) {
+		return nil
+	}
+	policy.UI.Alert(fmt.Sprintf("Approval of the request by %s DENIED: %s may not approve it (system policy %s)",
+		displayLine(scope.Client), displayLine(approver), rule.source))
+	audit.Record(AuditEventDecision, scope, cmd, "denied", fmt.Sprintf("approver %s not allowed by system policy %s", approver, rule.source))
+	return deny(DenialPolicy, "Approver not allowed by system policy")
+}
+
+// origin describes an approval the user is storing, in answer to the request
+// with the given ID.
+func (policy *Policy) origin(requestID string) RuleOrigin {
+	return RuleOrigin{Added: time.Now(), Via: promptVia(policy.UI), Request: requestID}
+}
+
+// originSuffix formats the origin of a stored approval for messages, e.g.
+// " (rule added 2024-03-02 via terminal)".
+func originSuffix(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	return " (" + origin + ")"
+}
+
+// tagSuffix lists the tags of the server, e.g. " [pci, prod]".
+func (policy *Policy) tagSuffix(scope Scope) string {
+	tags := policy.System.TagsFor(scope.ServiceHostname)
+	if len(tags) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(tags, ", ") + "]"
+}
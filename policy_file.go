@@ -0,0 +1,421 @@
+package guardianagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const policyFileVersion = 1
+
+const policyFileHeader = `# Guardian Agent policy (version 1).
+# See https://github.com/StanfordSNR/guardian-agent#policy-format
+`
+
+// policyFile is the YAML schema shared by the personal policy, system policy
+// files and rule packs:
+//
+//   version: 1
+//   include: [packs/git-hosting.yaml]
+//   tags:
+//     prod: ["*.prod.example.com", "db-*"]
+//   allow:
+//     - scope: {client: me@laptop, user: git, host: "gitlab.com:22"}
+//       commands: ["git-upload-pack 'team/repo.git'"]
+//   deny:
+//     - scope: {host: "prod-db:22"}
+//       all-commands: true
+//   prompt:
+//     - tags: [prod]
+//       all-commands: true
+//     - scp: {direction: upload, except: [/incoming]}
+//     - metacharacters: [redirection, substitution]
+//   batch:
+//     - tags: [web]
+//       all-commands: true
+//       max-hosts: 50
+//       window: 10m
+//   approve:
+//     - tags: [prod]
+//       all-commands: true
+//       approvers: ["%sre"]
+//   record:
+//     - tags: [prod]
+//       all-commands: true
+//       recording: full
+//       recipients: ["sga-recipient-..."]
+//   keys:
+//     - fingerprint: "SHA256:..."
+//       no-confirm: true
+//       destinations: ["*.example.com"]
+//   quotas:
+//     - client: "ci@*"
+//       max-sessions: 4
+//       max-approvals-per-day: 200
+//       max-prompts-per-hour: 10
+//   catastrophic:
+//     except: [fork-bomb]
+//     patterns:
+//       - {name: drop-database, pattern: '(?i)\bdrop\s+database\b'}
+type policyFile struct {
+	Version int                 `yaml:"version"`
+	Include []string            `yaml:"include,omitempty"`
+	Tags    map[string][]string `yaml:"tags,omitempty"`
+	Allow   []PolicyRule        `yaml:"allow,omitempty"`
+	Deny    []PolicyRule        `yaml:"deny,omitempty"`
+	Prompt  []PolicyRule        `yaml:"prompt,omitempty"`
+	Batch   []PolicyRule        `yaml:"batch,omitempty"`
+	Approve []PolicyRule        `yaml:"approve,omitempty"`
+	Record  []PolicyRule        `yaml:"record,omitempty"`
+	Quotas  []ClientQuota       `yaml:"quotas,omitempty"`
+
+	// Adjustments of the blocklist of catastrophic commands, only supported
+	// in system policy files and rule packs.
+	Catastrophic *CatastrophicRules `yaml:"catastrophic,omitempty"`
+
+	// Constraints on keys in ssh-agent passthrough mode, only supported in
+	// the personal policy.
+	Keys []KeyConstraint `yaml:"keys,omitempty"`
+
+	// Set if the file was in the legacy JSON format.
+	legacy bool
+}
+
+// PolicyError reports a problem at a specific position of a policy file.
+type PolicyError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Msg)
+}
+
+// parsePolicyFile strictly parses and validates a policy file. Files in the
+// legacy JSON formats are converted and flagged as such. If personal is set,
+// the file must only contain fully specified allow rules, as written by the
+// Store.
+func parsePolicyFile(name string, buf []byte, personal bool) (*policyFile, error) {
+	trimmed := bytes.TrimSpace(buf)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') && json.Valid(trimmed) {
+		return parseLegacyPolicyFile(name, trimmed)
+	}
+
+	file := &policyFile{}
+	var root yaml.Node
+	if err := yaml.Unmarshal(buf, &root); err != nil {
+		return nil, yamlPolicyError(name, err)
+	}
+	if len(root.Content) == 0 {
+		// Empty file.
+		file.Version = policyFileVersion
+		return file, nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(file); err != nil && err != io.EOF {
+		return nil, yamlPolicyError(name, err)
+	}
+
+	if file.Version != policyFileVersion {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "version"),
+			Msg: fmt.Sprintf("unsupported or missing policy version %d (expected version: %d)", file.Version, policyFileVersion)}
+	}
+	if personal && len(file.Deny) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "deny"),
+			Msg: "deny rules are only supported in system policy files and rule packs"}
+	}
+	if personal && len(file.Prompt) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "prompt"),
+			Msg: "prompt rules are only supported in system policy files and rule packs"}
+	}
+	if personal && len(file.Batch) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "batch"),
+			Msg: "batch rules are only supported in system policy files and rule packs"}
+	}
+	if personal && len(file.Approve) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "approve"),
+			Msg: "approve rules are only supported in system policy files and rule packs"}
+	}
+	if personal && len(file.Record) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "record"),
+			Msg: "record rules are only supported in system policy files and rule packs"}
+	}
+	if personal && len(file.Quotas) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "quotas"),
+			Msg: "quotas are only supported in system policy files and rule packs"}
+	}
+	for i := range file.Quotas {
+		if msg := file.Quotas[i].validate(); msg != "" {
+			return nil, &PolicyError{File: name, Line: itemLine(root.Content[0], "quotas", i), Msg: msg}
+		}
+	}
+	if personal && file.Catastrophic != nil {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "catastrophic"),
+			Msg: "catastrophic patterns are only supported in system policy files and rule packs"}
+	}
+	if file.Catastrophic != nil {
+		if msg := file.Catastrophic.validate(); msg != "" {
+			return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "catastrophic"), Msg: msg}
+		}
+	}
+	if !personal && len(file.Keys) > 0 {
+		return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "keys"),
+			Msg: "key constraints are only supported in the personal policy"}
+	}
+	for i := range file.Keys {
+		if msg := file.Keys[i].validate(); msg != "" {
+			return nil, &PolicyError{File: name, Line: itemLine(root.Content[0], "keys", i), Msg: msg}
+		}
+	}
+	for tag, patterns := range file.Tags {
+		for _, pattern := range patterns {
+			if _, err := compileHostPattern(pattern); err != nil {
+				return nil, &PolicyError{File: name, Line: keyLine(root.Content[0], "tags"),
+					Msg: fmt.Sprintf("invalid host pattern %q for tag %s", pattern, tag)}
+			}
+		}
+	}
+	for _, section := range []struct {
+		key   string
+		rules []PolicyRule
+	}{{"allow", file.Allow}, {"deny", file.Deny}, {"prompt", file.Prompt}, {"batch", file.Batch}, {"approve", file.Approve}, {"record", file.Record}} {
+		for i := range section.rules {
+			msg := section.rules[i].validate(personal)
+			if msg == "" {
+				msg = section.rules[i].validateBatchLimits(section.key == "batch")
+			}
+			if msg == "" {
+				msg = section.rules[i].validateApprovers(section.key == "approve")
+			}
+			if msg == "" {
+				msg = section.rules[i].validateRecording(section.key == "record")
+			}
+			if msg == "" && len(section.rules[i].Metacharacters) > 0 && (section.key == "allow" || section.key == "batch") {
+				msg = "metacharacters are not supported in allow and batch rules"
+			}
+			if msg == "" && len(section.rules[i].Templates) > 0 && (!personal || section.key != "allow") {
+				msg = "templates are only supported in the allow rules of the personal policy"
+			}
+			if msg != "" {
+				return nil, &PolicyError{File: name, Line: itemLine(root.Content[0], section.key, i), Msg: msg}
+			}
+		}
+	}
+	return file, nil
+}
+
+func (rule *PolicyRule) validate(personal bool) string {
+	set := 0
+	for _, isSet := range []bool{rule.AllCommands, len(rule.Commands) > 0 || len(rule.Templates) > 0, rule.SCP != nil || rule.Rsync != nil, rule.Git != nil, len(rule.Metacharacters) > 0} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return "rule must set exactly one of all-commands, commands/templates, scp/rsync, git or metacharacters"
+	}
+	for _, template := range rule.Templates {
+		if !isTemplate(template) {
+			return fmt.Sprintf("template %q has no placeholders", template)
+		}
+	}
+	for _, kind := range rule.Metacharacters {
+		if kind != ShellAny && !containsString(shellConstructKinds, kind) {
+			return fmt.Sprintf("invalid metacharacters %q (expected %s or %s)", kind, strings.Join(shellConstructKinds, ", "), ShellAny)
+		}
+	}
+	if rule.Git != nil {
+		if msg := rule.Git.validate(); msg != "" {
+			return msg
+		}
+	}
+	for _, transfer := range []*TransferRule{rule.SCP, rule.Rsync} {
+		if transfer == nil {
+			continue
+		}
+		if msg := transfer.validate(); msg != "" {
+			return msg
+		}
+	}
+	if personal && (rule.Scope.Client == "" || rule.Scope.ServiceUsername == "" || rule.Scope.ServiceHostname == "") {
+		return "rules in the personal policy must specify client, user and host"
+	}
+	if personal && (len(rule.Tags) > 0 || rule.SCP != nil || rule.Rsync != nil || rule.Git != nil) {
+		return "rules in the personal policy cannot use tags, scp, rsync or git"
+	}
+	if personal && isUserPattern(rule.Scope.ServiceUsername) {
+		return "rules in the personal policy cannot use user patterns"
+	}
+	if _, err := path.Match(strings.TrimPrefix(rule.Scope.ServiceUsername, "!"), ""); err != nil {
+		return fmt.Sprintf("invalid user pattern %q", rule.Scope.ServiceUsername)
+	}
+	return ""
+}
+
+func (rule *PolicyRule) validateBatchLimits(batch bool) string {
+	if !batch && (rule.MaxHosts != 0 || rule.Window != 0) {
+		return "max-hosts and window are only supported in batch rules"
+	}
+	if batch && (rule.MaxHosts <= 0 || rule.Window <= 0) {
+		return "batch rules must set a positive max-hosts and window"
+	}
+	return ""
+}
+
+func (rule *PolicyRule) validateApprovers(approve bool) string {
+	if !approve && len(rule.Approvers) > 0 {
+		return "approvers are only supported in approve rules"
+	}
+	if approve && len(rule.Approvers) == 0 {
+		return "approve rules must list their approvers"
+	}
+	return ""
+}
+
+func (rule *PolicyRule) validateRecording(record bool) string {
+	if !record && (rule.Recording != "" || len(rule.Recipients) > 0) {
+		return "recording and recipients are only supported in record rules"
+	}
+	if !record {
+		return ""
+	}
+	for _, recipient := range rule.Recipients {
+		if _, err := ParseRecordingRecipient(recipient); err != nil {
+			return err.Error()
+		}
+	}
+	for _, mode := range recordingModes {
+		if rule.Recording == mode {
+			return ""
+		}
+	}
+	return fmt.Sprintf("record rules must set recording to one of %s", strings.Join(recordingModes, ", "))
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// yamlPolicyError converts the errors returned by the yaml package, which
+// carry positions as a "line N: " prefix, to PolicyErrors.
+func yamlPolicyError(name string, err error) error {
+	msgs := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	}
+	var result []string
+	for _, msg := range msgs {
+		msg = strings.TrimPrefix(msg, "yaml: ")
+		perr := &PolicyError{File: name, Msg: msg}
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			perr.Line, _ = strconv.Atoi(m[1])
+			perr.Msg = m[2]
+		}
+		if len(msgs) == 1 {
+			return perr
+		}
+		result = append(result, perr.Error())
+	}
+	return errors.New(strings.Join(result, "\n"))
+}
+
+func keyNode(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func keyLine(mapping *yaml.Node, key string) int {
+	if node := keyNode(mapping, key); node != nil {
+		return node.Line
+	}
+	return 0
+}
+
+func itemLine(mapping *yaml.Node, key string, index int) int {
+	node := keyNode(mapping, key)
+	if node == nil || node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+		return 0
+	}
+	return node.Content[index].Line
+}
+
+// Legacy JSON formats: the personal store was either a list of entries or,
+// with includes, an object with Include and Rules; system policy files and
+// packs were objects with Include, Allow and Deny.
+type legacyStorageEntry struct {
+	PolicyScope Scope `json:"Scope"`
+	PolicyRule  struct {
+		AllCommands bool     `json:"AllCommands"`
+		Commands    []string `json:"Commands"`
+	} `json:"AllowedCommands"`
+}
+
+type legacyPolicyFile struct {
+	Include []string             `json:"Include"`
+	Rules   []legacyStorageEntry `json:"Rules"`
+	Allow   []PolicyRule         `json:"Allow"`
+	Deny    []PolicyRule         `json:"Deny"`
+}
+
+func parseLegacyPolicyFile(name string, buf []byte) (*policyFile, error) {
+	var legacy legacyPolicyFile
+	var err error
+	if buf[0] == '[' {
+		err = json.Unmarshal(buf, &legacy.Rules)
+	} else {
+		err = json.Unmarshal(buf, &legacy)
+	}
+	if err != nil {
+		return nil, &PolicyError{File: name, Msg: fmt.Sprintf("failed to parse legacy JSON policy: %s", err)}
+	}
+	file := &policyFile{
+		Version: policyFileVersion,
+		Include: legacy.Include,
+		Allow:   legacy.Allow,
+		Deny:    legacy.Deny,
+		legacy:  true,
+	}
+	for _, entry := range legacy.Rules {
+		if !entry.PolicyRule.AllCommands && len(entry.PolicyRule.Commands) == 0 {
+			continue
+		}
+		file.Allow = append(file.Allow, PolicyRule{
+			Scope:       entry.PolicyScope,
+			AllCommands: entry.PolicyRule.AllCommands,
+			Commands:    entry.PolicyRule.Commands,
+		})
+	}
+	return file, nil
+}
+
+func marshalPolicyFile(file *policyFile) ([]byte, error) {
+	file.Version = policyFileVersion
+	buf := bytes.NewBufferString(policyFileHeader)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(file); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,147 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Decisions of a policy program.
+const (
+	ProgramAllow = "allow"
+	ProgramDeny  = "deny"
+	ProgramAsk   = "ask"
+)
+
+// Time a policy program gets to decide by default.
+const DefaultPolicyProgramTimeout = 2 * time.Second
+
+// Time given to the output of a policy program to be closed once it exited or
+// was killed.
+const policyProgramWaitDelay = 100 * time.Millisecond
+
+// PolicyProgram is an external process consulted for every request, for
+// policy logic scripted in any language. It is run with /bin/sh -c, is given
+// a PolicyProgramRequest as JSON on its stdin and answers with a
+// PolicyProgramDecision as JSON on its stdout.
+type PolicyProgram struct {
+	Command string
+	Timeout time.Duration
+
+	// Decision taken if the program fails, times out or answers nonsense:
+	// ProgramAsk or ProgramDeny.
+	Fallback string
+}
+
+// PolicyProgramRequest is what a policy program decides on.
+type PolicyProgramRequest struct {
+	RequestID string   `json:"request_id"`
+	Client    string   `json:"client"`
+	User      string   `json:"user"`
+	Host      string   `json:"host"`
+	Tags      []string `json:"tags,omitempty"`
+	Command   string   `json:"command"`
+	Reason    string   `json:"reason,omitempty"`
+	Batch     string   `json:"batch,omitempty"`
+	GitRun    string   `json:"git_run,omitempty"`
+
+	Warnings  []string       `json:"warnings,omitempty"`
+	Anomalies []string       `json:"anomalies,omitempty"`
+	History   HistorySummary `json:"history"`
+}
+
+// PolicyProgramDecision is the answer of a policy program.
+type PolicyProgramDecision struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func (program *PolicyProgram) timeout() time.Duration {
+	if program.Timeout <= 0 {
+		return DefaultPolicyProgramTimeout
+	}
+	return program.Timeout
+}
+
+// Decide runs the program for req. It returns the fallback decision, along
+// with the error, if the program could not decide.
+func (program *PolicyProgram) Decide(req PolicyProgramRequest) (PolicyProgramDecision, error) {
+	decision, err := program.run(req)
+	if err != nil {
+		fallback := program.Fallback
+		if fallback == "" {
+			fallback = ProgramAsk
+		}
+		return PolicyProgramDecision{Decision: fallback, Reason: "fallback of the policy program"}, err
+	}
+	return decision, nil
+}
+
+func (program *PolicyProgram) run(req PolicyProgramRequest) (PolicyProgramDecision, error) {
+	var decision PolicyProgramDecision
+	input, err := json.Marshal(req)
+	if err != nil {
+		return decision, fmt.Errorf("Failed to encode policy program request: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), program.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", program.Command)
+	cmd.Stdin = bytes.NewReader(input)
+	// Children of the shell may keep its output open after it was killed.
+	cmd.WaitDelay = policyProgramWaitDelay
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return decision, fmt.Errorf("Policy program timed out after %s", program.timeout())
+	}
+	if err != nil {
+		return decision, fmt.Errorf("Policy program failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err = json.Unmarshal(out, &decision); err != nil {
+		return decision, fmt.Errorf("Failed to parse policy program decision: %s", err)
+	}
+	switch decision.Decision {
+	case ProgramAllow, ProgramDeny, ProgramAsk:
+		return decision, nil
+	}
+	return decision, fmt.Errorf("Invalid policy program decision %q", decision.Decision)
+}
+
+// consultProgram asks the policy program, if any, about a request. Failures
+// are alerted and audited, and yield the fallback decision.
+func (policy *Policy) consultProgram(audit requestAudit, scope Scope, cmd string, meta RequestMetadata, context RequestContext) PolicyProgramDecision {
+	if policy.Program == nil {
+		return PolicyProgramDecision{Decision: ProgramAsk}
+	}
+	decision, err := policy.Program.Decide(PolicyProgramRequest{
+		RequestID: meta.RequestID,
+		Client:    scope.Client,
+		User:      scope.ServiceUsername,
+		Host:      scope.ServiceHostname,
+		Tags:      policy.System.TagsFor(scope.ServiceHostname),
+		Command:   cmd,
+		Reason:    meta.Reason,
+		Batch:     meta.Batch,
+		GitRun:    meta.GitRun,
+		Warnings:  context.Warnings,
+		Anomalies: context.Anomalies,
+		History:   policy.History.Summary(scope, cmd),
+	})
+	if err != nil {
+		policy.UI.Alert(fmt.Sprintf("%s; falling back to %s", displayLine(err.Error()), decision.Decision))
+		audit.Record(AuditEventError, scope, cmd, "", err.Error())
+	}
+	return decision
+}
+
+func describeProgramDecision(decision PolicyProgramDecision) string {
+	if decision.Reason == "" {
+		return "policy program"
+	}
+	return "policy program: " + decision.Reason
+}
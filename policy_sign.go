@@ -0,0 +1,156 @@
+package guardianagent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PolicySignatureNamespace is the namespace policy files must be signed with:
+//   ssh-keygen -Y sign -f <key> -n guardian-agent-policy <policy-file>
+const PolicySignatureNamespace = "guardian-agent-policy"
+
+const policySignatureSuffix = ".sig"
+
+const sshSigMagic = "SSHSIG"
+
+// PolicyVerifier checks the detached SSH signatures (<file>.sig) of system
+// policy layers and rule packs against a set of trusted keys.
+type PolicyVerifier struct {
+	signers []ssh.PublicKey
+
+	// If set, unsigned or tampered files are loaded anyway and reported as
+	// warnings instead of failing.
+	WarnOnly bool
+}
+
+// NewPolicyVerifier reads the trusted signing keys from signersPath, which may
+// be in authorized_keys or ssh-keygen allowed_signers format.
+func NewPolicyVerifier(signersPath string, warnOnly bool) (*PolicyVerifier, error) {
+	buf, err := ioutil.ReadFile(signersPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy signers: %s", err)
+	}
+	verifier := &PolicyVerifier{WarnOnly: warnOnly}
+	for len(bytes.TrimSpace(buf)) > 0 {
+		var key ssh.PublicKey
+		key, _, _, buf, err = ssh.ParseAuthorizedKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse policy signers %s: %s", signersPath, err)
+		}
+		verifier.signers = append(verifier.signers, key)
+	}
+	if len(verifier.signers) == 0 {
+		return nil, fmt.Errorf("No keys found in policy signers %s", signersPath)
+	}
+	return verifier, nil
+}
+
+// Verify checks that content, read from name, carries a valid signature from
+// one of the trusted keys.
+func (verifier *PolicyVerifier) Verify(name string, content []byte) error {
+	armored, err := ioutil.ReadFile(name + policySignatureSuffix)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not signed", name)
+	}
+	if err != nil {
+		return err
+	}
+	return verifier.VerifySignature(name, armored, content)
+}
+
+// VerifySignature checks an armored signature over content, read from name.
+func (verifier *PolicyVerifier) VerifySignature(name string, armored []byte, content []byte) error {
+	if err := verifier.verify(armored, content); err != nil {
+		return fmt.Errorf("%s: invalid signature: %s", name, err)
+	}
+	return nil
+}
+
+// sshSignature is the SSHSIG blob produced by ssh-keygen -Y sign, see
+// PROTOCOL.sshsig in the OpenSSH sources.
+type sshSignature struct {
+	Magic     [6]byte
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  []byte
+	HashAlg   string
+	Signature []byte
+}
+
+type sshSignedData struct {
+	Magic     [6]byte
+	Namespace string
+	Reserved  []byte
+	HashAlg   string
+	Hash      []byte
+}
+
+func (verifier *PolicyVerifier) verify(armored []byte, content []byte) error {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return fmt.Errorf("not an SSH signature")
+	}
+	if len(block.Bytes) < len(sshSigMagic) || string(block.Bytes[:len(sshSigMagic)]) != sshSigMagic {
+		return fmt.Errorf("bad signature magic")
+	}
+	var sig sshSignature
+	if err := ssh.Unmarshal(block.Bytes, &sig); err != nil {
+		return err
+	}
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported signature version %d", sig.Version)
+	}
+	if sig.Namespace != PolicySignatureNamespace {
+		return fmt.Errorf("signed for namespace %q, expected %q", sig.Namespace, PolicySignatureNamespace)
+	}
+	pub, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !verifier.trusts(pub) {
+		return fmt.Errorf("signed by untrusted key %s", ssh.FingerprintSHA256(pub))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported hash algorithm %s", sig.HashAlg)
+	}
+	h.Write(content)
+	signed := sshSignedData{
+		Namespace: sig.Namespace,
+		Reserved:  sig.Reserved,
+		HashAlg:   sig.HashAlg,
+		Hash:      h.Sum(nil),
+	}
+	copy(signed.Magic[:], sshSigMagic)
+
+	var signature ssh.Signature
+	if err = ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return err
+	}
+	return pub.Verify(ssh.Marshal(signed), &signature)
+}
+
+func (verifier *PolicyVerifier) trusts(pub ssh.PublicKey) bool {
+	marshaled := pub.Marshal()
+	for _, signer := range verifier.signers {
+		if bytes.Equal(signer.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
+}
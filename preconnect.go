@@ -0,0 +1,198 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Pre-connections older than this when the request is approved are replaced,
+// since servers drop connections which do not authenticate in time
+// (OpenSSH's LoginGraceTime is two minutes by default).
+const preconnectionMaxAge = time.Minute
+
+// Limit on the lines servers may send before their identification, as in
+// RFC 4253.
+const maxServerIdentification = 8192
+
+// Longest wait between attempts to connect.
+const maxConnectBackoff = 10 * time.Second
+
+// ConnectOptions control how delegatees connect to servers.
+type ConnectOptions struct {
+	// Timeouts of each attempt to connect (which ProxyCommands do not
+	// observe), and to then read the server's identification. Zero means
+	// none.
+	Timeout       time.Duration
+	BannerTimeout time.Duration
+
+	// Attempts to connect, with a second between the first two, doubling
+	// up to maxConnectBackoff.
+	Attempts int
+
+	// If set, called before each retry, e.g. to tell the user.
+	OnRetry func(err error, attempt int, wait time.Duration)
+}
+
+// preconnection connects to the server while the approval prompt is open,
+// and reads the server's identification: the part of the ssh handshake which
+// does not need the guardian. Approved sessions then start a round trip or
+// two sooner.
+type preconnection struct {
+	connect func() (io.Reader, io.WriteCloser, error)
+	opts    ConnectOptions
+	started time.Time
+	done    chan struct{}
+	stop    chan struct{}
+	stopped sync.Once
+
+	reader         io.Reader
+	writer         io.WriteCloser
+	identification []byte
+	err            error
+}
+
+func startPreconnection(connect func() (io.Reader, io.WriteCloser, error), opts ConnectOptions) *preconnection {
+	pre := &preconnection{
+		connect: connect,
+		opts:    opts,
+		started: time.Now(),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go func() {
+		defer close(pre.done)
+		pre.reader, pre.writer, pre.identification, pre.err = pre.dial()
+	}()
+	return pre
+}
+
+// dial connects to the server and reads its identification, retrying as
+// the options allow until close is called.
+func (pre *preconnection) dial() (io.Reader, io.WriteCloser, []byte, error) {
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		reader, writer, identification, err := pre.dialOnce()
+		if err == nil || attempt >= pre.opts.Attempts {
+			return reader, writer, identification, err
+		}
+		if pre.opts.OnRetry != nil {
+			pre.opts.OnRetry(err, attempt, wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-pre.stop:
+			return nil, nil, nil, err
+		}
+		if wait *= 2; wait > maxConnectBackoff {
+			wait = maxConnectBackoff
+		}
+	}
+}
+
+func (pre *preconnection) dialOnce() (io.Reader, io.WriteCloser, []byte, error) {
+	reader, writer, err := pre.connect()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var timer *time.Timer
+	if pre.opts.BannerTimeout > 0 {
+		// Closing the connection interrupts the read.
+		timer = time.AfterFunc(pre.opts.BannerTimeout, func() { closeServerConn(reader, writer) })
+	}
+	identification, err := readServerIdentification(reader)
+	if timer != nil && !timer.Stop() {
+		err = fmt.Errorf("the server did not identify itself within %s", pre.opts.BannerTimeout)
+	}
+	if err != nil {
+		closeServerConn(reader, writer)
+		return nil, nil, nil, err
+	}
+	return reader, writer, identification, nil
+}
+
+// readServerIdentification reads up to and including the "SSH-" line of the
+// server.
+func readServerIdentification(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	lineStart := 0
+	for buf.Len() < maxServerIdentification {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("failed to read the server's identification: %s", err)
+		}
+		buf.WriteByte(b[0])
+		if b[0] != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(buf.Bytes()[lineStart:], []byte("SSH-")) {
+			return buf.Bytes(), nil
+		}
+		lineStart = buf.Len()
+	}
+	return nil, fmt.Errorf("failed to read the server's identification: too long")
+}
+
+func closeServerConn(reader io.Reader, writer io.WriteCloser) {
+	writer.Close()
+	if closer, ok := reader.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// cancelOnFailure calls cancel if connecting fails, e.g. to withdraw the
+// request.
+func (pre *preconnection) cancelOnFailure(ctx context.Context, cancel func()) {
+	go func() {
+		select {
+		case <-pre.done:
+			if pre.err != nil {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// failed returns the error connecting, if it failed by now.
+func (pre *preconnection) failed() error {
+	select {
+	case <-pre.done:
+		return pre.err
+	default:
+		return nil
+	}
+}
+
+// take returns the connection to the server, with the identification to be
+// read again, once connected. It connects anew if the connection is old
+// enough for the server to have dropped it.
+func (pre *preconnection) take() (io.Reader, io.WriteCloser, error) {
+	<-pre.done
+	if pre.err != nil {
+		return nil, nil, pre.err
+	}
+	reader, writer, identification := pre.reader, pre.writer, pre.identification
+	if time.Since(pre.started) > preconnectionMaxAge {
+		closeServerConn(reader, writer)
+		var err error
+		if reader, writer, identification, err = pre.dial(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return io.MultiReader(bytes.NewReader(identification), reader), writer, nil
+}
+
+// close tears the connection down, e.g. once the request is denied.
+func (pre *preconnection) close() {
+	pre.stopped.Do(func() { close(pre.stop) })
+	go func() {
+		<-pre.done
+		if pre.err == nil {
+			closeServerConn(pre.reader, pre.writer)
+		}
+	}()
+}
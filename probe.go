@@ -0,0 +1,37 @@
+package guardianagent
+
+import (
+	"time"
+)
+
+// Unrecognized messages (including unknown extensions) get a failure reply,
+// but a connection sending many of them is probing the guardian: replies are
+// slowed down to one per probeInterval after the first probeBurst, and the
+// connection is closed after maxProbes.
+const probeBurst = 8
+const probeInterval = time.Second
+const maxProbes = 64
+
+type probeLimiter struct {
+	count int
+	next  time.Time
+}
+
+// admit is called for every unrecognized message. It delays the caller as
+// needed and reports whether the connection should be kept open.
+func (limiter *probeLimiter) admit() bool {
+	limiter.count++
+	if limiter.count > maxProbes {
+		return false
+	}
+	if limiter.count <= probeBurst {
+		return true
+	}
+	now := time.Now()
+	if limiter.next.After(now) {
+		time.Sleep(limiter.next.Sub(now))
+		now = limiter.next
+	}
+	limiter.next = now.Add(probeInterval)
+	return true
+}
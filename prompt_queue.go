@@ -0,0 +1,242 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long a request waits before prompting for identical requests to arrive,
+// e.g. those of a parallel make, so that the prompt counts them.
+const promptCoalesceWindow = 200 * time.Millisecond
+
+// What a full prompt queue does with a new request.
+const (
+	// Deny the request that has been waiting the longest to make room.
+	QueueOverflowOldest = "oldest"
+
+	// Deny the new request.
+	QueueOverflowNewest = "newest"
+)
+
+// PromptQueue bounds the requests waiting for the approver, so that a burst
+// of requests cannot hold an unbounded number of connections open. Once Limit
+// requests wait, the oldest or the newest one is denied. Requests identical to
+// one already waiting (same scope and command) do not prompt again: they are
+// counted in its prompt, and its answer applies to them too.
+type PromptQueue struct {
+	mu       sync.Mutex
+	limit    int
+	overflow string
+	entries  []*queuedPrompt
+}
+
+// queuedPrompt is a request waiting for the approver.
+type queuedPrompt struct {
+	queue     *PromptQueue
+	scope     Scope
+	cmd       string
+	requestID string
+
+	// The identical request waited for, if any.
+	leader *queuedPrompt
+
+	cancel     context.CancelFunc
+	overflowed bool
+	done       chan struct{}
+	left       bool
+
+	// The answer to the request, once decided: the command approved, or
+	// the denial.
+	answered bool
+	approved string
+	denial   error
+}
+
+// NewPromptQueue returns a queue of at most limit requests (0 for no limit)
+// with the given overflow policy.
+func NewPromptQueue(limit int, overflow string) (*PromptQueue, error) {
+	if overflow != QueueOverflowOldest && overflow != QueueOverflowNewest {
+		return nil, fmt.Errorf("invalid prompt queue overflow policy %q", overflow)
+	}
+	return &PromptQueue{limit: limit, overflow: overflow}, nil
+}
+
+// SetPromptQueue bounds the requests waiting for the approver.
+func (agent *Agent) SetPromptQueue(limit int, overflow string) error {
+	queue, err := NewPromptQueue(limit, overflow)
+	if err != nil {
+		return err
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.policy.Prompts = queue
+	for _, tenant := range agent.tenants {
+		tenant.policy.Prompts = queue.empty()
+	}
+	return nil
+}
+
+// empty returns a new queue with the same limit and overflow policy as queue,
+// or nil if queue is nil.
+func (queue *PromptQueue) empty() *PromptQueue {
+	if queue == nil {
+		return nil
+	}
+	return &PromptQueue{limit: queue.limit, overflow: queue.overflow}
+}
+
+// enter queues a request about to prompt, and returns it along with the
+// context to prompt in, which is canceled if the request is denied to make
+// room. It fails if the queue is full and new requests are denied. A nil
+// queue admits every request.
+func (queue *PromptQueue) enter(ctx context.Context, scope Scope, cmd string, requestID string) (*queuedPrompt, context.Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	entry := &queuedPrompt{queue: queue, scope: scope, cmd: cmd, requestID: requestID, cancel: cancel, done: make(chan struct{})}
+	if queue == nil {
+		return entry, ctx, nil
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.limit > 0 && len(queue.entries) >= queue.limit {
+		if queue.overflow == QueueOverflowNewest {
+			cancel()
+			return nil, nil, deny(DenialRateLimit, fmt.Sprintf("Too many requests (%d) are waiting for approval", len(queue.entries)))
+		}
+		oldest := queue.entries[0]
+		oldest.overflowed = true
+		oldest.cancel()
+		queue.remove(oldest)
+	}
+	entry.leader = queue.first(scope, cmd)
+	queue.entries = append(queue.entries, entry)
+	return entry, ctx, nil
+}
+
+// first returns the request waiting the longest among those identical to
+// scope and cmd, if any.
+func (queue *PromptQueue) first(scope Scope, cmd string) *queuedPrompt {
+	for _, queued := range queue.entries {
+		if queued.scope == scope && queued.cmd == cmd {
+			return queued
+		}
+	}
+	return nil
+}
+
+// Len returns the number of requests waiting for the approver.
+func (queue *PromptQueue) Len() int {
+	if queue == nil {
+		return 0
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.entries)
+}
+
+func (queue *PromptQueue) remove(entry *queuedPrompt) {
+	for i, queued := range queue.entries {
+		if queued == entry {
+			queue.entries = append(queue.entries[:i], queue.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// waitLeader waits for the answer to the identical requests entry waits for,
+// and returns the identical request answered along with that answer. If the
+// request answered first is given up instead, the one waiting the longest
+// after it is waited for, and entry is to prompt itself once it is first. It
+// returns nil if there is no identical request left, or if ctx is done first.
+func (entry *queuedPrompt) waitLeader(ctx context.Context) *queuedPrompt {
+	for entry.leader != nil {
+		select {
+		case <-entry.leader.done:
+		case <-ctx.Done():
+			return nil
+		}
+		entry.lock()
+		leader := entry.leader
+		if leader.answered {
+			entry.unlock()
+			return leader
+		}
+		entry.leader = entry.queue.first(entry.scope, entry.cmd)
+		if entry.leader == entry {
+			entry.leader = nil
+		}
+		entry.unlock()
+	}
+	return nil
+}
+
+// gather waits for identical requests to arrive before entry prompts, and
+// returns how many requests the prompt is for.
+func (entry *queuedPrompt) gather(ctx context.Context) int {
+	if entry.queue == nil {
+		return 1
+	}
+	select {
+	case <-time.After(promptCoalesceWindow):
+	case <-ctx.Done():
+	}
+	entry.lock()
+	defer entry.unlock()
+	count := 0
+	for _, queued := range entry.queue.entries {
+		if queued.scope == entry.scope && queued.cmd == entry.cmd {
+			count++
+		}
+	}
+	return count
+}
+
+// decided records the answer to the request, for the identical requests
+// waiting for it. Errors other than denials are not shared: the requests
+// waiting prompt again instead.
+func (entry *queuedPrompt) decided(approved string, err error) {
+	if _, ok := err.(*Denial); err != nil && !ok {
+		return
+	}
+	entry.lock()
+	defer entry.unlock()
+	entry.answered = true
+	entry.approved = approved
+	entry.denial = err
+}
+
+// leave takes the request out of the queue, once it was answered or given up.
+func (entry *queuedPrompt) leave() {
+	entry.lock()
+	defer entry.unlock()
+	if entry.left {
+		return
+	}
+	entry.left = true
+	entry.cancel()
+	close(entry.done)
+	if entry.queue != nil {
+		entry.queue.remove(entry)
+	}
+}
+
+// isOverflowed reports whether the request was denied to make room.
+func (entry *queuedPrompt) isOverflowed() bool {
+	entry.lock()
+	defer entry.unlock()
+	return entry.overflowed
+}
+
+// Entries are guarded by their queue's lock.
+func (entry *queuedPrompt) lock() {
+	if entry.queue != nil {
+		entry.queue.mu.Lock()
+	}
+}
+
+func (entry *queuedPrompt) unlock() {
+	if entry.queue != nil {
+		entry.queue.mu.Unlock()
+	}
+}
@@ -0,0 +1,388 @@
+package guardianagent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ProxyCommand lets stock OpenSSH clients run commands through the
+// guardian, as their ProxyCommand. Since they cannot take part in the
+// handoff, it presents itself to them as the server, with a host key of its
+// own, runs the command they request as a delegated session, and relays the
+// session to them.
+type ProxyCommand struct {
+	// The server to connect to.
+	HostPort string
+
+	// Public key of the guardian, see SSHCommand.
+	GuardKey string
+
+	// Host key presented to the ssh client, generated if it does not exist.
+	HostKeyPath string
+
+	// Connect the ssh client to the server directly, without the guardian,
+	// e.g. as the ssh config says for the server.
+	Direct bool
+
+	// Jump hosts to reach the server through, as with ssh -J.
+	ProxyJump string
+
+	// Timeouts and retries of connecting to the server, which are reported
+	// to the ssh client.
+	Connect ConnectOptions
+
+	// The connection to the ssh client, usually stdin and stdout.
+	In  io.Reader
+	Out io.WriteCloser
+}
+
+// loadProxyHostKey reads the host key at path, generating it if there is
+// none yet.
+func loadProxyHostKey(path string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate host key: %s", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate host key: %s", err)
+		}
+		buf = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+			return nil, fmt.Errorf("Failed to save host key: %s", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read host key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse host key %s: %s", path, err)
+	}
+	return signer, nil
+}
+
+// pipeConn is a connection over a reader and a writer, e.g. stdin and
+// stdout.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func (conn *pipeConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (conn *pipeConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (conn *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// RunProxyCommand serves the ssh client until it disconnects. It runs a
+// single session, with the user the client logs in as.
+func RunProxyCommand(proxy ProxyCommand) error {
+	if proxy.Direct {
+		return proxy.splice()
+	}
+	signer, err := loadProxyHostKey(proxy.HostKeyPath)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	conn, chans, reqs, err := ssh.NewServerConn(&pipeConn{proxy.In, proxy.Out}, config)
+	if err != nil {
+		return fmt.Errorf("Failed to accept ssh connection: %s", err)
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan error, 1)
+	started := false
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" || started {
+			newChan.Reject(ssh.Prohibited, "only a single session can be run through the guardian")
+			continue
+		}
+		started = true
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			return fmt.Errorf("Failed to accept session: %s", err)
+		}
+		go func() {
+			done <- proxy.runSession(conn.User(), ch, chReqs)
+			conn.Close()
+		}()
+	}
+	if !started {
+		return nil
+	}
+	return <-done
+}
+
+// Requests of the ssh client which are relayed to the server.
+var proxiedRequests = map[string]bool{
+	"pty-req":       true,
+	"env":           true,
+	"window-change": true,
+	"signal":        true,
+	"break":         true,
+}
+
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// runSession waits for the command of the session, runs it as a delegated
+// session once the guardian approves it, and relays the session.
+func (proxy *ProxyCommand) runSession(user string, ch ssh.Channel, reqs <-chan *ssh.Request) error {
+	defer ch.Close()
+	var queued []*ssh.Request
+	var start *ssh.Request
+	var cmd string
+	var pty ptyRequest
+	for start == nil {
+		req, ok := <-reqs
+		if !ok {
+			return nil
+		}
+		switch {
+		case req.Type == "exec":
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			start, cmd = req, exec.Command
+		case req.Type == "shell":
+			start = req
+		case proxiedRequests[req.Type]:
+			if req.Type == "pty-req" {
+				ssh.Unmarshal(req.Payload, &pty)
+			}
+			queued = append(queued, req)
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	fail := func(err error) error {
+		start.Reply(true, nil)
+		fmt.Fprintf(ch.Stderr(), "%s\r\n", err)
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{255}))
+		return err
+	}
+
+	ctx := context.Background()
+	guardian, err := DialGuardian(ctx, proxy.GuardKey)
+	if err != nil {
+		return fail(err)
+	}
+	defer guardian.Close()
+	connectOpts := proxy.Connect
+	connectOpts.OnRetry = func(err error, attempt int, wait time.Duration) {
+		fmt.Fprintf(ch.Stderr(), "%s; retrying in %s (attempt %d of %d)...\r\n", err, wait, attempt+1, connectOpts.Attempts)
+	}
+	pre := startPreconnection(proxy.connectToServer, connectOpts)
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pre.cancelOnFailure(requestCtx, cancel)
+	approval, err := guardian.RequestExecution(requestCtx, ExecutionRequest{User: user, Server: proxy.HostPort, Command: cmd})
+	if denied, ok := err.(*DeniedError); ok {
+		if explanation := denied.Explanation(); explanation != "" {
+			fmt.Fprintf(ch.Stderr(), "%s\r\n", explanation)
+		}
+	}
+	if err != nil {
+		pre.close()
+		if connErr := pre.failed(); connErr != nil {
+			return fail(connErr)
+		}
+		return fail(err)
+	}
+	startType, startPayload := start.Type, start.Payload
+	if approval.Command != cmd {
+		fmt.Fprintf(ch.Stderr(), "Command was modified by the approver to: %s\r\n", approval.Command)
+		startType, startPayload = "exec", ssh.Marshal(struct{ Command string }{approval.Command})
+	}
+
+	serverReader, serverWriter, err := pre.take()
+	if err != nil {
+		return fail(err)
+	}
+	var serverCh ssh.Channel
+	var serverReqs <-chan *ssh.Request
+	sshClient, err := guardian.Handoff(ctx, proxy.HostPort, serverReader, serverWriter, func(sshClient *ssh.Client) error {
+		if serverCh, serverReqs, err = sshClient.OpenChannel("session", nil); err != nil {
+			return err
+		}
+		for _, req := range queued {
+			serverCh.SendRequest(req.Type, true, req.Payload)
+		}
+		ok, err := serverCh.SendRequest(startType, true, startPayload)
+		if err == nil && !ok {
+			err = fmt.Errorf("the server refused to start the session")
+		}
+		return err
+	})
+	if sshClient != nil {
+		defer sshClient.Close()
+	}
+	// The command may have ended before the handoff; its output is still
+	// relayed.
+	if _, closed := err.(*ClosedBeforeHandoffError); err != nil && !closed {
+		return fail(err)
+	}
+	start.Reply(true, nil)
+
+	var in io.Reader = ch
+	var out, errOut io.Writer = ch, ch.Stderr()
+	var recorder *SessionRecorder
+	if approval.Recording != "" && approval.Recording != RecordingNone {
+		fmt.Fprintf(errOut, "The guardian requires recording this session%s\r\n", strings.TrimPrefix(describeRecording(approval.Recording), "\nThe session will be recorded"))
+		recorder, err = NewSessionRecorder(RecordingsDir(), SessionRecording{
+			RequestID:  approval.RequestID,
+			User:       user,
+			Server:     proxy.HostPort,
+			Command:    approval.Command,
+			Mode:       approval.Recording,
+			Width:      int(pty.Columns),
+			Height:     int(pty.Rows),
+			Recipients: approval.RecordingRecipients,
+		})
+		if err != nil {
+			fmt.Fprintf(errOut, "%s\r\n", err)
+		} else {
+			in = io.TeeReader(ch, recorder.Input())
+			out, errOut = io.MultiWriter(ch, recorder), io.MultiWriter(ch.Stderr(), recorder)
+		}
+	}
+
+	go func() {
+		io.Copy(serverCh, in)
+		serverCh.CloseWrite()
+	}()
+	go func() {
+		for req := range reqs {
+			ok := false
+			if proxiedRequests[req.Type] {
+				ok, _ = serverCh.SendRequest(req.Type, req.WantReply, req.Payload)
+			}
+			req.Reply(ok, nil)
+		}
+	}()
+	var relayed sync.WaitGroup
+	relayed.Add(3)
+	go func() {
+		io.Copy(out, serverCh)
+		relayed.Done()
+	}()
+	go func() {
+		io.Copy(errOut, serverCh.Stderr())
+		relayed.Done()
+	}()
+	go func() {
+		// E.g. exit-status, which must reach the client before the channel
+		// is closed.
+		for req := range serverReqs {
+			ok, _ := ch.SendRequest(req.Type, req.WantReply, req.Payload)
+			req.Reply(ok, nil)
+		}
+		relayed.Done()
+	}()
+	relayed.Wait()
+
+	if recorder != nil {
+		proxy.finishRecording(recorder)
+	}
+	return nil
+}
+
+// connectToServer connects to the server, through the jump hosts if any.
+func (proxy *ProxyCommand) connectToServer() (io.Reader, io.WriteCloser, error) {
+	if proxy.ProxyJump == "" || proxy.ProxyJump == "none" {
+		conn, err := net.DialTimeout("tcp", proxy.HostPort, proxy.Connect.Timeout)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to %s: %s", proxy.HostPort, err)
+		}
+		return conn, conn, nil
+	}
+	jumps := strings.Split(proxy.ProxyJump, ",")
+	args := []string{"-W", proxy.HostPort}
+	if len(jumps) > 1 {
+		args = append(args, "-J", strings.Join(jumps[:len(jumps)-1], ","))
+	}
+	jump := exec.Command("ssh", append(args, jumps[len(jumps)-1])...)
+	jump.Stderr = os.Stderr
+	reader, err := jump.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	writer, err := jump.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = jump.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to %s through %s: %s", proxy.HostPort, proxy.ProxyJump, err)
+	}
+	go jump.Wait()
+	return reader, writer, nil
+}
+
+// splice connects the ssh client to the server directly.
+func (proxy *ProxyCommand) splice() error {
+	connectOpts := proxy.Connect
+	connectOpts.OnRetry = func(err error, attempt int, wait time.Duration) {
+		fmt.Fprintf(os.Stderr, "%s; retrying in %s (attempt %d of %d)...\n", err, wait, attempt+1, connectOpts.Attempts)
+	}
+	reader, writer, err := startPreconnection(proxy.connectToServer, connectOpts).take()
+	if err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(writer, proxy.In)
+		if cw, ok := writer.(CloseWriter); ok {
+			cw.CloseWrite()
+		} else {
+			writer.Close()
+		}
+	}()
+	_, err = io.Copy(proxy.Out, reader)
+	return err
+}
+
+// finishRecording closes the recording and reports its hash to the
+// guardian, as sga-ssh does.
+func (proxy *ProxyCommand) finishRecording(recorder *SessionRecorder) {
+	rec, err := recorder.Close()
+	if err == nil {
+		var guardian *GuardianClient
+		if guardian, err = DialGuardian(context.Background(), proxy.GuardKey); err == nil {
+			err = guardian.ReportRecording(context.Background(), rec.RequestID, rec.Hash)
+			guardian.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to report recording to the guardian: %s\n", err)
+	}
+}
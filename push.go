@@ -0,0 +1,456 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Prompts can also be answered on paired mobile devices, through a push
+// relay (a bridge to Web Push or FCM) with this API:
+//
+//   POST /v1/push               {"Token": ..., "Payload": ...}
+//     sends Payload to the device registered with the relay under Token.
+//   POST /v1/channels/<channel> <message>
+//     posts a message from a device to the guardian owning the channel.
+//   GET  /v1/channels/<channel>?wait=<seconds>
+//     returns the messages posted to the channel as a JSON array, waiting up
+//     to the given time for one.
+//
+// The relay is not trusted: payloads are encrypted with a key shared when
+// pairing, and answers are signed with the key of the device.
+
+// How long the relay is asked to wait for messages on each poll.
+const pushPollWait = 25 * time.Second
+
+// How long the relay is asked to wait for a pairing, which is awaited through
+// the admin API.
+const pushPairingPollWait = 15 * time.Second
+
+// How long a pairing code can be used.
+const pushPairingLifetime = 10 * time.Minute
+
+var errNoPushDevices = errors.New("no paired devices")
+
+var errPushTimeout = errors.New("no answer from the paired devices")
+
+// PushDevice is a paired mobile device.
+type PushDevice struct {
+	ID        string
+	Name      string
+	Paired    time.Time
+	PublicKey []byte
+
+	// The device's registration with the relay.
+	Token string
+
+	// Encrypts the payloads sent to the device.
+	Key []byte `json:",omitempty"`
+}
+
+// pushDevices is saved next to the personal policy.
+type pushDevices struct {
+	// The channel answers are posted to.
+	Channel string
+	Devices []PushDevice
+}
+
+// pushPayload is sent, encrypted, to devices: a prompt to answer, or the
+// withdrawal of one.
+type pushPayload struct {
+	Type     string
+	Guardian string
+	Request  string
+	Nonce    []byte   `json:",omitempty"`
+	Question string   `json:",omitempty"`
+	Choices  []string `json:",omitempty"`
+	Channel  string   `json:",omitempty"`
+	Expires  time.Time
+}
+
+// pushMessage is posted by a device to a channel: a pairing, or the answer to
+// a prompt.
+type pushMessage struct {
+	Type   string
+	Device string `json:",omitempty"`
+
+	// Pairing, authenticated by MAC with the pairing secret.
+	Name      string `json:",omitempty"`
+	PublicKey []byte `json:",omitempty"`
+	Token     string `json:",omitempty"`
+	MAC       []byte `json:",omitempty"`
+
+	// Answer, signed by the device.
+	Request   string `json:",omitempty"`
+	Choice    int    `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+}
+
+// PushPairing is a pairing in progress, shown to the user as a QR code of URI.
+type PushPairing struct {
+	Channel string
+	URI     string
+	Expires time.Time
+}
+
+type pushPairing struct {
+	secret  []byte
+	expires time.Time
+}
+
+// PushApprover sends prompts to paired mobile devices and collects their
+// answers.
+type PushApprover struct {
+	relay   string
+	path    string
+	timeout time.Duration
+	client  http.Client
+
+	mu       sync.Mutex
+	devices  pushDevices
+	pairings map[string]pushPairing
+	waiting  map[string]chan pushMessage
+	polling  bool
+}
+
+// NewPushApprover uses the relay at relayURL, and keeps the paired devices in
+// path. Prompts not answered on a device within timeout are given up on.
+func NewPushApprover(relayURL string, path string, timeout time.Duration) (*PushApprover, error) {
+	if _, err := url.Parse(relayURL); err != nil {
+		return nil, fmt.Errorf("Failed to parse push relay URL: %s", err)
+	}
+	push := &PushApprover{
+		relay:    relayURL,
+		path:     path,
+		timeout:  timeout,
+		client:   http.Client{Timeout: pushPollWait + 15*time.Second},
+		pairings: make(map[string]pushPairing),
+		waiting:  make(map[string]chan pushMessage),
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if push.devices.Channel, err = randomID(); err != nil {
+			return nil, err
+		}
+		return push, push.save()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read paired devices: %s", err)
+	}
+	if err = json.Unmarshal(buf, &push.devices); err != nil {
+		return nil, fmt.Errorf("Failed to parse paired devices %s: %s", path, err)
+	}
+	return push, nil
+}
+
+func randomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (push *PushApprover) save() error {
+	buf, err := json.MarshalIndent(push.devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := push.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("Failed to save paired devices: %s", err)
+	}
+	return os.Rename(tmpPath, push.path)
+}
+
+// Devices lists the paired devices, without their keys.
+func (push *PushApprover) Devices() []PushDevice {
+	push.mu.Lock()
+	defer push.mu.Unlock()
+	devices := make([]PushDevice, len(push.devices.Devices))
+	for i, device := range push.devices.Devices {
+		device.Key = nil
+		devices[i] = device
+	}
+	return devices
+}
+
+// Unpair removes a paired device.
+func (push *PushApprover) Unpair(id string) error {
+	push.mu.Lock()
+	defer push.mu.Unlock()
+	for i, device := range push.devices.Devices {
+		if device.ID == id {
+			push.devices.Devices = append(push.devices.Devices[:i], push.devices.Devices[i+1:]...)
+			return push.save()
+		}
+	}
+	return fmt.Errorf("no paired device %s", id)
+}
+
+// StartPairing creates a pairing code for a new device.
+func (push *PushApprover) StartPairing() (*PushPairing, error) {
+	channel, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	pairing := &PushPairing{Channel: channel, Expires: time.Now().Add(pushPairingLifetime)}
+	pairing.URI = "sga-pair:?" + url.Values{
+		"relay":    {push.relay},
+		"channel":  {channel},
+		"secret":   {base64.RawURLEncoding.EncodeToString(secret)},
+		"guardian": {host},
+	}.Encode()
+
+	push.mu.Lock()
+	defer push.mu.Unlock()
+	for channel, pairing := range push.pairings {
+		if time.Now().After(pairing.expires) {
+			delete(push.pairings, channel)
+		}
+	}
+	push.pairings[channel] = pushPairing{secret: secret, expires: pairing.Expires}
+	return pairing, nil
+}
+
+func pairingMAC(secret []byte, msg *pushMessage) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "sga-push-pair\x00%s\x00%s\x00", msg.Name, msg.Token)
+	mac.Write(msg.PublicKey)
+	return mac.Sum(nil)
+}
+
+// AwaitPairing waits a while for the device to answer the pairing code of
+// channel. It returns nil if it did not answer yet.
+func (push *PushApprover) AwaitPairing(channel string) (*PushDevice, error) {
+	push.mu.Lock()
+	pairing, ok := push.pairings[channel]
+	push.mu.Unlock()
+	if !ok || time.Now().After(pairing.expires) {
+		return nil, errors.New("unknown or expired pairing code")
+	}
+	messages, err := push.receive(channel, pushPairingPollWait)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if msg.Type != "pair" || len(msg.PublicKey) != ed25519.PublicKeySize ||
+			!hmac.Equal(msg.MAC, pairingMAC(pairing.secret, &msg)) {
+			continue
+		}
+		sum := sha256.Sum256(msg.PublicKey)
+		device := PushDevice{
+			ID:        base64.RawURLEncoding.EncodeToString(sum[:9]),
+			Name:      msg.Name,
+			Paired:    time.Now(),
+			PublicKey: msg.PublicKey,
+			Token:     msg.Token,
+			Key:       pairing.secret,
+		}
+		push.mu.Lock()
+		defer push.mu.Unlock()
+		delete(push.pairings, channel)
+		// Pairing a device again replaces it.
+		for i := range push.devices.Devices {
+			if push.devices.Devices[i].ID == device.ID {
+				push.devices.Devices = append(push.devices.Devices[:i], push.devices.Devices[i+1:]...)
+				break
+			}
+		}
+		push.devices.Devices = append(push.devices.Devices, device)
+		if err = push.save(); err != nil {
+			return nil, err
+		}
+		device.Key = nil
+		return &device, nil
+	}
+	return nil, nil
+}
+
+func (push *PushApprover) receive(channel string, wait time.Duration) ([]pushMessage, error) {
+	resp, err := push.client.Get(fmt.Sprintf("%s/v1/channels/%s?wait=%d", push.relay, url.PathEscape(channel), int(wait.Seconds())))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to poll push relay: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to poll push relay: %s", resp.Status)
+	}
+	var messages []pushMessage
+	if err = json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		return nil, fmt.Errorf("Failed to parse messages from push relay: %s", err)
+	}
+	return messages, nil
+}
+
+func (push *PushApprover) send(device PushDevice, payload pushPayload) error {
+	plain, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	var key [32]byte
+	copy(key[:], device.Key)
+	body, err := json.Marshal(struct {
+		Token   string
+		Payload []byte
+	}{device.Token, secretbox.Seal(nonce[:], plain, &nonce, &key)})
+	if err != nil {
+		return err
+	}
+	resp, err := push.client.Post(push.relay+"/v1/push", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to push to %s: %s", device.Name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Failed to push to %s: %s", device.Name, resp.Status)
+	}
+	return nil
+}
+
+// pushSignedData is what a device signs to answer a prompt.
+func pushSignedData(request string, nonce []byte, choice int) []byte {
+	data := []byte("sga-push-answer\x00" + request + "\x00")
+	data = append(data, nonce...)
+	return append(data, "\x00"+strconv.Itoa(choice)...)
+}
+
+// Ask sends the prompt to all paired devices, and returns the first valid
+// answer.
+func (push *PushApprover) Ask(ctx context.Context, prompt Prompt) (RemoteAnswer, error) {
+	id, err := randomID()
+	if err != nil {
+		return RemoteAnswer{}, err
+	}
+	nonce := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return RemoteAnswer{}, err
+	}
+	host, _ := os.Hostname()
+	answers := make(chan pushMessage, 4)
+	push.mu.Lock()
+	devices := append([]PushDevice(nil), push.devices.Devices...)
+	payload := pushPayload{Type: "prompt", Guardian: host, Request: id, Nonce: nonce, Question: prompt.Question,
+		Choices: prompt.Choices, Channel: push.devices.Channel, Expires: time.Now().Add(push.timeout)}
+	if len(devices) > 0 {
+		push.waiting[id] = answers
+		if !push.polling {
+			push.polling = true
+			go push.poll()
+		}
+	}
+	push.mu.Unlock()
+	if len(devices) == 0 {
+		return RemoteAnswer{}, errNoPushDevices
+	}
+	defer func() {
+		push.mu.Lock()
+		delete(push.waiting, id)
+		push.mu.Unlock()
+		// Take the prompt off the other devices.
+		go func() {
+			for _, device := range devices {
+				push.send(device, pushPayload{Type: "withdraw", Guardian: host, Request: id})
+			}
+		}()
+	}()
+
+	sent := 0
+	for _, device := range devices {
+		if err = push.send(device, payload); err != nil {
+			log.Printf("%s", err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return RemoteAnswer{}, err
+	}
+	timeout := time.NewTimer(push.timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-answers:
+			if device := verifyPushAnswer(devices, &msg, id, nonce, len(prompt.Choices)); device != nil {
+				return RemoteAnswer{Choice: msg.Choice, Approver: "device " + device.Name}, nil
+			}
+			log.Printf("Ignoring invalid answer from device %s", msg.Device)
+		case <-timeout.C:
+			return RemoteAnswer{}, errPushTimeout
+		case <-ctx.Done():
+			return RemoteAnswer{}, ctx.Err()
+		}
+	}
+}
+
+// verifyPushAnswer returns the device that signed a valid answer.
+func verifyPushAnswer(devices []PushDevice, msg *pushMessage, id string, nonce []byte, choices int) *PushDevice {
+	if msg.Choice < 1 || msg.Choice > choices {
+		return nil
+	}
+	for i, device := range devices {
+		if device.ID == msg.Device && len(device.PublicKey) == ed25519.PublicKeySize &&
+			ed25519.Verify(device.PublicKey, pushSignedData(id, nonce, msg.Choice), msg.Signature) {
+			return &devices[i]
+		}
+	}
+	return nil
+}
+
+// poll collects answers from the relay while prompts wait for them.
+func (push *PushApprover) poll() {
+	for {
+		push.mu.Lock()
+		if len(push.waiting) == 0 {
+			push.polling = false
+			push.mu.Unlock()
+			return
+		}
+		channel := push.devices.Channel
+		push.mu.Unlock()
+
+		messages, err := push.receive(channel, pushPollWait)
+		if err != nil {
+			log.Printf("%s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		push.mu.Lock()
+		for _, msg := range messages {
+			if answers, ok := push.waiting[msg.Request]; ok && msg.Type == "answer" {
+				select {
+				case answers <- msg:
+				default:
+				}
+			}
+		}
+		push.mu.Unlock()
+	}
+}
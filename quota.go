@@ -0,0 +1,120 @@
+package guardianagent
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// ClientQuota limits how much the clients matching a pattern may request.
+// Zero limits are not enforced.
+type ClientQuota struct {
+	// Pattern of client names, as in path.Match.
+	Client string `yaml:"client"`
+
+	// Concurrent sessions, until their handoff.
+	MaxSessions int `yaml:"max-sessions,omitempty"`
+
+	// Approved requests in the last 24 hours, however they were approved.
+	MaxApprovalsPerDay int `yaml:"max-approvals-per-day,omitempty"`
+
+	// Requests the user was prompted for in the last hour.
+	MaxPromptsPerHour int `yaml:"max-prompts-per-hour,omitempty"`
+
+	source string
+}
+
+func (quota *ClientQuota) validate() string {
+	if quota.Client == "" {
+		return "quotas must specify a client"
+	}
+	if _, err := path.Match(quota.Client, ""); err != nil {
+		return fmt.Sprintf("invalid client pattern %q", quota.Client)
+	}
+	if quota.MaxSessions < 0 || quota.MaxApprovalsPerDay < 0 || quota.MaxPromptsPerHour < 0 {
+		return "quota limits cannot be negative"
+	}
+	if quota.MaxSessions == 0 && quota.MaxApprovalsPerDay == 0 && quota.MaxPromptsPerHour == 0 {
+		return "quotas must set max-sessions, max-approvals-per-day or max-prompts-per-hour"
+	}
+	return ""
+}
+
+func (quota *ClientQuota) matches(client string) bool {
+	matched, _ := path.Match(quota.Client, client)
+	return matched
+}
+
+// QuotaUsage counts the approvals and prompts of clients with quotas.
+type QuotaUsage struct {
+	mu        sync.Mutex
+	approvals map[string][]time.Time
+	prompts   map[string][]time.Time
+}
+
+func NewQuotaUsage() *QuotaUsage {
+	return &QuotaUsage{approvals: make(map[string][]time.Time), prompts: make(map[string][]time.Time)}
+}
+
+// recent prunes the events older than window and returns the rest.
+func recent(events map[string][]time.Time, client string, window time.Duration) []time.Time {
+	cutoff := time.Now().Add(-window)
+	times := events[client]
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(events, client)
+		return nil
+	}
+	events[client] = times
+	return times
+}
+
+// checkRequest enforces the session and approval quotas of client, given its
+// number of active sessions.
+func (usage *QuotaUsage) checkRequest(quotas []ClientQuota, client string, sessions int) error {
+	if usage == nil {
+		return nil
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	approvals := len(recent(usage.approvals, client, 24*time.Hour))
+	for _, quota := range quotas {
+		if quota.MaxSessions > 0 && sessions >= quota.MaxSessions {
+			return deny(DenialRateLimit, fmt.Sprintf("Quota exceeded: %s already has %d active sessions (%s)", client, sessions, quota.source))
+		}
+		if quota.MaxApprovalsPerDay > 0 && approvals >= quota.MaxApprovalsPerDay {
+			return deny(DenialRateLimit, fmt.Sprintf("Quota exceeded: %s had %d requests approved in the last day (%s)", client, approvals, quota.source))
+		}
+	}
+	return nil
+}
+
+// checkPrompt enforces the prompt quotas of client, and counts the prompt if
+// it is allowed.
+func (usage *QuotaUsage) checkPrompt(quotas []ClientQuota, client string) error {
+	if usage == nil || len(quotas) == 0 {
+		return nil
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	prompts := recent(usage.prompts, client, time.Hour)
+	for _, quota := range quotas {
+		if quota.MaxPromptsPerHour > 0 && len(prompts) >= quota.MaxPromptsPerHour {
+			return deny(DenialRateLimit, fmt.Sprintf("Quota exceeded: %s prompted %d times in the last hour (%s)", client, len(prompts), quota.source))
+		}
+	}
+	usage.prompts[client] = append(prompts, time.Now())
+	return nil
+}
+
+func (usage *QuotaUsage) recordApproval(quotas []ClientQuota, client string) {
+	if usage == nil || len(quotas) == 0 {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.approvals[client] = append(recent(usage.approvals, client, 24*time.Hour), time.Now())
+}
@@ -0,0 +1,609 @@
+package guardianagent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Files of a recording, next to each other: its description, and the
+// output of the session with its timing, as an asciicast (v2), which
+// asciinema and its web player can play. Earlier recordings are raw
+// transcripts instead: the output of the session (a typescript) and the
+// timing of each chunk of output, in the format of script -t. Encrypted
+// asciicasts have their own suffix, since asciinema cannot play them.
+const (
+	recordingInfoSuffix       = ".json"
+	recordingEncryptedSuffix  = ".cast.sga"
+	recordingCastSuffix       = ".cast"
+	recordingTypescriptSuffix = ".typescript"
+	recordingTimingSuffix     = ".timing"
+)
+
+// Formats of recordings.
+const (
+	RecordingFormatTranscript = ""
+	RecordingFormatAsciicast  = "asciicast-v2"
+)
+
+// What sessions are recorded: nothing, only when and what was run, what
+// was typed, or everything the session showed, too.
+const (
+	RecordingNone     = "none"
+	RecordingMetadata = "metadata"
+	RecordingInput    = "input"
+	RecordingFull     = "full"
+)
+
+var recordingModes = []string{RecordingNone, RecordingMetadata, RecordingInput, RecordingFull}
+
+// describeRecording tells the approver how the session will be recorded.
+func describeRecording(mode string) string {
+	switch mode {
+	case RecordingMetadata:
+		return "\nThe session will be recorded (command and times only)."
+	case RecordingInput:
+		return "\nThe session will be recorded (input only)."
+	case RecordingFull:
+		return "\nThe session will be recorded (input and output)."
+	}
+	return ""
+}
+
+// Terminal size of recordings of sessions without a terminal.
+const (
+	defaultRecordingWidth  = 80
+	defaultRecordingHeight = 24
+)
+
+// asciicastHeader is the first line of an asciicast.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// SessionRecording describes a session recorded by sga-ssh --record.
+type SessionRecording struct {
+	// ID of the request which started the session, if it was delegated.
+	RequestID string `json:",omitempty"`
+
+	User    string
+	Server  string
+	Command string
+	Started time.Time
+	Ended   time.Time
+
+	// Format of the recording's files, and the size of its terminal.
+	Format string `json:",omitempty"`
+	Width  int    `json:",omitempty"`
+	Height int    `json:",omitempty"`
+
+	// What was recorded, see RecordingFull and others.
+	Mode string `json:",omitempty"`
+
+	// If set, the asciicast is encrypted, and it takes the keys of all of
+	// these recipients to read it.
+	Recipients []string `json:",omitempty"`
+
+	// SHA-256 of the asciicast (encrypted, if it is) (or, for transcripts, over the hashes of the
+	// typescript and the timing), which the guardian records in its audit
+	// log at the end of delegated sessions.
+	Hash string
+
+	// Path of the recording's files, without their suffixes.
+	base string
+
+	// Keys to read encrypted recordings with, see Unlock.
+	identities []*RecordingIdentity
+}
+
+// RecordingsDir is where sga-ssh keeps recordings by default.
+func RecordingsDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "sga_recordings")
+}
+
+// Name identifies the recording in its directory.
+func (rec *SessionRecording) Name() string {
+	return filepath.Base(rec.base)
+}
+
+// Unlock provides the keys to read the recording with, if it is encrypted.
+func (rec *SessionRecording) Unlock(ids []*RecordingIdentity) {
+	rec.identities = ids
+}
+
+// suffixes returns the suffixes of the files holding the session.
+func (rec *SessionRecording) suffixes() []string {
+	switch {
+	case rec.Format == RecordingFormatTranscript:
+		return []string{recordingTypescriptSuffix, recordingTimingSuffix}
+	case len(rec.Recipients) > 0:
+		return []string{recordingEncryptedSuffix}
+	}
+	return []string{recordingCastSuffix}
+}
+
+// Upload stores the files of the recording in store, under the same names
+// they have in the recordings directory.
+func (rec *SessionRecording) Upload(store ObjectStore) error {
+	suffixes := append(rec.suffixes(), recordingInfoSuffix)
+	for _, suffix := range suffixes {
+		if err := PutFile(store, rec.Name()+suffix, rec.base+suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func transcriptHash(typescript hash.Hash, timing hash.Hash) string {
+	sum := sha256.New()
+	sum.Write(typescript.Sum(nil))
+	sum.Write(timing.Sum(nil))
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// SessionRecorder records the output written to it, and the input written
+// to Input(), with their timing, as far as its mode requires.
+type SessionRecorder struct {
+	info SessionRecording
+
+	mu        sync.Mutex
+	cast      *os.File
+	castHash  hash.Hash
+	out       io.Writer
+	encryptor *castEncryptor
+	err       error
+
+	// The start of a UTF-8 sequence cut off at the end of the last write of
+	// output and input, since asciicasts hold text.
+	partialOutput []byte
+	partialInput  []byte
+}
+
+// NewSessionRecorder starts a recording of the session described by info
+// (including the size of its terminal, if any, the recording mode,
+// RecordingFull if unset, and the recipients to encrypt it to) in dir.
+func NewSessionRecorder(dir string, info SessionRecording) (*SessionRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create recordings directory: %s", err)
+	}
+	info.Started = time.Now()
+	info.Format = RecordingFormatAsciicast
+	if info.Mode == "" {
+		info.Mode = RecordingFull
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		info.Width, info.Height = defaultRecordingWidth, defaultRecordingHeight
+	}
+	name := info.Started.Format("20060102-150405")
+	if info.RequestID != "" {
+		name += "-" + info.RequestID
+	}
+	info.base = filepath.Join(dir, name)
+	rec := &SessionRecorder{
+		info:     info,
+		castHash: sha256.New(),
+	}
+	var err error
+	if rec.cast, err = os.OpenFile(info.base+info.suffixes()[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		return nil, fmt.Errorf("Failed to create recording: %s", err)
+	}
+	rec.out = io.MultiWriter(rec.cast, rec.castHash)
+	if len(info.Recipients) > 0 {
+		if rec.encryptor, err = newCastEncryptor(rec.out, info.Recipients); err == nil {
+			rec.out = rec.encryptor
+		}
+	}
+	header, err := json.Marshal(info.asciicastHeader())
+	if err == nil {
+		_, err = rec.out.Write(append(header, '\n'))
+	}
+	if err != nil {
+		rec.cast.Close()
+		os.Remove(rec.cast.Name())
+		return nil, fmt.Errorf("Failed to create recording: %s", err)
+	}
+	return rec, nil
+}
+
+func (rec *SessionRecording) asciicastHeader() asciicastHeader {
+	header := asciicastHeader{
+		Version:   2,
+		Width:     rec.Width,
+		Height:    rec.Height,
+		Timestamp: rec.Started.Unix(),
+		Command:   rec.Command,
+		Title:     fmt.Sprintf("%s@%s", rec.User, rec.Server),
+	}
+	if header.Width <= 0 || header.Height <= 0 {
+		header.Width, header.Height = defaultRecordingWidth, defaultRecordingHeight
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		header.Env = map[string]string{"TERM": term}
+	}
+	return header
+}
+
+// asciicastEvent formats an output ("o") or input ("i") event of an
+// asciicast.
+func asciicastEvent(elapsed time.Duration, kind string, data []byte) ([]byte, error) {
+	text, err := json.Marshal(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("[%.6f, %q, %s]\n", elapsed.Seconds(), kind, text)), nil
+}
+
+// splitPartialRune splits off a UTF-8 sequence cut off at the end of data.
+func splitPartialRune(data []byte) (complete []byte, partial []byte) {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i], append([]byte(nil), data[i:]...)
+			}
+			break
+		}
+	}
+	return data, nil
+}
+
+// record records an event. Failures to record are reported by Close, so
+// that they never interrupt the session.
+func (rec *SessionRecorder) record(kind string, partial *[]byte, p []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.err != nil || len(p) == 0 {
+		return
+	}
+	var data []byte
+	data, *partial = splitPartialRune(append(*partial, p...))
+	if len(data) == 0 {
+		return
+	}
+	rec.writeEvent(kind, data)
+}
+
+func (rec *SessionRecorder) writeEvent(kind string, data []byte) {
+	event, err := asciicastEvent(time.Since(rec.info.Started), kind, data)
+	if err == nil {
+		_, err = rec.out.Write(event)
+	}
+	rec.err = err
+}
+
+// Write records a chunk of output, if the mode includes it.
+func (rec *SessionRecorder) Write(p []byte) (int, error) {
+	if rec.info.Mode == RecordingFull {
+		rec.record("o", &rec.partialOutput, p)
+	}
+	return len(p), nil
+}
+
+type recorderInput struct {
+	rec *SessionRecorder
+}
+
+func (input recorderInput) Write(p []byte) (int, error) {
+	if mode := input.rec.info.Mode; mode == RecordingInput || mode == RecordingFull {
+		input.rec.record("i", &input.rec.partialInput, p)
+	}
+	return len(p), nil
+}
+
+// Input returns a writer recording the input written to it, if the mode
+// includes it.
+func (rec *SessionRecorder) Input() io.Writer {
+	return recorderInput{rec}
+}
+
+// Close finishes the recording and returns its description.
+func (rec *SessionRecorder) Close() (SessionRecording, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.partialOutput) > 0 && rec.err == nil {
+		rec.writeEvent("o", rec.partialOutput)
+	}
+	if len(rec.partialInput) > 0 && rec.err == nil {
+		rec.writeEvent("i", rec.partialInput)
+	}
+	if rec.encryptor != nil && rec.err == nil {
+		rec.err = rec.encryptor.Close()
+	}
+	if err := rec.cast.Close(); err != nil && rec.err == nil {
+		rec.err = err
+	}
+	info := rec.info
+	info.Ended = time.Now()
+	info.Hash = hex.EncodeToString(rec.castHash.Sum(nil))
+	if rec.err != nil {
+		return info, fmt.Errorf("Failed to record session: %s", rec.err)
+	}
+	buf, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return info, err
+	}
+	if err = ioutil.WriteFile(info.base+recordingInfoSuffix, buf, 0600); err != nil {
+		return info, fmt.Errorf("Failed to record session: %s", err)
+	}
+	return info, nil
+}
+
+// LoadRecording reads the description of a recording, given the path of
+// any of its files or their common prefix.
+func LoadRecording(path string) (*SessionRecording, error) {
+	base := path
+	for _, suffix := range []string{recordingInfoSuffix, recordingEncryptedSuffix, recordingCastSuffix, recordingTypescriptSuffix, recordingTimingSuffix} {
+		base = strings.TrimSuffix(base, suffix)
+	}
+	buf, err := ioutil.ReadFile(base + recordingInfoSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recording: %s", err)
+	}
+	rec := &SessionRecording{base: base}
+	if err = json.Unmarshal(buf, rec); err != nil {
+		return nil, fmt.Errorf("Failed to parse recording %s: %s", base+recordingInfoSuffix, err)
+	}
+	return rec, nil
+}
+
+// ListRecordings returns the recordings in dir, oldest first.
+func ListRecordings(dir string) ([]*SessionRecording, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+recordingInfoSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var recordings []*SessionRecording
+	for _, name := range matches {
+		rec, err := LoadRecording(name)
+		if err != nil {
+			return nil, err
+		}
+		recordings = append(recordings, rec)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Started.Before(recordings[j].Started) })
+	return recordings, nil
+}
+
+// Contains reports whether the command, server or output of the recording
+// contain text.
+func (rec *SessionRecording) Contains(text string) (bool, error) {
+	if strings.Contains(rec.Command, text) || strings.Contains(rec.Server, text) {
+		return true, nil
+	}
+	var output bytes.Buffer
+	err := rec.play(func(delay time.Duration, data []byte) error {
+		output.Write(data)
+		return nil
+	})
+	return bytes.Contains(output.Bytes(), []byte(text)), err
+}
+
+// Verify checks that the files of the recording match its hash.
+func (rec *SessionRecording) Verify() error {
+	var hashes []hash.Hash
+	for _, suffix := range rec.suffixes() {
+		f, err := os.Open(rec.base + suffix)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h)
+	}
+	sum := hex.EncodeToString(hashes[0].Sum(nil))
+	if len(hashes) == 2 {
+		sum = transcriptHash(hashes[0], hashes[1])
+	}
+	if sum != rec.Hash {
+		return fmt.Errorf("the recording does not match its hash; it was modified")
+	}
+	return nil
+}
+
+// play calls output with each chunk of output (or, for recordings of input
+// only, input) of the recording, and the time since the previous one.
+func (rec *SessionRecording) play(output func(delay time.Duration, data []byte) error) error {
+	switch rec.Format {
+	case RecordingFormatAsciicast:
+		return rec.playAsciicast(output)
+	case RecordingFormatTranscript:
+		return rec.playTranscript(output)
+	}
+	return fmt.Errorf("unsupported recording format %q", rec.Format)
+}
+
+func (rec *SessionRecording) playAsciicast(output func(delay time.Duration, data []byte) error) error {
+	f, err := os.Open(rec.base + rec.suffixes()[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var cast io.Reader = f
+	if len(rec.Recipients) > 0 {
+		if cast, err = newCastDecryptor(f, rec.identities); err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(cast)
+	var header asciicastHeader
+	if err = dec.Decode(&header); err != nil {
+		return fmt.Errorf("invalid asciicast header: %s", err)
+	}
+	if header.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	// Recordings of input only show what was typed instead.
+	shown := "o"
+	if rec.Mode == RecordingInput {
+		shown = "i"
+	}
+	var last float64
+	for {
+		var event []interface{}
+		if err = dec.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid asciicast event: %s", err)
+		}
+		if len(event) != 3 {
+			return fmt.Errorf("invalid asciicast event %v", event)
+		}
+		at, ok1 := event[0].(float64)
+		kind, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return fmt.Errorf("invalid asciicast event %v", event)
+		}
+		if kind != shown {
+			continue
+		}
+		if err = output(time.Duration((at-last)*float64(time.Second)), []byte(data)); err != nil {
+			return err
+		}
+		last = at
+	}
+}
+
+func (rec *SessionRecording) playTranscript(output func(delay time.Duration, data []byte) error) error {
+	typescript, err := os.Open(rec.base + recordingTypescriptSuffix)
+	if err != nil {
+		return err
+	}
+	defer typescript.Close()
+	timing, err := os.Open(rec.base + recordingTimingSuffix)
+	if err != nil {
+		return err
+	}
+	defer timing.Close()
+	scanner := bufio.NewScanner(timing)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid timing %q", scanner.Text())
+		}
+		delay, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return fmt.Errorf("invalid timing %q", scanner.Text())
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timing %q", scanner.Text())
+		}
+		data := make([]byte, n)
+		if _, err = io.ReadFull(typescript, data); err != nil {
+			return err
+		}
+		if err = output(time.Duration(delay*float64(time.Second)), data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Replay writes the output of the recording to w at its original pace,
+// divided by speed, shortening pauses to maxWait if set.
+func (rec *SessionRecording) Replay(w io.Writer, speed float64, maxWait time.Duration) error {
+	return rec.play(func(delay time.Duration, data []byte) error {
+		wait := time.Duration(float64(delay) / speed)
+		if maxWait > 0 && wait > maxWait {
+			wait = maxWait
+		}
+		time.Sleep(wait)
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// ExportAsciicast writes the recording to w as an asciicast (v2), e.g. to
+// convert a transcript for asciinema.
+func (rec *SessionRecording) ExportAsciicast(w io.Writer) error {
+	header, err := json.Marshal(rec.asciicastHeader())
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(append(header, '\n')); err != nil {
+		return err
+	}
+	var elapsed time.Duration
+	var partial []byte
+	write := func(data []byte) error {
+		event, err := asciicastEvent(elapsed, "o", data)
+		if err == nil {
+			_, err = w.Write(event)
+		}
+		return err
+	}
+	err = rec.play(func(delay time.Duration, data []byte) error {
+		elapsed += delay
+		data, partial = splitPartialRune(append(partial, data...))
+		if len(data) == 0 {
+			return nil
+		}
+		return write(data)
+	})
+	if err == nil && len(partial) > 0 {
+		err = write(partial)
+	}
+	return err
+}
+
+// FindRecordingInAudit checks that the audit log read from r shows that the
+// recording's session was handed off by the guardian, and that the client
+// reported the recording's hash at its end.
+func FindRecordingInAudit(r io.Reader, rec *SessionRecording) error {
+	if rec.RequestID == "" {
+		return fmt.Errorf("the session was not delegated by a guardian")
+	}
+	reader := NewAuditReader(r)
+	handedOff, reported := false, false
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entry.RequestID != rec.RequestID {
+			continue
+		}
+		switch {
+		case entry.Event == AuditEventHandoff && entry.Decision == "complete":
+			handedOff = true
+		case entry.Event == AuditEventRecording && entry.Detail == "sha256:"+rec.Hash:
+			reported = true
+		case entry.Event == AuditEventRecording && strings.HasPrefix(entry.Detail, "sha256:"):
+			return fmt.Errorf("the audit log records a different hash for request %s; the recording was modified", rec.RequestID)
+		}
+	}
+	if !handedOff {
+		return fmt.Errorf("the audit log has no handoff of request %s", rec.RequestID)
+	}
+	if !reported {
+		return fmt.Errorf("the audit log has no recording hash for request %s", rec.RequestID)
+	}
+	return nil
+}
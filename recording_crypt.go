@@ -0,0 +1,286 @@
+package guardianagent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Recordings can be encrypted to several recipients, e.g. the guardian's
+// owner and a compliance escrow key, such that it takes all of their keys to
+// read them. Each recipient gets a share of the key of the recording, sealed
+// to their X25519 key as with age; the shares XOR to the key.
+const (
+	recordingRecipientPrefix = "sga-recipient-"
+	recordingIdentityPrefix  = "SGA-IDENTITY-"
+
+	// The output is encrypted in chunks of at most this size.
+	recordingChunkSize = 64 * 1024
+)
+
+// RecordingIdentity is a key pair that recordings can be encrypted to.
+type RecordingIdentity struct {
+	public  [32]byte
+	private [32]byte
+}
+
+func GenerateRecordingIdentity() (*RecordingIdentity, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate key: %s", err)
+	}
+	return &RecordingIdentity{public: *public, private: *private}, nil
+}
+
+// Recipient returns the public half of the identity, to encrypt
+// recordings to.
+func (id *RecordingIdentity) Recipient() string {
+	return recordingRecipientPrefix + base64.RawURLEncoding.EncodeToString(id.public[:])
+}
+
+// Marshal encodes the identity as the contents of a key file.
+func (id *RecordingIdentity) Marshal() []byte {
+	return []byte(fmt.Sprintf("# created: %s\n# recipient: %s\n%s%s\n", time.Now().Format(time.RFC3339),
+		id.Recipient(), recordingIdentityPrefix, base64.RawURLEncoding.EncodeToString(id.private[:])))
+}
+
+// LoadRecordingIdentities reads the identities in a key file.
+func LoadRecordingIdentities(path string) ([]*RecordingIdentity, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recording key: %s", err)
+	}
+	var ids []*RecordingIdentity
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, recordingIdentityPrefix))
+		if !strings.HasPrefix(line, recordingIdentityPrefix) || err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Invalid recording key in %s", path)
+		}
+		id := &RecordingIdentity{}
+		copy(id.private[:], key)
+		public, err := curve25519.X25519(id.private[:], curve25519.Basepoint)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recording key in %s", path)
+		}
+		copy(id.public[:], public)
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No recording key in %s", path)
+	}
+	return ids, nil
+}
+
+// ParseRecordingRecipient decodes a recipient, as returned by Recipient.
+func ParseRecordingRecipient(s string) (*[32]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, recordingRecipientPrefix))
+	if !strings.HasPrefix(s, recordingRecipientPrefix) || err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid recording recipient %q", s)
+	}
+	var public [32]byte
+	copy(public[:], key)
+	return &public, nil
+}
+
+// mergeRecipients returns the distinct recipients of all lists.
+func mergeRecipients(lists ...[]string) []string {
+	var merged []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, recipient := range list {
+			if !seen[recipient] {
+				seen[recipient] = true
+				merged = append(merged, recipient)
+			}
+		}
+	}
+	return merged
+}
+
+// encryptedCastHeader is the first line of an encrypted asciicast.
+type encryptedCastHeader struct {
+	Version int                 `json:"sga-encrypted"`
+	Nonce   []byte              `json:"nonce"`
+	Shares  []encryptedKeyShare `json:"shares"`
+}
+
+type encryptedKeyShare struct {
+	Recipient string `json:"recipient"`
+	Box       []byte `json:"box"`
+}
+
+// castEncryptor encrypts what is written to it as a sequence of chunks,
+// each prefixed by its length. The last chunk is marked in its nonce, so that
+// truncated recordings are detected.
+type castEncryptor struct {
+	w       io.Writer
+	key     [32]byte
+	prefix  [16]byte
+	counter uint64
+}
+
+// newCastEncryptor writes the header of a recording encrypted to all of
+// recipients to w, and returns a writer encrypting to it.
+func newCastEncryptor(w io.Writer, recipients []string) (*castEncryptor, error) {
+	enc := &castEncryptor{w: w}
+	if _, err := rand.Read(enc.key[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(enc.prefix[:]); err != nil {
+		return nil, err
+	}
+	header := encryptedCastHeader{Version: 1, Nonce: enc.prefix[:]}
+	last := enc.key
+	for i, recipient := range recipients {
+		public, err := ParseRecordingRecipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+		share := last
+		if i < len(recipients)-1 {
+			if _, err = rand.Read(share[:]); err != nil {
+				return nil, err
+			}
+			for j := range last {
+				last[j] ^= share[j]
+			}
+		}
+		sealed, err := box.SealAnonymous(nil, share[:], public, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		header.Shares = append(header.Shares, encryptedKeyShare{Recipient: recipient, Box: sealed})
+	}
+	buf, err := json.Marshal(header)
+	if err == nil {
+		_, err = w.Write(append(buf, '\n'))
+	}
+	return enc, err
+}
+
+func (enc *castEncryptor) nonce(final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], enc.prefix[:])
+	counter := enc.counter
+	if final {
+		counter |= 1 << 63
+	}
+	binary.BigEndian.PutUint64(nonce[16:], counter)
+	return &nonce
+}
+
+func (enc *castEncryptor) writeChunk(p []byte, final bool) error {
+	sealed := secretbox.Seal(make([]byte, 4), p, enc.nonce(final), &enc.key)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	enc.counter++
+	_, err := enc.w.Write(sealed)
+	return err
+}
+
+func (enc *castEncryptor) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := len(p) - written
+		if n > recordingChunkSize {
+			n = recordingChunkSize
+		}
+		if err := enc.writeChunk(p[written:written+n], false); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
+
+// Close writes the final chunk.
+func (enc *castEncryptor) Close() error {
+	return enc.writeChunk(nil, true)
+}
+
+// castDecryptor reads an encrypted asciicast.
+type castDecryptor struct {
+	r       *bufio.Reader
+	enc     castEncryptor
+	pending []byte
+	done    bool
+}
+
+// newCastDecryptor reads the header of an encrypted recording from r and
+// recovers its key, which takes the identities of all of its recipients.
+func newCastDecryptor(r io.Reader, ids []*RecordingIdentity) (*castDecryptor, error) {
+	dec := &castDecryptor{r: bufio.NewReader(r)}
+	line, err := dec.r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted recording: %s", err)
+	}
+	var header encryptedCastHeader
+	if err = json.Unmarshal(line, &header); err != nil || header.Version != 1 || len(header.Nonce) != 16 || len(header.Shares) == 0 {
+		return nil, fmt.Errorf("invalid encrypted recording header")
+	}
+	copy(dec.enc.prefix[:], header.Nonce)
+	var missing []string
+	for _, share := range header.Shares {
+		var opened []byte
+		for _, id := range ids {
+			if id.Recipient() == share.Recipient {
+				var ok bool
+				if opened, ok = box.OpenAnonymous(nil, share.Box, &id.public, &id.private); !ok {
+					return nil, fmt.Errorf("Failed to decrypt the key share of %s", share.Recipient)
+				}
+				break
+			}
+		}
+		if len(opened) != 32 {
+			missing = append(missing, share.Recipient)
+			continue
+		}
+		for i := range dec.enc.key {
+			dec.enc.key[i] ^= opened[i]
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the recording is encrypted; reading it also takes the keys of %s", strings.Join(missing, ", "))
+	}
+	return dec, nil
+}
+
+func (dec *castDecryptor) Read(p []byte) (int, error) {
+	for len(dec.pending) == 0 {
+		if dec.done {
+			return 0, io.EOF
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(dec.r, size[:]); err != nil {
+			return 0, fmt.Errorf("the recording is truncated")
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(dec.r, sealed); err != nil {
+			return 0, fmt.Errorf("the recording is truncated")
+		}
+		var ok bool
+		if dec.pending, ok = secretbox.Open(nil, sealed, dec.enc.nonce(false), &dec.enc.key); !ok {
+			if dec.pending, ok = secretbox.Open(nil, sealed, dec.enc.nonce(true), &dec.enc.key); !ok {
+				return 0, fmt.Errorf("Failed to decrypt the recording: wrong keys, or it was modified")
+			}
+			dec.done = true
+		}
+		dec.enc.counter++
+	}
+	n := copy(p, dec.pending)
+	dec.pending = dec.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package guardianagent
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ReloadReport describes the outcome of a reload of the configuration: the
+// options whose changes were applied, and those whose changes only take
+// effect once the guardian is restarted.
+type ReloadReport struct {
+	Applied         []string
+	RestartRequired []string
+}
+
+// Reloader rereads the configuration, applying what can be applied live with
+// Reconfigure, e.g. on SIGHUP.
+type Reloader func() (*ReloadReport, error)
+
+// SetReloader makes Reload, and thus the admin API, reread the configuration
+// with reload.
+func (agent *Agent) SetReloader(reload Reloader) {
+	agent.reloader = reload
+}
+
+// Reconfigure applies settings to a running agent. Connections made from
+// then on use them, while active sessions and pending requests keep theirs.
+func (agent *Agent) Reconfigure(apply func()) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	apply()
+}
+
+// SetSystemPolicyDir sets the directory of the system policy, which takes
+// effect at the next ReloadPolicy.
+func (agent *Agent) SetSystemPolicyDir(dir string) {
+	agent.systemPolicyDir = dir
+}
+
+// ReloadPolicy rereads the personal policy, those of the tenants and the
+// system policy. The previous policy is kept if any is invalid.
+func (agent *Agent) ReloadPolicy() error {
+	fresh, err := NewStore(agent.policyConfigPath)
+	if err != nil {
+		return fmt.Errorf("Failed to load policy store: %s", err)
+	}
+	system, err := agent.loadSystemPolicyWith(fresh)
+	if err != nil {
+		return err
+	}
+	if err = agent.reloadTenants(); err != nil {
+		return err
+	}
+	agent.store.replaceRules(fresh)
+	agent.policy.System.Replace(system)
+	agent.reportPolicyProblems()
+	return nil
+}
+
+// Reload rereads the configuration, if there is a reloader, and the policy,
+// and audits the outcome.
+func (agent *Agent) Reload() (*ReloadReport, error) {
+	agent.reloadMu.Lock()
+	defer agent.reloadMu.Unlock()
+	report := &ReloadReport{}
+	if agent.reloader != nil {
+		var err error
+		if report, err = agent.reloader(); err != nil {
+			agent.policy.Audit.Record(AuditEventError, Scope{}, "", "", "reload failed: "+err.Error())
+			return nil, err
+		}
+	}
+	if err := agent.ReloadPolicy(); err != nil {
+		agent.policy.Audit.Record(AuditEventError, Scope{}, "", "", "reload failed: "+err.Error())
+		return nil, err
+	}
+	detail := "reloaded configuration and policy"
+	if len(report.Applied) > 0 {
+		detail += "; applied " + strings.Join(report.Applied, ", ")
+	}
+	if len(report.RestartRequired) > 0 {
+		detail += "; restart required for " + strings.Join(report.RestartRequired, ", ")
+	}
+	log.Printf("%s", detail)
+	agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", detail)
+	return report, nil
+}
@@ -0,0 +1,127 @@
+package guardianagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RemoteApprover shows prompts somewhere other than the guardian's own
+// terminal or display, e.g. on a paired phone or in a chat room.
+type RemoteApprover interface {
+	Ask(ctx context.Context, prompt Prompt) (RemoteAnswer, error)
+}
+
+// RemoteAnswer is the answer to a prompt from a remote approver.
+type RemoteAnswer struct {
+	Choice int
+
+	// Who answered, e.g. "telegram:@alice".
+	Approver string
+
+	// How long an approval is to be remembered, if the approver said so.
+	TTL time.Duration
+}
+
+// PromptAnswer records which remote approver answered a prompt, if any.
+type PromptAnswer struct {
+	mu     sync.Mutex
+	answer RemoteAnswer
+}
+
+type promptAnswerKey struct{}
+
+// withPromptAnswer returns a context in which the answer of the remote
+// approver that answered a prompt is recorded.
+func withPromptAnswer(ctx context.Context) (context.Context, *PromptAnswer) {
+	answer := &PromptAnswer{}
+	return context.WithValue(ctx, promptAnswerKey{}, answer), answer
+}
+
+func recordAnswer(ctx context.Context, remote RemoteAnswer) {
+	if answer, ok := ctx.Value(promptAnswerKey{}).(*PromptAnswer); ok {
+		answer.mu.Lock()
+		answer.answer = remote
+		answer.mu.Unlock()
+	}
+}
+
+// Approver returns who answered, or "" for the local user.
+func (answer *PromptAnswer) Approver() string {
+	answer.mu.Lock()
+	defer answer.mu.Unlock()
+	return answer.answer.Approver
+}
+
+// TTL returns how long an approval is to be remembered, or 0 for forever.
+func (answer *PromptAnswer) TTL() time.Duration {
+	answer.mu.Lock()
+	defer answer.mu.Unlock()
+	return answer.answer.TTL
+}
+
+// raceApprovers shows a prompt with local and the remote approvers, and
+// returns the first answer. The other prompts are withdrawn. If all fail, the
+// error of local is returned.
+func raceApprovers(ctx context.Context, prompt Prompt, local func(ctx context.Context) (int, error), remotes []RemoteApprover) (int, error) {
+	if len(remotes) == 0 {
+		return local(ctx)
+	}
+	var answeredRemotely bool
+	parent := ctx
+	ctx = context.WithValue(ctx, withdrawReasonKey{}, func() string {
+		if answeredRemotely {
+			return "answered remotely"
+		}
+		return withdrawReason(parent)
+	})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type answer struct {
+		RemoteAnswer
+		err    error
+		remote bool
+	}
+	answers := make(chan answer, len(remotes)+1)
+	go func() {
+		reply, err := local(ctx)
+		answers <- answer{RemoteAnswer{Choice: reply}, err, false}
+	}()
+	for _, remote := range remotes {
+		go func(remote RemoteApprover) {
+			reply, err := remote.Ask(ctx, prompt)
+			answers <- answer{reply, err, true}
+		}(remote)
+	}
+
+	var localErr, remoteErr error
+	localDone := false
+	for i := 0; i < len(remotes)+1; i++ {
+		a := <-answers
+		if !a.remote {
+			localDone = true
+		}
+		if a.err == nil {
+			answeredRemotely = a.remote
+			cancel()
+			// Wait for the local prompt to be taken down.
+			for !localDone {
+				localDone = !(<-answers).remote
+			}
+			if a.remote {
+				recordAnswer(parent, a.RemoteAnswer)
+			}
+			return a.Choice, nil
+		}
+		if a.remote {
+			remoteErr = a.err
+		} else {
+			localErr = a.err
+		}
+	}
+	if localErr != nil {
+		return 0, localErr
+	}
+	return 0, remoteErr
+}
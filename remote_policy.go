@@ -0,0 +1,156 @@
+package guardianagent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	remotePolicyFile    = "remote_policy.yaml"
+	remotePolicyETag    = "remote_policy.etag"
+	remotePolicyMaxSize = 1 << 20
+	remotePolicyTimeout = 30 * time.Second
+)
+
+// RemotePolicy is a policy bundle that is periodically fetched from an HTTPS
+// endpoint. The last bundle that was fetched and verified successfully is kept
+// in CacheDir, and used while the endpoint is unreachable.
+type RemotePolicy struct {
+	URL      string
+	CacheDir string
+	Interval time.Duration
+
+	// If set, the bundle must be signed (<URL>.sig), see PolicyVerifier.
+	Verifier *PolicyVerifier
+
+	client http.Client
+}
+
+func NewRemotePolicy(url string, cacheDir string, interval time.Duration, verifier *PolicyVerifier) (*RemotePolicy, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("remote policy URL must use https: %s", url)
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create policy cache: %s", err)
+	}
+	return &RemotePolicy{
+		URL:      url,
+		CacheDir: cacheDir,
+		Interval: interval,
+		Verifier: verifier,
+		client:   http.Client{Timeout: remotePolicyTimeout},
+	}, nil
+}
+
+// CachedPath returns the path of the last-known-good bundle, or an empty
+// string if none was fetched yet.
+func (remote *RemotePolicy) CachedPath() string {
+	name := filepath.Join(remote.CacheDir, remotePolicyFile)
+	if _, err := os.Stat(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// Fetch downloads the bundle if it changed since the last fetch, and reports
+// whether the cached copy was updated. Invalid or badly signed bundles are
+// rejected and leave the cache untouched.
+func (remote *RemotePolicy) Fetch() (bool, error) {
+	req, err := http.NewRequest("GET", remote.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	etagPath := filepath.Join(remote.CacheDir, remotePolicyETag)
+	if remote.CachedPath() != "" {
+		if etag, err := ioutil.ReadFile(etagPath); err == nil && len(etag) > 0 {
+			req.Header.Set("If-None-Match", string(etag))
+		}
+	}
+	resp, err := remote.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("Failed to fetch remote policy: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Failed to fetch remote policy: %s returned %s", remote.URL, resp.Status)
+	}
+	bundle, err := readLimited(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("Failed to fetch remote policy: %s", err)
+	}
+	if _, err = parsePolicyFile(remote.URL, bundle, false); err != nil {
+		return false, err
+	}
+
+	var sig []byte
+	if remote.Verifier != nil {
+		sig, err = remote.fetchSignature()
+		if err == nil {
+			err = remote.Verifier.VerifySignature(remote.URL, sig, bundle)
+		}
+		if err != nil {
+			if !remote.Verifier.WarnOnly {
+				return false, err
+			}
+			log.Printf("Warning: %s", err)
+		}
+	}
+
+	// The signature goes first, so that the bundle is never paired with a
+	// stale signature.
+	name := filepath.Join(remote.CacheDir, remotePolicyFile)
+	if sig != nil {
+		if err = writeFileAtomic(name+policySignatureSuffix, sig); err != nil {
+			return false, err
+		}
+	}
+	if err = writeFileAtomic(name, bundle); err != nil {
+		return false, err
+	}
+	if err = writeFileAtomic(etagPath, []byte(resp.Header.Get("ETag"))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (remote *RemotePolicy) fetchSignature() ([]byte, error) {
+	resp, err := remote.client.Get(remote.URL + policySignatureSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch remote policy signature: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch remote policy signature: %s returned %s",
+			remote.URL+policySignatureSuffix, resp.Status)
+	}
+	return readLimited(resp.Body)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, remotePolicyMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > remotePolicyMaxSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", remotePolicyMaxSize)
+	}
+	return buf, nil
+}
+
+func writeFileAtomic(name string, buf []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,182 @@
+package guardianagent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RequestMetadata is optional information attached to an execution request.
+// On the wire, it is a sequence of name/value string pairs; unknown names are
+// ignored, so that fields can be added without breaking older guardians.
+type RequestMetadata struct {
+	// One-time approval token issued by the guardian's admin API.
+	Token string
+
+	// Invitation issued by the guardian's admin API, as "<id>.<secret>".
+	Invitation string
+
+	// Free-text justification, e.g. a ticket ID, shown to the approver.
+	Reason string
+
+	// Directory on the server the command is intended to run in.
+	WorkingDir string
+
+	// Batch identifies a run of a high-fan-out tool (e.g. a hash of the
+	// Ansible inventory and playbook), covering BatchSize hosts in the group
+	// (host tag) BatchGroup.
+	Batch      string
+	BatchGroup string
+	BatchSize  int
+
+	// GitRun identifies the git command on the intermediary a git operation
+	// belongs to, so that the user can approve its other connections to the
+	// same server along with the first (see GitRuns).
+	GitRun string
+
+	// RequestID is a UUID chosen by the client. A client which retries a
+	// request, e.g. after losing its connection while waiting for a decision,
+	// resends it with the same ID so that it is not prompted for again.
+	// Setting it also tells the guardian that the client understands
+	// MsgExecutionPending and the metadata of responses. The guardian assigns
+	// an ID to requests without one.
+	RequestID string
+
+	// Denial classifies the denial in responses (see DenialPolicy and
+	// others).
+	Denial string
+
+	// Recording tells the client how the system policy requires the session
+	// to be recorded in approvals (see RecordingFull and others), and
+	// RecordingRecipients the keys it must be encrypted to, if any.
+	Recording           string
+	RecordingRecipients []string
+}
+
+type metadataField struct {
+	Name  string
+	Value string
+	Rest  []byte `ssh:"rest"`
+}
+
+const (
+	metadataToken      = "token"
+	metadataInvitation = "invitation"
+	metadataReason     = "reason"
+	metadataWorkingDir = "cwd"
+	metadataBatch      = "batch"
+	metadataBatchGroup = "batch-group"
+	metadataBatchSize  = "batch-size"
+	metadataGitRun     = "git-run"
+	metadataRequestID  = "request-id"
+	metadataDenial     = "denial"
+	metadataRecording  = "recording"
+
+	metadataRecordingRecipients = "recording-recipients"
+)
+
+func (meta *RequestMetadata) fields() []metadataField {
+	var batchSize string
+	if meta.BatchSize > 0 {
+		batchSize = strconv.Itoa(meta.BatchSize)
+	}
+	return []metadataField{
+		{Name: metadataToken, Value: meta.Token},
+		{Name: metadataInvitation, Value: meta.Invitation},
+		{Name: metadataReason, Value: meta.Reason},
+		{Name: metadataWorkingDir, Value: meta.WorkingDir},
+		{Name: metadataBatch, Value: meta.Batch},
+		{Name: metadataBatchGroup, Value: meta.BatchGroup},
+		{Name: metadataBatchSize, Value: batchSize},
+		{Name: metadataGitRun, Value: meta.GitRun},
+		{Name: metadataRequestID, Value: meta.RequestID},
+		{Name: metadataDenial, Value: meta.Denial},
+		{Name: metadataRecording, Value: meta.Recording},
+		{Name: metadataRecordingRecipients, Value: strings.Join(meta.RecordingRecipients, " ")},
+	}
+}
+
+// Marshal encodes the non-empty fields of meta.
+func (meta *RequestMetadata) Marshal() []byte {
+	var buf []byte
+	for _, field := range meta.fields() {
+		if field.Value != "" {
+			buf = append(buf, ssh.Marshal(field)...)
+		}
+	}
+	return buf
+}
+
+func ParseRequestMetadata(buf []byte) (RequestMetadata, error) {
+	var meta RequestMetadata
+	for len(buf) > 0 {
+		var field metadataField
+		if err := ssh.Unmarshal(buf, &field); err != nil {
+			return meta, fmt.Errorf("Failed to parse request metadata: %s", err)
+		}
+		switch field.Name {
+		case metadataToken:
+			meta.Token = field.Value
+		case metadataInvitation:
+			meta.Invitation = field.Value
+		case metadataReason:
+			meta.Reason = field.Value
+		case metadataWorkingDir:
+			meta.WorkingDir = field.Value
+		case metadataBatch:
+			meta.Batch = field.Value
+		case metadataBatchGroup:
+			meta.BatchGroup = field.Value
+		case metadataBatchSize:
+			size, err := strconv.Atoi(field.Value)
+			if err != nil {
+				return meta, fmt.Errorf("Invalid batch size %q", field.Value)
+			}
+			meta.BatchSize = size
+		case metadataGitRun:
+			meta.GitRun = field.Value
+		case metadataRequestID:
+			meta.RequestID = field.Value
+		case metadataDenial:
+			meta.Denial = field.Value
+		case metadataRecording:
+			meta.Recording = field.Value
+		case metadataRecordingRecipients:
+			meta.RecordingRecipients = strings.Fields(field.Value)
+		}
+		buf = field.Rest
+	}
+	return meta, nil
+}
+
+// NewRequestID returns a random (version 4) UUID.
+func NewRequestID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Failed to generate request ID: %s", err)
+	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
+
+// describe formats the metadata shown to approvers.
+func (meta *RequestMetadata) describe() string {
+	var desc string
+	if meta.Reason != "" {
+		desc += fmt.Sprintf("\n  Reason: %s", displayLine(meta.Reason))
+	}
+	if meta.WorkingDir != "" {
+		desc += fmt.Sprintf("\n  Working directory: %s", displayLine(meta.WorkingDir))
+	}
+	if meta.Batch != "" {
+		desc += fmt.Sprintf("\n  Batch: %s (%d hosts in %s)", displayLine(meta.Batch), meta.BatchSize, displayLine(meta.BatchGroup))
+	}
+	if meta.GitRun != "" {
+		desc += fmt.Sprintf("\n  Git run: %s", displayLine(meta.GitRun))
+	}
+	return desc
+}
@@ -0,0 +1,186 @@
+package guardianagent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delays between attempts to bring a reverse tunnel back up.
+const (
+	tunnelMinBackoff = time.Second
+	tunnelMaxBackoff = time.Minute
+)
+
+// ReverseTunnel exposes the guardian on a socket of a jump host, through a
+// remote forwarding of a local socket, which it keeps up with the ssh
+// program. Clients which cannot reach the guardian, e.g. behind NAT, can
+// then connect to the socket on the jump host without any ssh -R of their
+// own.
+type ReverseTunnel struct {
+	SSHProgram string
+
+	// [user@]host of the jump host, and the path of the socket there.
+	Host         string
+	RemoteSocket string
+
+	// Permissions of the socket on the jump host.
+	Mode os.FileMode
+
+	start    sync.Once
+	listener net.Listener
+	local    string
+	closed   chan struct{}
+
+	mu    sync.Mutex
+	stdin io.Closer
+}
+
+// NewReverseTunnel listens on a local socket, which is forwarded to the jump
+// host once the tunnel is first accepted from.
+func NewReverseTunnel(host string, remoteSocket string, mode os.FileMode) (*ReverseTunnel, error) {
+	if host == "" || !strings.HasPrefix(remoteSocket, "/") {
+		return nil, fmt.Errorf("a reverse tunnel requires a jump host and the absolute path of the socket there")
+	}
+	listener, local, err := CreateSocket(path.Join(UserTempDir(),
+		fmt.Sprintf(".guard.%d.%s", os.Getpid(), adminSocketSanitizer.Replace(host))))
+	if err != nil {
+		return nil, err
+	}
+	return &ReverseTunnel{
+		SSHProgram:   "ssh",
+		Host:         host,
+		RemoteSocket: remoteSocket,
+		Mode:         mode,
+		listener:     listener,
+		local:        local,
+		closed:       make(chan struct{}),
+	}, nil
+}
+
+// Accept brings the tunnel up, if it is not yet, and accepts connections
+// forwarded through it.
+func (tunnel *ReverseTunnel) Accept() (net.Conn, error) {
+	tunnel.start.Do(func() { go tunnel.run() })
+	return tunnel.listener.Accept()
+}
+
+func (tunnel *ReverseTunnel) Addr() net.Addr {
+	return tunnel.listener.Addr()
+}
+
+// Close takes the tunnel down.
+func (tunnel *ReverseTunnel) Close() error {
+	select {
+	case <-tunnel.closed:
+		return nil
+	default:
+	}
+	close(tunnel.closed)
+	tunnel.mu.Lock()
+	if tunnel.stdin != nil {
+		tunnel.stdin.Close()
+	}
+	tunnel.mu.Unlock()
+	err := tunnel.listener.Close()
+	os.Remove(tunnel.local)
+	return err
+}
+
+func (tunnel *ReverseTunnel) String() string {
+	return fmt.Sprintf("%s:%s", tunnel.Host, tunnel.RemoteSocket)
+}
+
+// run brings the tunnel up again whenever it goes down, backing off while
+// the jump host cannot be reached.
+func (tunnel *ReverseTunnel) run() {
+	backoff := tunnelMinBackoff
+	for {
+		started := time.Now()
+		err := tunnel.connect()
+		select {
+		case <-tunnel.closed:
+			return
+		default:
+		}
+		if time.Since(started) > tunnelMaxBackoff {
+			backoff = tunnelMinBackoff
+		}
+		log.Printf("Reverse tunnel to %s went down (%s), reconnecting in %s", tunnel, err, backoff)
+		select {
+		case <-tunnel.closed:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > tunnelMaxBackoff {
+			backoff = tunnelMaxBackoff
+		}
+	}
+}
+
+// connect forwards the socket until the connection to the jump host is
+// lost. sshd only binds sockets which do not exist, and with the mode of its
+// StreamLocalBindMask, so a stale socket is removed first and the mode is set
+// once it is bound.
+func (tunnel *ReverseTunnel) connect() error {
+	remote := shellQuote(tunnel.RemoteSocket)
+	options := []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3"}
+	cleanup := exec.Command(tunnel.SSHProgram, append(options, tunnel.Host, "rm -f -- "+remote)...)
+	if out, err := cleanup.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// With ExitOnForwardFailure, the command only runs once the socket is
+	// bound. It then blocks until its input is closed.
+	cmd := exec.Command(tunnel.SSHProgram, append(options, "-o", "ExitOnForwardFailure=yes",
+		"-R", tunnel.RemoteSocket+":"+tunnel.local, tunnel.Host,
+		fmt.Sprintf("chmod %04o %s && echo ready && exec cat >/dev/null", tunnel.Mode.Perm(), remote))...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	tunnel.mu.Lock()
+	tunnel.stdin = stdin
+	tunnel.mu.Unlock()
+	select {
+	case <-tunnel.closed:
+		stdin.Close()
+	default:
+	}
+
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); strings.TrimSpace(line) == "ready" {
+		log.Printf("Reverse tunnel to %s is up", tunnel)
+	}
+	io.Copy(ioutil.Discard, stdout)
+	if err = cmd.Wait(); err == nil {
+		err = fmt.Errorf("the connection was closed")
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		err = fmt.Errorf("%s: %s", err, msg)
+	}
+	return err
+}
+
+// shellQuote quotes s for the POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,210 @@
+package guardianagent
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const rotatedSuffixFormat = "20060102T150405.000"
+
+// RotationPolicy controls when a RotatingFile is rotated and how long rotated
+// files are kept. Zero values disable the corresponding limit.
+type RotationPolicy struct {
+	MaxSize   int64
+	MaxAge    time.Duration
+	Retention time.Duration
+	MaxFiles  int
+	Compress  bool
+
+	// Rotated files are also stored here, if set, before they are pruned.
+	Archive ObjectStore
+}
+
+// RotatingFile is an append-only file which is renamed to
+// <path>.<timestamp>[.gz] once it grows past the policy limits.
+type RotatingFile struct {
+	path   string
+	policy RotationPolicy
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func OpenRotatingFile(path string, policy RotationPolicy) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, policy: policy}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = info.ModTime()
+	if rf.size == 0 {
+		rf.opened = time.Now()
+	}
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	return rf.file.Close()
+}
+
+// NeedsRotation reports whether the file has outgrown the policy limits and
+// should be rotated before it is written to again.
+func (rf *RotatingFile) NeedsRotation() bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.policy.MaxSize > 0 && rf.size >= rf.policy.MaxSize {
+		return true
+	}
+	return rf.policy.MaxAge > 0 && time.Since(rf.opened) > rf.policy.MaxAge
+}
+
+func (rf *RotatingFile) Rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rotated := rf.path + "." + time.Now().Format(rotatedSuffixFormat)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	go func() {
+		if rf.policy.Compress {
+			if err := compressFile(rotated); err != nil {
+				log.Printf("Failed to compress %s: %s", rotated, err)
+			} else {
+				rotated += ".gz"
+			}
+		}
+		if rf.policy.Archive != nil {
+			if err := PutFile(rf.policy.Archive, filepath.Base(rotated), rotated); err != nil {
+				log.Printf("Failed to archive %s: %s", rotated, err)
+			}
+		}
+		if err := PruneRotated(rf.path, rf.policy); err != nil {
+			log.Printf("Failed to prune rotated files of %s: %s", rf.path, err)
+		}
+	}()
+	return nil
+}
+
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// RotatedFiles returns the rotated files of path, oldest first.
+func RotatedFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// PruneRotated removes rotated files of path exceeding the retention limits
+// of the policy.
+func PruneRotated(path string, policy RotationPolicy) error {
+	rotated, err := RotatedFiles(path)
+	if err != nil {
+		return err
+	}
+	var keep []string
+	for _, name := range rotated {
+		if policy.Retention > 0 {
+			info, err := os.Stat(name)
+			if err == nil && time.Since(info.ModTime()) > policy.Retention {
+				if err = os.Remove(name); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		keep = append(keep, name)
+	}
+	if policy.MaxFiles > 0 && len(keep) > policy.MaxFiles {
+		for _, name := range keep[:len(keep)-policy.MaxFiles] {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OpenLogFile opens a current or rotated log file for reading, transparently
+// decompressing rotated files.
+func OpenLogFile(name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return file, nil
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to decompress %s: %s", name, err)
+	}
+	return &gzipFile{Reader: zr, file: file}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (gf *gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.file.Close()
+}
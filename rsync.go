@@ -0,0 +1,50 @@
+package guardianagent
+
+import (
+	"path"
+	"strings"
+)
+
+// RsyncCommand is the remote side of an rsync transfer over ssh, e.g.
+// "rsync --server -vlogDtpre.iLsfxC . /backup".
+type RsyncCommand struct {
+	Direction string
+	Paths     []string
+	Options   []string
+}
+
+// ParseRsyncCommand recognizes "rsync --server" invocations. With --sender,
+// the server sends files to the client (a download); otherwise it receives
+// them. The paths follow a lone "." argument.
+func ParseRsyncCommand(cmd string) (*RsyncCommand, bool) {
+	args := strings.Fields(cmd)
+	if len(args) < 4 || path.Base(args[0]) != "rsync" {
+		return nil, false
+	}
+	rsync := &RsyncCommand{Direction: TransferUpload}
+	server := false
+	i := 1
+	for ; i < len(args) && args[i] != "."; i++ {
+		switch {
+		case args[i] == "--server":
+			server = true
+		case args[i] == "--sender":
+			rsync.Direction = TransferDownload
+		case strings.HasPrefix(args[i], "-"):
+			rsync.Options = append(rsync.Options, args[i])
+		default:
+			return nil, false
+		}
+	}
+	if !server || i+1 >= len(args) {
+		return nil, false
+	}
+	for _, p := range args[i+1:] {
+		rsync.Paths = append(rsync.Paths, unquoteSCPPath(p))
+	}
+	return rsync, true
+}
+
+func (rsync *RsyncCommand) Transfer() *Transfer {
+	return &Transfer{Tool: "rsync", Direction: rsync.Direction, Paths: rsync.Paths}
+}
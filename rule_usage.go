@@ -0,0 +1,165 @@
+package guardianagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// ruleUse records when a stored approval last auto-approved a request. The
+// approval of all commands in a scope has an empty Command.
+type ruleUse struct {
+	Scope    Scope
+	Command  string `json:",omitempty"`
+	LastUsed time.Time
+}
+
+// ruleUsage is saved next to the personal policy, so that using a rule does
+// not rewrite the policy file.
+type ruleUsage struct {
+	// When usage tracking started, which rules without a known origin or use
+	// are judged by.
+	Since time.Time
+	Rules []ruleUse
+}
+
+// StaleRule is a stored approval that was not used for a while.
+type StaleRule struct {
+	Scope Scope
+
+	// Empty for the approval of all commands.
+	Command string
+
+	// Zero if the rule was never used, or not since usage is tracked.
+	LastUsed time.Time
+
+	// Zero if unknown.
+	Added time.Time
+}
+
+type ruleKey struct {
+	scope Scope
+	cmd   string
+}
+
+func (store *Store) usagePath() string {
+	return store.path + ".usage"
+}
+
+func (store *Store) loadUsage() error {
+	store.usage = make(map[ruleKey]time.Time)
+	buf, err := ioutil.ReadFile(store.usagePath())
+	if os.IsNotExist(err) {
+		store.usageSince = time.Now()
+		return store.saveUsage()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read rule usage: %s", err)
+	}
+	var usage ruleUsage
+	if err = json.Unmarshal(buf, &usage); err != nil {
+		return fmt.Errorf("Failed to parse rule usage %s: %s", store.usagePath(), err)
+	}
+	store.usageSince = usage.Since
+	for _, use := range usage.Rules {
+		store.usage[ruleKey{use.Scope, use.Command}] = use.LastUsed
+	}
+	return nil
+}
+
+func (store *Store) saveUsage() error {
+	usage := ruleUsage{Since: store.usageSince}
+	for key, lastUsed := range store.usage {
+		usage.Rules = append(usage.Rules, ruleUse{Scope: key.scope, Command: key.cmd, LastUsed: lastUsed})
+	}
+	buf, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	tmpPath := store.usagePath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("Failed to save rule usage: %s", err)
+	}
+	return os.Rename(tmpPath, store.usagePath())
+}
+
+// MarkUsed records that the stored approval of cmd in scope auto-approved a
+// request.
+func (store *Store) MarkUsed(scope Scope, cmd string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	allowed := store.rules[scope]
+	if allowed.AllCommands {
+		cmd = ""
+	} else if rule, ok := allowed.match(cmd, time.Now()); ok {
+		cmd = rule
+	}
+	store.usage[ruleKey{scope, cmd}] = time.Now()
+	return store.saveUsage()
+}
+
+// StaleRules lists the stored approvals that were neither used nor added in
+// the last maxAge.
+func (store *Store) StaleRules(maxAge time.Duration) []StaleRule {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.staleRules(time.Now().Add(-maxAge))
+}
+
+func (store *Store) staleRules(cutoff time.Time) []StaleRule {
+	var stale []StaleRule
+	check := func(scope Scope, cmd string, origin *RuleOrigin) {
+		rule := StaleRule{Scope: scope, Command: cmd, LastUsed: store.usage[ruleKey{scope, cmd}]}
+		if origin != nil {
+			rule.Added = origin.Added
+		}
+		since := rule.LastUsed
+		if since.IsZero() {
+			since = rule.Added
+		}
+		if since.IsZero() || since.Before(store.usageSince) {
+			since = store.usageSince
+		}
+		if since.Before(cutoff) {
+			stale = append(stale, rule)
+		}
+	}
+	for scope, allowed := range store.rules {
+		if allowed.AllCommands {
+			check(scope, "", allowed.origin(""))
+			continue
+		}
+		for _, cmd := range append(append([]string{}, allowed.Commands...), allowed.Templates...) {
+			check(scope, cmd, allowed.origin(cmd))
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].Scope != stale[j].Scope {
+			return lessScope(stale[i].Scope, stale[j].Scope)
+		}
+		return stale[i].Command < stale[j].Command
+	})
+	return stale
+}
+
+// ExpireStaleRules removes the stored approvals listed by StaleRules, and
+// returns them.
+func (store *Store) ExpireStaleRules(maxAge time.Duration) ([]StaleRule, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	stale := store.staleRules(time.Now().Add(-maxAge))
+	for _, rule := range stale {
+		store.removeRule(rule.Scope, rule.Command)
+		delete(store.usage, ruleKey{rule.Scope, rule.Command})
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	if err := store.save(); err != nil {
+		return nil, err
+	}
+	return stale, store.saveUsage()
+}
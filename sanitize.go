@@ -0,0 +1,128 @@
+package guardianagent
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Characters which render like others, or not at all, and could make the
+// command or host name shown in a prompt differ from the real one: scripts
+// with letters looking like Latin ones, and look-alike forms of Latin letters
+// and digits.
+var confusableRunes = []*unicode.RangeTable{
+	unicode.Cyrillic, unicode.Greek, unicode.Armenian, unicode.Cherokee, unicode.Lisu,
+	unicode.Mn, unicode.Me, unicode.Cf, unicode.Zs, unicode.Zl, unicode.Zp,
+	{R16: []unicode.Range16{
+		{Lo: 0x0250, Hi: 0x02ff, Stride: 1}, // IPA extensions, modifier letters
+		{Lo: 0x0131, Hi: 0x0131, Stride: 1}, // dotless i
+		{Lo: 0x2100, Hi: 0x214f, Stride: 1}, // letterlike symbols
+		{Lo: 0x2460, Hi: 0x24ff, Stride: 1}, // enclosed alphanumerics
+		{Lo: 0xff00, Hi: 0xffef, Stride: 1}, // fullwidth and halfwidth forms
+	}, R32: []unicode.Range32{
+		{Lo: 0x1d400, Hi: 0x1d7ff, Stride: 1}, // mathematical alphanumerics
+	}},
+}
+
+// needsEscape reports whether r is not shown as is in prompts: control
+// characters (but newlines, which separate the lines of prompts), bidi
+// overrides and other invisible characters, and confusable ones.
+func needsEscape(r rune) bool {
+	if r == '\n' {
+		return false
+	}
+	if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+		return true
+	}
+	if r == ' ' {
+		return false
+	}
+	return r >= 0x80 && unicode.IsOneOf(confusableRunes, r)
+}
+
+// sanitizeDisplay escapes backslashes as \\, and the characters of s which
+// could make what a prompt shows differ from what it is about (see
+// needsEscape), and invalid UTF-8, as \xNN, \uNNNN or \UNNNNNNNN, so that
+// what the client sent cannot look like an escape.
+func sanitizeDisplay(s string) string {
+	return escapeDisplay(s, true)
+}
+
+// sanitizeEscaped escapes s like sanitizeDisplay, but for backslashes: s is
+// a prompt or message whose values from requests were escaped already (with
+// displayLine), and must not be escaped twice.
+func sanitizeEscaped(s string) string {
+	return escapeDisplay(s, false)
+}
+
+func escapeDisplay(s string, backslashes bool) string {
+	if !needsSanitizing(s) && !(backslashes && strings.Contains(s, `\`)) {
+		return s
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&buf, `\x%02x`, s[i])
+		case r == '\\' && backslashes:
+			buf.WriteString(`\\`)
+		case !needsEscape(r):
+			buf.WriteRune(r)
+		case r < 0x80:
+			fmt.Fprintf(&buf, `\x%02x`, r)
+		case r <= 0xffff:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		default:
+			fmt.Fprintf(&buf, `\U%08x`, r)
+		}
+		i += size
+	}
+	return buf.String()
+}
+
+// displayLine escapes s, a value from a request shown within a line of a
+// prompt or message, with sanitizeDisplay, and its newlines as \n, so that it
+// cannot pass for further lines.
+func displayLine(s string) string {
+	return strings.Replace(sanitizeDisplay(s), "\n", `\n`, -1)
+}
+
+// displayScope escapes the fields of scope with displayLine, for showing.
+func displayScope(scope Scope) Scope {
+	scope.Client = displayLine(scope.Client)
+	scope.ServiceUsername = displayLine(scope.ServiceUsername)
+	scope.ServiceHostname = displayLine(scope.ServiceHostname)
+	return scope
+}
+
+func sanitizeAllEscaped(list []string) []string {
+	sanitized := make([]string, len(list))
+	for i, s := range list {
+		sanitized[i] = sanitizeEscaped(s)
+	}
+	return sanitized
+}
+
+func needsSanitizing(s string) bool {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || needsEscape(r) {
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+// describeEscapes warns approvers if the request shows escaped characters, so
+// that they are not mistaken for what the client typed.
+func describeEscapes(scope Scope, cmd string) string {
+	for _, s := range []string{cmd, scope.Client, scope.ServiceUsername, scope.ServiceHostname} {
+		if strings.Contains(s, "\n") || needsSanitizing(s) {
+			return "\n  (!) The request contains control, invisible or look-alike characters, shown escaped (\\x.., \\u....)"
+		}
+	}
+	return ""
+}
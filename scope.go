@@ -1,7 +1,7 @@
 package guardianagent
 
 type Scope struct {
-	Client          string `json:"Client"`
-	ServiceUsername string `json:"ServiceUsername"`
-	ServiceHostname string `json:"ServiceHostname"`
+	Client          string `json:"Client" yaml:"client,omitempty"`
+	ServiceUsername string `json:"ServiceUsername" yaml:"user,omitempty"`
+	ServiceHostname string `json:"ServiceHostname" yaml:"host,omitempty"`
 }
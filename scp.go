@@ -0,0 +1,97 @@
+package guardianagent
+
+import (
+	"path"
+	"strings"
+)
+
+// SCPCommand is the remote side of an scp transfer, e.g. "scp -t -- /tmp".
+type SCPCommand struct {
+	Direction string
+	Path      string
+	Recursive bool
+}
+
+// ParseSCPCommand recognizes the commands scp runs on the server: "-t" for
+// uploads ("to") and "-f" for downloads ("from").
+func ParseSCPCommand(cmd string) (*SCPCommand, bool) {
+	args := strings.Fields(cmd)
+	if len(args) < 2 || path.Base(args[0]) != "scp" {
+		return nil, false
+	}
+	scp := &SCPCommand{}
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "--"; i++ {
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 't':
+				scp.Direction = TransferUpload
+			case 'f':
+				scp.Direction = TransferDownload
+			case 'r':
+				scp.Recursive = true
+			case 'd', 'p', 'v', 'q':
+			default:
+				return nil, false
+			}
+		}
+	}
+	if i < len(args) && args[i] == "--" {
+		i++
+	}
+	// Paths with spaces can't be told apart from multiple arguments.
+	if scp.Direction == "" || i != len(args)-1 {
+		return nil, false
+	}
+	scp.Path = unquoteSCPPath(args[i])
+	return scp, true
+}
+
+func unquoteSCPPath(p string) string {
+	if len(p) >= 2 && (p[0] == '\'' || p[0] == '"') && p[len(p)-1] == p[0] {
+		return p[1 : len(p)-1]
+	}
+	return p
+}
+
+func (scp *SCPCommand) Transfer() *Transfer {
+	return &Transfer{Tool: "SCP", Direction: scp.Direction, Paths: []string{scp.Path}}
+}
+
+// SCPRemote is a remote operand of scp, "[user@]host:[path]".
+type SCPRemote struct {
+	UserHost string
+	Path     string
+}
+
+// ParseSCPOperand tells remote operands of scp from local paths as scp
+// does: they have a colon before any slash, and IPv6 hosts are in brackets.
+// scp:// URIs are not recognized.
+func ParseSCPOperand(arg string) (*SCPRemote, bool) {
+	if arg == "" || arg[0] == ':' {
+		return nil, false
+	}
+	bracketed := arg[0] == '['
+	for i := 0; i < len(arg); i++ {
+		switch {
+		case arg[i] == '@' && i+1 < len(arg) && arg[i+1] == '[':
+			bracketed = true
+		case arg[i] == ']' && i+1 < len(arg) && arg[i+1] == ':' && bracketed:
+			return newSCPRemote(arg[:i+1], arg[i+2:]), true
+		case arg[i] == ':' && !bracketed:
+			return newSCPRemote(arg[:i], arg[i+1:]), true
+		case arg[i] == '/':
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func newSCPRemote(userHost string, p string) *SCPRemote {
+	userHost = strings.Replace(strings.Replace(userHost, "@[", "@", 1), "]", "", 1)
+	userHost = strings.TrimPrefix(userHost, "[")
+	if p == "" {
+		p = "."
+	}
+	return &SCPRemote{UserHost: userHost, Path: p}
+}
@@ -0,0 +1,116 @@
+package guardianagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between checks of the screen lock while prompts are deferred.
+const screenLockPollInterval = 2 * time.Second
+
+var errScreenLocked = errors.New("the screen stayed locked")
+
+// ScreenLock tells whether the approver's desktop session is locked, so that
+// prompts are not shown on the lock screen.
+type ScreenLock struct {
+	// Prompts deferred for longer than this are given up on, if set.
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	locked  bool
+}
+
+func NewScreenLock(maxWait time.Duration) *ScreenLock {
+	return &ScreenLock{maxWait: maxWait}
+}
+
+// Locked reports whether the screen is locked. The answer is cached briefly,
+// since all deferred prompts ask.
+func (lock *ScreenLock) Locked() bool {
+	if lock == nil {
+		return false
+	}
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	if time.Since(lock.checked) < screenLockPollInterval/2 {
+		return lock.locked
+	}
+	locked, err := screenLocked()
+	if err != nil {
+		log.Printf("Failed to check whether the screen is locked: %s", err)
+	}
+	lock.locked, lock.checked = locked, time.Now()
+	return locked
+}
+
+// Wait waits until the screen is unlocked. It returns errScreenLocked if it
+// stays locked for longer than the maximum wait, and ctx.Err() if ctx is
+// canceled meanwhile.
+func (lock *ScreenLock) Wait(ctx context.Context) error {
+	start := time.Now()
+	for lock.Locked() {
+		if lock.maxWait > 0 && time.Since(start) > lock.maxWait {
+			return errScreenLocked
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(screenLockPollInterval):
+		}
+	}
+	return nil
+}
+
+func screenLocked() (bool, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return logindLocked()
+	case "darwin":
+		return quartzLocked()
+	}
+	return false, nil
+}
+
+// logindLocked asks systemd-logind whether the graphical session is locked.
+func logindLocked() (bool, error) {
+	session := os.Getenv("XDG_SESSION_ID")
+	if session == "" {
+		// Outside the session, e.g. in a service, use the user's display
+		// session.
+		u, err := user.Current()
+		if err != nil {
+			return false, err
+		}
+		out, err := exec.Command("loginctl", "show-user", u.Uid, "--property=Display", "--value").Output()
+		if err != nil {
+			return false, fmt.Errorf("loginctl: %s", err)
+		}
+		if session = strings.TrimSpace(string(out)); session == "" {
+			return false, nil
+		}
+	}
+	out, err := exec.Command("loginctl", "show-session", session, "--property=LockedHint", "--value").Output()
+	if err != nil {
+		return false, fmt.Errorf("loginctl: %s", err)
+	}
+	return strings.TrimSpace(string(out)) == "yes", nil
+}
+
+// quartzLocked looks for the lock flag of the Quartz console session.
+func quartzLocked() (bool, error) {
+	out, err := exec.Command("ioreg", "-n", "Root", "-d1").Output()
+	if err != nil {
+		return false, fmt.Errorf("ioreg: %s", err)
+	}
+	return strings.Contains(string(out), `"CGSSessionScreenIsLocked"=Yes`), nil
+}
@@ -5,8 +5,9 @@
 
 # Set environment variables overriding the ssh program
 export RSYNC_RSH=sga-ssh
-export GIT_SSH_COMMAND=sga-ssh
+export GIT_SSH_COMMAND=sga-git-ssh
 
 # For tools not providing environment variables, set aliases
 alias mosh="mosh --ssh=sga-ssh"
-alias scp="scp -S sga-ssh"
+alias scp="sga-scp"
+alias sftp="sga-sftp"
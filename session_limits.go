@@ -0,0 +1,189 @@
+package guardianagent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Label of the goroutines serving a session, by which they are counted.
+// Goroutines inherit the labels of the goroutine starting them, so those of
+// the session's multiplexer and SSH proxy are counted too.
+const sessionLabel = "sga-session"
+
+// The streams a client opens for a session: control, SSH data and transport.
+const sessionStreams = 3
+
+// yamux refuses smaller stream windows.
+const minStreamWindow = 256 * 1024
+
+// How often the goroutines of sessions are counted to enforce MaxGoroutines.
+const sessionLimitInterval = time.Second
+
+// SessionLimits caps the resources the guardian spends on each session while
+// it proxies it, so that one misbehaving session cannot starve the prompts of
+// the others. Sessions exceeding a cap are terminated. Zero means no cap.
+type SessionLimits struct {
+	// Goroutines serving the session.
+	MaxGoroutines int
+
+	// Bytes buffered for the session's streams, rounded up to what the
+	// multiplexer supports (768 KiB).
+	MaxMemory int64
+
+	// Bytes relayed to and from the server before the handoff.
+	MaxBytes int64
+}
+
+// SessionResources is the resource usage of a session.
+type SessionResources struct {
+	ID         uint64
+	RequestID  string
+	Client     string
+	State      string
+	Goroutines int
+	Streams    int
+
+	// Upper bound of the bytes buffered for the session's streams.
+	Memory int64
+
+	BytesToServer   int64
+	BytesFromServer int64
+}
+
+// SessionDebug is the resource usage of the guardian and its sessions.
+type SessionDebug struct {
+	Goroutines int
+	HeapAlloc  uint64
+	Limits     SessionLimits
+	Sessions   []SessionResources
+}
+
+var (
+	goroutineStackSyntax = regexp.MustCompile(`^(\d+) @`)
+	sessionLabelSyntax   = regexp.MustCompile(`"` + sessionLabel + `":"(\d+)"`)
+)
+
+// sessionGoroutines counts the goroutines of each session, by ID, from their
+// labels in the goroutine profile.
+func sessionGoroutines() map[uint64]int {
+	var buf bytes.Buffer
+	counts := make(map[uint64]int)
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		log.Printf("Failed to count goroutines: %s", err)
+		return counts
+	}
+	stacks := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if m := goroutineStackSyntax.FindStringSubmatch(line); m != nil {
+			stacks, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if m := sessionLabelSyntax.FindStringSubmatch(line); m != nil {
+			id, _ := strconv.ParseUint(m[1], 10, 64)
+			counts[id] += stacks
+		}
+	}
+	return counts
+}
+
+// yamuxConfig returns the multiplexer configuration of sessions, which only
+// accepts the streams of a session and bounds their buffers.
+func (limits SessionLimits) yamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.AcceptBacklog = sessionStreams
+	if limits.MaxMemory > 0 {
+		window := limits.MaxMemory / sessionStreams
+		if window < minStreamWindow {
+			window = minStreamWindow
+		}
+		config.MaxStreamWindowSize = uint32(window)
+	}
+	return config
+}
+
+// SetSessionLimits caps the resources of each session.
+func (agent *Agent) SetSessionLimits(limits SessionLimits) {
+	agent.sessionLimits = limits
+	if limits.MaxGoroutines > 0 {
+		go agent.enforceSessionLimits()
+	}
+}
+
+func (agent *Agent) enforceSessionLimits() {
+	for range time.Tick(sessionLimitInterval) {
+		counts := sessionGoroutines()
+		killed := agent.policy.Sessions.killWith(func(session *Session) bool {
+			return counts[session.ID] > agent.sessionLimits.MaxGoroutines
+		}, func(session *Session) error {
+			return fmt.Errorf("exceeded the limit of %d goroutines (%d)", agent.sessionLimits.MaxGoroutines, counts[session.ID])
+		})
+		for _, session := range killed {
+			log.Printf("Terminated session %d: %s", session.ID, session.Error)
+			agent.policy.Audit.forRequest(session.RequestID).Record(AuditEventHandoff, session.Scope, session.Command, "terminated",
+				"session "+session.Error)
+		}
+	}
+}
+
+// SessionDebug returns the resource usage of the active sessions.
+func (agent *Agent) SessionDebug() SessionDebug {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	debug := SessionDebug{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		Limits:     agent.sessionLimits,
+		Sessions:   []SessionResources{},
+	}
+	counts := sessionGoroutines()
+	sessions := agent.policy.Sessions
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	for _, session := range sessions.sessions {
+		if !session.active() {
+			continue
+		}
+		resources := SessionResources{
+			ID:              session.ID,
+			RequestID:       session.RequestID,
+			Client:          session.Scope.Client,
+			State:           session.State,
+			Goroutines:      counts[session.ID],
+			BytesToServer:   atomic.LoadInt64(&session.BytesToServer),
+			BytesFromServer: atomic.LoadInt64(&session.BytesFromServer),
+		}
+		if session.streams != nil {
+			resources.Streams = session.streams()
+			resources.Memory = int64(resources.Streams) * session.streamWindow
+		}
+		debug.Sessions = append(debug.Sessions, resources)
+	}
+	return debug
+}
+
+// setStreams lets the resource usage of session be accounted from its
+// multiplexer.
+func (sessions *Sessions) setStreams(session *Session, ymux *yamux.Session, config *yamux.Config) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	session.streams = ymux.NumStreams
+	session.streamWindow = int64(config.MaxStreamWindowSize)
+}
+
+// errSessionBytes fails the connection to the server of a session that
+// relayed more than its limit.
+type errSessionBytes int64
+
+func (limit errSessionBytes) Error() string {
+	return fmt.Sprintf("exceeded the limit of %d bytes relayed before the handoff", int64(limit))
+}
@@ -0,0 +1,268 @@
+package guardianagent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of a session, as seen by the guardian:
+//
+//   negotiating      approved, waiting for the client to open its streams
+//   proxying         authenticating to the server and starting the command
+//   handoff-pending  proxying done, telling the client where to take over
+//   handed-off       the client talks to the server directly (final)
+//   failed           the session ended before the handoff (final)
+const (
+	SessionNegotiating    = "negotiating"
+	SessionProxying       = "proxying"
+	SessionHandoffPending = "handoff-pending"
+	SessionHandedOff      = "handed-off"
+	SessionFailed         = "failed"
+)
+
+// sessionTransitions lists the states each state may move to. Final states
+// have none.
+var sessionTransitions = map[string][]string{
+	SessionNegotiating:    {SessionProxying, SessionFailed},
+	SessionProxying:       {SessionHandoffPending, SessionFailed},
+	SessionHandoffPending: {SessionHandedOff, SessionFailed},
+}
+
+// How long sessions stay listed after reaching a final state.
+const finishedSessionRetention = 5 * time.Minute
+
+// Session is a delegated command, from its approval until the handoff of the
+// SSH session to the client.
+type Session struct {
+	ID        uint64
+	RequestID string
+	Listener  string
+	Scope     Scope
+	Command   string
+	Started   time.Time
+	State     string
+	Ended     time.Time `json:",omitempty"`
+
+	// Why the session failed.
+	Error string `json:",omitempty"`
+
+	// Bytes relayed to and from the server, updated atomically.
+	BytesToServer   int64
+	BytesFromServer int64
+
+	// kill closes the client's connection, ending the session.
+	kill func() error
+
+	// The number of streams of the session's multiplexer, and the size of
+	// their windows, once it is started (see setStreams).
+	streams      func() int
+	streamWindow int64
+}
+
+func (session *Session) active() bool {
+	return len(sessionTransitions[session.State]) > 0
+}
+
+// Sessions tracks the sessions, so that they can be listed and terminated.
+type Sessions struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*Session
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{sessions: make(map[uint64]*Session)}
+}
+
+func (sessions *Sessions) add(session *Session) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sessions.nextID++
+	session.ID = sessions.nextID
+	session.Started = time.Now()
+	session.State = SessionNegotiating
+	sessions.sessions[session.ID] = session
+	log.Printf("%s Session %d: %s", requestTag(session.RequestID, session.Scope), session.ID, session.State)
+}
+
+// transition moves session to state, and fails if that is not a valid
+// transition. Sessions reaching a final state are forgotten after a while.
+func (sessions *Sessions) transition(session *Session, state string, cause error) error {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	valid := false
+	for _, next := range sessionTransitions[session.State] {
+		valid = valid || next == state
+	}
+	if !valid {
+		return fmt.Errorf("Invalid session transition %s -> %s", session.State, state)
+	}
+	log.Printf("%s Session %d: %s -> %s", requestTag(session.RequestID, session.Scope), session.ID, session.State, state)
+	session.State = state
+	if cause != nil {
+		session.Error = cause.Error()
+	}
+	if !session.active() {
+		session.Ended = time.Now()
+		time.AfterFunc(finishedSessionRetention, func() {
+			sessions.mu.Lock()
+			defer sessions.mu.Unlock()
+			delete(sessions.sessions, session.ID)
+		})
+	}
+	return nil
+}
+
+// finish fails the session, unless it already reached a final state.
+func (sessions *Sessions) finish(session *Session, cause error) {
+	sessions.mu.Lock()
+	active, state := session.active(), session.State
+	sessions.mu.Unlock()
+	if active {
+		if cause == nil {
+			cause = fmt.Errorf("session ended while %s", state)
+		}
+		sessions.transition(session, SessionFailed, cause)
+	}
+}
+
+// Count returns the number of active sessions.
+func (sessions *Sessions) Count() int {
+	return sessions.count(func(session *Session) bool { return true })
+}
+
+// CountClient returns the number of active sessions of client.
+func (sessions *Sessions) CountClient(client string) int {
+	return sessions.count(func(session *Session) bool { return session.Scope.Client == client })
+}
+
+func (sessions *Sessions) count(match func(*Session) bool) int {
+	if sessions == nil {
+		return 0
+	}
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	count := 0
+	for _, session := range sessions.sessions {
+		if session.active() && match(session) {
+			count++
+		}
+	}
+	return count
+}
+
+// List returns a snapshot of the active and recently finished sessions,
+// oldest first.
+func (sessions *Sessions) List() []Session {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	list := make([]Session, 0, len(sessions.sessions))
+	for _, session := range sessions.sessions {
+		list = append(list, session.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Kill terminates the active session with the given ID.
+func (sessions *Sessions) Kill(id uint64) (Session, error) {
+	killed := sessions.kill(func(session *Session) bool { return session.ID == id })
+	if len(killed) == 0 {
+		return Session{}, fmt.Errorf("no active session %d", id)
+	}
+	return killed[0], nil
+}
+
+// KillClient terminates all active sessions of the given client.
+func (sessions *Sessions) KillClient(client string) []Session {
+	return sessions.kill(func(session *Session) bool { return session.Scope.Client == client })
+}
+
+// KillAll terminates all active sessions.
+func (sessions *Sessions) KillAll() []Session {
+	return sessions.kill(func(session *Session) bool { return true })
+}
+
+func (sessions *Sessions) kill(match func(*Session) bool) []Session {
+	return sessions.killWith(match, func(*Session) error { return fmt.Errorf("terminated") })
+}
+
+// killWith terminates the active sessions that match, failing them with the
+// cause returned for each.
+func (sessions *Sessions) killWith(match func(*Session) bool, cause func(*Session) error) []Session {
+	sessions.mu.Lock()
+	var killed []*Session
+	for _, session := range sessions.sessions {
+		if session.active() && match(session) {
+			killed = append(killed, session)
+		}
+	}
+	sessions.mu.Unlock()
+
+	var list []Session
+	for _, session := range killed {
+		// The session may have been handed off in the meantime.
+		if sessions.transition(session, SessionFailed, cause(session)) != nil {
+			continue
+		}
+		session.kill()
+		sessions.mu.Lock()
+		list = append(list, session.snapshot())
+		sessions.mu.Unlock()
+	}
+	return list
+}
+
+func (session *Session) snapshot() Session {
+	return Session{
+		ID:              session.ID,
+		RequestID:       session.RequestID,
+		Listener:        session.Listener,
+		Scope:           session.Scope,
+		Command:         session.Command,
+		Started:         session.Started,
+		State:           session.State,
+		Ended:           session.Ended,
+		Error:           session.Error,
+		BytesToServer:   atomic.LoadInt64(&session.BytesToServer),
+		BytesFromServer: atomic.LoadInt64(&session.BytesFromServer),
+	}
+}
+
+// sessionConn counts the bytes relayed over a connection to the server, and
+// fails once they exceed limit, if set.
+type sessionConn struct {
+	net.Conn
+	session *Session
+	limit   int64
+}
+
+func (conn *sessionConn) Read(p []byte) (int, error) {
+	if err := conn.checkLimit(); err != nil {
+		return 0, err
+	}
+	n, err := conn.Conn.Read(p)
+	atomic.AddInt64(&conn.session.BytesFromServer, int64(n))
+	return n, err
+}
+
+func (conn *sessionConn) Write(p []byte) (int, error) {
+	if err := conn.checkLimit(); err != nil {
+		return 0, err
+	}
+	n, err := conn.Conn.Write(p)
+	atomic.AddInt64(&conn.session.BytesToServer, int64(n))
+	return n, err
+}
+
+func (conn *sessionConn) checkLimit() error {
+	if conn.limit > 0 && atomic.LoadInt64(&conn.session.BytesToServer)+atomic.LoadInt64(&conn.session.BytesFromServer) > conn.limit {
+		return errSessionBytes(conn.limit)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package guardianagent
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultSFTPServer is where OpenSSH installs the sftp server on Debian
+// and its derivatives.
+const DefaultSFTPServer = "/usr/lib/openssh/sftp-server"
+
+// ParseSFTPCommand recognizes the sftp server. Since sessions through the
+// guardian run commands, sga-sftp runs the server by its path rather than
+// as the sftp subsystem.
+func ParseSFTPCommand(cmd string) bool {
+	args := strings.Fields(cmd)
+	return len(args) > 0 && strings.Contains(args[0], "/") && path.Base(args[0]) == "sftp-server"
+}
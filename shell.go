@@ -0,0 +1,60 @@
+package guardianagent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Duration offered for interactive shell sessions.
+const defaultShellDuration = time.Hour
+
+// shellCommand runs the login shell of the user on the server for at most d,
+// hanging it up once the time is up. It needs the timeout of GNU coreutils.
+func shellCommand(d time.Duration) string {
+	return fmt.Sprintf(`exec timeout --foreground -s HUP -k 10 %d "${SHELL:-/bin/sh}" -l`, int64(d/time.Second))
+}
+
+// approveShell asks the approver of an interactive shell session for its
+// purpose and maximum duration, which are audited, and returns the command
+// running the shell for that long. Shell approvals are otherwise
+// indistinguishable from the approval of any command.
+func (policy *Policy) approveShell(ctx context.Context, audit requestAudit, scope Scope, meta RequestMetadata, by string) (string, error) {
+	ask := func(msg string, text string) (string, error) {
+		answer, err := policy.UI.Edit(ctx, msg, text)
+		if ctx.Err() != nil {
+			return "", policy.withdraw(audit, scope, "")
+		}
+		if err != nil {
+			audit.Record(AuditEventError, scope, "", "", err.Error())
+			return "", fmt.Errorf("Failed to get user approval: %s", err)
+		}
+		return strings.TrimSpace(answer), nil
+	}
+	shown := displayScope(scope)
+	purpose, err := ask(fmt.Sprintf("Purpose of the shell session of %s on %s@%s:",
+		shown.Client, shown.ServiceUsername, shown.ServiceHostname), meta.Reason)
+	if err != nil {
+		return "", err
+	}
+	if purpose == "" {
+		audit.Record(AuditEventDecision, scope, "", "denied", "no purpose given for the shell session")
+		return "", deny(DenialUser, "User gave no purpose for the shell session")
+	}
+	answer, err := ask("Maximum duration of the shell session (e.g. 30m, 2h):", defaultShellDuration.String())
+	if err != nil {
+		return "", err
+	}
+	d, err := time.ParseDuration(answer)
+	if err != nil || d < time.Second {
+		audit.Record(AuditEventDecision, scope, "", "denied", fmt.Sprintf("invalid shell session duration %q", answer))
+		return "", deny(DenialUser, "User gave an invalid duration for the shell session")
+	}
+
+	cmd := shellCommand(d)
+	policy.UI.Inform(fmt.Sprintf("Shell session of %s on %s@%s APPROVED by %s for %s: %s",
+		scope.Client, scope.ServiceUsername, scope.ServiceHostname, by, d, purpose))
+	audit.Record(AuditEventDecision, scope, cmd, "approved", fmt.Sprintf("shell session for %s, purpose: %s", d, purpose))
+	return cmd, nil
+}
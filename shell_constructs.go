@@ -0,0 +1,224 @@
+package guardianagent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of shell constructs which change what a command does beyond its
+// arguments, and which approvers could overlook. Policy rules can match
+// commands containing them (see PolicyRule.Metacharacters), and prompts
+// highlight them.
+const (
+	// Redirections of input or output, e.g. "> /etc/hosts" or "2>&1".
+	ShellRedirection = "redirection"
+
+	// Command substitutions ("$(...)" and backticks) and process
+	// substitutions ("<(...)" and ">(...)").
+	ShellSubstitution = "substitution"
+
+	// Commands run in the background with "&".
+	ShellBackground = "background"
+
+	// Here-documents ("<<") and here-strings ("<<<").
+	ShellHeredoc = "heredoc"
+
+	// Any of the above, in policy rules.
+	ShellAny = "any"
+)
+
+var shellConstructKinds = []string{ShellRedirection, ShellSubstitution, ShellBackground, ShellHeredoc}
+
+// ShellConstruct is a construct found in a command.
+type ShellConstruct struct {
+	Kind string
+
+	// The construct as written, e.g. "> /etc/hosts".
+	Text string
+}
+
+// FindShellConstructs returns the shell constructs of cmd, honoring quotes:
+// only substitutions are found within double quotes, and nothing within
+// single quotes.
+func FindShellConstructs(cmd string) []ShellConstruct {
+	var constructs []ShellConstruct
+	add := func(kind string, start int, end int) {
+		constructs = append(constructs, ShellConstruct{Kind: kind, Text: strings.TrimSpace(cmd[start:end])})
+	}
+	var quote byte
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '$' && strings.HasPrefix(cmd[i:], "$(("):
+			// Arithmetic expansions only compute.
+			i = closingParen(cmd, i+1)
+		case c == '$' && strings.HasPrefix(cmd[i:], "$("):
+			end := closingParen(cmd, i+1)
+			add(ShellSubstitution, i, end+1)
+			i = end
+		case c == '`':
+			end := strings.IndexByte(cmd[i+1:], '`')
+			if end < 0 {
+				end = len(cmd) - 1
+			} else {
+				end += i + 1
+			}
+			add(ShellSubstitution, i, end+1)
+			i = end
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case (c == '<' || c == '>') && strings.HasPrefix(cmd[i+1:], "("):
+			end := closingParen(cmd, i+1)
+			add(ShellSubstitution, i, end+1)
+			i = end
+		case strings.HasPrefix(cmd[i:], "<<"):
+			start := i
+			i += 2
+			for i < len(cmd) && (cmd[i] == '<' || cmd[i] == '-') {
+				i++
+			}
+			end := shellWordEnd(cmd, i)
+			add(ShellHeredoc, start, end)
+			i = end - 1
+		case c == '<' || c == '>' || (c == '&' && strings.HasPrefix(cmd[i+1:], ">")):
+			start := i
+			// File descriptors, as in "2>".
+			for start > 0 && cmd[start-1] >= '0' && cmd[start-1] <= '9' {
+				start--
+			}
+			if start > 0 && cmd[start-1] != ' ' && cmd[start-1] != '\t' {
+				start = i
+			}
+			i++
+			for i < len(cmd) && strings.IndexByte("<>&|", cmd[i]) >= 0 {
+				i++
+			}
+			end := shellWordEnd(cmd, i)
+			add(ShellRedirection, start, end)
+			i = end - 1
+		case c == '&':
+			if strings.HasPrefix(cmd[i+1:], "&") {
+				i++
+				continue
+			}
+			add(ShellBackground, i, i+1)
+		case c == '|' && strings.HasPrefix(cmd[i+1:], "&"):
+			// "|&" pipes standard error too.
+			add(ShellRedirection, i, i+2)
+			i++
+		}
+	}
+	return constructs
+}
+
+// closingParen returns the index of the parenthesis closing the one at open,
+// or of the last byte of cmd if there is none.
+func closingParen(cmd string, open int) int {
+	depth := 0
+	for i := open; i < len(cmd); i++ {
+		switch cmd[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(cmd) - 1
+}
+
+// shellWordEnd returns where the word starting at (or after blanks from) i
+// ends.
+func shellWordEnd(cmd string, i int) int {
+	for i < len(cmd) && (cmd[i] == ' ' || cmd[i] == '\t') {
+		i++
+	}
+	var quote byte
+	for ; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '\\':
+			i++
+		case strings.IndexByte(" \t\n;|&<>()", c) >= 0:
+			return i
+		}
+	}
+	return len(cmd)
+}
+
+// hasShellConstructs reports whether cmd contains a shell construct of any of
+// kinds.
+func hasShellConstructs(cmd string, kinds []string) bool {
+	for _, construct := range FindShellConstructs(cmd) {
+		if containsString(kinds, ShellAny) || containsString(kinds, construct.Kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeShellConstructs flags the shell constructs of cmd for approvers, and
+// returns them for highlighting.
+func describeShellConstructs(cmd string) (string, []string) {
+	constructs := FindShellConstructs(cmd)
+	if len(constructs) == 0 {
+		return "", nil
+	}
+	var descs, texts []string
+	for _, construct := range constructs {
+		text := displayLine(construct.Text)
+		descs = append(descs, fmt.Sprintf("%s '%s'", construct.Kind, text))
+		texts = append(texts, text)
+	}
+	return "\n  (!) Shell constructs: " + strings.Join(descs, ", "), texts
+}
+
+// highlight wraps the occurrences of highlights in text with start and end,
+// e.g. terminal escape sequences.
+func highlight(text string, highlights []string, start string, end string) string {
+	marked := make([]bool, len(text))
+	for _, h := range highlights {
+		if h == "" {
+			continue
+		}
+		for i := 0; i+len(h) <= len(text); {
+			j := strings.Index(text[i:], h)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(h); k++ {
+				marked[k] = true
+			}
+			i += j + len(h)
+		}
+	}
+	var buf strings.Builder
+	for i := 0; i < len(text); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			buf.WriteString(start)
+		}
+		buf.WriteByte(text[i])
+		if marked[i] && (i == len(text)-1 || !marked[i+1]) {
+			buf.WriteString(end)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,398 @@
+package guardianagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// AuditSink receives a copy of every entry written to the audit log.
+type AuditSink interface {
+	Send(entry AuditEntry)
+	Close() error
+}
+
+// AddSink forwards all subsequent audit entries to sink.
+func (audit *AuditLog) AddSink(sink AuditSink) {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	audit.sinks = append(audit.sinks, sink)
+}
+
+// RemoveSink stops forwarding audit entries to sink, and closes it.
+func (audit *AuditLog) RemoveSink(sink AuditSink) error {
+	audit.mu.Lock()
+	for i, s := range audit.sinks {
+		if s == sink {
+			audit.sinks = append(audit.sinks[:i:i], audit.sinks[i+1:]...)
+			break
+		}
+	}
+	audit.mu.Unlock()
+	return sink.Close()
+}
+
+const (
+	auditSinkQueueSize = 1024
+	auditSinkBatchSize = 128
+	auditSinkTimeout   = 10 * time.Second
+)
+
+// NewAuditSink creates a SIEM sink from a spec of the form
+// <format>+<destination>, where format is "cef" (ArcSight Common Event Format)
+// or "ecs" (Elastic Common Schema JSON), and destination is a file:// path, a
+// tcp://host:port address, or an http(s):// URL. ECS documents sent over HTTP
+// use the Elasticsearch bulk API format.
+func NewAuditSink(spec string) (AuditSink, error) {
+	parts := strings.SplitN(spec, "+", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid audit sink %q, expected <format>+<destination>", spec)
+	}
+	var format auditFormatter
+	switch parts[0] {
+	case "cef":
+		format = formatCEF
+	case "ecs":
+		format = formatECS
+	default:
+		return nil, fmt.Errorf("unknown audit sink format: %s", parts[0])
+	}
+	dest, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit sink destination %s: %s", parts[1], err)
+	}
+
+	var writer batchWriter
+	switch dest.Scheme {
+	case "file":
+		writer = &streamWriter{format: format, dial: func() (io.WriteCloser, error) {
+			return os.OpenFile(dest.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		}}
+	case "tcp":
+		writer = &streamWriter{format: format, dial: func() (io.WriteCloser, error) {
+			return net.DialTimeout("tcp", dest.Host, auditSinkTimeout)
+		}}
+	case "http", "https":
+		writer = &httpWriter{format: format, url: dest.String(), bulk: parts[0] == "ecs"}
+	default:
+		return nil, fmt.Errorf("unsupported audit sink destination: %s", parts[1])
+	}
+	return newAsyncSink(spec, writer), nil
+}
+
+type auditFormatter func(entry *AuditEntry) ([]byte, error)
+
+type batchWriter interface {
+	writeBatch(entries []AuditEntry) error
+	close() error
+}
+
+// asyncSink decouples slow or unreachable SIEM endpoints from the approval
+// path. Entries are dropped (and the loss logged) if the queue fills up.
+type asyncSink struct {
+	name   string
+	writer batchWriter
+	queue  chan AuditEntry
+	done   chan struct{}
+}
+
+func newAsyncSink(name string, writer batchWriter) *asyncSink {
+	sink := &asyncSink{
+		name:   name,
+		writer: writer,
+		queue:  make(chan AuditEntry, auditSinkQueueSize),
+		done:   make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (sink *asyncSink) Send(entry AuditEntry) {
+	select {
+	case sink.queue <- entry:
+	default:
+		log.Printf("Audit sink %s is not keeping up, dropped entry %d", sink.name, entry.Seq)
+	}
+}
+
+func (sink *asyncSink) run() {
+	defer close(sink.done)
+	for entry := range sink.queue {
+		batch := []AuditEntry{entry}
+	collect:
+		for len(batch) < auditSinkBatchSize {
+			select {
+			case next, ok := <-sink.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		if err := sink.writer.writeBatch(batch); err != nil {
+			log.Printf("Failed to send %d audit entries to %s: %s", len(batch), sink.name, err)
+		}
+	}
+}
+
+func (sink *asyncSink) Close() error {
+	close(sink.queue)
+	<-sink.done
+	return sink.writer.close()
+}
+
+type streamWriter struct {
+	format auditFormatter
+	dial   func() (io.WriteCloser, error)
+	w      io.WriteCloser
+}
+
+func (sw *streamWriter) writeBatch(entries []AuditEntry) (err error) {
+	if sw.w == nil {
+		if sw.w, err = sw.dial(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	for i := range entries {
+		line, err := sw.format(&entries[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err = sw.w.Write(buf.Bytes()); err != nil {
+		// Reconnect on the next batch.
+		sw.w.Close()
+		sw.w = nil
+	}
+	return err
+}
+
+func (sw *streamWriter) close() error {
+	if sw.w == nil {
+		return nil
+	}
+	return sw.w.Close()
+}
+
+type httpWriter struct {
+	format auditFormatter
+	url    string
+	bulk   bool
+}
+
+func (hw *httpWriter) writeBatch(entries []AuditEntry) error {
+	var buf bytes.Buffer
+	for i := range entries {
+		doc, err := hw.format(&entries[i])
+		if err != nil {
+			return err
+		}
+		if hw.bulk {
+			buf.WriteString(`{"index":{}}` + "\n")
+		}
+		buf.Write(doc)
+		buf.WriteByte('\n')
+	}
+	contentType := "text/plain"
+	if hw.bulk {
+		contentType = "application/x-ndjson"
+	}
+	client := http.Client{Timeout: auditSinkTimeout}
+	resp, err := client.Post(hw.url, contentType, &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", hw.url, resp.Status)
+	}
+	return nil
+}
+
+func (hw *httpWriter) close() error {
+	return nil
+}
+
+func auditSeverity(entry *AuditEntry) int {
+	switch {
+	case entry.Event == AuditEventError:
+		return 7
+	case entry.Event == AuditEventDecision && entry.Command == "" && entry.Decision != "denied":
+		// Any command was allowed on the server.
+		return 6
+	case entry.Decision == "denied":
+		return 5
+	case entry.Event == AuditEventDecision:
+		return 3
+	default:
+		return 1
+	}
+}
+
+func auditOutcome(entry *AuditEntry) string {
+	switch entry.Decision {
+	case "":
+		return "unknown"
+	case "denied", "failed":
+		return "failure"
+	default:
+		return "success"
+	}
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+func formatCEF(entry *AuditEntry) ([]byte, error) {
+	name := entry.Event
+	if entry.Decision != "" {
+		name += " " + entry.Decision
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CEF:0|StanfordSNR|guardian-agent|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(Version), cefHeaderEscaper.Replace(entry.Event),
+		cefHeaderEscaper.Replace(name), auditSeverity(entry))
+
+	ext := []struct{ key, val string }{
+		{"rt", fmt.Sprint(entry.Time.UnixNano() / int64(time.Millisecond))},
+		{"externalId", fmt.Sprint(entry.Seq)},
+		{"suser", entry.Scope.Client},
+		{"duser", entry.Scope.ServiceUsername},
+		{"dhost", entry.Scope.ServiceHostname},
+		{"act", entry.Decision},
+		{"outcome", auditOutcome(entry)},
+		{"cs1", entry.Command},
+		{"cs2", entry.Hash},
+		{"cs3", strings.Join(entry.Tags, ",")},
+		{"cs4", entry.Reason},
+		{"cs5", entry.WorkingDir},
+		{"cs6", entry.RequestID},
+		{"flexString1", strings.Join(append(entry.Warnings, entry.Anomalies...), "; ")},
+		{"flexString2", entry.Network},
+		{"msg", entry.Detail},
+	}
+	if entry.Command != "" {
+		ext = append(ext, struct{ key, val string }{"cs1Label", "command"})
+	}
+	ext = append(ext, struct{ key, val string }{"cs2Label", "hash"})
+	if len(entry.Tags) > 0 {
+		ext = append(ext, struct{ key, val string }{"cs3Label", "tags"})
+	}
+	if entry.Reason != "" {
+		ext = append(ext, struct{ key, val string }{"cs4Label", "reason"})
+	}
+	if entry.WorkingDir != "" {
+		ext = append(ext, struct{ key, val string }{"cs5Label", "cwd"})
+	}
+	if entry.RequestID != "" {
+		ext = append(ext, struct{ key, val string }{"cs6Label", "requestId"})
+	}
+	if len(entry.Warnings)+len(entry.Anomalies) > 0 {
+		ext = append(ext, struct{ key, val string }{"flexString1Label", "anomalies"})
+	}
+	if entry.Network != "" {
+		ext = append(ext, struct{ key, val string }{"flexString2Label", "network"})
+	}
+	first := true
+	for _, kv := range ext {
+		if kv.val == "" {
+			continue
+		}
+		if !first {
+			buf.WriteByte(' ')
+		}
+		first = false
+		buf.WriteString(kv.key + "=" + cefValueEscaper.Replace(kv.val))
+	}
+	return buf.Bytes(), nil
+}
+
+type ecsDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Message   string    `json:"message,omitempty"`
+	Event     struct {
+		Kind     string   `json:"kind"`
+		Category []string `json:"category"`
+		Action   string   `json:"action"`
+		Outcome  string   `json:"outcome"`
+		Severity int      `json:"severity"`
+		Sequence uint64   `json:"sequence"`
+		Hash     string   `json:"hash"`
+		Reason   string   `json:"reason,omitempty"`
+	} `json:"event"`
+	Source struct {
+		Address string `json:"address,omitempty"`
+	} `json:"source"`
+	Destination struct {
+		Address string `json:"address,omitempty"`
+	} `json:"destination"`
+	User struct {
+		Name string `json:"name,omitempty"`
+	} `json:"user"`
+	Process struct {
+		CommandLine      string `json:"command_line,omitempty"`
+		WorkingDirectory string `json:"working_directory,omitempty"`
+	} `json:"process"`
+	Observer struct {
+		Vendor  string `json:"vendor"`
+		Product string `json:"product"`
+		Version string `json:"version,omitempty"`
+	} `json:"observer"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Tags   []string          `json:"tags,omitempty"`
+}
+
+func formatECS(entry *AuditEntry) ([]byte, error) {
+	doc := ecsDocument{Timestamp: entry.Time, Message: entry.Detail, Tags: entry.Tags}
+	doc.Event.Kind = "event"
+	doc.Event.Category = []string{"authentication", "process"}
+	doc.Event.Action = entry.Event
+	doc.Event.Outcome = auditOutcome(entry)
+	doc.Event.Severity = auditSeverity(entry)
+	doc.Event.Sequence = entry.Seq
+	doc.Event.Hash = entry.Hash
+	doc.Source.Address = entry.Scope.Client
+	doc.Destination.Address = entry.Scope.ServiceHostname
+	doc.User.Name = entry.Scope.ServiceUsername
+	doc.Event.Reason = entry.Reason
+	doc.Process.CommandLine = entry.Command
+	doc.Process.WorkingDirectory = entry.WorkingDir
+	doc.Observer.Vendor = "StanfordSNR"
+	doc.Observer.Product = "guardian-agent"
+	doc.Observer.Version = Version
+	if entry.Decision != "" || entry.RequestID != "" || entry.Approver != "" || len(entry.Warnings)+len(entry.Anomalies) > 0 || entry.Network != "" {
+		doc.Labels = make(map[string]string)
+	}
+	if entry.Decision != "" {
+		doc.Labels["decision"] = entry.Decision
+	}
+	if entry.Approver != "" {
+		doc.Labels["approver"] = entry.Approver
+	}
+	if entry.RequestID != "" {
+		doc.Labels["request_id"] = entry.RequestID
+	}
+	if len(entry.Warnings) > 0 {
+		doc.Labels["warnings"] = strings.Join(entry.Warnings, "; ")
+	}
+	if len(entry.Anomalies) > 0 {
+		doc.Labels["anomalies"] = strings.Join(entry.Anomalies, "; ")
+	}
+	if entry.Network != "" {
+		doc.Labels["network"] = entry.Network
+	}
+	return json.Marshal(doc)
+}
@@ -23,3 +23,13 @@ func CreateSocket(name string) (s net.Listener, finalName string, err error) {
 	unix.Umask(oldMask)
 	return
 }
+
+// AdminSocketPath returns the admin API socket of the guardian for the given
+// intermediary host.
+func AdminSocketPath(name string) string {
+	return path.Join(UserRuntimeDir(), AdminSockPrefix+adminSocketSanitizer.Replace(name))
+}
+
+func DialSocket(name string) (net.Conn, error) {
+	return net.Dial("unix", name)
+}
@@ -22,3 +22,13 @@ func CreateSocket(name string) (s net.Listener, finalName string, err error) {
 	s, err = npipe.Listen(finalName)
 	return
 }
+
+// AdminSocketPath returns the admin API pipe of the guardian for the given
+// intermediary host.
+func AdminSocketPath(name string) string {
+	return path.Join(`\\.\pipe`, AdminSockPrefix+adminSocketSanitizer.Replace(name))
+}
+
+func DialSocket(name string) (net.Conn, error) {
+	return npipe.Dial(name)
+}
@@ -0,0 +1,502 @@
+package guardianagent
+
+import (
+	"strings"
+)
+
+// Words which are never taken for table, column or alias names in queries:
+// those of the SELECT grammar isReadOnlySelect accepts, and those which would
+// make a query write or lock, e.g. SELECT INTO or FOR UPDATE.
+var sqlReservedWords = map[string]bool{
+	"select": true, "distinct": true, "all": true, "from": true, "where": true,
+	"and": true, "or": true, "not": true, "as": true, "join": true, "inner": true,
+	"left": true, "right": true, "full": true, "outer": true, "cross": true,
+	"natural": true, "on": true, "using": true, "group": true, "by": true,
+	"having": true, "order": true, "asc": true, "desc": true, "limit": true,
+	"offset": true, "union": true, "intersect": true, "except": true, "with": true,
+	"in": true, "is": true, "null": true, "true": true, "false": true, "like": true,
+	"ilike": true, "between": true, "exists": true, "case": true, "when": true,
+	"then": true, "else": true, "end": true,
+	"into": true, "for": true, "update": true, "delete": true, "insert": true,
+	"merge": true, "values": true, "table": true, "lateral": true, "returning": true,
+	"window": true, "fetch": true, "lock": true, "procedure": true, "create": true,
+	"drop": true, "alter": true, "truncate": true, "grant": true, "revoke": true,
+	"copy": true, "call": true, "do": true, "execute": true, "set": true, "reset": true,
+}
+
+// Operators of the SELECT grammar, longest first.
+var sqlOperators = []string{"<>", "!=", "<=", ">=", "||", ",", ".", "(", ")", "*", "=", "<", ">", "+", "-", "/", "%"}
+
+// How deeply subqueries and parentheses may nest.
+const maxSQLDepth = 32
+
+// Kinds of SQL tokens.
+const (
+	sqlWord = iota + 1
+	sqlQuotedName
+	sqlNumber
+	sqlString
+	sqlOperator
+)
+
+type sqlToken struct {
+	kind int
+	text string
+}
+
+// isReadOnlySelect reports whether s is a single SELECT query (or a WITH query
+// made of SELECTs) of a restricted grammar, which cannot write: it is made of
+// column and table names, literals, the usual operators and predicates, CASE,
+// subqueries, joins, grouping, ordering and limits only. Function calls,
+// including aggregates, casts, comments, parameters, client meta-commands
+// (e.g. psql's backslash commands) and further statements are refused, as
+// even one function could write.
+func isReadOnlySelect(s string) bool {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSpace(strings.TrimSuffix(s, ";"))
+	tokens, ok := tokenizeSQL(s)
+	if !ok {
+		return false
+	}
+	parser := sqlParser{tokens: tokens}
+	return parser.query() && parser.pos == len(tokens)
+}
+
+// tokenizeSQL splits s into tokens, lowercasing words. It fails on characters
+// the grammar of isReadOnlySelect has no use for, and on comments.
+func tokenizeSQL(s string) ([]sqlToken, bool) {
+	var tokens []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(s) && (s[i] == '_' || (s[i] >= 'a' && s[i] <= 'z') || (s[i] >= 'A' && s[i] <= 'Z') || (s[i] >= '0' && s[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlWord, strings.ToLower(s[start:i])})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(s) && ((s[i] >= '0' && s[i] <= '9') || s[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlNumber, s[start:i]})
+		case c == '\'':
+			// Quotes within strings are doubled.
+			start := i
+			for i++; ; i++ {
+				if i >= len(s) || s[i] == '\\' {
+					return nil, false
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			i++
+			tokens = append(tokens, sqlToken{sqlString, s[start:i]})
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end <= 0 {
+				return nil, false
+			}
+			tokens = append(tokens, sqlToken{sqlQuotedName, s[i : i+end+2]})
+			i += end + 2
+		case strings.HasPrefix(s[i:], "--") || strings.HasPrefix(s[i:], "/*"):
+			return nil, false
+		default:
+			found := false
+			for _, op := range sqlOperators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, sqlToken{sqlOperator, op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		}
+	}
+	return tokens, true
+}
+
+// sqlParser recognizes the SELECT grammar of isReadOnlySelect. Its methods
+// consume what they recognize and report whether they did.
+type sqlParser struct {
+	tokens []sqlToken
+	pos    int
+	depth  int
+}
+
+func (p *sqlParser) peek() sqlToken {
+	if p.pos >= len(p.tokens) {
+		return sqlToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token if it is of kind, and text if not empty.
+func (p *sqlParser) accept(kind int, text string) bool {
+	token := p.peek()
+	if token.kind != kind || (text != "" && token.text != text) {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *sqlParser) keyword(word string) bool {
+	return p.accept(sqlWord, word)
+}
+
+func (p *sqlParser) op(op string) bool {
+	return p.accept(sqlOperator, op)
+}
+
+// name consumes a table, column or alias name.
+func (p *sqlParser) name() bool {
+	if token := p.peek(); token.kind == sqlWord && sqlReservedWords[token.text] {
+		return false
+	}
+	return p.accept(sqlWord, "") || p.accept(sqlQuotedName, "")
+}
+
+// alias consumes an optional alias.
+func (p *sqlParser) alias() bool {
+	if p.keyword("as") {
+		return p.name()
+	}
+	p.name()
+	return true
+}
+
+// nameList consumes names separated by commas, within parentheses.
+func (p *sqlParser) nameList() bool {
+	if !p.op("(") {
+		return false
+	}
+	for {
+		if !p.name() {
+			return false
+		}
+		if !p.op(",") {
+			return p.op(")")
+		}
+	}
+}
+
+// nested reports whether another level of nesting is allowed, and enters it.
+// Callers leave it with p.depth--.
+func (p *sqlParser) nested() bool {
+	p.depth++
+	return p.depth <= maxSQLDepth
+}
+
+func (p *sqlParser) query() bool {
+	defer func() { p.depth-- }()
+	if !p.nested() {
+		return false
+	}
+	if p.keyword("with") {
+		p.keyword("recursive")
+		for {
+			if !p.name() {
+				return false
+			}
+			if p.peek().text == "(" && !p.nameList() {
+				return false
+			}
+			if !p.keyword("as") || !p.subquery() {
+				return false
+			}
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	for {
+		if !p.selectCore() {
+			return false
+		}
+		if !p.keyword("union") && !p.keyword("intersect") && !p.keyword("except") {
+			break
+		}
+		if !p.keyword("all") {
+			p.keyword("distinct")
+		}
+	}
+	if p.keyword("order") {
+		if !p.keyword("by") {
+			return false
+		}
+		for {
+			if !p.expr() {
+				return false
+			}
+			if !p.keyword("asc") {
+				p.keyword("desc")
+			}
+			if p.keyword("nulls") && !p.keyword("first") && !p.keyword("last") {
+				return false
+			}
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("limit") && !p.accept(sqlNumber, "") && !p.keyword("all") {
+		return false
+	}
+	if p.keyword("offset") && !p.accept(sqlNumber, "") {
+		return false
+	}
+	return true
+}
+
+// subquery consumes a parenthesized query.
+func (p *sqlParser) subquery() bool {
+	return p.op("(") && p.query() && p.op(")")
+}
+
+func (p *sqlParser) selectCore() bool {
+	if !p.keyword("select") {
+		return false
+	}
+	if !p.keyword("distinct") {
+		p.keyword("all")
+	}
+	for {
+		if !p.op("*") && !(p.expr() && p.alias()) {
+			return false
+		}
+		if !p.op(",") {
+			break
+		}
+	}
+	if p.keyword("from") {
+		for {
+			if !p.fromItem() || !p.joins() {
+				return false
+			}
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("where") && !p.expr() {
+		return false
+	}
+	if p.keyword("group") {
+		if !p.keyword("by") {
+			return false
+		}
+		for {
+			if !p.expr() {
+				return false
+			}
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("having") && !p.expr() {
+		return false
+	}
+	return true
+}
+
+// fromItem consumes a table, or a subquery, and its alias. Table functions
+// are refused.
+func (p *sqlParser) fromItem() bool {
+	if p.peek().text == "(" {
+		if !p.subquery() {
+			return false
+		}
+	} else if !p.qualifiedName(false) {
+		return false
+	}
+	return p.alias()
+}
+
+func (p *sqlParser) joins() bool {
+	for {
+		start := p.pos
+		natural := p.keyword("natural")
+		cross := false
+		switch {
+		case p.keyword("inner"):
+		case p.keyword("cross"):
+			cross = true
+		case p.keyword("left") || p.keyword("right") || p.keyword("full"):
+			p.keyword("outer")
+		}
+		if !p.keyword("join") {
+			return p.pos == start
+		}
+		if !p.fromItem() {
+			return false
+		}
+		if natural || cross {
+			continue
+		}
+		switch {
+		case p.keyword("on"):
+			if !p.expr() {
+				return false
+			}
+		case p.keyword("using"):
+			if !p.nameList() {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+}
+
+// qualifiedName consumes a name such as schema.table.column, or table.* if
+// star is set. Names followed by parentheses, i.e. function calls, are
+// refused.
+func (p *sqlParser) qualifiedName(star bool) bool {
+	if !p.name() {
+		return false
+	}
+	for p.op(".") {
+		if star && p.op("*") {
+			return true
+		}
+		if !p.name() {
+			return false
+		}
+	}
+	return p.peek().text != "("
+}
+
+func (p *sqlParser) expr() bool {
+	defer func() { p.depth-- }()
+	if !p.nested() {
+		return false
+	}
+	for {
+		if !p.conjunction() {
+			return false
+		}
+		if !p.keyword("or") {
+			return true
+		}
+	}
+}
+
+func (p *sqlParser) conjunction() bool {
+	for {
+		for p.keyword("not") {
+		}
+		if !p.predicate() {
+			return false
+		}
+		if !p.keyword("and") {
+			return true
+		}
+	}
+}
+
+func (p *sqlParser) predicate() bool {
+	if !p.arithmetic() {
+		return false
+	}
+	for _, op := range []string{"=", "<>", "!=", "<=", ">=", "<", ">"} {
+		if p.op(op) {
+			return p.arithmetic()
+		}
+	}
+	if p.keyword("is") {
+		p.keyword("not")
+		return p.keyword("null") || p.keyword("true") || p.keyword("false")
+	}
+	negated := p.keyword("not")
+	switch {
+	case p.keyword("in"):
+		if next := p.pos + 1; next < len(p.tokens) && (p.tokens[next].text == "select" || p.tokens[next].text == "with") {
+			return p.subquery()
+		}
+		if !p.op("(") {
+			return false
+		}
+		for {
+			if !p.expr() {
+				return false
+			}
+			if !p.op(",") {
+				return p.op(")")
+			}
+		}
+	case p.keyword("like") || p.keyword("ilike"):
+		return p.arithmetic()
+	case p.keyword("between"):
+		return p.arithmetic() && p.keyword("and") && p.arithmetic()
+	}
+	return !negated
+}
+
+func (p *sqlParser) arithmetic() bool {
+	for {
+		for p.op("-") || p.op("+") {
+		}
+		if !p.operand() {
+			return false
+		}
+		matched := false
+		for _, op := range []string{"+", "-", "*", "/", "%", "||"} {
+			if p.op(op) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return true
+		}
+	}
+}
+
+func (p *sqlParser) operand() bool {
+	switch {
+	case p.accept(sqlNumber, ""), p.accept(sqlString, ""),
+		p.keyword("null"), p.keyword("true"), p.keyword("false"):
+		return true
+	case p.keyword("exists"):
+		return p.subquery()
+	case p.keyword("case"):
+		return p.caseExpr()
+	case p.peek().text == "(":
+		if next := p.pos + 1; next < len(p.tokens) && (p.tokens[next].text == "select" || p.tokens[next].text == "with") {
+			return p.subquery()
+		}
+		return p.op("(") && p.expr() && p.op(")")
+	}
+	return p.qualifiedName(true)
+}
+
+func (p *sqlParser) caseExpr() bool {
+	if p.peek().text != "when" && !p.expr() {
+		return false
+	}
+	if p.peek().text != "when" {
+		return false
+	}
+	for p.keyword("when") {
+		if !p.expr() || !p.keyword("then") || !p.expr() {
+			return false
+		}
+	}
+	if p.keyword("else") && !p.expr() {
+		return false
+	}
+	return p.keyword("end")
+}
@@ -0,0 +1,72 @@
+package guardianagent
+
+import "testing"
+
+func TestIsReadOnlySelect(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"select 1", true},
+		{"SELECT id, name FROM users WHERE active", true},
+		{"select * from t;", true},
+		{"select a.*, b.x as y from a join b on a.id = b.id left outer join c using (id) order by 1 desc nulls last limit 10 offset 5", true},
+		{"with x as (select * from t) select * from x union all select * from y", true},
+		{"select case when a > 1 then 'x' else 'y' end from t where exists (select 1 from u where u.id = t.id)", true},
+		{"select * from (select a from t) s where a not in (select a from u) and b between 1 and 2 and c is not null", true},
+		{"select * from t where name like 'a%' or name = 'it''s'", true},
+		{`select "select" from "into"`, true},
+
+		// Statements which write.
+		{"delete from t", false},
+		{"select 1; drop table t", false},
+		{"select 1;; select 2", false},
+		{"select into b from t", false},
+		{"select a into b from t", false},
+		{"select * from t for update", false},
+		{"with x as (delete from t returning *) select * from x", false},
+
+		// Function calls, even harmless looking ones.
+		{"select count(*) from users", false},
+		{"select query_to_xml(concat(chr(68),'ROP TABLE t'),true,true,'')", false},
+		{"select pg_drop_replication_slot('x')", false},
+		{"select pg_promote()", false},
+		{"select lo_unlink(1)", false},
+		{"select pg_promote ()", false},
+		{"select * from generate_series(1,10)", false},
+		{"select * from dblink('host=evil', 'drop table t') as t(a int)", false},
+
+		// Comments, casts, parameters and quoting tricks.
+		{"select 1 -- x", false},
+		{"select 1 /* x */", false},
+		{"select 1 # x", false},
+		{"select a::text from t", false},
+		{"select * from t where a = $1", false},
+		{"select $$x$$", false},
+		{"select e'x'", false},
+		{`select 'a\' from t`, false},
+		{"select 'unterminated", false},
+		{`select "unterminated`, false},
+		{`select 1 \gexec`, false},
+
+		// Not queries at all.
+		{"selectors", false},
+		{"select", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isReadOnlySelect(test.query); got != test.want {
+			t.Errorf("isReadOnlySelect(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestIsReadOnlySelectNesting(t *testing.T) {
+	query := "select "
+	for i := 0; i < 1000; i++ {
+		query += "("
+	}
+	if isReadOnlySelect(query + "1") {
+		t.Errorf("isReadOnlySelect accepted a query nested too deeply")
+	}
+}
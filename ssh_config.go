@@ -0,0 +1,227 @@
+package guardianagent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Keyword of the OpenSSH client config telling sga-stub whether to run
+// sessions with a destination through the guardian ("yes", the default) or
+// to connect to it directly ("no"). ssh must be told to ignore it, with
+// "IgnoreUnknown SGAGuardian" before the first use.
+const SSHConfigGuardianKeyword = "sgaguardian"
+
+// Nesting limit of Include directives, as in OpenSSH.
+const sshConfigMaxDepth = 16
+
+// SSHDestination is what Host and Match blocks of the OpenSSH client config
+// are matched against.
+type SSHDestination struct {
+	// The host name after HostName substitution (%h), and as given on the
+	// command line (%n).
+	Host         string
+	OriginalHost string
+
+	Port string
+	User string
+}
+
+// LookupSSHConfig returns the options the OpenSSH client config at path
+// sets for dest, keyed by their lower-cased keywords. As with ssh, the first
+// value of each option wins. Match blocks support all, canonical, final,
+// host, originalhost, user, localuser and exec.
+func LookupSSHConfig(path string, dest SSHDestination) (map[string]string, error) {
+	options := map[string]string{}
+	if dest.OriginalHost == "" {
+		dest.OriginalHost = dest.Host
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return options, nil
+	}
+	err := readSSHConfig(path, filepath.Dir(path), dest, options, false, 0)
+	return options, err
+}
+
+// readSSHConfig reads a config file as ssh does, setting the options of the
+// blocks matching dest. Relative includes are relative to dir. Included files
+// never match if the block including them does not.
+func readSSHConfig(path string, dir string, dest SSHDestination, options map[string]string, neverMatch bool, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read ssh config: %s", err)
+	}
+	defer f.Close()
+	active := !neverMatch
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args := splitSSHConfigLine(scanner.Text())
+		switch keyword {
+		case "":
+		case "host":
+			active = !neverMatch && matchesSSHHostList(args, dest.OriginalHost)
+		case "match":
+			matched, err := matchSSHConfig(args, dest)
+			if err != nil {
+				return fmt.Errorf("Invalid Match in %s, line %d: %s", path, line, err)
+			}
+			active = !neverMatch && matched
+		case "include":
+			if depth >= sshConfigMaxDepth {
+				return fmt.Errorf("Too many nested includes in %s", path)
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				included, _ := filepath.Glob(pattern)
+				for _, include := range included {
+					if err = readSSHConfig(include, dir, dest, options, !active, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if _, set := options[keyword]; active && !set && len(args) > 0 {
+				options[keyword] = strings.Join(args, " ")
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSSHConfigLine returns the lower-cased keyword of a config line and
+// its arguments, which may be quoted.
+func splitSSHConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			if end = strings.IndexByte(rest[1:], '"'); end < 0 {
+				arg, rest = rest[1:], ""
+			} else {
+				arg, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if end = strings.IndexAny(rest, " \t"); end >= 0 {
+			arg, rest = rest[:end], rest[end:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, args
+}
+
+// matchSSHConfig evaluates the criteria of a Match line.
+func matchSSHConfig(args []string, dest SSHDestination) (bool, error) {
+	matched := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		var result bool
+		switch criterion {
+		case "all", "canonical", "final":
+			result = true
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("missing argument to %s", criterion)
+			}
+			i++
+			result = matchSSHCriterion(criterion, args[i], dest)
+		default:
+			return false, fmt.Errorf("unsupported criterion %q", args[i])
+		}
+		if result == negate {
+			matched = false
+		}
+	}
+	return matched, nil
+}
+
+func matchSSHCriterion(criterion string, arg string, dest SSHDestination) bool {
+	switch criterion {
+	case "host":
+		return matchesSSHPatternList(arg, dest.Host)
+	case "originalhost":
+		return matchesSSHPatternList(arg, dest.OriginalHost)
+	case "user":
+		return matchesSSHPatternList(arg, dest.User)
+	case "localuser":
+		current, err := user.Current()
+		return err == nil && matchesSSHPatternList(arg, current.Username)
+	}
+	cmd := strings.NewReplacer("%h", dest.Host, "%n", dest.OriginalHost, "%p", dest.Port, "%r", dest.User, "%%", "%").Replace(arg)
+	return exec.Command("/bin/sh", "-c", cmd).Run() == nil
+}
+
+// matchesSSHHostList matches the patterns of a Host line: one must match,
+// and none of the negated ones.
+func matchesSSHHostList(patterns []string, host string) bool {
+	return matchesSSHPatternList(strings.Join(patterns, ","), host)
+}
+
+// matchesSSHPatternList matches a comma-separated list of patterns, some of
+// which may be negated with "!".
+func matchesSSHPatternList(list string, s string) bool {
+	matched := false
+	for _, pattern := range strings.Split(list, ",") {
+		negate := strings.HasPrefix(pattern, "!")
+		if matchesSSHPattern(strings.ToLower(strings.TrimPrefix(pattern, "!")), strings.ToLower(s)) {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchesSSHPattern matches a pattern with the wildcards * and ?.
+func matchesSSHPattern(pattern string, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchesSSHPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
@@ -0,0 +1,123 @@
+package guardianagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var errStepUpDenied = errors.New("the push was denied")
+
+// StepUpFactor verifies the approver with a second factor, e.g. a push to
+// their phone, until ctx is done.
+type StepUpFactor interface {
+	// Name names the factor in messages, e.g. "Duo Push".
+	Name() string
+	Verify(ctx context.Context, reason string) error
+}
+
+// Kinds of approvals which may require a step-up.
+const (
+	StepUpOnce    = "once"
+	StepUpForever = "forever"
+	StepUpAny     = "any"
+	StepUpBatch   = "batch"
+	StepUpUnusual = "unusual"
+)
+
+// DefaultStepUpKinds are the approvals considered high-risk by default:
+// stored approvals, approvals of any command or of batches, and approvals of
+// requests flagged as unusual.
+var DefaultStepUpKinds = []string{StepUpForever, StepUpAny, StepUpBatch, StepUpUnusual}
+
+// StepUp requires completing a second factor before high-risk approvals are
+// honored.
+type StepUp struct {
+	factor StepUpFactor
+	kinds  map[string]bool
+}
+
+func NewStepUp(factor StepUpFactor, kinds []string) (*StepUp, error) {
+	stepUp := &StepUp{factor: factor, kinds: make(map[string]bool)}
+	for _, kind := range kinds {
+		switch kind {
+		case StepUpOnce, StepUpForever, StepUpAny, StepUpBatch, StepUpUnusual:
+			stepUp.kinds[kind] = true
+		default:
+			return nil, fmt.Errorf("unknown kind of approval %q (expected %s, %s, %s, %s or %s)",
+				kind, StepUpOnce, StepUpForever, StepUpAny, StepUpBatch, StepUpUnusual)
+		}
+	}
+	return stepUp, nil
+}
+
+// requires returns whether an approval of the given kinds requires a step-up.
+func (stepUp *StepUp) requires(kinds ...string) bool {
+	if stepUp == nil {
+		return false
+	}
+	for _, kind := range kinds {
+		if stepUp.kinds[kind] {
+			return true
+		}
+	}
+	return false
+}
+
+// Kinds returns the kinds of approvals which require a step-up.
+func (stepUp *StepUp) Kinds() []string {
+	var kinds []string
+	for kind := range stepUp.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// stepUpKindOf maps the actions which approve a request to their kinds.
+var stepUpKindOf = map[approvalChoice]string{
+	choiceAllowOnce:     StepUpOnce,
+	choiceModify:        StepUpOnce,
+	choiceAllowForever:  StepUpForever,
+	choiceAllowTemplate: StepUpForever,
+	choiceAllowAll:      StepUpAny,
+	choiceAllowBatch:    StepUpBatch,
+	choiceAllowGitRun:   StepUpBatch,
+}
+
+// stepUpKinds returns the kinds of an approval of the request, given the
+// kind of the chosen action.
+func stepUpKinds(kind string, context RequestContext) []string {
+	if len(context.Anomalies) > 0 {
+		return []string{kind, StepUpUnusual}
+	}
+	return []string{kind}
+}
+
+// stepUp completes the step-up factor, if the approval is of a kind that
+// requires it, before the approval is honored.
+func (policy *Policy) stepUp(ctx context.Context, audit requestAudit, scope Scope, cmd string, kinds ...string) error {
+	if !policy.StepUp.requires(kinds...) {
+		return nil
+	}
+	factor := policy.StepUp.factor
+	what := "to run ANY COMMAND"
+	if cmd != "" {
+		what = fmt.Sprintf("to run '%s'", cmd)
+	}
+	reason := fmt.Sprintf("%s %s on %s@%s", scope.Client, strings.TrimPrefix(what, "to "), scope.ServiceUsername, scope.ServiceHostname)
+	policy.UI.Inform(fmt.Sprintf("Waiting for %s to approve the request by %s %s on %s@%s...",
+		factor.Name(), scope.Client, what, scope.ServiceUsername, scope.ServiceHostname))
+	err := factor.Verify(ctx, reason)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return policy.withdraw(audit, scope, cmd)
+	}
+	policy.UI.Alert(fmt.Sprintf("Approval of the request by %s DENIED: %s failed: %s", displayLine(scope.Client), factor.Name(), displayLine(err.Error())))
+	audit.Record(AuditEventDecision, scope, cmd, "denied", fmt.Sprintf("%s failed: %s", factor.Name(), err))
+	return deny(DenialUser, "Step-up authentication failed")
+}
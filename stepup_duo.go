@@ -0,0 +1,158 @@
+package guardianagent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DuoFactor sends Duo Push challenges through the Duo Auth API.
+type DuoFactor struct {
+	host     string
+	ikey     string
+	skey     string
+	username string
+	client   http.Client
+}
+
+// NewDuoFactor verifies username with Duo Push, using the Auth API
+// application with the given API hostname and integration and secret keys.
+func NewDuoFactor(host string, ikey string, skey string, username string) (*DuoFactor, error) {
+	if host == "" || ikey == "" || skey == "" {
+		return nil, fmt.Errorf("Duo requires an API hostname, an integration key and a secret key")
+	}
+	duo := &DuoFactor{
+		host:     strings.ToLower(host),
+		ikey:     ikey,
+		skey:     skey,
+		username: username,
+		client:   http.Client{Timeout: 90 * time.Second},
+	}
+	var check struct{}
+	if err := duo.call("GET", "/auth/v2/check", nil, &check); err != nil {
+		return nil, err
+	}
+	return duo, nil
+}
+
+func (duo *DuoFactor) Name() string {
+	return "Duo Push"
+}
+
+// duoCanonicalParams encodes params as the Duo API signs them.
+func duoCanonicalParams(params url.Values) string {
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range params[key] {
+			pairs = append(pairs, strings.Replace(url.QueryEscape(key), "+", "%20", -1)+"="+
+				strings.Replace(url.QueryEscape(value), "+", "%20", -1))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (duo *DuoFactor) call(method string, path string, params url.Values, result interface{}) error {
+	date := time.Now().UTC().Format(time.RFC1123Z)
+	query := duoCanonicalParams(params)
+	mac := hmac.New(sha1.New, []byte(duo.skey))
+	mac.Write([]byte(strings.Join([]string{date, method, duo.host, path, query}, "\n")))
+
+	u := "https://" + duo.host + path
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		if query != "" {
+			u += "?" + query
+		}
+		req, err = http.NewRequest(method, u, nil)
+	} else {
+		req, err = http.NewRequest(method, u, strings.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Date", date)
+	req.SetBasicAuth(duo.ikey, hex.EncodeToString(mac.Sum(nil)))
+	resp, err := duo.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to call Duo: %s", err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Stat     string          `json:"stat"`
+		Message  string          `json:"message"`
+		Detail   string          `json:"message_detail"`
+		Response json.RawMessage `json:"response"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("Failed to call Duo: %s", resp.Status)
+	}
+	if reply.Stat != "OK" {
+		return fmt.Errorf("Failed to call Duo: %s %s", reply.Message, reply.Detail)
+	}
+	return json.Unmarshal(reply.Response, result)
+}
+
+// Verify sends a push to the user's devices, and waits for them to approve
+// it.
+func (duo *DuoFactor) Verify(ctx context.Context, reason string) error {
+	var auth struct {
+		TxID string `json:"txid"`
+	}
+	err := duo.call("POST", "/auth/v2/auth", url.Values{
+		"username": {duo.username},
+		"factor":   {"push"},
+		"device":   {"auto"},
+		"async":    {"1"},
+		"type":     {"Guardian Agent request"},
+		"pushinfo": {url.Values{"request": {reason}}.Encode()},
+	}, &auth)
+	if err != nil {
+		return err
+	}
+	for {
+		// auth_status waits for the state of the push to change.
+		var status struct {
+			Result    string `json:"result"`
+			Status    string `json:"status"`
+			StatusMsg string `json:"status_msg"`
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- duo.call("GET", "/auth/v2/auth_status", url.Values{"txid": {auth.TxID}}, &status)
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		switch status.Result {
+		case "allow":
+			return nil
+		case "deny":
+			if status.StatusMsg != "" {
+				return fmt.Errorf("%s", status.StatusMsg)
+			}
+			return errStepUpDenied
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package guardianagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How often Okta is asked whether a push was answered.
+const oktaPollInterval = 2 * time.Second
+
+// OktaFactor sends Okta Verify push challenges through the Okta Factors API.
+type OktaFactor struct {
+	org    string
+	token  string
+	user   string
+	factor string
+	client http.Client
+}
+
+// NewOktaFactor verifies the Okta user with the given login with an Okta
+// Verify push, using an API token of the Okta organization at org.
+func NewOktaFactor(org string, token string, login string) (*OktaFactor, error) {
+	if org == "" || token == "" {
+		return nil, fmt.Errorf("Okta requires an organization URL and an API token")
+	}
+	okta := &OktaFactor{
+		org:    strings.TrimSuffix(org, "/"),
+		token:  token,
+		client: http.Client{Timeout: 30 * time.Second},
+	}
+	var user struct {
+		ID string `json:"id"`
+	}
+	if err := okta.call("GET", "/api/v1/users/"+url.PathEscape(login), nil, &user); err != nil {
+		return nil, err
+	}
+	var factors []struct {
+		ID         string `json:"id"`
+		FactorType string `json:"factorType"`
+		Provider   string `json:"provider"`
+		Status     string `json:"status"`
+	}
+	if err := okta.call("GET", "/api/v1/users/"+user.ID+"/factors", nil, &factors); err != nil {
+		return nil, err
+	}
+	for _, factor := range factors {
+		if factor.FactorType == "push" && factor.Provider == "OKTA" && factor.Status == "ACTIVE" {
+			okta.user, okta.factor = user.ID, factor.ID
+			return okta, nil
+		}
+	}
+	return nil, fmt.Errorf("Okta user %s has not enrolled Okta Verify push", login)
+}
+
+func (okta *OktaFactor) Name() string {
+	return "Okta Verify"
+}
+
+func (okta *OktaFactor) call(method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	u := path
+	if strings.HasPrefix(path, "/") {
+		u = okta.org + path
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "SSWS "+okta.token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := okta.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to call Okta: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var oktaErr struct {
+			Summary string `json:"errorSummary"`
+		}
+		json.NewDecoder(resp.Body).Decode(&oktaErr)
+		return fmt.Errorf("Failed to call Okta: %s %s", resp.Status, oktaErr.Summary)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+type oktaVerification struct {
+	FactorResult string `json:"factorResult"`
+	Links        struct {
+		Poll struct {
+			Href string `json:"href"`
+		} `json:"poll"`
+	} `json:"_links"`
+}
+
+// Verify sends a push to the user's device, and waits for them to approve
+// it. Okta does not show reason on the device.
+func (okta *OktaFactor) Verify(ctx context.Context, reason string) error {
+	var verification oktaVerification
+	err := okta.call("POST", fmt.Sprintf("/api/v1/users/%s/factors/%s/verify", okta.user, okta.factor), struct{}{}, &verification)
+	if err != nil {
+		return err
+	}
+	poll := verification.Links.Poll.Href
+	for {
+		switch verification.FactorResult {
+		case "SUCCESS":
+			return nil
+		case "REJECTED":
+			return errStepUpDenied
+		case "WAITING":
+		default:
+			return fmt.Errorf("the push ended with %s", strings.ToLower(verification.FactorResult))
+		}
+		select {
+		case <-time.After(oktaPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		verification = oktaVerification{}
+		if err = okta.call("GET", poll, nil, &verification); err != nil {
+			return err
+		}
+	}
+}
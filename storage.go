@@ -0,0 +1,100 @@
+package guardianagent
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore keeps copies of recordings and rotated audit logs, e.g. so
+// that compliance teams can collect them off the hosts they were made on.
+type ObjectStore interface {
+	// Put stores the contents of r as the object with the given name.
+	Put(name string, r io.Reader) error
+
+	String() string
+}
+
+// NewObjectStore parses the URL of an object store:
+//
+//	file:///var/lib/sga/archive
+//	s3://bucket/prefix?region=eu-west-1&sse=aws:kms&kms-key=<id>&tag=retention=7y
+//	gs://bucket/prefix?kms-key=projects/.../cryptoKeys/<key>&tag=retention=7y
+//
+// S3 credentials are read from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN, GCS credentials from the HMAC key in
+// $GCS_HMAC_ACCESS_ID and $GCS_HMAC_SECRET.
+func NewObjectStore(spec string) (ObjectStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid object store %q: %s", spec, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("Invalid object store %q: missing directory", spec)
+		}
+		return localStore(u.Path), nil
+	case "s3", "gs":
+		return newBucketStore(u)
+	}
+	return nil, fmt.Errorf("Invalid object store %q: expected a file://, s3:// or gs:// URL", spec)
+}
+
+// localStore keeps objects as files in a directory, e.g. a mounted network
+// share.
+type localStore string
+
+func (dir localStore) Put(name string, r io.Reader) error {
+	path := filepath.Join(string(dir), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (dir localStore) String() string {
+	return "file://" + string(dir)
+}
+
+// PutFile stores the file at path as the object with the given name.
+func PutFile(store ObjectStore, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = store.Put(name, f); err != nil {
+		return fmt.Errorf("Failed to store %s in %s: %s", filepath.Base(path), store, err)
+	}
+	return nil
+}
+
+// objectName joins the parts of an object name with slashes.
+func objectName(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part = strings.Trim(part, "/"); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "/")
+}
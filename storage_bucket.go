@@ -0,0 +1,277 @@
+package guardianagent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bucketStore puts objects in an S3 or GCS bucket, using the XML API and
+// version 4 request signatures, so no SDK is needed.
+type bucketStore struct {
+	scheme string
+	bucket string
+	prefix string
+
+	// Endpoint URL of the bucket, e.g. https://bucket.s3.eu-west-1.amazonaws.com.
+	endpoint string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	// Extra headers stored with every object: server-side encryption,
+	// storage class, tags and labels.
+	headers http.Header
+}
+
+// bucketFlavor holds what differs between the S3 and GCS XML APIs.
+type bucketFlavor struct {
+	algorithm   string // e.g. "AWS4-HMAC-SHA256"
+	keyPrefix   string // e.g. "AWS4"
+	service     string
+	terminator  string
+	dateHeader  string
+	hashHeader  string
+	tokenHeader string
+}
+
+var s3Flavor = bucketFlavor{
+	algorithm:   "AWS4-HMAC-SHA256",
+	keyPrefix:   "AWS4",
+	service:     "s3",
+	terminator:  "aws4_request",
+	dateHeader:  "X-Amz-Date",
+	hashHeader:  "X-Amz-Content-Sha256",
+	tokenHeader: "X-Amz-Security-Token",
+}
+
+var gcsFlavor = bucketFlavor{
+	algorithm:  "GOOG4-HMAC-SHA256",
+	keyPrefix:  "GOOG4",
+	service:    "storage",
+	terminator: "goog4_request",
+	dateHeader: "X-Goog-Date",
+	hashHeader: "X-Goog-Content-Sha256",
+}
+
+func newBucketStore(u *url.URL) (*bucketStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid object store %q: missing bucket", u)
+	}
+	store := &bucketStore{
+		scheme:  u.Scheme,
+		bucket:  u.Host,
+		prefix:  strings.Trim(u.Path, "/"),
+		headers: http.Header{},
+	}
+	query := u.Query()
+	var tags url.Values
+	for _, tag := range query["tag"] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid object store %q: tags must be key=value, got %q", u, tag)
+		}
+		if tags == nil {
+			tags = url.Values{}
+		}
+		tags.Add(kv[0], kv[1])
+	}
+
+	if u.Scheme == "s3" {
+		store.region = query.Get("region")
+		if store.region == "" {
+			store.region = os.Getenv("AWS_REGION")
+		}
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		if endpoint := query.Get("endpoint"); endpoint != "" {
+			// S3-compatible services are addressed by path.
+			store.endpoint = strings.TrimRight(endpoint, "/") + "/" + store.bucket
+		} else {
+			store.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", store.bucket, store.region)
+		}
+		store.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		store.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		store.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		if store.accessKey == "" || store.secretKey == "" {
+			return nil, fmt.Errorf("Invalid object store %q: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", u)
+		}
+
+		sse := query.Get("sse")
+		if sse == "" && query.Get("kms-key") != "" {
+			sse = "aws:kms"
+		}
+		switch sse {
+		case "":
+		case "AES256", "aws:kms", "aws:kms:dsse":
+			store.headers.Set("X-Amz-Server-Side-Encryption", sse)
+		default:
+			return nil, fmt.Errorf("Invalid object store %q: sse must be AES256, aws:kms or aws:kms:dsse", u)
+		}
+		if key := query.Get("kms-key"); key != "" {
+			store.headers.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", key)
+		}
+		if class := query.Get("class"); class != "" {
+			store.headers.Set("X-Amz-Storage-Class", class)
+		}
+		if tags != nil {
+			store.headers.Set("X-Amz-Tagging", tags.Encode())
+		}
+		return store, nil
+	}
+
+	store.region = "auto"
+	store.endpoint = "https://storage.googleapis.com/" + store.bucket
+	store.accessKey = os.Getenv("GCS_HMAC_ACCESS_ID")
+	store.secretKey = os.Getenv("GCS_HMAC_SECRET")
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("Invalid object store %q: GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET must be set", u)
+	}
+	if query.Get("sse") != "" {
+		return nil, fmt.Errorf("Invalid object store %q: GCS always encrypts objects, use kms-key to choose the key", u)
+	}
+	if key := query.Get("kms-key"); key != "" {
+		store.headers.Set("X-Goog-Encryption-Kms-Key-Name", key)
+	}
+	if class := query.Get("class"); class != "" {
+		store.headers.Set("X-Goog-Storage-Class", class)
+	}
+	// GCS has no object tags; they are stored as custom metadata instead.
+	for key, values := range tags {
+		store.headers.Set("X-Goog-Meta-"+key, values[0])
+	}
+	return store, nil
+}
+
+func (store *bucketStore) flavor() *bucketFlavor {
+	if store.scheme == "gs" {
+		return &gcsFlavor
+	}
+	return &s3Flavor
+}
+
+func (store *bucketStore) Put(name string, r io.Reader) error {
+	// Recordings and rotated logs are small enough to be hashed in memory,
+	// which the signature requires.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	key := objectName(store.prefix, name)
+	req, err := http.NewRequest("PUT", store.endpoint+"/"+uriEncode(key, false), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range store.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	store.sign(req, data, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds a version 4 signature to req, see
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (store *bucketStore) sign(req *http.Request, payload []byte, now time.Time) {
+	flavor := store.flavor()
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set(flavor.dateHeader, now.Format("20060102T150405Z"))
+	req.Header.Set(flavor.hashHeader, hex.EncodeToString(payloadHash[:]))
+	if store.sessionToken != "" && flavor.tokenHeader != "" {
+		req.Header.Set(flavor.tokenHeader, store.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{date, store.region, flavor.service, flavor.terminator}, "/")
+	stringToSign := strings.Join([]string{
+		flavor.algorithm,
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte(flavor.keyPrefix + store.secretKey)
+	for _, part := range []string{date, store.region, flavor.service, flavor.terminator} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		flavor.algorithm, store.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode percent-encodes everything except unreserved characters and,
+// unless encodeSlash is set, slashes.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func (store *bucketStore) String() string {
+	return store.scheme + "://" + objectName(store.bucket, store.prefix)
+}
@@ -1,33 +1,138 @@
 package guardianagent
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Store struct {
-	mutex sync.RWMutex
-	rules map[Scope]AllowedCommands
-	path  string
+	mutex    sync.RWMutex
+	rules    map[Scope]AllowedCommands
+	includes []string
+	tags     map[string][]string
+	keys     map[string]KeyConstraint
+	path     string
+
+	// When stored approvals were last used, see rule_usage.go.
+	usage      map[ruleKey]time.Time
+	usageSince time.Time
 }
 
 type AllowedCommands struct {
 	AllCommands bool     `json:"AllCommands"`
 	Commands    []string `json:"Commands"`
+
+	// Command templates (see command_template.go), which only AllowTemplate
+	// and the policy file's templates add.
+	Templates []string `json:"Templates,omitempty"`
+
+	AllCommandsOrigin *RuleOrigin           `json:"-"`
+	Origins           map[string]RuleOrigin `json:"-"`
+}
+
+// RuleOrigin records how a stored approval was made, to show when it is used.
+// Approvals stored before origins were recorded have none.
+type RuleOrigin struct {
+	Added time.Time `yaml:"added" json:"Added"`
+
+	// The prompt the user approved in (terminal or display), or import for
+	// approvals imported from another machine's bundle.
+	Via string `yaml:"via" json:"Via"`
+
+	// ID of the request that was approved.
+	Request string `yaml:"request,omitempty" json:"Request,omitempty"`
+
+	// The approval lapses after this time, if set (see sga-admin review).
+	Expires time.Time `yaml:"expires,omitempty" json:"Expires,omitempty"`
 }
 
-type storageEntry struct {
-	PolicyScope Scope           `json:"Scope"`
-	PolicyRule  AllowedCommands `json:"AllowedCommands"`
+func (origin *RuleOrigin) describe() string {
+	if origin.Added.IsZero() {
+		return ""
+	}
+	desc := fmt.Sprintf("rule added %s via %s", origin.Added.Format("2006-01-02"), origin.Via)
+	if origin.Request != "" {
+		desc += ", request " + origin.Request
+	}
+	return desc
+}
+
+// setOrigin records the origin of cmd, or of the approval of all commands if
+// cmd is empty.
+func (allowed *AllowedCommands) setOrigin(cmd string, origin RuleOrigin) {
+	if cmd == "" {
+		allowed.AllCommandsOrigin = &origin
+		return
+	}
+	if allowed.Origins == nil {
+		allowed.Origins = make(map[string]RuleOrigin)
+	}
+	allowed.Origins[cmd] = origin
+}
+
+// origin returns the origin of cmd, or of the approval of all commands if cmd
+// is empty, if known.
+func (allowed *AllowedCommands) origin(cmd string) *RuleOrigin {
+	if cmd == "" {
+		return allowed.AllCommandsOrigin
+	}
+	if origin, ok := allowed.Origins[cmd]; ok {
+		return &origin
+	}
+	return nil
+}
+
+func (allowed *AllowedCommands) expired(cmd string, now time.Time) bool {
+	origin := allowed.origin(cmd)
+	return origin != nil && !origin.Expires.IsZero() && now.After(origin.Expires)
+}
+
+// match returns the stored command allowing cmd, if any: cmd itself, or a
+// template cmd is an instance of (see command_template.go).
+func (allowed *AllowedCommands) match(cmd string, now time.Time) (string, bool) {
+	for _, storedCommand := range allowed.Commands {
+		if cmd == storedCommand {
+			return cmd, !allowed.expired(cmd, now)
+		}
+	}
+	for _, template := range allowed.Templates {
+		if matchTemplate(template, cmd) && !allowed.expired(template, now) {
+			return template, true
+		}
+	}
+	return "", false
+}
+
+// StoredRule is a stored approval, as listed by Store.Rules.
+type StoredRule struct {
+	Scope Scope
+
+	// Empty for the approval of all commands.
+	Command string
+
+	// Whether Command is a template.
+	Template bool `json:",omitempty"`
+
+	Origin   *RuleOrigin `json:",omitempty"`
+	LastUsed time.Time
 }
 
 func NewStore(configPath string) (store *Store, err error) {
 	store = &Store{
 		path:  configPath,
 		rules: make(map[Scope]AllowedCommands),
+		keys:  make(map[string]KeyConstraint),
 	}
-	err = store.load()
+	if err = store.load(); err != nil {
+		return store, err
+	}
+	err = store.loadUsage()
 
 	return store, err
 }
@@ -41,60 +146,259 @@ func (store *Store) load() (err error) {
 	}
 	defer file.Close()
 
-	dec := json.NewDecoder(file)
-	if dec.More() {
-		if err = dec.Decode(&store); err != nil {
-			return err
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	policy, err := parsePolicyFile(store.path, buf, true)
+	if err != nil {
+		return err
+	}
+	store.includes = policy.Include
+	store.tags = policy.Tags
+	for _, constraint := range policy.Keys {
+		store.keys[constraint.Fingerprint] = constraint
+	}
+	for _, rule := range policy.Allow {
+		allowed := store.rules[rule.Scope]
+		allowed.AllCommands = allowed.AllCommands || rule.AllCommands
+		allowed.Commands = append(allowed.Commands, rule.Commands...)
+		allowed.Templates = append(allowed.Templates, rule.Templates...)
+		if rule.Origin != nil {
+			allowed.setOrigin("", *rule.Origin)
+		}
+		for cmd, origin := range rule.Origins {
+			allowed.setOrigin(cmd, origin)
 		}
+		store.rules[rule.Scope] = allowed
+	}
+
+	if policy.legacy {
+		// Keep the original around, and rewrite the policy in the current format.
+		if err = ioutil.WriteFile(store.path+".json.bak", buf, 0600); err != nil {
+			return fmt.Errorf("Failed to back up legacy policy: %s", err)
+		}
+		if err = store.save(); err != nil {
+			return fmt.Errorf("Failed to migrate legacy policy: %s", err)
+		}
+		log.Printf("Migrated %s to the YAML policy format (backup in %s.json.bak)", store.path, store.path)
 	}
 	return nil
 }
 
+// replaceRules takes the rules, key constraints, includes and tags of a
+// freshly loaded store, keeping the usage of the rules.
+func (store *Store) replaceRules(fresh *Store) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.rules = fresh.rules
+	store.keys = fresh.keys
+	store.includes = fresh.includes
+	store.tags = fresh.tags
+}
+
 func (store *Store) Save() (err error) {
-	file, err := os.OpenFile(store.path, os.O_WRONLY|os.O_CREATE, 0600)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.save()
+}
+
+func (store *Store) save() error {
+	buf, err := marshalPolicyFile(store.policyFile())
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	enc := json.NewEncoder(file)
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
-	if err := enc.Encode(store); err != nil {
+	// Write to a temporary file first, so that a failure doesn't leave a
+	// truncated policy behind.
+	tmpPath := store.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
 		return err
 	}
-	return nil
+	return os.Rename(tmpPath, store.path)
 }
 
-func (store *Store) MarshalJSON() ([]byte, error) {
-	ps := []storageEntry{}
-	for k, v := range store.rules {
-		ps = append(ps, storageEntry{PolicyScope: k, PolicyRule: v})
+func (store *Store) policyFile() *policyFile {
+	policy := &policyFile{Include: store.includes, Tags: store.tags}
+	for scope, allowed := range store.rules {
+		rule := PolicyRule{Scope: scope, AllCommands: allowed.AllCommands}
+		if allowed.AllCommands {
+			rule.Origin = allowed.AllCommandsOrigin
+		} else {
+			rule.Commands = allowed.Commands
+			rule.Templates = allowed.Templates
+			rule.Origins = allowed.Origins
+		}
+		policy.Allow = append(policy.Allow, rule)
 	}
-	val, err := json.Marshal(ps)
+	sort.Slice(policy.Allow, func(i, j int) bool {
+		a, b := policy.Allow[i].Scope, policy.Allow[j].Scope
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.ServiceHostname != b.ServiceHostname {
+			return a.ServiceHostname < b.ServiceHostname
+		}
+		return a.ServiceUsername < b.ServiceUsername
+	})
+	for _, constraint := range store.keys {
+		policy.Keys = append(policy.Keys, constraint)
+	}
+	sort.Slice(policy.Keys, func(i, j int) bool { return policy.Keys[i].Fingerprint < policy.Keys[j].Fingerprint })
+	return policy
+}
+
+// Export returns the personal policy, in the policy file format.
+func (store *Store) Export() ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return marshalPolicyFile(store.policyFile())
+}
 
+// Import merges an exported personal policy into the store, and returns the
+// number of rules it added to. Existing tags and key constraints take
+// precedence over imported ones of the same name.
+func (store *Store) Import(buf []byte) (int, error) {
+	policy, err := parsePolicyFile("imported policy", buf, true)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, include := range policy.Include {
+		if !containsString(store.includes, include) {
+			store.includes = append(store.includes, include)
+		}
+	}
+	for tag, hosts := range policy.Tags {
+		if _, ok := store.tags[tag]; !ok {
+			if store.tags == nil {
+				store.tags = make(map[string][]string)
+			}
+			store.tags[tag] = hosts
+		}
+	}
+	for _, constraint := range policy.Keys {
+		if _, ok := store.keys[constraint.Fingerprint]; !ok {
+			store.keys[constraint.Fingerprint] = constraint
+		}
+	}
+	added := 0
+	// Imported approvals keep their original origin, if any.
+	imported := RuleOrigin{Added: time.Now(), Via: "import"}
+	for _, rule := range policy.Allow {
+		allowed := store.rules[rule.Scope]
+		changed := rule.AllCommands && !allowed.AllCommands
+		if changed {
+			if rule.Origin != nil {
+				allowed.setOrigin("", *rule.Origin)
+			} else {
+				allowed.setOrigin("", imported)
+			}
+		}
+		allowed.AllCommands = allowed.AllCommands || rule.AllCommands
+		for _, list := range []struct{ imported, stored *[]string }{{&rule.Commands, &allowed.Commands}, {&rule.Templates, &allowed.Templates}} {
+			for _, cmd := range *list.imported {
+				if !containsString(*list.stored, cmd) {
+					*list.stored = append(*list.stored, cmd)
+					if origin, ok := rule.Origins[cmd]; ok {
+						allowed.setOrigin(cmd, origin)
+					} else {
+						allowed.setOrigin(cmd, imported)
+					}
+					changed = true
+				}
+			}
+		}
+		if changed {
+			added++
+		}
+		store.rules[rule.Scope] = allowed
 	}
-	return val, nil
+	return added, store.save()
 }
 
-func (store *Store) UnmarshalJSON(b []byte) error {
-	tmpStore := []storageEntry{}
-	err := json.Unmarshal(b, &tmpStore)
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
 
-	if err != nil {
-		return err
+// Includes returns the rule packs included by the store.
+func (store *Store) Includes() []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.includes
+}
+
+// Tags returns the host tags defined in the personal policy.
+func (store *Store) Tags() map[string][]string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.tags
+}
+
+// KeyConstraint returns the constraint on the key with the given fingerprint.
+func (store *Store) KeyConstraint(fingerprint string) (KeyConstraint, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	constraint, ok := store.keys[fingerprint]
+	return constraint, ok
+}
+
+// KeyConstraints returns all key constraints.
+func (store *Store) KeyConstraints() []KeyConstraint {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var constraints []KeyConstraint
+	for _, constraint := range store.keys {
+		constraints = append(constraints, constraint)
 	}
-	for _, v := range tmpStore {
-		store.rules[v.PolicyScope] = v.PolicyRule
+	sort.Slice(constraints, func(i, j int) bool { return constraints[i].Fingerprint < constraints[j].Fingerprint })
+	return constraints
+}
+
+// SetKeyConstraint replaces the constraint on a key.
+func (store *Store) SetKeyConstraint(constraint KeyConstraint) error {
+	if msg := constraint.validate(); msg != "" {
+		return errors.New(msg)
 	}
+	store.mutex.Lock()
+	store.keys[constraint.Fingerprint] = constraint
+	store.mutex.Unlock()
+	return store.Save()
+}
 
-	return nil
+// RemoveKeyConstraint removes the constraint on a key, if any.
+func (store *Store) RemoveKeyConstraint(fingerprint string) error {
+	store.mutex.Lock()
+	delete(store.keys, fingerprint)
+	store.mutex.Unlock()
+	return store.Save()
 }
 
-func (store *Store) AllowAll(scope Scope) (err error) {
+// Origin describes how the stored approval of cmd in scope (or of all
+// commands, if cmd is empty) was made, if known.
+func (store *Store) Origin(scope Scope, cmd string) string {
 	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	allowed := store.rules[scope]
+	if allowed.AllCommands {
+		cmd = ""
+	} else if rule, ok := allowed.match(cmd, time.Now()); ok {
+		cmd = rule
+	}
+	origin := allowed.origin(cmd)
+	if origin == nil {
+		return ""
+	}
+	return origin.describe()
+}
+
+func (store *Store) AllowAll(scope Scope, origin RuleOrigin) (err error) {
+	store.mutex.Lock()
 	allowed, ok := store.rules[scope]
 	if !ok {
 		allowed = AllowedCommands{
@@ -102,13 +406,14 @@ func (store *Store) AllowAll(scope Scope) (err error) {
 			Commands:    []string{}}
 	}
 	allowed.AllCommands = true
+	allowed.setOrigin("", origin)
 	store.rules[scope] = allowed
-	store.mutex.RUnlock()
+	store.mutex.Unlock()
 
 	return store.Save()
 }
 
-func (store *Store) AllowCommand(scope Scope, cmd string) (err error) {
+func (store *Store) AllowCommand(scope Scope, cmd string, origin RuleOrigin) (err error) {
 	store.mutex.Lock()
 	allowed, ok := store.rules[scope]
 	if !ok {
@@ -118,10 +423,32 @@ func (store *Store) AllowCommand(scope Scope, cmd string) (err error) {
 	}
 	for _, command := range allowed.Commands {
 		if cmd == command {
+			store.mutex.Unlock()
 			return
 		}
 	}
 	allowed.Commands = append(allowed.Commands, cmd)
+	allowed.setOrigin(cmd, origin)
+	store.rules[scope] = allowed
+	store.mutex.Unlock()
+
+	return store.Save()
+}
+
+// AllowTemplate stores the approval of the commands matching template (see
+// command_template.go).
+func (store *Store) AllowTemplate(scope Scope, template string, origin RuleOrigin) error {
+	if !isTemplate(template) {
+		return fmt.Errorf("template %q has no placeholders", template)
+	}
+	store.mutex.Lock()
+	allowed := store.rules[scope]
+	if containsString(allowed.Templates, template) {
+		store.mutex.Unlock()
+		return nil
+	}
+	allowed.Templates = append(allowed.Templates, template)
+	allowed.setOrigin(template, origin)
 	store.rules[scope] = allowed
 	store.mutex.Unlock()
 
@@ -136,15 +463,12 @@ func (store *Store) IsAllowed(scope Scope, cmd string) bool {
 		return false
 	}
 
+	now := time.Now()
 	if allowed.AllCommands {
-		return true
-	}
-	for _, storedCommand := range allowed.Commands {
-		if cmd == storedCommand {
-			return true
-		}
+		return !allowed.expired("", now)
 	}
-	return false
+	_, ok = allowed.match(cmd, now)
+	return ok
 }
 
 func (store *Store) AreAllAllowed(scope Scope) bool {
@@ -155,5 +479,120 @@ func (store *Store) AreAllAllowed(scope Scope) bool {
 		return false
 	}
 
-	return allowed.AllCommands
+	return allowed.AllCommands && !allowed.expired("", time.Now())
+}
+
+// Rules lists the stored approvals.
+func (store *Store) Rules() []StoredRule {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var rules []StoredRule
+	add := func(scope Scope, allowed *AllowedCommands, cmd string, template bool) {
+		rules = append(rules, StoredRule{Scope: scope, Command: cmd, Template: template, Origin: allowed.origin(cmd), LastUsed: store.usage[ruleKey{scope, cmd}]})
+	}
+	for scope, allowed := range store.rules {
+		allowed := allowed
+		if allowed.AllCommands {
+			add(scope, &allowed, "", false)
+			continue
+		}
+		for _, cmd := range allowed.Commands {
+			add(scope, &allowed, cmd, false)
+		}
+		for _, template := range allowed.Templates {
+			add(scope, &allowed, template, true)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Scope != rules[j].Scope {
+			return lessScope(rules[i].Scope, rules[j].Scope)
+		}
+		return rules[i].Command < rules[j].Command
+	})
+	return rules
+}
+
+func lessScope(a, b Scope) bool {
+	if a.Client != b.Client {
+		return a.Client < b.Client
+	}
+	if a.ServiceHostname != b.ServiceHostname {
+		return a.ServiceHostname < b.ServiceHostname
+	}
+	return a.ServiceUsername < b.ServiceUsername
+}
+
+// RemoveRule removes the stored approval of cmd in scope, or of all commands
+// if cmd is empty.
+func (store *Store) RemoveRule(scope Scope, cmd string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if !store.removeRule(scope, cmd) {
+		return fmt.Errorf("no such approval")
+	}
+	delete(store.usage, ruleKey{scope, cmd})
+	if err := store.save(); err != nil {
+		return err
+	}
+	return store.saveUsage()
+}
+
+func (store *Store) removeRule(scope Scope, cmd string) bool {
+	allowed, ok := store.rules[scope]
+	if !ok {
+		return false
+	}
+	if cmd == "" {
+		if !allowed.AllCommands {
+			return false
+		}
+		allowed.AllCommands = false
+		allowed.AllCommandsOrigin = nil
+		allowed.Commands = nil
+		allowed.Templates = nil
+	} else {
+		commands := removeString(allowed.Commands, cmd)
+		templates := removeString(allowed.Templates, cmd)
+		if len(commands) == len(allowed.Commands) && len(templates) == len(allowed.Templates) {
+			return false
+		}
+		allowed.Commands = commands
+		allowed.Templates = templates
+		delete(allowed.Origins, cmd)
+	}
+	if allowed.AllCommands || len(allowed.Commands) > 0 || len(allowed.Templates) > 0 {
+		store.rules[scope] = allowed
+	} else {
+		delete(store.rules, scope)
+	}
+	return true
+}
+
+func removeString(list []string, s string) []string {
+	var kept []string
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// SetRuleExpiry makes the stored approval of cmd in scope (or of all commands
+// if cmd is empty) lapse at expires, or never if it is zero.
+func (store *Store) SetRuleExpiry(scope Scope, cmd string, expires time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	allowed, ok := store.rules[scope]
+	if !ok || (cmd == "") != allowed.AllCommands || (cmd != "" && !containsString(allowed.Commands, cmd) && !containsString(allowed.Templates, cmd)) {
+		return fmt.Errorf("no such approval")
+	}
+	origin := RuleOrigin{}
+	if o := allowed.origin(cmd); o != nil {
+		origin = *o
+	}
+	origin.Expires = expires
+	allowed.setOrigin(cmd, origin)
+	store.rules[scope] = allowed
+	return store.save()
 }
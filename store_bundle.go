@@ -0,0 +1,135 @@
+package guardianagent
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// storeBundleFormat identifies exported store bundles.
+const storeBundleFormat = "sga-store-bundle-1"
+
+// Parameters of the scrypt key derivation from the bundle passphrase.
+const (
+	bundleScryptN = 1 << 15
+	bundleScryptR = 8
+	bundleScryptP = 1
+)
+
+// storeBundle is the content of an exported store: the personal policy and
+// the command history, which together make up what the guardian has learned
+// on a machine.
+type storeBundle struct {
+	Exported time.Time
+	Host     string
+	Policy   []byte
+	History  json.RawMessage `json:",omitempty"`
+}
+
+// encryptedBundle is a storeBundle, encrypted with a key derived from a
+// passphrase.
+type encryptedBundle struct {
+	Format string
+	Salt   []byte
+	Nonce  []byte
+	Box    []byte
+}
+
+// StoreImport summarizes an imported bundle.
+type StoreImport struct {
+	Exported time.Time
+	Host     string
+	Rules    int
+}
+
+func bundleKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, bundleScryptN, bundleScryptR, bundleScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// ExportStore returns the personal policy and command history in a bundle
+// encrypted with passphrase, to be imported on another machine.
+func (agent *Agent) ExportStore(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("a passphrase is required")
+	}
+	bundle := storeBundle{Exported: time.Now()}
+	bundle.Host, _ = os.Hostname()
+	var err error
+	if bundle.Policy, err = agent.store.Export(); err != nil {
+		return nil, fmt.Errorf("Failed to export policy: %s", err)
+	}
+	if bundle.History, err = agent.policy.History.Export(); err != nil {
+		return nil, fmt.Errorf("Failed to export command history: %s", err)
+	}
+	plain, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := encryptedBundle{Format: storeBundleFormat, Salt: make([]byte, 16), Nonce: make([]byte, 24)}
+	if _, err = io.ReadFull(rand.Reader, encrypted.Salt); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(rand.Reader, encrypted.Nonce); err != nil {
+		return nil, err
+	}
+	key, err := bundleKey(passphrase, encrypted.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], encrypted.Nonce)
+	encrypted.Box = secretbox.Seal(nil, plain, &nonce, key)
+	agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "", "store exported")
+	return json.MarshalIndent(encrypted, "", "  ")
+}
+
+// ImportStore merges a bundle made by ExportStore into the personal policy and
+// command history.
+func (agent *Agent) ImportStore(buf []byte, passphrase string) (*StoreImport, error) {
+	var encrypted encryptedBundle
+	if err := json.Unmarshal(buf, &encrypted); err != nil || encrypted.Format != storeBundleFormat {
+		return nil, errors.New("not a store bundle")
+	}
+	if len(encrypted.Nonce) != 24 {
+		return nil, errors.New("invalid store bundle")
+	}
+	key, err := bundleKey(passphrase, encrypted.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], encrypted.Nonce)
+	plain, ok := secretbox.Open(nil, encrypted.Box, &nonce, key)
+	if !ok {
+		return nil, errors.New("wrong passphrase, or the bundle was tampered with")
+	}
+	var bundle storeBundle
+	if err = json.Unmarshal(plain, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid store bundle: %s", err)
+	}
+
+	summary := &StoreImport{Exported: bundle.Exported, Host: bundle.Host}
+	if summary.Rules, err = agent.store.Import(bundle.Policy); err != nil {
+		return nil, fmt.Errorf("Failed to import policy: %s", err)
+	}
+	if err = agent.policy.History.Import(bundle.History); err != nil {
+		return nil, err
+	}
+	agent.policy.Audit.Record(AuditEventPolicy, Scope{}, "", "",
+		fmt.Sprintf("store imported from %s (exported %s), %d rules added", bundle.Host, bundle.Exported.Format(time.RFC3339), summary.Rules))
+	return summary, nil
+}
@@ -0,0 +1,227 @@
+package guardianagent
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SudoCommand is a command run through sudo or doas.
+type SudoCommand struct {
+	// sudo or doas.
+	Tool string
+
+	// The user the command runs as.
+	User string
+
+	// The command run, or "" for a shell.
+	Command string
+}
+
+// Options of sudo and doas which take an argument, short and long (sudo only).
+var (
+	sudoArgOptions     = "CDghpRrTtUu"
+	sudoLongArgOptions = map[string]bool{
+		"chdir": true, "chroot": true, "close-from": true, "command-timeout": true, "group": true,
+		"host": true, "other-user": true, "prompt": true, "role": true, "type": true, "user": true,
+	}
+	doasArgOptions = "Cu"
+)
+
+// Options which make sudo and doas do something else than running a command,
+// e.g. edit files or list privileges.
+var (
+	sudoNoCommandOptions = "eKklVv"
+	doasNoCommandOptions = "CL"
+)
+
+// ParseSudo parses cmd as a command run through sudo or doas. It fails if cmd
+// does not start with either, or if they do not run a command.
+func ParseSudo(cmd string) (SudoCommand, bool) {
+	words, rest := shellPrefixWords(cmd)
+	if len(words) == 0 {
+		return SudoCommand{}, false
+	}
+	sudo := SudoCommand{Tool: path.Base(words[0].value), User: "root"}
+	argOptions, noCommandOptions := sudoArgOptions, sudoNoCommandOptions
+	switch sudo.Tool {
+	case "sudo":
+	case "doas":
+		argOptions, noCommandOptions = doasArgOptions, doasNoCommandOptions
+	default:
+		return SudoCommand{}, false
+	}
+	i := 1
+	shell := false
+	setOption := func(option string, value string) {
+		if option == "u" || option == "user" {
+			sudo.User = value
+		}
+	}
+options:
+	for ; i < len(words); i++ {
+		word := words[i].value
+		switch {
+		case word == "--":
+			i++
+			break options
+		case strings.HasPrefix(word, "--") && sudo.Tool == "sudo":
+			name := strings.TrimPrefix(word, "--")
+			if eq := strings.IndexByte(name, '='); eq >= 0 {
+				setOption(name[:eq], name[eq+1:])
+				continue
+			}
+			switch name {
+			case "edit", "list", "validate", "version", "remove-timestamp", "reset-timestamp", "help":
+				return SudoCommand{}, false
+			case "login", "shell":
+				shell = true
+			}
+			if sudoLongArgOptions[name] {
+				if i+1 >= len(words) {
+					return SudoCommand{}, false
+				}
+				i++
+				setOption(name, words[i].value)
+			}
+		case strings.HasPrefix(word, "-") && len(word) > 1:
+			for j := 1; j < len(word); j++ {
+				option := word[j : j+1]
+				if strings.Contains(noCommandOptions, option) {
+					// Only -k may be combined with a command.
+					if option != "k" || sudo.Tool != "sudo" {
+						return SudoCommand{}, false
+					}
+					continue
+				}
+				if option == "s" || (option == "i" && sudo.Tool == "sudo") {
+					shell = true
+				}
+				if strings.Contains(argOptions, option) {
+					value := word[j+1:]
+					if value == "" {
+						if i+1 >= len(words) {
+							return SudoCommand{}, false
+						}
+						i++
+						value = words[i].value
+					}
+					setOption(option, value)
+					break
+				}
+			}
+		default:
+			break options
+		}
+	}
+	// Variables set for the command, e.g. sudo FOO=bar cmd.
+	for i < len(words) && sudo.Tool == "sudo" && strings.Index(words[i].value, "=") > 0 {
+		i++
+	}
+	if i < len(words) {
+		sudo.Command = strings.TrimSpace(cmd[words[i].start:])
+	} else if strings.HasPrefix(rest, "-") {
+		// An option which could not be parsed.
+		return SudoCommand{}, false
+	} else {
+		sudo.Command = strings.TrimSpace(rest)
+	}
+	if sudo.Command == "" && !shell {
+		return SudoCommand{}, false
+	}
+	return sudo, true
+}
+
+// shellPrefixWords splits the leading words of cmd which are plain or simply
+// quoted, and returns the rest of cmd from the first word which is not.
+func shellPrefixWords(cmd string) ([]shellWord, string) {
+	var words []shellWord
+	i := 0
+	for {
+		for i < len(cmd) && (cmd[i] == ' ' || cmd[i] == '\t') {
+			i++
+		}
+		if i >= len(cmd) {
+			return words, ""
+		}
+		start := i
+		var value string
+		var quote byte
+		for ; i < len(cmd) && (quote != 0 || (cmd[i] != ' ' && cmd[i] != '\t')); i++ {
+			c := cmd[i]
+			switch {
+			case quote != 0 && c == quote:
+				quote = 0
+			case quote != 0:
+				value += string(c)
+			case c == '\'' || c == '"':
+				quote = c
+			case strings.IndexByte("\\$`;|&<>(){}\n", c) >= 0:
+				return words, cmd[start:]
+			default:
+				value += string(c)
+			}
+		}
+		if quote != 0 {
+			return words, cmd[start:]
+		}
+		words = append(words, shellWord{value: value, start: start, end: i})
+	}
+}
+
+// restrictedCommands returns the commands restrictive rules (deny and prompt
+// rules) apply to for cmd: cmd itself, the stages of a pipeline, and the
+// commands run through sudo or doas by any of them.
+func restrictedCommands(cmd string) []string {
+	commands := []string{cmd}
+	stages, _ := ParsePipeline(cmd)
+	for _, stage := range stages {
+		commands = append(commands, stage.Command)
+	}
+	for _, sudo := range sudoCommands(cmd) {
+		if sudo.Command != "" {
+			commands = append(commands, sudo.Command)
+		}
+	}
+	return commands
+}
+
+// sudoCommands returns the commands run through sudo or doas by cmd, or by the
+// stages of a pipeline, including those run through sudo by them in turn.
+func sudoCommands(cmd string) []SudoCommand {
+	commands := []string{cmd}
+	if stages, ok := ParsePipeline(cmd); ok {
+		commands = nil
+		for _, stage := range stages {
+			commands = append(commands, stage.Command)
+		}
+	}
+	var sudos []SudoCommand
+	for i := 0; i < len(commands); i++ {
+		if sudo, ok := ParseSudo(commands[i]); ok {
+			sudos = append(sudos, sudo)
+			commands = append(commands, sudo.Command)
+		}
+	}
+	return sudos
+}
+
+func (sudo SudoCommand) String() string {
+	as := "AS ROOT"
+	if sudo.User != "root" && sudo.User != "#0" {
+		as = "AS USER " + sudo.User
+	}
+	if sudo.Command == "" {
+		return fmt.Sprintf("%s: a shell, through %s", as, sudo.Tool)
+	}
+	return fmt.Sprintf("%s: '%s', through %s", as, sudo.Command, sudo.Tool)
+}
+
+// describeSudo shows approvers the commands cmd runs as another user.
+func describeSudo(cmd string) string {
+	var desc string
+	for _, sudo := range sudoCommands(cmd) {
+		desc += "\n  " + displayLine(sudo.String())
+	}
+	return desc
+}
@@ -0,0 +1,373 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package guardianagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Guardians which fail sooner than this after being started are not started
+// again before supervisorBackoff, so that a broken configuration does not
+// make the supervisor spin.
+const (
+	supervisorMinRun  = 5 * time.Second
+	supervisorBackoff = 30 * time.Second
+)
+
+// Supervisor runs a separate guardian (sga-guard-bin --no-forward) for each
+// local user of a multi-user host, as that user, with the user's own
+// configuration and policy in their home directory. While a user is logged in,
+// i.e. their runtime directory exists, the supervisor listens on the guardian
+// socket in it, and starts the user's guardian on the first connection,
+// passing the socket on. Guardians exit once idle for IdleExit, and are
+// started again on the next connection; they are stopped when the user logs
+// out.
+type Supervisor struct {
+	// The guardian program, and the arguments every guardian is started
+	// with (before those set by the supervisor).
+	Program string
+	Args    []string
+
+	// Variables added to the environment of the guardians, e.g. DISPLAY.
+	Env []string
+
+	// Directory of the users' runtime directories, named by UID.
+	RuntimeBase string
+
+	// Users a guardian is run for (names, %groups or +netgroups), or every
+	// user whose UID is at least MinUID if empty.
+	Users  []string
+	MinUID int
+
+	IdleExit time.Duration
+
+	// How often RuntimeBase is checked for logins and logouts.
+	ScanInterval time.Duration
+
+	mu    sync.Mutex
+	users map[int]*supervisedUser
+}
+
+// supervisedUser is the socket of a logged in user, and their guardian, if
+// running.
+type supervisedUser struct {
+	user     *user.User
+	uid, gid int
+	groups   []uint32
+	runtime  string
+
+	listener *net.UnixListener
+	// Duplicate of the socket, polled and passed to the guardian.
+	file *os.File
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	done    chan struct{}
+}
+
+// Run supervises the users' guardians until Stop is called.
+func (sup *Supervisor) Run() error {
+	if _, err := os.Stat(sup.RuntimeBase); err != nil {
+		return err
+	}
+	sup.mu.Lock()
+	if sup.users == nil {
+		sup.users = make(map[int]*supervisedUser)
+	}
+	sup.mu.Unlock()
+	for {
+		sup.scan()
+		time.Sleep(sup.ScanInterval)
+	}
+}
+
+// Stop stops every guardian and removes their sockets.
+func (sup *Supervisor) Stop() {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	for uid, u := range sup.users {
+		u.stop()
+		delete(sup.users, uid)
+	}
+}
+
+// scan starts supervising the users who logged in, and stops supervising
+// those who logged out.
+func (sup *Supervisor) scan() {
+	entries, err := ioutil.ReadDir(sup.RuntimeBase)
+	if err != nil {
+		log.Printf("Failed to list runtime directories: %s", err)
+		return
+	}
+	present := make(map[int]bool)
+	for _, entry := range entries {
+		uid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		present[uid] = true
+	}
+
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	for uid, u := range sup.users {
+		if !present[uid] {
+			if u != nil {
+				log.Printf("%s logged out, stopping their guardian", u.user.Username)
+			}
+			u.stop()
+			delete(sup.users, uid)
+		}
+	}
+	for uid := range present {
+		if _, ok := sup.users[uid]; ok {
+			continue
+		}
+		u, err := sup.supervise(uid)
+		if err != nil {
+			log.Printf("Not supervising UID %d: %s", uid, err)
+		}
+		// Users who are not supervised are remembered too, so that they
+		// are only checked again after logging in again.
+		sup.users[uid] = u
+	}
+}
+
+// supervise listens on the guardian socket of uid, if it is to be supervised,
+// and returns nil otherwise.
+func (sup *Supervisor) supervise(uid int) (*supervisedUser, error) {
+	account, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return nil, err
+	}
+	if !sup.allowed(uid, account.Username) {
+		return nil, nil
+	}
+	u := &supervisedUser{user: account, uid: uid, runtime: filepath.Join(sup.RuntimeBase, strconv.Itoa(uid)), done: make(chan struct{})}
+	if u.gid, err = strconv.Atoi(account.Gid); err != nil {
+		return nil, err
+	}
+	groupIDs, err := account.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range groupIDs {
+		if gid, err := strconv.Atoi(id); err == nil {
+			u.groups = append(u.groups, uint32(gid))
+		}
+	}
+
+	sock := filepath.Join(u.runtime, AgentGuardSockName)
+	if _, err = os.Lstat(sock); err == nil {
+		// E.g. the user runs a guardian of their own.
+		return nil, fmt.Errorf("%s already exists", sock)
+	}
+	if u.listener, err = listenAs(u.runtime, AgentGuardSockName, uid, u.gid); err != nil {
+		return nil, err
+	}
+	if u.file, err = u.listener.File(); err != nil {
+		u.listener.Close()
+		return nil, err
+	}
+	log.Printf("Supervising the guardian of %s on %s", account.Username, sock)
+	go sup.serve(u)
+	return u, nil
+}
+
+// listenAs listens on the socket name in dir, a directory of the user uid, and
+// gives the socket to the user. Since the user could replace the socket with a
+// link to any file before it is chowned, it is created and chowned in a
+// directory of its own which only root can write to, and then moved into dir.
+func listenAs(dir string, name string, uid int, gid int) (*net.UnixListener, error) {
+	dirFd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s: %s", dir, err)
+	}
+	defer unix.Close(dirFd)
+	staging := fmt.Sprintf(".%s.%d.%d", name, os.Getpid(), time.Now().UnixNano())
+	if err = unix.Mkdirat(dirFd, staging, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create %s in %s: %s", staging, dir, err)
+	}
+	defer unix.Unlinkat(dirFd, staging, unix.AT_REMOVEDIR)
+	stagingFd, err := unix.Openat(dirFd, staging, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s in %s: %s", staging, dir, err)
+	}
+	defer unix.Close(stagingFd)
+	var st unix.Stat_t
+	if err = unix.Fstat(stagingFd, &st); err != nil {
+		return nil, err
+	}
+	if st.Uid != 0 || st.Mode&0077 != 0 {
+		return nil, fmt.Errorf("%s in %s was replaced", staging, dir)
+	}
+
+	// The directory bound in is looked up by path, and may not be the one
+	// checked above if the user replaced it meanwhile, in which case the
+	// socket is not found in the latter below.
+	l, _, err := CreateSocket(filepath.Join(dir, staging, name))
+	if err != nil {
+		return nil, err
+	}
+	listener := l.(*net.UnixListener)
+	listener.SetUnlinkOnClose(false)
+	if err = unix.Fstatat(stagingFd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil && st.Mode&unix.S_IFMT != unix.S_IFSOCK {
+		err = fmt.Errorf("%s is not a socket", name)
+	}
+	if err == nil {
+		err = unix.Fchownat(stagingFd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	if err == nil {
+		err = unix.Renameat(stagingFd, name, dirFd, name)
+	}
+	if err != nil {
+		unix.Unlinkat(stagingFd, name, 0)
+		listener.Close()
+		return nil, fmt.Errorf("Failed to create the socket %s in %s: %s", name, dir, err)
+	}
+	return listener, nil
+}
+
+func (sup *Supervisor) allowed(uid int, name string) bool {
+	if len(sup.Users) == 0 {
+		return uid >= sup.MinUID
+	}
+	for _, pattern := range sup.Users {
+		if matchesUserOrGroup(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve starts the guardian of u whenever a connection is waiting on its
+// socket and the guardian is not running, until u is stopped.
+func (sup *Supervisor) serve(u *supervisedUser) {
+	for {
+		if !u.waitConnection() {
+			return
+		}
+		started := time.Now()
+		err := sup.runGuardian(u)
+		if u.isStopped() {
+			return
+		}
+		if err != nil {
+			log.Printf("The guardian of %s failed: %s", u.user.Username, err)
+			if time.Since(started) < supervisorMinRun {
+				select {
+				case <-u.done:
+					return
+				case <-time.After(supervisorBackoff):
+				}
+			}
+		} else {
+			log.Printf("The guardian of %s exited", u.user.Username)
+		}
+	}
+}
+
+// waitConnection waits for a connection to be waiting on the socket of u, and
+// returns false if u was stopped first.
+func (u *supervisedUser) waitConnection() bool {
+	fds := []unix.PollFd{{Fd: int32(u.file.Fd()), Events: unix.POLLIN}}
+	for !u.isStopped() {
+		n, err := unix.Poll(fds, 1000)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to wait for connections to the guardian of %s: %s", u.user.Username, err)
+			return false
+		}
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runGuardian runs the guardian of u until it exits.
+func (sup *Supervisor) runGuardian(u *supervisedUser) error {
+	args := append(append([]string{}, sup.Args...),
+		"--no-forward",
+		"--listen=fd:3",
+		fmt.Sprintf("--idle-exit=%s", sup.IdleExit))
+	cmd := exec.Command(sup.Program, args...)
+	cmd.Dir = u.user.HomeDir
+	cmd.Env = append([]string{
+		"HOME=" + u.user.HomeDir,
+		"USER=" + u.user.Username,
+		"LOGNAME=" + u.user.Username,
+		"PATH=" + os.Getenv("PATH"),
+		"XDG_RUNTIME_DIR=" + u.runtime,
+		"DBUS_SESSION_BUS_ADDRESS=unix:path=" + filepath.Join(u.runtime, "bus"),
+	}, sup.Env...)
+	cmd.ExtraFiles = []*os.File{u.file}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Credential: &syscall.Credential{Uid: uint32(u.uid), Gid: uint32(u.gid), Groups: u.groups},
+	}
+
+	u.mu.Lock()
+	if u.stopped {
+		u.mu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		u.mu.Unlock()
+		return err
+	}
+	u.cmd = cmd
+	u.mu.Unlock()
+	log.Printf("Started the guardian of %s (pid %d)", u.user.Username, cmd.Process.Pid)
+
+	err := cmd.Wait()
+	u.mu.Lock()
+	u.cmd = nil
+	u.mu.Unlock()
+	return err
+}
+
+func (u *supervisedUser) isStopped() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.stopped
+}
+
+// stop terminates the guardian of u, if running, and removes its socket.
+func (u *supervisedUser) stop() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stopped {
+		return
+	}
+	u.stopped = true
+	close(u.done)
+	if u.cmd != nil {
+		u.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	u.file.Close()
+	u.listener.Close()
+	os.Remove(filepath.Join(u.runtime, AgentGuardSockName))
+}
@@ -0,0 +1,256 @@
+package guardianagent
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddTags adds host patterns to the policy's tags. Patterns use path.Match
+// syntax, extended with numeric ranges such as web[01-20].corp, and are
+// matched against the host name with and without the port. A pattern
+// +<netgroup> matches the hosts of a netgroup.
+func (sys *SystemPolicy) AddTags(tags map[string][]string) {
+	if len(tags) == 0 {
+		return
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	sys.clearTagCache()
+	if sys.Tags == nil {
+		sys.Tags = make(map[string][]string)
+	}
+	for tag, patterns := range tags {
+		sys.Tags[tag] = append(sys.Tags[tag], patterns...)
+	}
+}
+
+// TagsFor returns the sorted tags of hostname (host:port).
+func (sys *SystemPolicy) TagsFor(hostname string) []string {
+	if sys == nil {
+		return nil
+	}
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	return sys.tagsFor(hostname)
+}
+
+// How long the tags of a host are cached. Netgroups may change meanwhile.
+const tagCacheLifetime = time.Minute
+
+// tagsFor returns the tags of hostname, which are cached, since large fleets
+// have many host patterns to match.
+func (sys *SystemPolicy) tagsFor(hostname string) []string {
+	if hostname == "" {
+		return nil
+	}
+	sys.tagCacheMu.Lock()
+	if time.Since(sys.tagCacheTime) > tagCacheLifetime {
+		sys.tagCache = nil
+	}
+	tags, ok := sys.tagCache[hostname]
+	sys.tagCacheMu.Unlock()
+	if ok {
+		return tags
+	}
+	for tag, patterns := range sys.Tags {
+		if matchesHostPattern(patterns, hostname) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	sys.tagCacheMu.Lock()
+	if sys.tagCache == nil {
+		sys.tagCache = make(map[string][]string)
+		sys.tagCacheTime = time.Now()
+	}
+	sys.tagCache[hostname] = tags
+	sys.tagCacheMu.Unlock()
+	return tags
+}
+
+// clearTagCache is called with sys.mu held when the tags change.
+func (sys *SystemPolicy) clearTagCache() {
+	sys.tagCacheMu.Lock()
+	sys.tagCache = nil
+	sys.tagCacheMu.Unlock()
+}
+
+// matchesHostPattern reports whether hostname (host:port) matches any of the
+// patterns, with or without the port.
+func matchesHostPattern(patterns []string, hostname string) bool {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "+") {
+			if groupResolver().HostInNetgroup(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		compiled, err := compileHostPattern(pattern)
+		if err != nil {
+			continue
+		}
+		if compiled.matches(hostname) || compiled.matches(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// numericRange is a [<lo>-<hi>] range in a host pattern. Zero-padded ranges
+// (e.g. [01-20]) only match numbers of the same width.
+type numericRange struct {
+	lo, hi int
+	width  int
+}
+
+// hostPattern is a host pattern compiled to a regular expression, with a
+// group for each numeric range.
+type hostPattern struct {
+	re     *regexp.Regexp
+	ranges []numericRange
+}
+
+var (
+	hostPatternsMu sync.Mutex
+	hostPatterns   = make(map[string]*hostPattern)
+)
+
+var numericRangeSyntax = regexp.MustCompile(`^(\d+)-(\d+)$`)
+
+// compileHostPattern compiles a path.Match pattern, in which a bracket
+// expression of two numbers with more than one digit, such as [01-20] or
+// [8-12], is a numeric range. Compiled patterns are cached.
+func compileHostPattern(pattern string) (*hostPattern, error) {
+	hostPatternsMu.Lock()
+	defer hostPatternsMu.Unlock()
+	if compiled, ok := hostPatterns[pattern]; ok {
+		return compiled, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	compiled := &hostPattern{}
+	expr := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr += "[^/]*"
+		case '?':
+			expr += "[^/]"
+		case '\\':
+			i++
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']') + i + 1
+			class := pattern[i+1 : end]
+			i = end
+			if m := numericRangeSyntax.FindStringSubmatch(class); m != nil && len(m[1])+len(m[2]) > 2 {
+				r := numericRange{}
+				r.lo, _ = strconv.Atoi(m[1])
+				r.hi, _ = strconv.Atoi(m[2])
+				if strings.HasPrefix(m[1], "0") && len(m[1]) == len(m[2]) {
+					r.width = len(m[1])
+				}
+				compiled.ranges = append(compiled.ranges, r)
+				expr += `(\d+)`
+				continue
+			}
+			expr += "[" + class + "]"
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	re, err := regexp.Compile(expr + "$")
+	if err != nil {
+		return nil, err
+	}
+	compiled.re = re
+	hostPatterns[pattern] = compiled
+	return compiled, nil
+}
+
+func (pattern *hostPattern) matches(host string) bool {
+	m := pattern.re.FindStringSubmatch(host)
+	if m == nil {
+		return false
+	}
+	for i, r := range pattern.ranges {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil || n < r.lo || n > r.hi || (r.width > 0 && len(m[i+1]) != r.width) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesUser reports whether user matches the user of a rule's scope: a
+// path.Match pattern, a directory group (%<group> or +<netgroup>), or
+// !<pattern> for any user not matching it, e.g. !root. An empty pattern
+// matches any user.
+func matchesUser(pattern string, user string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "!") {
+		return !matchesUserOrGroup(pattern[1:], user)
+	}
+	return matchesUserOrGroup(pattern, user)
+}
+
+func matchesUserOrGroup(pattern string, user string) bool {
+	if strings.HasPrefix(pattern, "%") || strings.HasPrefix(pattern, "+") {
+		return groupResolver().UserInGroup(user, pattern)
+	}
+	matched, _ := path.Match(pattern, user)
+	return matched
+}
+
+// isUserPattern reports whether the user of a scope is a pattern rather than
+// a user name.
+func isUserPattern(user string) bool {
+	return strings.ContainsAny(user, "*?[!\\%+")
+}
+
+// CheckTags makes sure all tags used by rules are defined. A rule with a
+// misspelled tag would otherwise silently never match.
+func (sys *SystemPolicy) CheckTags() error {
+	sys.mu.RLock()
+	defer sys.mu.RUnlock()
+	for _, rules := range [][]PolicyRule{sys.Allow, sys.Deny, sys.Prompt, sys.Batch} {
+		for _, rule := range rules {
+			for _, tag := range rule.Tags {
+				if _, ok := sys.Tags[tag]; !ok {
+					return fmt.Errorf("%s: rule uses undefined tag %s", rule.source, tag)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasAllTags(tags []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, t := range tags {
+			if t == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package guardianagent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var tenantNameSyntax = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Tenant is one of several delegatees served by a shared guardian, e.g. the
+// members of a family sharing a workstation. Each tenant has its own personal
+// policy, approvals, history and signing keys, kept in its directory, so that
+// what one approved never applies to another. Prompts are queued, and denials
+// remembered, per tenant too. Tenants are selected by the
+// listener a connection arrives on (see ParseListener), never by what the
+// client announces.
+type Tenant struct {
+	Name string
+
+	// Holds the personal policy (policy) and its companion files, and the
+	// tenant's key files (keys/id_*).
+	dir string
+
+	// Only the per-tenant parts of a policy are set, see apply.
+	policy Policy
+
+	keys passthroughKeys
+}
+
+// AddTenant serves the tenant name, whose files are kept in a directory next
+// to the guardian's personal policy, creating it if needed. Adding a tenant
+// again returns the existing one.
+func (agent *Agent) AddTenant(name string) (*Tenant, error) {
+	if !tenantNameSyntax.MatchString(name) {
+		return nil, fmt.Errorf("invalid tenant name %q", name)
+	}
+	agent.mu.Lock()
+	tenant := agent.tenants[name]
+	agent.mu.Unlock()
+	if tenant != nil {
+		return tenant, nil
+	}
+
+	dir := filepath.Join(agent.policyConfigPath+".tenants", name)
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create the directory of tenant %s: %s", name, err)
+	}
+	policyPath := filepath.Join(dir, "policy")
+	store, err := NewStore(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the policy store of tenant %s: %s", name, err)
+	}
+	history, err := NewHistory(policyPath + ".history")
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := NewCredentialLedger(policyPath + ".ledger")
+	if err != nil {
+		return nil, err
+	}
+	invitations, err := NewInvitations(policyPath+".invitations", ledger)
+	if err != nil {
+		return nil, err
+	}
+	system, err := agent.loadSystemPolicyWith(store)
+	if err != nil {
+		return nil, fmt.Errorf("Tenant %s: %s", name, err)
+	}
+	tenant = &Tenant{
+		Name: name,
+		dir:  dir,
+		policy: Policy{
+			Store:       store,
+			System:      system,
+			Tokens:      NewApprovalTokens(ledger),
+			Invitations: invitations,
+			Ledger:      ledger,
+			Batches:     NewBatchApprovals(),
+			GitRuns:     NewGitRuns(),
+			Quotas:      NewQuotaUsage(),
+			History:     history,
+		},
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.tenants == nil {
+		agent.tenants = make(map[string]*Tenant)
+	}
+	if existing := agent.tenants[name]; existing != nil {
+		return existing, nil
+	}
+	tenant.policy.Prompts = agent.policy.Prompts.empty()
+	tenant.policy.Denials = agent.policy.Denials.empty()
+	agent.tenants[name] = tenant
+	return tenant, nil
+}
+
+// tenant returns the tenant name, or nil if it is not served.
+func (agent *Agent) tenant(name string) *Tenant {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	return agent.tenants[name]
+}
+
+// apply replaces the parts of policy that are kept per tenant. The lockdown,
+// the audit log, the approvers and the agent-wide settings stay shared. It
+// must be called with agent.mu held, as SetPromptQueue and SetDenialMemory
+// replace the tenant's queue and denial cache.
+func (tenant *Tenant) apply(policy *Policy) {
+	policy.Store = tenant.policy.Store
+	policy.System = tenant.policy.System
+	policy.Tokens = tenant.policy.Tokens
+	policy.Invitations = tenant.policy.Invitations
+	policy.Ledger = tenant.policy.Ledger
+	policy.Batches = tenant.policy.Batches
+	policy.GitRuns = tenant.policy.GitRuns
+	policy.Quotas = tenant.policy.Quotas
+	policy.History = tenant.policy.History
+	policy.Prompts = tenant.policy.Prompts
+	policy.Denials = tenant.policy.Denials
+	policy.Tenant = tenant
+}
+
+// signers returns the tenant's key files, loaded once so that passphrases are
+// only asked for once. The guardian owner's keys and ssh-agent are never used
+// for tenants.
+func (tenant *Tenant) signers(ui UI) []ssh.Signer {
+	tenant.keys.once.Do(func() {
+		tenant.keys.signers = getKeyFileSigners(filepath.Join(tenant.dir, "keys"), ui)
+	})
+	return tenant.keys.signers
+}
+
+// reloadTenants rereads the personal policy of every tenant, along with the
+// system policy it is layered over. Every tenant keeps its previous policy
+// unless all are valid.
+func (agent *Agent) reloadTenants() error {
+	agent.mu.Lock()
+	tenants := make([]*Tenant, 0, len(agent.tenants))
+	for _, tenant := range agent.tenants {
+		tenants = append(tenants, tenant)
+	}
+	agent.mu.Unlock()
+
+	stores := make([]*Store, len(tenants))
+	systems := make([]*SystemPolicy, len(tenants))
+	for i, tenant := range tenants {
+		var err error
+		if stores[i], err = NewStore(filepath.Join(tenant.dir, "policy")); err != nil {
+			return fmt.Errorf("Failed to load the policy store of tenant %s: %s", tenant.Name, err)
+		}
+		if systems[i], err = agent.loadSystemPolicyWith(stores[i]); err != nil {
+			return fmt.Errorf("Tenant %s: %s", tenant.Name, err)
+		}
+	}
+	for i, tenant := range tenants {
+		tenant.policy.Store.replaceRules(stores[i])
+		tenant.policy.System.Replace(systems[i])
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package guardianagent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ApprovalToken pre-authorizes a single execution of a command, so that
+// scripted clients can run without prompting the user at that time.
+type ApprovalToken struct {
+	// Identifies the token in the credential ledger.
+	ID      string `json:",omitempty"`
+	Scope   Scope
+	Command string
+	Expires time.Time
+
+	token string
+}
+
+// ApprovalTokens holds the outstanding one-time approval tokens.
+type ApprovalTokens struct {
+	mu     sync.Mutex
+	tokens []*ApprovalToken
+	ledger *CredentialLedger
+}
+
+// NewApprovalTokens records the tokens it issues in ledger, if set.
+func NewApprovalTokens(ledger *CredentialLedger) *ApprovalTokens {
+	return &ApprovalTokens{ledger: ledger}
+}
+
+// Issue creates a token allowing cmd to run once in scope before ttl elapses.
+// An empty scope client matches any client.
+func (tokens *ApprovalTokens) Issue(scope Scope, cmd string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 28)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := &ApprovalToken{
+		ID:      hex.EncodeToString(buf[:4]),
+		Scope:   scope,
+		Command: cmd,
+		Expires: now.Add(ttl),
+		token:   base64.RawURLEncoding.EncodeToString(buf[4:]),
+	}
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.expire()
+	tokens.tokens = append(tokens.tokens, token)
+	tokens.ledger.issued(IssuedCredential{
+		ID:       token.ID,
+		Kind:     CredentialToken,
+		Scope:    scope,
+		Commands: []string{cmd},
+		Issued:   now,
+		Expires:  token.Expires,
+		MaxUses:  1,
+	})
+	return token.token, nil
+}
+
+// Redeem consumes the token if it was issued for exactly this request.
+func (tokens *ApprovalTokens) Redeem(token string, scope Scope, cmd string) bool {
+	if tokens == nil || token == "" {
+		return false
+	}
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.expire()
+	for i, t := range tokens.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.token), []byte(token)) != 1 {
+			continue
+		}
+		if t.Command != cmd || t.Scope.ServiceUsername != scope.ServiceUsername ||
+			t.Scope.ServiceHostname != scope.ServiceHostname ||
+			(t.Scope.Client != "" && t.Scope.Client != scope.Client) {
+			return false
+		}
+		tokens.tokens = append(tokens.tokens[:i], tokens.tokens[i+1:]...)
+		tokens.ledger.used(CredentialToken, t.ID)
+		return true
+	}
+	return false
+}
+
+// Pending lists the outstanding tokens, without their secret values.
+func (tokens *ApprovalTokens) Pending() []ApprovalToken {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.expire()
+	pending := make([]ApprovalToken, 0, len(tokens.tokens))
+	for _, t := range tokens.tokens {
+		pending = append(pending, ApprovalToken{ID: t.ID, Scope: t.Scope, Command: t.Command, Expires: t.Expires})
+	}
+	return pending
+}
+
+// RevokeAll invalidates all outstanding tokens, and returns how many there
+// were.
+func (tokens *ApprovalTokens) RevokeAll() int {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.expire()
+	count := len(tokens.tokens)
+	for _, t := range tokens.tokens {
+		tokens.ledger.revoked(CredentialToken, t.ID)
+	}
+	tokens.tokens = nil
+	return count
+}
+
+func (tokens *ApprovalTokens) expire() {
+	now := time.Now()
+	live := tokens.tokens[:0]
+	for _, t := range tokens.tokens {
+		if now.Before(t.Expires) {
+			live = append(live, t)
+		}
+	}
+	tokens.tokens = live
+}
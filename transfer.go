@@ -0,0 +1,124 @@
+package guardianagent
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// Transfer is a file transfer (scp or rsync) recognized in an execution
+// request.
+type Transfer struct {
+	Tool      string
+	Direction string
+	Paths     []string
+}
+
+// ParseTransfer recognizes the server side of scp and rsync transfers.
+func ParseTransfer(cmd string) (*Transfer, bool) {
+	if scp, ok := ParseSCPCommand(cmd); ok {
+		return scp.Transfer(), true
+	}
+	if rsync, ok := ParseRsyncCommand(cmd); ok {
+		return rsync.Transfer(), true
+	}
+	return nil, false
+}
+
+func (t *Transfer) String() string {
+	if t.Direction == TransferUpload {
+		return fmt.Sprintf("%s upload to %s", t.Tool, strings.Join(t.Paths, ", "))
+	}
+	return fmt.Sprintf("%s download from %s", t.Tool, strings.Join(t.Paths, ", "))
+}
+
+// TransferRule matches transfers in the given direction (or both, if empty)
+// of paths under any of Paths (or any path, if empty) and none of Except.
+// Paths may contain path.Match wildcards.
+type TransferRule struct {
+	Direction string   `json:"Direction,omitempty" yaml:"direction,omitempty"`
+	Paths     []string `json:"Paths,omitempty" yaml:"paths,omitempty"`
+	Except    []string `json:"Except,omitempty" yaml:"except,omitempty"`
+}
+
+func (rule *TransferRule) validate() string {
+	if rule.Direction != "" && rule.Direction != TransferUpload && rule.Direction != TransferDownload {
+		return fmt.Sprintf("invalid transfer direction %q (expected %s or %s)", rule.Direction, TransferUpload, TransferDownload)
+	}
+	for _, p := range append(append([]string{}, rule.Paths...), rule.Except...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Sprintf("invalid path pattern %q", p)
+		}
+	}
+	return ""
+}
+
+// matches reports whether the transfer is covered by the rule. Transfers of
+// several paths match restrictive (deny and prompt) rules if any of the paths
+// does, and other rules only if all of them do.
+func (rule *TransferRule) matches(t *Transfer, restrictive bool) bool {
+	if rule.Direction != "" && rule.Direction != t.Direction {
+		return false
+	}
+	for _, p := range t.Paths {
+		covered := (len(rule.Paths) == 0 || underAny(p, rule.Paths)) && !underAny(p, rule.Except)
+		if covered == restrictive {
+			return restrictive
+		}
+	}
+	return !restrictive
+}
+
+func (rule *TransferRule) describe(tool string) string {
+	what := tool + " transfers"
+	if rule.Direction != "" {
+		what = tool + " " + rule.Direction + "s"
+	}
+	if len(rule.Paths) > 0 {
+		what += " under " + strings.Join(rule.Paths, ", ")
+	}
+	if len(rule.Except) > 0 {
+		what += " except under " + strings.Join(rule.Except, ", ")
+	}
+	return what
+}
+
+// underAny reports whether p, or one of its parent directories, matches one
+// of patterns.
+func underAny(p string, patterns []string) bool {
+	p = path.Clean(p)
+	for _, pattern := range patterns {
+		pattern = path.Clean(pattern)
+		for dir := p; ; dir = path.Dir(dir) {
+			if matched, _ := path.Match(pattern, dir); matched {
+				return true
+			}
+			if dir == path.Dir(dir) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// describeCommand returns a readable description of cmd for prompts.
+func describeCommand(cmd string) string {
+	if cmd == "" {
+		return "open an interactive shell"
+	}
+	if t, ok := ParseTransfer(cmd); ok {
+		return displayLine(t.String())
+	}
+	if git, ok := ParseGitCommand(cmd); ok {
+		return displayLine(git.String())
+	}
+	if ParseSFTPCommand(cmd) {
+		return "start an SFTP session (transfers of any file)"
+	}
+	return fmt.Sprintf("run '%s'", displayLine(cmd))
+}
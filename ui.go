@@ -1,24 +1,32 @@
 package guardianagent
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/howeyc/gopass"
 	i "github.com/sternhenri/interact"
 )
 
+// UI asks the user for decisions. Prompts taking a context are withdrawn when
+// it is canceled, and return its error.
 type UI interface {
-	Ask(prompt Prompt) (int, error)
+	Ask(ctx context.Context, prompt Prompt) (int, error)
 	Confirm(msg string) bool
 	Inform(msg string)
 	Alert(msg string)
 	AskPassword(msg string) (string, error)
+
+	// Edit lets the user modify text; an empty result means the user gave up.
+	Edit(ctx context.Context, msg string, text string) (string, error)
 }
 
 type FancyTerminalUI struct {
@@ -29,6 +37,22 @@ type AskPassUI struct{}
 type Prompt struct {
 	Question string
 	Choices  []string
+
+	// The choices (from 1) that approve the request once, and forever, if
+	// offered, for approvers that do not show the choices.
+	Once    int
+	Forever int
+
+	// How urgently unanswered prompts escalate: RiskNormal (if unset) or
+	// RiskHigh.
+	Risk string
+
+	// Who may approve the request (see MayApprove), anyone if empty.
+	Approvers []string
+
+	// Parts of Question to draw attention to, e.g. shell constructs, for
+	// approvers that can highlight them.
+	Highlights []string
 }
 
 func formatPrompt(params Prompt) (formattedPrompt string) {
@@ -50,27 +74,65 @@ func mapToChoice(vs []string) []i.Choice {
 	return vsm
 }
 
-func (tui *FancyTerminalUI) Ask(params Prompt) (reply int, err error) {
+type withdrawReasonKey struct{}
+
+// withdrawReason explains why the prompt of ctx was withdrawn. Prompts are
+// withdrawn when their client disconnects, unless ctx says otherwise.
+func withdrawReason(ctx context.Context) string {
+	if reason, ok := ctx.Value(withdrawReasonKey{}).(func() string); ok {
+		return reason()
+	}
+	return "the client disconnected"
+}
+
+// withdrawable runs read, which reads from the terminal, until ctx is canceled.
+// The read is then interrupted where the terminal supports it; otherwise it
+// consumes the next line the user enters.
+func withdrawable(ctx context.Context, read func()) error {
+	done := make(chan struct{})
+	go func() {
+		read()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	fmt.Printf("\r\033[K\nRequest withdrawn: %s.\n", withdrawReason(ctx))
+	if os.Stdin.SetReadDeadline(time.Now()) == nil {
+		<-done
+		os.Stdin.SetReadDeadline(time.Time{})
+	} else {
+		fmt.Println("Press enter to continue.")
+		<-done
+	}
+	return ctx.Err()
+}
+
+func (tui *FancyTerminalUI) Ask(ctx context.Context, params Prompt) (reply int, err error) {
 	tui.mu.Lock()
 	defer tui.mu.Unlock()
 
 	var resp int64
 
-	i.Run(&i.Interact{
-		Questions: []*i.Question{
-			{
-				Quest: i.Quest{
-					Msg: params.Question,
-					Choices: i.Choices{
-						Alternatives: mapToChoice(params.Choices),
+	err = withdrawable(ctx, func() {
+		i.Run(&i.Interact{
+			Questions: []*i.Question{
+				{
+					Quest: i.Quest{
+						Msg: highlight(sanitizeEscaped(params.Question), sanitizeAllEscaped(params.Highlights), "\033[1;31m", "\033[0m"),
+						Choices: i.Choices{
+							Alternatives: mapToChoice(sanitizeAllEscaped(params.Choices)),
+						},
+					},
+					Action: func(c i.Context) interface{} {
+						resp, _ = c.Ans().Int()
+						return nil
 					},
-				},
-				Action: func(c i.Context) interface{} {
-					resp, _ = c.Ans().Int()
-					return nil
 				},
 			},
-		},
+		})
 	})
 	reply = int(resp)
 	return
@@ -80,21 +142,21 @@ func (tui *FancyTerminalUI) Inform(msg string) {
 	tui.mu.Lock()
 	defer tui.mu.Unlock()
 
-	fmt.Println(msg)
+	fmt.Println(displayLine(msg))
 }
 
 func (tui *FancyTerminalUI) Alert(msg string) {
 	tui.mu.Lock()
 	defer tui.mu.Unlock()
 
-	fmt.Fprintln(os.Stderr, msg)
+	fmt.Fprintln(os.Stderr, sanitizeEscaped(msg))
 }
 
 func (tui *FancyTerminalUI) AskPassword(msg string) (string, error) {
 	tui.mu.Lock()
 	defer tui.mu.Unlock()
 
-	fmt.Println(msg)
+	fmt.Println(sanitizeEscaped(msg))
 	passBytes, err := gopass.GetPasswd()
 	if err == nil {
 		return string(passBytes), nil
@@ -102,19 +164,43 @@ func (tui *FancyTerminalUI) AskPassword(msg string) (string, error) {
 	return "", err
 }
 
+func (tui *FancyTerminalUI) Edit(ctx context.Context, msg string, text string) (string, error) {
+	tui.mu.Lock()
+	defer tui.mu.Unlock()
+
+	fmt.Printf("%s\n  [%s]\nPress enter to keep, or type the replacement: ", sanitizeEscaped(msg), displayLine(text))
+	var line string
+	var err error
+	if werr := withdrawable(ctx, func() {
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+	}); werr != nil {
+		return "", werr
+	}
+	if err != nil {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return text, nil
+}
+
 func (tui *FancyTerminalUI) Confirm(msg string) bool {
 	prompt := Prompt{Question: msg, Choices: []string{"Yes", "No"}}
-	ans, err := tui.Ask(prompt)
+	ans, err := tui.Ask(context.Background(), prompt)
 	return err == nil && ans == 1
 }
 
-func (AskPassUI) Ask(params Prompt) (reply int, err error) {
+func (AskPassUI) Ask(ctx context.Context, params Prompt) (reply int, err error) {
 	reply = -1
 	var convErr error
 
 	for convErr != nil || reply <= 0 || reply > len(params.Choices) { // 1 indexed
-		cmd := exec.Command("ssh-askpass", formatPrompt(params))
+		cmd := exec.CommandContext(ctx, "ssh-askpass", sanitizeEscaped(formatPrompt(params)))
 		out, err := cmd.Output()
+		if ctx.Err() != nil {
+			return reply, ctx.Err()
+		}
 		if err != nil {
 			return reply, err
 		}
@@ -126,16 +212,16 @@ func (AskPassUI) Ask(params Prompt) (reply int, err error) {
 }
 
 func (AskPassUI) Inform(msg string) {
-	fmt.Println(msg)
+	fmt.Println(displayLine(msg))
 }
 
 func (AskPassUI) Alert(msg string) {
-	cmd := exec.Command("ssh-askpass", msg)
+	cmd := exec.Command("ssh-askpass", sanitizeEscaped(msg))
 	cmd.Run()
 }
 
 func (AskPassUI) AskPassword(msg string) (string, error) {
-	cmd := exec.Command("ssh-askpass", msg)
+	cmd := exec.Command("ssh-askpass", sanitizeEscaped(msg))
 	out, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -143,8 +229,23 @@ func (AskPassUI) AskPassword(msg string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+func (AskPassUI) Edit(ctx context.Context, msg string, text string) (string, error) {
+	cmd := exec.CommandContext(ctx, "ssh-askpass", fmt.Sprintf("%s\n  [%s]\n\nLeave empty to keep, or enter the replacement:", sanitizeEscaped(msg), displayLine(text)))
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return "", err
+	}
+	if reply := strings.TrimSpace(string(out)); reply != "" {
+		return reply, nil
+	}
+	return text, nil
+}
+
 func (apui AskPassUI) Confirm(msg string) bool {
-	cmd := exec.Command("ssh-askpass", msg)
+	cmd := exec.Command("ssh-askpass", sanitizeEscaped(msg))
 	out, err := cmd.Output()
 	if err != nil {
 		return false
@@ -153,3 +254,71 @@ func (apui AskPassUI) Confirm(msg string) bool {
 	outStr := strings.ToLower(strings.TrimSpace(string(out)))
 	return len(outStr) == 0 || outStr == "yes"
 }
+
+// promptVia names the kind of prompt ui shows, as recorded in rule origins.
+func promptVia(ui UI) string {
+	switch ui := ui.(type) {
+	case taggedUI:
+		return promptVia(ui.UI)
+	case *monitoredUI:
+		return promptVia(ui.UI)
+	case *FancyTerminalUI:
+		return "terminal"
+	case *AskPassUI, AskPassUI:
+		return "display"
+	}
+	return "prompt"
+}
+
+// requestTag identifies a request in UI messages and log lines, by the start
+// of its ID and its scope, so that the output of concurrent requests can be
+// told apart.
+func requestTag(id string, scope Scope) string {
+	var fields []string
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	target := scope.ServiceHostname
+	if scope.ServiceUsername != "" {
+		target = scope.ServiceUsername + "@" + target
+	}
+	for _, field := range []string{id, scope.Client, target} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return "[" + strings.Join(fields, " ") + "]"
+}
+
+// taggedUI prefixes all messages and prompts with a request tag. Like the
+// values from requests in them, the tag is escaped with displayLine, but in
+// messages shown with Inform, which escapes them whole.
+type taggedUI struct {
+	UI
+	tag string
+}
+
+func (ui taggedUI) Ask(ctx context.Context, prompt Prompt) (int, error) {
+	prompt.Question = displayLine(ui.tag) + " " + prompt.Question
+	return ui.UI.Ask(ctx, prompt)
+}
+
+func (ui taggedUI) Confirm(msg string) bool {
+	return ui.UI.Confirm(displayLine(ui.tag) + " " + msg)
+}
+
+func (ui taggedUI) Inform(msg string) {
+	ui.UI.Inform(ui.tag + " " + msg)
+}
+
+func (ui taggedUI) Alert(msg string) {
+	ui.UI.Alert(displayLine(ui.tag) + " " + msg)
+}
+
+func (ui taggedUI) AskPassword(msg string) (string, error) {
+	return ui.UI.AskPassword(displayLine(ui.tag) + " " + msg)
+}
+
+func (ui taggedUI) Edit(ctx context.Context, msg string, text string) (string, error) {
+	return ui.UI.Edit(ctx, displayLine(ui.tag)+" "+msg, text)
+}
@@ -0,0 +1,30 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package guardianagent
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// relayWindowChanges sends window-change requests to the server whenever the
+// local terminal is resized, for sessions with a pseudo terminal.
+func (c *client) relayWindowChanges() {
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+	go func() {
+		for range sigwinch {
+			w, h, err := terminal.GetSize(int(os.Stdin.Fd()))
+			if err != nil {
+				continue
+			}
+			if err = c.session.WindowChange(h, w); err != nil {
+				log.Printf("Failed to send window change: %s", err)
+			}
+		}
+	}()
+}
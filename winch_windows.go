@@ -0,0 +1,7 @@
+// +build windows
+
+package guardianagent
+
+// relayWindowChanges does nothing, since Windows consoles do not signal
+// resizes.
+func (c *client) relayWindowChanges() {}